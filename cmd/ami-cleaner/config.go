@@ -0,0 +1,518 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/trussworks/truss-aws-tools/pkg/amiclean"
+
+	"github.com/aws/aws-sdk-go/aws"
+	flag "github.com/jessevdk/go-flags"
+	"gopkg.in/yaml.v2"
+)
+
+// configFormat works out from its name whether a config file is YAML
+// or JSON. Anything not named .yaml or .yml is taken to be JSON.
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	return "json"
+}
+
+// loadConfig reads a config file, in format ("json" or "yaml"), whose
+// keys are the long flag names (e.g. "prefix", "days", "tag-key") and
+// applies its values to opts. Each value is parsed the same way as on
+// the command line, so durations such as "72h" work and choices are
+// checked, and a list is the option given once for each item. Anything
+// set explicitly on the command line or through an environment variable
+// takes precedence over the file, and the file takes precedence over
+// the built-in defaults.
+func loadConfig(parser *flag.Parser, opts *Options, r io.Reader, format string) error {
+	config := map[string]interface{}{}
+	if format == "yaml" {
+		data, err := ioutil.ReadAll(r)
+		if err == nil {
+			err = yaml.Unmarshal(data, &config)
+		}
+		if err != nil {
+			return fmt.Errorf("could not parse config file: %v", err)
+		}
+	} else {
+		decoder := json.NewDecoder(r)
+		decoder.UseNumber()
+		if err := decoder.Decode(&config); err != nil {
+			return fmt.Errorf("could not parse config file: %v", err)
+		}
+	}
+
+	optsValue := reflect.ValueOf(opts).Elem()
+	for name, value := range config {
+		option := parser.FindOptionByLongName(name)
+		if option == nil || name == "config" {
+			return fmt.Errorf("unknown option in config file: %v", name)
+		}
+		if isExplicit(option) {
+			continue
+		}
+
+		// go-flags doesn't let us set an option from outside, so a
+		// parser of its own parses the value as a flag, and we take
+		// just this option's field from what it parsed.
+		args, err := configArgs(option, value)
+		if err == nil {
+			var parsed Options
+			_, err = flag.NewParser(&parsed, flag.None).ParseArgs(args)
+			if err == nil {
+				fieldName := option.Field().Name
+				optsValue.FieldByName(fieldName).Set(reflect.ValueOf(parsed).FieldByName(fieldName))
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value for %v in config file: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// configArgs turns an option's value from a config file into the
+// command line arguments that would give it. A switch is given if it's
+// true and left out if it's false, and each item of a list is given on
+// its own.
+func configArgs(option *flag.Option, value interface{}) ([]string, error) {
+	flagName := "--" + option.LongName
+	kind := option.Field().Type.Kind()
+	if kind == reflect.Bool {
+		on, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("expected true or false, got %v", value)
+		}
+		if !on {
+			return nil, nil
+		}
+		return []string{flagName}, nil
+	}
+
+	values := []interface{}{value}
+	if list, ok := value.([]interface{}); ok {
+		if kind != reflect.Slice {
+			return nil, fmt.Errorf("expected a single value, got %v", value)
+		}
+		values = list
+	}
+	var args []string
+	for _, v := range values {
+		switch v.(type) {
+		case nil, []interface{}, map[string]interface{}, map[interface{}]interface{}:
+			return nil, fmt.Errorf("expected a string or number, got %v", v)
+		}
+		args = append(args, fmt.Sprintf("%v=%v", flagName, v))
+	}
+	return args, nil
+}
+
+// checkRuleAges applies the --max-age-guard to the retention of each of
+// the rules in a tag filter file, as validateOptions does for --days.
+func checkRuleAges(rules []amiclean.Rule, opts *Options) error {
+	if opts.AllowAggressive {
+		return nil
+	}
+	for i, rule := range rules {
+		if rule.Days != nil && *rule.Days < opts.MaxAgeGuard {
+			return fmt.Errorf("rule %d: days %d is below the --max-age-guard of %d; use --allow-aggressive if you really mean it",
+				i+1, *rule.Days, opts.MaxAgeGuard)
+		}
+	}
+	return nil
+}
+
+// isExplicit returns true if an option was given on the command line or
+// through its environment variable, rather than coming from a default.
+func isExplicit(option *flag.Option) bool {
+	if option.IsSet() && !option.IsSetDefault() {
+		return true
+	}
+	if option.EnvDefaultKey != "" {
+		if _, ok := os.LookupEnv(option.EnvDefaultKey); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validateOptions checks that the options make sense together, whether
+// they came from flags, the environment, or a config file. It also
+// resolves --tag into the tag key and value, and the aliases, such as
+// --force, into the options they stand for. It runs before we make any
+// AWS calls, so a bad option never gets as far as a partial run.
+func validateOptions(opts *Options) error {
+	// go-flags only gives an option one long name, so --force is an
+	// option of its own that means --yes, and so on.
+	if opts.Force {
+		opts.Yes = true
+	}
+	opts.ExcludeAMI = append(opts.ExcludeAMI, opts.ExcludeAMIIDs...)
+	if opts.ExcludeIDsFile != "" {
+		if opts.ExcludeFile != "" && opts.ExcludeFile != opts.ExcludeIDsFile {
+			return fmt.Errorf("cannot specify both --exclude-file and --exclude-ids-file")
+		}
+		opts.ExcludeFile = opts.ExcludeIDsFile
+	}
+	// The --tag flag is shorthand for --tag-key and --tag-value, so we
+	// shouldn't get both.
+	if opts.Tag != "" {
+		if opts.TagKey != "" || opts.TagValue != "" {
+			return fmt.Errorf("cannot specify --tag along with --tag-key or --tag-value")
+		}
+		opts.TagKey, opts.TagValue = parseTag(opts.Tag)
+		if strings.TrimSpace(opts.TagKey) == "" {
+			return fmt.Errorf("invalid --tag %q: must be key=value, or just key to match any value", opts.Tag)
+		}
+	}
+	// --branch is a tag filter too, on the branch tag, with a leading
+	// "!" standing in for --invert.
+	if opts.Branch != "" {
+		if opts.Tag != "" || opts.TagKey != "" || opts.TagValue != "" {
+			return fmt.Errorf("cannot specify --branch along with --tag, --tag-key or --tag-value")
+		}
+		var err error
+		if opts.TagKey, opts.TagValue, err = parseBranch(opts.Branch, opts.BranchTagKey, opts.Invert); err != nil {
+			return err
+		}
+		opts.Invert = opts.Invert || strings.HasPrefix(opts.Branch, "!")
+	}
+	// A tag filter file's rules do the selecting, name, tag, and age
+	// alike, so the flags that would otherwise do it don't go with it.
+	if opts.TagFilterFile != "" {
+		if opts.TagKey != "" || opts.NamePrefix != "" || opts.NameSuffix != "" || opts.Invert {
+			return fmt.Errorf("cannot specify --tag-filter-file along with --tag, --tag-key, --branch, --prefix, --name-suffix or --invert")
+		}
+		if opts.InvertAge || opts.DeprecatedOnly || opts.CreatedAfter != "" || opts.CreatedBefore != "" {
+			return fmt.Errorf("cannot specify --tag-filter-file along with --invert-age, --deprecated-only, --created-after or --created-before")
+		}
+	}
+	// An IDs file names the AMIs to purge outright, so there's nothing
+	// left for the selection flags to do, and nothing to keep back.
+	if opts.IDsFile != "" {
+		if opts.TagKey != "" || opts.NamePrefix != "" || opts.NameSuffix != "" || opts.Invert || opts.TagFilterFile != "" {
+			return fmt.Errorf("cannot specify --ids-file along with --tag, --tag-key, --branch, --prefix, --name-suffix, --invert or --tag-filter-file")
+		}
+		if opts.InvertAge || opts.DeprecatedOnly || opts.CreatedAfter != "" || opts.CreatedBefore != "" || opts.TTLTagKey != "" || opts.LifecycleTagKey != "" {
+			return fmt.Errorf("cannot specify --ids-file along with --invert-age, --deprecated-only, --created-after, --created-before, --ttl-tag-key or --lifecycle-tag-key")
+		}
+		if opts.MinRetain > 0 || opts.MinImagesRetained > 0 {
+			return fmt.Errorf("cannot specify --ids-file along with --min-retain or --min-images-retained")
+		}
+		if opts.Explain != "" || opts.ConfirmStable {
+			return fmt.Errorf("cannot specify --ids-file along with --explain or --confirm-stable")
+		}
+	}
+	// We need to check to make sure that if we have a Tag Value, we also
+	// have a Tag Key. A Key without a Value matches on the key alone.
+	if opts.TagKey == "" && opts.TagValue != "" {
+		return fmt.Errorf("must specify a tag Key along with a tag Value")
+	}
+	// Deprecated-only mode doesn't look at the creation date, so there's
+	// no age comparison to flip.
+	if opts.InvertAge && opts.DeprecatedOnly {
+		return fmt.Errorf("cannot specify --invert-age along with --deprecated-only")
+	}
+	// Deprecated images are fetched unless we're told not to, and we
+	// can't leave them out if they're all we're after.
+	if opts.ExcludeDeprecated && (opts.IncludeDeprecated || opts.DeprecatedOnly) {
+		return fmt.Errorf("cannot specify --exclude-deprecated along with --include-deprecated or --deprecated-only")
+	}
+	// Ignoring the sharing of some AMIs only means something while shared
+	// AMIs are skipped, and only those AMIs have their launch permissions
+	// revoked.
+	ignoresShared := len(opts.IgnoreSharedUsage) > 0 || opts.IgnoreSharedUsageTag != ""
+	if ignoresShared && opts.AllowShared {
+		return fmt.Errorf("cannot specify --ignore-shared-usage or --ignore-shared-usage-tag along with --allow-shared, which purges every shared AMI")
+	}
+	if opts.RevokeLaunchPermissions && !ignoresShared {
+		return fmt.Errorf("--revoke-launch-permissions needs --ignore-shared-usage or --ignore-shared-usage-tag")
+	}
+	// We have to ask DescribeImages for somebody's images.
+	if len(opts.Owners) == 0 {
+		return fmt.Errorf("at least one --owner is required")
+	}
+	for _, owner := range opts.Owners {
+		if strings.TrimSpace(owner) == "" {
+			return fmt.Errorf("--owner must not be blank")
+		}
+	}
+	// --clean-failed swaps the default state for failed, so it can't be
+	// given along with other states.
+	if opts.CleanFailed {
+		if len(opts.States) != 1 || opts.States[0] != "available" {
+			return fmt.Errorf("cannot specify --clean-failed along with --state")
+		}
+		opts.States = []string{"failed"}
+	}
+	if len(opts.States) == 0 {
+		return fmt.Errorf("at least one --state is required")
+	}
+	if opts.RetentionDays < 0 {
+		return fmt.Errorf("--days must not be negative")
+	}
+	retention := time.Duration(opts.RetentionDays) * 24 * time.Hour
+	if opts.OlderThan != "" {
+		var err error
+		if opts.olderThan, err = parseAge(opts.OlderThan); err != nil {
+			return fmt.Errorf("invalid --older-than: %v", err)
+		}
+		retention = opts.olderThan
+	}
+	// A very short retention purges almost everything, which is rarely
+	// what anyone means, so it has to be asked for explicitly. The
+	// other ways of choosing by age don't use --days that way.
+	usesDays := !opts.DeprecatedOnly && !opts.InvertAge && opts.CreatedAfter == "" && opts.CreatedBefore == ""
+	if usesDays && retention < time.Duration(opts.MaxAgeGuard)*24*time.Hour && !opts.AllowAggressive {
+		if opts.OlderThan != "" {
+			return fmt.Errorf("--older-than %v is below the --max-age-guard of %d days; use --allow-aggressive if you really mean it",
+				opts.OlderThan, opts.MaxAgeGuard)
+		}
+		return fmt.Errorf("--days %d is below the --max-age-guard of %d; use --allow-aggressive if you really mean it",
+			opts.RetentionDays, opts.MaxAgeGuard)
+	}
+	if opts.MinRetain < 0 {
+		return fmt.Errorf("--min-retain must not be negative")
+	}
+	if opts.GroupByTagKey != "" && opts.MinRetain <= 0 {
+		return fmt.Errorf("--group-by-tag-key needs --min-retain")
+	}
+	if opts.MinSnapshots < 0 {
+		return fmt.Errorf("--min-snapshots must not be negative")
+	}
+	if opts.MinImagesRetained < 0 {
+		return fmt.Errorf("--min-images-retained must not be negative")
+	}
+	if opts.Concurrency < 0 {
+		return fmt.Errorf("--concurrency must not be negative")
+	}
+	if opts.UsageCheckConcurrency < 0 {
+		return fmt.Errorf("--usage-check-concurrency must not be negative")
+	}
+	if opts.RateLimit < 0 {
+		return fmt.Errorf("--rate-limit must not be negative")
+	}
+	// Each region of a sweep is a run of its own, and an AMI ID only
+	// means something in one of them.
+	if len(opts.Regions) > 0 {
+		if opts.RegionConcurrency < 1 {
+			return fmt.Errorf("--region-concurrency must be at least 1")
+		}
+		if opts.Explain != "" {
+			return fmt.Errorf("cannot specify --explain along with --regions")
+		}
+		if opts.IDsFile != "" {
+			return fmt.Errorf("cannot specify --ids-file along with --regions")
+		}
+		seen := make(map[string]bool)
+		for _, region := range opts.Regions {
+			if strings.TrimSpace(region) == "" {
+				return fmt.Errorf("--regions must not be empty")
+			}
+			if seen[region] {
+				return fmt.Errorf("region %v is given more than once in --regions", region)
+			}
+			seen[region] = true
+		}
+	}
+	// Each account of an org sweep is a run of its own too.
+	if opts.Org {
+		if opts.OrgConcurrency < 1 {
+			return fmt.Errorf("--org-concurrency must be at least 1")
+		}
+		if strings.TrimSpace(opts.OrgRole) == "" {
+			return fmt.Errorf("--org-role must not be empty")
+		}
+		if opts.Explain != "" {
+			return fmt.Errorf("cannot specify --explain along with --org")
+		}
+		if opts.IDsFile != "" {
+			return fmt.Errorf("cannot specify --ids-file along with --org")
+		}
+	} else if len(opts.OrgAccounts) > 0 || len(opts.OrgExcludeAccounts) > 0 {
+		return fmt.Errorf("--org-account and --org-exclude-account require --org")
+	}
+	// There's nothing to validate if we're making the real calls.
+	if opts.ValidatePermissions && opts.Delete {
+		return fmt.Errorf("--validate-permissions only applies in dry run mode; remove --delete")
+	}
+	// Only a purge is worth asking about AMI by AMI.
+	if opts.Interactive {
+		if !opts.Delete {
+			return fmt.Errorf("--interactive only applies when deleting; add --delete")
+		}
+		if opts.MarkOnly || opts.Deprecate {
+			return fmt.Errorf("cannot specify --interactive along with --mark-only or --deprecate")
+		}
+	}
+	// Marking and purging what was marked are the two halves of
+	// soft-delete mode; they happen in separate runs.
+	if opts.MarkOnly && opts.PurgeMarked {
+		return fmt.Errorf("cannot specify both --mark-only and --purge-marked")
+	}
+	if opts.MarkOnly && opts.MarkGracePeriod <= 0 {
+		return fmt.Errorf("--mark-grace-period must be positive with --mark-only")
+	}
+	// A marker template is only of use if we're marking, and a bad one
+	// should stop us before anything is marked.
+	if opts.MarkerTemplate != "" {
+		if !opts.MarkOnly {
+			return fmt.Errorf("--marker-template needs --mark-only")
+		}
+		var err error
+		if opts.markerTemplate, err = amiclean.ParseMarkerTemplate(opts.MarkerTemplate); err != nil {
+			return fmt.Errorf("invalid --marker-template %q: %v", opts.MarkerTemplate, err)
+		}
+	}
+	// Deprecating is instead of purging, as marking is.
+	if opts.Deprecate && (opts.MarkOnly || opts.PurgeMarked) {
+		return fmt.Errorf("cannot specify --deprecate along with --mark-only or --purge-marked")
+	}
+	if opts.VerifyDeletion && opts.VerifyDeletionTimeout <= 0 {
+		return fmt.Errorf("--verify-deletion-timeout must be positive with --verify-deletion")
+	}
+	if opts.ConfirmStable && opts.ConfirmStableDelay < 0 {
+		return fmt.Errorf("--confirm-stable-delay must not be negative")
+	}
+	// Keeping the snapshots means none of the ways of deleting them apply.
+	if opts.TagRetainedSnapshots && !opts.RetainSnapshots {
+		return fmt.Errorf("--tag-retained-snapshots requires --retain-snapshots")
+	}
+	if opts.RetainSnapshots && (opts.BatchSnapshots || opts.SnapshotGracePeriod > 0) {
+		return fmt.Errorf("cannot specify --retain-snapshots along with --batch-snapshots or --snapshot-grace-period")
+	}
+	// The archive options only mean something along with --archive.
+	if !opts.Archive && (opts.ArchiveAccountID != "" || opts.ArchiveRegion != "" || opts.ArchiveProfile != "") {
+		return fmt.Errorf("--archive-account-id, --archive-region and --archive-profile require --archive")
+	}
+	if opts.Archive && opts.ArchiveAccountID == "" && (opts.ArchiveRegion == "" || opts.ArchiveRegion == opts.Region) {
+		return fmt.Errorf("--archive needs an --archive-account-id or an --archive-region other than the one being cleaned")
+	}
+	var err error
+	if opts.encrypted, err = parseBool(opts.Encrypted); err != nil {
+		return fmt.Errorf("invalid --encrypted: %v", err)
+	}
+	// A creation window replaces the usual age check, so the options
+	// that change that check don't go with it.
+	if opts.createdAfter, err = parseCreationTime(opts.CreatedAfter); err != nil {
+		return fmt.Errorf("invalid --created-after: %v", err)
+	}
+	if opts.createdBefore, err = parseCreationTime(opts.CreatedBefore); err != nil {
+		return fmt.Errorf("invalid --created-before: %v", err)
+	}
+	if !opts.createdAfter.IsZero() || !opts.createdBefore.IsZero() {
+		if opts.InvertAge || opts.DeprecatedOnly || opts.TTLTagKey != "" || opts.LifecycleTagKey != "" {
+			return fmt.Errorf("cannot specify --created-after or --created-before along with --invert-age, --deprecated-only, --ttl-tag-key, or --lifecycle-tag-key")
+		}
+		if !opts.createdAfter.IsZero() && !opts.createdBefore.IsZero() && opts.createdAfter.After(opts.createdBefore) {
+			return fmt.Errorf("--created-after must not be later than --created-before")
+		}
+	}
+	// Without any selection criteria, every AMI older than the
+	// retention period would be purged, so we want to be sure that's
+	// really what was intended.
+	if opts.TagKey == "" && opts.NamePrefix == "" && opts.NameSuffix == "" && opts.TagFilterFile == "" && opts.IDsFile == "" && !opts.CleanFailed && !opts.ForceSelectAll {
+		return fmt.Errorf("no selection criteria: missing a tag (--tag, --tag-key or --branch), a name prefix or suffix (--prefix or --name-suffix), " +
+			"a tag filter policy (--tag-filter-file), a list of AMI IDs (--ids-file) or --clean-failed; " +
+			"specify at least one, or use --force-select-all to consider every AMI")
+	}
+	return nil
+}
+
+// parseBranch turns a --branch value into the tag key and value to
+// filter on. A leading "!" means the branch is to be inverted, which
+// can't be combined with --invert; that would invert it twice.
+func parseBranch(branch, branchTagKey string, invert bool) (string, string, error) {
+	if strings.TrimSpace(branchTagKey) == "" {
+		return "", "", fmt.Errorf("--branch-tag-key must not be blank")
+	}
+	value := strings.TrimPrefix(branch, "!")
+	if strings.TrimSpace(value) == "" {
+		return "", "", fmt.Errorf("invalid --branch %q: must name a branch", branch)
+	}
+	if value != branch && invert {
+		return "", "", fmt.Errorf("cannot specify --branch %q along with --invert", branch)
+	}
+	return branchTagKey, value, nil
+}
+
+// parseBool parses a true or false value, such as --encrypted's, and
+// returns nil if it wasn't given at all so that the filter is left off.
+func parseBool(value string) (*bool, error) {
+	switch value {
+	case "":
+		return nil, nil
+	case "true":
+		return aws.Bool(true), nil
+	case "false":
+		return aws.Bool(false), nil
+	}
+	return nil, fmt.Errorf("expected true or false, got %q", value)
+}
+
+// parseAge parses a duration for --older-than. It takes anything
+// time.ParseDuration does, such as "12h" or "90m", and also a number of
+// days or weeks, such as "90d", "6w" or "1.5d". Negative ages don't make
+// sense, so they're an error.
+func parseAge(value string) (time.Duration, error) {
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(value, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(value, "w"):
+		unit = 7 * 24 * time.Hour
+	}
+
+	var age time.Duration
+	if unit != 0 {
+		number, err := strconv.ParseFloat(value[:len(value)-1], 64)
+		// ParseFloat also takes "NaN" and "Inf", which aren't ages.
+		if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+			return 0, fmt.Errorf("%q is not a duration such as 12h, 90d or 6w", value)
+		}
+		age = time.Duration(number * float64(unit))
+	} else {
+		var err error
+		if age, err = time.ParseDuration(value); err != nil {
+			return 0, fmt.Errorf("%q is not a duration such as 12h, 90d or 6w", value)
+		}
+	}
+	if age < 0 {
+		return 0, fmt.Errorf("%q must not be negative", value)
+	}
+	return age, nil
+}
+
+// creationTimeLayouts are the formats we accept for --created-after and
+// --created-before: a full timestamp, or just a date (meaning midnight
+// UTC).
+var creationTimeLayouts = []string{time.RFC3339, "2006-01-02"}
+
+// parseCreationTime parses a time given for a creation window. An empty
+// string leaves that end of the window open.
+func parseCreationTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range creationTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date (2006-01-02) or RFC 3339 timestamp", value)
+}
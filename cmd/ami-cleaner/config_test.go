@@ -0,0 +1,545 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/trussworks/truss-aws-tools/pkg/amiclean"
+
+	"github.com/aws/aws-sdk-go/aws"
+	flag "github.com/jessevdk/go-flags"
+)
+
+func TestLoadConfig(t *testing.T) {
+	config := `{
+		"prefix": "my_ami",
+		"days": 7,
+		"tag": "Branch=master",
+		"invert": true,
+		"delete": true
+	}`
+
+	var opts Options
+	parser := flag.NewParser(&opts, flag.Default)
+	// The command line should win over the config file.
+	_, err := parser.ParseArgs([]string{"--days", "14"})
+	if err != nil {
+		t.Fatalf("ParseArgs() returned error: %v", err)
+	}
+	err = loadConfig(parser, &opts, strings.NewReader(config), "json")
+	if err != nil {
+		t.Fatalf("loadConfig() returned error: %v", err)
+	}
+	err = validateOptions(&opts)
+	if err != nil {
+		t.Fatalf("validateOptions() returned error: %v", err)
+	}
+
+	if opts.NamePrefix != "my_ami" {
+		t.Errorf("NamePrefix == %q, want %q", opts.NamePrefix, "my_ami")
+	}
+	if opts.RetentionDays != 14 {
+		t.Errorf("RetentionDays == %v, want %v", opts.RetentionDays, 14)
+	}
+	if opts.TagKey != "Branch" || opts.TagValue != "master" {
+		t.Errorf("tag == %q=%q, want %q=%q", opts.TagKey, opts.TagValue, "Branch", "master")
+	}
+	if !opts.Invert || !opts.Delete {
+		t.Errorf("Invert == %v, Delete == %v, want both true", opts.Invert, opts.Delete)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	cases := []struct {
+		config string
+		format string
+	}{
+		{`{"no-such-option": true}`, "json"},
+		{`{"days": "thirty"}`, "json"},
+		{`{"report-format": "xml"}`, "json"},
+		{`{"log-format": "text"}`, "json"},
+		{`{"state": ["available", "deleted"]}`, "json"},
+		{`{"snapshot-grace-period": "3 days"}`, "json"},
+		{`{"delete": "yes"}`, "json"},
+		{`{"prefix": ["a", "b"]}`, "json"},
+		{`{"config": "other.json"}`, "json"},
+		{`not json`, "json"},
+		{"report-format: xml", "yaml"},
+		{"- not a map", "yaml"},
+	}
+	for _, c := range cases {
+		var opts Options
+		parser := flag.NewParser(&opts, flag.Default)
+		_, err := parser.ParseArgs([]string{})
+		if err != nil {
+			t.Fatalf("ParseArgs() returned error: %v", err)
+		}
+		if err := loadConfig(parser, &opts, strings.NewReader(c.config), c.format); err == nil {
+			t.Errorf("loadConfig(%q, %v) did not return an error", c.config, c.format)
+		}
+	}
+}
+
+func TestLoadConfigFlagValues(t *testing.T) {
+	configs := map[string]string{
+		"json": `{
+			"prefix": "my_ami",
+			"snapshot-grace-period": "72h",
+			"report-format": "jsonl",
+			"state": ["available", "failed"],
+			"owner": "123456789012"
+		}`,
+		"yaml": `
+prefix: my_ami
+snapshot-grace-period: 72h
+report-format: jsonl
+state:
+  - available
+  - failed
+owner: "123456789012"
+`,
+	}
+	for format, config := range configs {
+		var opts Options
+		parser := flag.NewParser(&opts, flag.Default)
+		_, err := parser.ParseArgs([]string{})
+		if err != nil {
+			t.Fatalf("ParseArgs() returned error: %v", err)
+		}
+		err = loadConfig(parser, &opts, strings.NewReader(config), format)
+		if err != nil {
+			t.Fatalf("loadConfig(%v) returned error: %v", format, err)
+		}
+
+		if opts.NamePrefix != "my_ami" {
+			t.Errorf("%v: NamePrefix == %q, want %q", format, opts.NamePrefix, "my_ami")
+		}
+		if opts.SnapshotGracePeriod != 72*time.Hour {
+			t.Errorf("%v: SnapshotGracePeriod == %v, want %v", format, opts.SnapshotGracePeriod, 72*time.Hour)
+		}
+		if opts.ReportFormat != "jsonl" {
+			t.Errorf("%v: ReportFormat == %q, want %q", format, opts.ReportFormat, "jsonl")
+		}
+		wantStates := []string{"available", "failed"}
+		if !reflect.DeepEqual(opts.States, wantStates) {
+			t.Errorf("%v: States == %v, want %v", format, opts.States, wantStates)
+		}
+		wantOwners := []string{"123456789012"}
+		if !reflect.DeepEqual(opts.Owners, wantOwners) {
+			t.Errorf("%v: Owners == %v, want %v", format, opts.Owners, wantOwners)
+		}
+	}
+}
+
+func TestConfigFormat(t *testing.T) {
+	cases := map[string]string{
+		"ami-cleaner.json": "json",
+		"ami-cleaner.yaml": "yaml",
+		"ami-cleaner.YML":  "yaml",
+		"ami-cleaner":      "json",
+	}
+	for path, want := range cases {
+		if got := configFormat(path); got != want {
+			t.Errorf("configFormat(%q) == %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestValidateOptions(t *testing.T) {
+	cases := []struct {
+		opts  Options
+		valid bool
+	}{
+		{Options{}, false},
+		{Options{ForceSelectAll: true}, true},
+		{Options{NamePrefix: "my_ami"}, true},
+		{Options{Invert: true}, false},
+		{Options{Tag: "Branch"}, true},
+		{Options{TagKey: "Branch"}, true},
+		{Options{TagKey: "Branch", TagValue: "master"}, true},
+		{Options{TagKey: "Branch", NamePrefix: "my_ami"}, true},
+		{Options{TagValue: "master"}, false},
+		{Options{TagValue: "master", ForceSelectAll: true}, false},
+		{Options{Tag: "Branch=master", TagKey: "Branch"}, false},
+		{Options{Tag: "="}, false},
+		{Options{Tag: "=master"}, false},
+		{Options{Tag: " =master", ForceSelectAll: true}, false},
+		{Options{NamePrefix: "my_ami", RetentionDays: 0}, true},
+		{Options{NamePrefix: "my_ami", RetentionDays: 0, MaxAgeGuard: 1}, false},
+		{Options{NamePrefix: "my_ami", RetentionDays: 0, MaxAgeGuard: 1, AllowAggressive: true}, true},
+		{Options{NamePrefix: "my_ami", RetentionDays: 7, MaxAgeGuard: 14}, false},
+		{Options{NamePrefix: "my_ami", RetentionDays: 14, MaxAgeGuard: 14}, true},
+		{Options{NamePrefix: "my_ami", RetentionDays: 0, MaxAgeGuard: 1, DeprecatedOnly: true}, true},
+		{Options{NamePrefix: "my_ami", RetentionDays: 0, MaxAgeGuard: 1, CreatedAfter: "2019-03-01"}, true},
+		{Options{NamePrefix: "my_ami", RetentionDays: -1}, false},
+		{Options{NamePrefix: "my_ami", RetentionDays: 0, MaxAgeGuard: 1, OlderThan: "90d"}, true},
+		{Options{NamePrefix: "my_ami", RetentionDays: 30, MaxAgeGuard: 1, OlderThan: "12h"}, false},
+		{Options{NamePrefix: "my_ami", RetentionDays: 30, MaxAgeGuard: 1, OlderThan: "12h", AllowAggressive: true}, true},
+		{Options{NamePrefix: "my_ami", OlderThan: "soon"}, false},
+		{Options{NamePrefix: "my_ami", InvertAge: true}, true},
+		{Options{NamePrefix: "my_ami", InvertAge: true, DeprecatedOnly: true}, false},
+		{Options{NamePrefix: "my_ami", Encrypted: "false"}, true},
+		{Options{NamePrefix: "my_ami", Encrypted: "yes"}, false},
+		{Options{NamePrefix: "my_ami", ValidatePermissions: true}, true},
+		{Options{NamePrefix: "my_ami", Concurrency: 4}, true},
+		{Options{NamePrefix: "my_ami", Concurrency: -1}, false},
+		{Options{NamePrefix: "my_ami", Concurrency: 8, RateLimit: 20}, true},
+		{Options{NamePrefix: "my_ami", Unused: true, RecheckUnused: true, Concurrency: 8, UsageCheckConcurrency: 2}, true},
+		{Options{NamePrefix: "my_ami", UsageCheckConcurrency: -1}, false},
+		{Options{NamePrefix: "my_ami", IgnoreSharedUsage: []string{"ami-1"}, RevokeLaunchPermissions: true}, true},
+		{Options{NamePrefix: "my_ami", IgnoreSharedUsageTag: "internal-only"}, true},
+		{Options{NamePrefix: "my_ami", IgnoreSharedUsage: []string{"ami-1"}, AllowShared: true}, false},
+		{Options{NamePrefix: "my_ami", RevokeLaunchPermissions: true}, false},
+		{Options{NamePrefix: "my_ami", RateLimit: -1}, false},
+		{Options{NamePrefix: "my_ami", ValidatePermissions: true, Delete: true}, false},
+		{Options{NamePrefix: "my_ami", VerifyDeletion: true, VerifyDeletionTimeout: 5 * time.Minute}, true},
+		{Options{NamePrefix: "my_ami", VerifyDeletion: true}, false},
+		{Options{NamePrefix: "my_ami", ConfirmStable: true, ConfirmStableDelay: 10 * time.Second}, true},
+		{Options{NamePrefix: "my_ami", ConfirmStable: true, ConfirmStableDelay: -time.Second}, false},
+		{Options{NamePrefix: "my_ami", MarkOnly: true, MarkGracePeriod: 168 * time.Hour}, true},
+		{Options{NamePrefix: "my_ami", MarkOnly: true}, false},
+		{Options{NamePrefix: "my_ami", PurgeMarked: true}, true},
+		{Options{NamePrefix: "my_ami", MarkOnly: true, MarkGracePeriod: time.Hour, PurgeMarked: true}, false},
+		{Options{NamePrefix: "my_ami", Deprecate: true}, true},
+		{Options{NamePrefix: "my_ami", Deprecate: true, MarkOnly: true, MarkGracePeriod: time.Hour}, false},
+		{Options{NamePrefix: "my_ami", Deprecate: true, PurgeMarked: true}, false},
+		{Options{NamePrefix: "my_ami", Owners: []string{"self", "123456789012"}}, true},
+		{Options{NamePrefix: "my_ami", Owners: []string{}}, false},
+		{Options{NamePrefix: "my_ami", Owners: []string{"self", " "}}, false},
+		{Options{NamePrefix: "my_ami", Regions: []string{"us-east-1", "us-west-2"}, RegionConcurrency: 2}, true},
+		{Options{NamePrefix: "my_ami", Regions: []string{"us-east-1"}, RegionConcurrency: 0}, false},
+		{Options{NamePrefix: "my_ami", Regions: []string{"us-east-1", "us-east-1"}, RegionConcurrency: 2}, false},
+		{Options{NamePrefix: "my_ami", Regions: []string{"us-east-1", " "}, RegionConcurrency: 2}, false},
+		{Options{NamePrefix: "my_ami", Regions: []string{"us-east-1"}, RegionConcurrency: 2, Explain: "ami-1"}, false},
+		{Options{NamePrefix: "my_ami", Org: true, OrgRole: "ami-cleaner", OrgConcurrency: 4}, true},
+		{Options{NamePrefix: "my_ami", Org: true, OrgRole: "ami-cleaner", OrgConcurrency: 4, OrgAccounts: []string{"111111111111"}}, true},
+		{Options{NamePrefix: "my_ami", Org: true, OrgRole: "ami-cleaner", OrgConcurrency: 0}, false},
+		{Options{NamePrefix: "my_ami", Org: true, OrgRole: "", OrgConcurrency: 4}, false},
+		{Options{NamePrefix: "my_ami", Org: true, OrgRole: "ami-cleaner", OrgConcurrency: 4, Explain: "ami-1"}, false},
+		{Options{NamePrefix: "my_ami", OrgExcludeAccounts: []string{"111111111111"}}, false},
+		{Options{NamePrefix: "my_ami", RetainSnapshots: true, TagRetainedSnapshots: true}, true},
+		{Options{NamePrefix: "my_ami", TagRetainedSnapshots: true}, false},
+		{Options{NamePrefix: "my_ami", RetainSnapshots: true, BatchSnapshots: true}, false},
+		{Options{NamePrefix: "my_ami", RetainSnapshots: true, SnapshotGracePeriod: time.Hour}, false},
+		{Options{NamePrefix: "my_ami", Archive: true, ArchiveRegion: "us-west-2"}, true},
+		{Options{NamePrefix: "my_ami", Archive: true, ArchiveAccountID: "210987654321"}, true},
+		{Options{NamePrefix: "my_ami", Archive: true}, false},
+		{Options{NamePrefix: "my_ami", Archive: true, Region: "us-west-2", ArchiveRegion: "us-west-2"}, false},
+		{Options{NamePrefix: "my_ami", ArchiveRegion: "us-west-2"}, false},
+		{Options{NamePrefix: "my_ami", CreatedAfter: "2019-03-01"}, true},
+		{Options{NamePrefix: "my_ami", CreatedBefore: "2019-03-08T12:00:00Z"}, true},
+		{Options{NamePrefix: "my_ami", CreatedAfter: "2019-03-01", CreatedBefore: "2019-03-08"}, true},
+		{Options{NamePrefix: "my_ami", CreatedAfter: "2019-03-08", CreatedBefore: "2019-03-01"}, false},
+		{Options{NamePrefix: "my_ami", CreatedAfter: "last week"}, false},
+		{Options{NamePrefix: "my_ami", CreatedAfter: "2019-03-01", InvertAge: true}, false},
+		{Options{NamePrefix: "my_ami", CreatedBefore: "2019-03-08", TTLTagKey: "ttl-days"}, false},
+		{Options{NamePrefix: "my_ami", MinRetain: 3}, true},
+		{Options{NamePrefix: "my_ami", MinRetain: -1}, false},
+		{Options{NamePrefix: "my_ami", MinRetain: 3, MinImagesRetained: 10}, true},
+		{Options{NamePrefix: "my_ami", MinImagesRetained: -1}, false},
+		{Options{NamePrefix: "my_ami", MinSnapshots: 4}, true},
+		{Options{NamePrefix: "my_ami", MinSnapshots: -1}, false},
+		{Options{NamePrefix: "my_ami", ExcludeDeprecated: true}, true},
+		{Options{NamePrefix: "my_ami", ExcludeDeprecated: true, IncludeDeprecated: true}, false},
+		{Options{NamePrefix: "my_ami", ExcludeDeprecated: true, DeprecatedOnly: true}, false},
+		{Options{NamePrefix: "my_ami", States: []string{"available", "failed"}}, true},
+		{Options{NamePrefix: "my_ami", States: []string{}}, false},
+		{Options{CleanFailed: true}, true},
+		{Options{CleanFailed: true, States: []string{"pending"}}, false},
+		{Options{TagFilterFile: "policy.json"}, true},
+		{Options{TagFilterFile: "policy.json", TTLTagKey: "ttl-days"}, true},
+		{Options{TagFilterFile: "policy.json", NamePrefix: "my_ami"}, false},
+		{Options{TagFilterFile: "policy.json", NameSuffix: "-debug"}, false},
+		{Options{NameSuffix: "-debug"}, true},
+		{Options{NamePrefix: "app-", NameSuffix: "-debug"}, true},
+		{Options{NamePrefix: "my_ami", MarkOnly: true, MarkGracePeriod: time.Hour, MarkerTemplate: "run:{{.RunID}},at:{{.Now}}"}, true},
+		{Options{NamePrefix: "my_ami", MarkOnly: true, MarkGracePeriod: time.Hour, MarkerTemplate: "run:{{.RunID"}, false},
+		{Options{NamePrefix: "my_ami", MarkOnly: true, MarkGracePeriod: time.Hour, MarkerTemplate: "{{.Account}}"}, false},
+		{Options{NamePrefix: "my_ami", MarkerTemplate: "run:{{.RunID}}"}, false},
+		{Options{NamePrefix: "my_ami", MinRetain: 3, GroupByTagKey: "service"}, true},
+		{Options{NamePrefix: "my_ami", GroupByTagKey: "service"}, false},
+		{Options{NamePrefix: "my_ami", Interactive: true, Delete: true}, true},
+		{Options{NamePrefix: "my_ami", Interactive: true}, false},
+		{Options{NamePrefix: "my_ami", Interactive: true, Delete: true, MarkOnly: true, MarkGracePeriod: time.Hour}, false},
+		{Options{IDsFile: "ami-ids.txt"}, true},
+		{Options{IDsFile: "ami-ids.txt", ExcludeFile: "golden-amis.txt", Delete: true}, true},
+		{Options{IDsFile: "ami-ids.txt", NamePrefix: "app-"}, false},
+		{Options{IDsFile: "ami-ids.txt", Tag: "Branch=master"}, false},
+		{Options{IDsFile: "ami-ids.txt", TagFilterFile: "policy.json"}, false},
+		{Options{IDsFile: "ami-ids.txt", CreatedBefore: "2019-03-01"}, false},
+		{Options{IDsFile: "ami-ids.txt", MinRetain: 2}, false},
+		{Options{IDsFile: "ami-ids.txt", MinImagesRetained: 10}, false},
+		{Options{IDsFile: "ami-ids.txt", ConfirmStable: true}, false},
+		{Options{IDsFile: "ami-ids.txt", Explain: "ami-12345678"}, false},
+		{Options{IDsFile: "ami-ids.txt", Regions: []string{"us-east-1", "us-west-2"}, RegionConcurrency: 1}, false},
+		{Options{IDsFile: "ami-ids.txt", Org: true, OrgConcurrency: 1, OrgRole: "ami-cleaner"}, false},
+		{Options{TagFilterFile: "policy.json", Tag: "Branch=master"}, false},
+		{Options{TagFilterFile: "policy.json", Branch: "master", BranchTagKey: "branch"}, false},
+		{Options{TagFilterFile: "policy.json", DeprecatedOnly: true}, false},
+		{Options{TagFilterFile: "policy.json", CreatedAfter: "2019-03-01"}, false},
+	}
+	for _, c := range cases {
+		opts := c.opts
+		// The flag parser always gives us an owner and a state,
+		// unless one is what we're testing.
+		if opts.Owners == nil {
+			opts.Owners = []string{"self"}
+		}
+		if opts.States == nil {
+			opts.States = []string{"available"}
+		}
+		err := validateOptions(&opts)
+		if (err == nil) != c.valid {
+			t.Errorf("validateOptions(%+v) == %v, want valid %v", c.opts, err, c.valid)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	cases := []struct {
+		in    string
+		want  time.Duration
+		valid bool
+	}{
+		{"12h", 12 * time.Hour, true},
+		{"90m", 90 * time.Minute, true},
+		{"1h30m", 90 * time.Minute, true},
+		{"90d", 90 * 24 * time.Hour, true},
+		{"1.5d", 36 * time.Hour, true},
+		{"6w", 6 * 7 * 24 * time.Hour, true},
+		{"0d", 0, true},
+		{"", 0, false},
+		{"30", 0, false},
+		{"d", 0, false},
+		{"w", 0, false},
+		{"-3d", 0, false},
+		{"-1h", 0, false},
+		{"3x", 0, false},
+		{"3dw", 0, false},
+		{"NaNd", 0, false},
+		{"Infw", 0, false},
+	}
+	for _, c := range cases {
+		got, err := parseAge(c.in)
+		if (err == nil) != c.valid {
+			t.Errorf("parseAge(%q) returned error %v, want valid %v", c.in, err, c.valid)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("parseAge(%q) == %v, want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestValidateOptionsBranch(t *testing.T) {
+	cases := []struct {
+		opts     Options
+		tagKey   string
+		tagValue string
+		invert   bool
+		valid    bool
+	}{
+		{Options{Branch: "master", BranchTagKey: "branch"}, "branch", "master", false, true},
+		{Options{Branch: "!master", BranchTagKey: "branch"}, "branch", "master", true, true},
+		{Options{Branch: "master", BranchTagKey: "Branch", Invert: true}, "Branch", "master", true, true},
+		{Options{Branch: "!master", BranchTagKey: "branch", Invert: true}, "", "", false, false},
+		{Options{Branch: "!", BranchTagKey: "branch"}, "", "", false, false},
+		{Options{Branch: "master", BranchTagKey: ""}, "", "", false, false},
+		{Options{Branch: "master", BranchTagKey: "branch", Tag: "Branch=master"}, "", "", false, false},
+	}
+	for _, c := range cases {
+		opts := c.opts
+		opts.Owners = []string{"self"}
+		opts.States = []string{"available"}
+		err := validateOptions(&opts)
+		if (err == nil) != c.valid {
+			t.Errorf("validateOptions(%+v) == %v, want valid %v", c.opts, err, c.valid)
+			continue
+		}
+		if !c.valid {
+			continue
+		}
+		if opts.TagKey != c.tagKey || opts.TagValue != c.tagValue || opts.Invert != c.invert {
+			t.Errorf("--branch %q gave tag %v=%v invert %v, want %v=%v invert %v",
+				c.opts.Branch, opts.TagKey, opts.TagValue, opts.Invert, c.tagKey, c.tagValue, c.invert)
+		}
+	}
+}
+
+func TestValidateOptionsSelection(t *testing.T) {
+	// Each of these is enough to select AMIs on its own, and the error
+	// without any of them has to name them all.
+	cases := map[string]Options{
+		"--tag":             {Tag: "Branch=master"},
+		"--tag-key":         {TagKey: "Branch"},
+		"--branch":          {Branch: "master", BranchTagKey: "branch"},
+		"--prefix":          {NamePrefix: "my_ami"},
+		"--name-suffix":     {NameSuffix: "-debug"},
+		"--tag-filter-file": {TagFilterFile: "policy.json"},
+		"--ids-file":        {IDsFile: "ami-ids.txt"},
+		"--clean-failed":    {CleanFailed: true},
+	}
+	for flagName, opts := range cases {
+		opts.Owners = []string{"self"}
+		opts.States = []string{"available"}
+		if err := validateOptions(&opts); err != nil {
+			t.Errorf("validateOptions() with only %v == %v, want nil", flagName, err)
+		}
+	}
+
+	opts := Options{Owners: []string{"self"}, States: []string{"available"}}
+	err := validateOptions(&opts)
+	if err == nil {
+		t.Fatalf("validateOptions() with no selection criteria == nil, want an error")
+	}
+	mentioned := map[string]bool{}
+	for _, flagName := range regexp.MustCompile(`--[a-z-]+`).FindAllString(err.Error(), -1) {
+		mentioned[flagName] = true
+	}
+	want := map[string]bool{"--force-select-all": true}
+	for flagName := range cases {
+		want[flagName] = true
+	}
+	if !reflect.DeepEqual(mentioned, want) {
+		t.Errorf("no selection criteria error %q mentions %v, want %v", err, mentioned, want)
+	}
+}
+
+func TestValidateOptionsForce(t *testing.T) {
+	cases := []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"--prefix=my_ami", "-D"}, false},
+		{[]string{"--prefix=my_ami", "-D", "--yes"}, true},
+		{[]string{"--prefix=my_ami", "-D", "-y"}, true},
+		{[]string{"--prefix=my_ami", "-D", "--force"}, true},
+	}
+	for _, c := range cases {
+		var opts Options
+		if _, err := flag.ParseArgs(&opts, c.args); err != nil {
+			t.Fatalf("ParseArgs(%v) returned error: %v", c.args, err)
+		}
+		if err := validateOptions(&opts); err != nil {
+			t.Fatalf("validateOptions(%v) returned error: %v", c.args, err)
+		}
+		if opts.Yes != c.want {
+			t.Errorf("%v gave Yes %v, want %v", c.args, opts.Yes, c.want)
+		}
+	}
+}
+
+func TestValidateOptionsExcludeAliases(t *testing.T) {
+	cases := []struct {
+		args        []string
+		excludeAMI  []string
+		excludeFile string
+		valid       bool
+	}{
+		{[]string{"--prefix=my_ami", "--exclude-ami=ami-1", "--exclude-ami-ids=ami-2"}, []string{"ami-1", "ami-2"}, "", true},
+		{[]string{"--prefix=my_ami", "--exclude-ids-file=golden-amis.txt"}, nil, "golden-amis.txt", true},
+		{[]string{"--prefix=my_ami", "--exclude-file=golden-amis.txt", "--exclude-ids-file=golden-amis.txt"}, nil, "golden-amis.txt", true},
+		{[]string{"--prefix=my_ami", "--exclude-file=golden-amis.txt", "--exclude-ids-file=other-amis.txt"}, nil, "", false},
+	}
+	for _, c := range cases {
+		var opts Options
+		if _, err := flag.ParseArgs(&opts, c.args); err != nil {
+			t.Fatalf("ParseArgs(%v) returned error: %v", c.args, err)
+		}
+		err := validateOptions(&opts)
+		if (err == nil) != c.valid {
+			t.Errorf("validateOptions(%v) == %v, want valid %v", c.args, err, c.valid)
+			continue
+		}
+		if !c.valid {
+			continue
+		}
+		if !reflect.DeepEqual(opts.ExcludeAMI, c.excludeAMI) || opts.ExcludeFile != c.excludeFile {
+			t.Errorf("%v gave --exclude-ami %v and --exclude-file %q, want %v and %q",
+				c.args, opts.ExcludeAMI, opts.ExcludeFile, c.excludeAMI, c.excludeFile)
+		}
+	}
+}
+
+func TestCheckRuleAges(t *testing.T) {
+	days := func(d int) *int { return &d }
+	rules := func(d ...*int) []amiclean.Rule {
+		var rules []amiclean.Rule
+		for _, days := range d {
+			rules = append(rules, amiclean.Rule{TagKey: "branch", Days: days})
+		}
+		return rules
+	}
+	cases := []struct {
+		rules []amiclean.Rule
+		opts  Options
+		valid bool
+	}{
+		{rules(days(7), nil), Options{MaxAgeGuard: 1}, true},
+		{rules(days(7), days(0)), Options{MaxAgeGuard: 1}, false},
+		{rules(days(0)), Options{MaxAgeGuard: 1, AllowAggressive: true}, true},
+		{rules(days(7)), Options{MaxAgeGuard: 14}, false},
+		{rules(days(14)), Options{MaxAgeGuard: 14}, true},
+		{rules(days(7)), Options{MaxAgeGuard: 14, AllowAggressive: true}, true},
+	}
+	for _, c := range cases {
+		err := checkRuleAges(c.rules, &c.opts)
+		if (err == nil) != c.valid {
+			t.Errorf("checkRuleAges(%v, %+v) == %v, want valid %v", c.rules, c.opts, err, c.valid)
+		}
+	}
+}
+
+func TestValidateOptionsEncrypted(t *testing.T) {
+	cases := []struct {
+		args      []string
+		encrypted *bool
+		valid     bool
+	}{
+		{[]string{"--prefix=my_ami"}, nil, true},
+		{[]string{"--prefix=my_ami", "--encrypted", "true"}, aws.Bool(true), true},
+		{[]string{"--prefix=my_ami", "--encrypted=false"}, aws.Bool(false), true},
+		{[]string{"--prefix=my_ami", "--encrypted", "yes"}, nil, false},
+		{[]string{"--prefix=my_ami", "--encrypted"}, nil, false},
+	}
+	for _, c := range cases {
+		var opts Options
+		_, err := flag.ParseArgs(&opts, c.args)
+		if err == nil {
+			err = validateOptions(&opts)
+		}
+		if (err == nil) != c.valid {
+			t.Errorf("%v gave error %v, want valid %v", c.args, err, c.valid)
+			continue
+		}
+		if !c.valid {
+			continue
+		}
+		if !reflect.DeepEqual(opts.encrypted, c.encrypted) {
+			t.Errorf("%v gave encrypted %v, want %v", c.args, aws.BoolValue(opts.encrypted), aws.BoolValue(c.encrypted))
+		}
+	}
+}
+
+func TestParseBool(t *testing.T) {
+	cases := []struct {
+		value string
+		want  *bool
+		valid bool
+	}{
+		{"", nil, true},
+		{"true", aws.Bool(true), true},
+		{"false", aws.Bool(false), true},
+		{"yes", nil, false},
+		{"TRUE", nil, false},
+	}
+	for _, c := range cases {
+		got, err := parseBool(c.value)
+		if (err == nil) != c.valid || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseBool(%q) == %v, %v, want %v, valid %v", c.value, got, err, c.want, c.valid)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// cleanupEvent is the cleanup policy an EventBridge rule can hand the
+// Lambda function, so one deployment can run a different policy for
+// each rule that invokes it. Fields that are left out fall back to the
+// options the function was deployed with, from its environment.
+type cleanupEvent struct {
+	Region        *string `json:"region"`
+	RetentionDays *int    `json:"retention_days"`
+	TagKey        *string `json:"tag_key"`
+	TagValue      *string `json:"tag_value"`
+	Invert        *bool   `json:"invert"`
+	DryRun        *bool   `json:"dry_run"`
+}
+
+// parseCleanupEvent reads a cleanupEvent from what Lambda was invoked
+// with. A rule with a constant input sends the policy as it is; one
+// without sends the whole EventBridge event, with the policy, if any, in
+// its detail. Fields we don't know are an error, since a misspelled one
+// would otherwise quietly fall back to the environment.
+func parseCleanupEvent(payload []byte) (cleanupEvent, error) {
+	var event cleanupEvent
+	payload = bytes.TrimSpace(payload)
+	if len(payload) == 0 || bytes.Equal(payload, []byte("null")) {
+		return event, nil
+	}
+
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return event, fmt.Errorf("invalid event: %v", err)
+	}
+	if _, ok := envelope["detail-type"]; ok {
+		payload = bytes.TrimSpace(envelope["detail"])
+		if len(payload) == 0 || bytes.Equal(payload, []byte("null")) {
+			return event, nil
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&event); err != nil {
+		return event, fmt.Errorf("invalid event: %v", err)
+	}
+	if event.Region != nil && strings.TrimSpace(*event.Region) == "" {
+		return event, fmt.Errorf("invalid event: region must not be empty")
+	}
+	if event.TagKey != nil && strings.TrimSpace(*event.TagKey) == "" {
+		return event, fmt.Errorf("invalid event: tag_key must not be empty")
+	}
+	return event, nil
+}
+
+// apply returns opts with the event's policy in place of theirs, checked
+// with validateOptions. opts have to be as they were given, before
+// validateOptions worked anything out from them. The event's region
+// replaces any --regions, its tag any --tag or --branch, and its
+// retention_days any --older-than. A tag_value on its own keeps the
+// tag key we were deployed with.
+func (e cleanupEvent) apply(opts Options) (Options, error) {
+	if e.Region != nil {
+		opts.Region = *e.Region
+		opts.Regions = nil
+	}
+	if e.RetentionDays != nil {
+		opts.RetentionDays = *e.RetentionDays
+		opts.OlderThan = ""
+	}
+	if e.TagKey != nil || e.TagValue != nil {
+		key, value := opts.TagKey, opts.TagValue
+		if opts.Tag != "" {
+			key, value = parseTag(opts.Tag)
+		}
+		if opts.Branch != "" {
+			key, value = opts.BranchTagKey, ""
+		}
+		if e.TagKey != nil {
+			key, value = *e.TagKey, ""
+		}
+		if e.TagValue != nil {
+			value = *e.TagValue
+		}
+		opts.Tag, opts.Branch = "", ""
+		opts.TagKey, opts.TagValue = key, value
+	}
+	if e.Invert != nil {
+		opts.Invert = *e.Invert
+	}
+	if e.DryRun != nil {
+		opts.Delete = !*e.DryRun
+	}
+	if err := validateOptions(&opts); err != nil {
+		return opts, fmt.Errorf("invalid event: %v", err)
+	}
+	return opts, nil
+}
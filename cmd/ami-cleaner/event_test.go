@@ -0,0 +1,160 @@
+package main
+
+import (
+	"testing"
+
+	flag "github.com/jessevdk/go-flags"
+)
+
+// deployedOptions are the options of a Lambda function deployed to
+// remove dev images from us-east-1 after 30 days, before validation.
+func deployedOptions(t *testing.T, args ...string) Options {
+	var opts Options
+	parser := flag.NewParser(&opts, flag.Default)
+	base := []string{"--lambda", "--region", "us-east-1", "--tag", "Branch=dev", "--days", "30", "--delete"}
+	if _, err := parser.ParseArgs(append(base, args...)); err != nil {
+		t.Fatalf("ParseArgs() returned error: %v", err)
+	}
+	return opts
+}
+
+func TestParseCleanupEvent(t *testing.T) {
+	// A scheduled rule without a constant input sends the whole event.
+	scheduled := `{
+		"version": "0",
+		"id": "53dc4d37-cffa-4f76-80c9-8b7d4a4d2eaa",
+		"detail-type": "Scheduled Event",
+		"source": "aws.events",
+		"account": "123456789012",
+		"time": "2019-04-01T00:00:00Z",
+		"region": "us-east-1",
+		"resources": ["arn:aws:events:us-east-1:123456789012:rule/ami-cleaner-dev"],
+		"detail": {}
+	}`
+	// One with a constant input sends just the policy.
+	policy := `{
+		"region": "us-west-2",
+		"retention_days": 14,
+		"tag_key": "Branch",
+		"tag_value": "master",
+		"invert": true,
+		"dry_run": true
+	}`
+
+	event, err := parseCleanupEvent([]byte(policy))
+	if err != nil {
+		t.Fatalf("parseCleanupEvent() returned error: %v", err)
+	}
+	opts, err := event.apply(deployedOptions(t))
+	if err != nil {
+		t.Fatalf("apply() returned error: %v", err)
+	}
+	if opts.Region != "us-west-2" {
+		t.Errorf("Region == %q, want %q", opts.Region, "us-west-2")
+	}
+	if opts.RetentionDays != 14 {
+		t.Errorf("RetentionDays == %v, want %v", opts.RetentionDays, 14)
+	}
+	if opts.TagKey != "Branch" || opts.TagValue != "master" {
+		t.Errorf("tag == %v=%v, want Branch=master", opts.TagKey, opts.TagValue)
+	}
+	if !opts.Invert {
+		t.Errorf("Invert == false, want true")
+	}
+	if opts.Delete {
+		t.Errorf("Delete == true, want false for dry_run")
+	}
+
+	// The EventBridge event's own region is where the rule is, not
+	// which region to clean, so it mustn't be taken as the policy.
+	for _, payload := range []string{scheduled, "", "null", "{}"} {
+		event, err := parseCleanupEvent([]byte(payload))
+		if err != nil {
+			t.Fatalf("parseCleanupEvent(%q) returned error: %v", payload, err)
+		}
+		opts, err := event.apply(deployedOptions(t))
+		if err != nil {
+			t.Fatalf("apply() for %q returned error: %v", payload, err)
+		}
+		if opts.Region != "us-east-1" || opts.RetentionDays != 30 || opts.TagKey != "Branch" ||
+			opts.TagValue != "dev" || opts.Invert || !opts.Delete {
+			t.Errorf("apply() for %q == %+v, want the deployed options", payload, opts)
+		}
+	}
+}
+
+func TestParseCleanupEventDetail(t *testing.T) {
+	event, err := parseCleanupEvent([]byte(`{
+		"detail-type": "Scheduled Event",
+		"source": "aws.events",
+		"detail": {"tag_value": "staging", "dry_run": false}
+	}`))
+	if err != nil {
+		t.Fatalf("parseCleanupEvent() returned error: %v", err)
+	}
+	opts, err := event.apply(deployedOptions(t))
+	if err != nil {
+		t.Fatalf("apply() returned error: %v", err)
+	}
+	// A tag value on its own keeps the deployed tag key.
+	if opts.TagKey != "Branch" || opts.TagValue != "staging" {
+		t.Errorf("tag == %v=%v, want Branch=staging", opts.TagKey, opts.TagValue)
+	}
+	if !opts.Delete {
+		t.Errorf("Delete == false, want true")
+	}
+}
+
+func TestCleanupEventOverrides(t *testing.T) {
+	event, err := parseCleanupEvent([]byte(`{"region": "eu-west-1", "retention_days": 7, "tag_key": "Owner"}`))
+	if err != nil {
+		t.Fatalf("parseCleanupEvent() returned error: %v", err)
+	}
+	deployed := deployedOptions(t, "--regions", "us-east-1", "--regions", "us-west-2", "--older-than", "90d")
+	deployed.Tag, deployed.Branch = "", "master"
+	opts, err := event.apply(deployed)
+	if err != nil {
+		t.Fatalf("apply() returned error: %v", err)
+	}
+	if opts.Region != "eu-west-1" || len(opts.Regions) != 0 {
+		t.Errorf("Region, Regions == %q, %v, want %q and none", opts.Region, opts.Regions, "eu-west-1")
+	}
+	if opts.RetentionDays != 7 || opts.OlderThan != "" {
+		t.Errorf("RetentionDays, OlderThan == %v, %q, want 7 and none", opts.RetentionDays, opts.OlderThan)
+	}
+	// A tag key replaces --branch, and without a value matches any.
+	if opts.Branch != "" || opts.TagKey != "Owner" || opts.TagValue != "" {
+		t.Errorf("Branch, tag == %q, %v=%v, want none and Owner", opts.Branch, opts.TagKey, opts.TagValue)
+	}
+}
+
+func TestParseCleanupEventInvalid(t *testing.T) {
+	tables := []string{
+		`not json`,
+		`[]`,
+		`{"region": 1}`,
+		`{"retention_days": "30"}`,
+		`{"retention-days": 30}`,
+		`{"region": " "}`,
+		`{"tag_key": ""}`,
+		`{"detail-type": "Scheduled Event", "detail": {"dryrun": true}}`,
+		`{"retention_days": 30} {"region": "us-west-2"}`,
+	}
+	for _, payload := range tables {
+		if _, err := parseCleanupEvent([]byte(payload)); err == nil {
+			t.Errorf("parseCleanupEvent(%q) returned no error", payload)
+		}
+	}
+
+	// Events that parse can still ask for something validateOptions
+	// won't allow.
+	for _, payload := range []string{`{"retention_days": -1}`, `{"retention_days": 0}`} {
+		event, err := parseCleanupEvent([]byte(payload))
+		if err != nil {
+			t.Fatalf("parseCleanupEvent(%q) returned error: %v", payload, err)
+		}
+		if _, err := event.apply(deployedOptions(t)); err == nil {
+			t.Errorf("apply() for %q returned no error", payload)
+		}
+	}
+}
@@ -5,97 +5,1532 @@ import (
 	"github.com/trussworks/truss-aws-tools/pkg/amiclean"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudtrail"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/imagebuilder"
+	"github.com/aws/aws-sdk-go/service/s3"
 	flag "github.com/jessevdk/go-flags"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 
+	"bufio"
+	"bytes"
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"math/rand"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"text/template"
 	"time"
 )
 
 // The Options struct describes the command line options available.
 type Options struct {
-	Delete        bool   `short:"D" long:"delete" env:"DELETE" description:"Actually purge AMIs (runs in dryrun mode by default)."`
-	NamePrefix    string `long:"prefix" env:"NAME_PREFIX" description:"Name prefix to filter on (not affected by --invert)."`
-	RetentionDays int    `long:"days" default:"30" env:"RETENTION_DAYS" description:"Age of AMI in days before it is a candidate for removal."`
-	TagKey        string `long:"tag-key" env:"TAG_KEY" description:"Key of tag to operate on. If you specify a Key, you must also specify a Value."`
-	TagValue      string `long:"tag-value" env:"TAG_VALUE" description:"Value of tag to operate on. If you specify a Value, you must also specify a Key."`
-	Invert        bool   `short:"i" long:"invert" env:"INVERT" description:"Operate in inverted mode -- only purge AMIs that do NOT match the Tag provided."`
-	Unused        bool   `long:"unused" env:"UNUSED" description:"Only purge AMIs for which no running instances were built from."`
-	Profile       string `short:"p" long:"profile" env:"AWS_PROFILE" required:"false" description:"The AWS profile to use."`
-	Region        string `short:"r" long:"region" env:"AWS_REGION" required:"false" description:"The AWS region to use."`
-	Lambda        bool   `long:"lambda" required:"false" env:"LAMBDA" description:"Run as an AWS Lambda function."`
+	Delete                  bool          `short:"D" long:"delete" env:"DELETE" description:"Actually purge AMIs (runs in dryrun mode by default)."`
+	Preflight               bool          `long:"preflight" env:"PREFLIGHT" description:"Check that the role can make each call a run needs, print a checklist, and exit without purging anything."`
+	ValidatePermissions     bool          `long:"validate-permissions" env:"VALIDATE_PERMISSIONS" description:"In dry run mode, make the deregister and delete calls with DryRun set to check that they would be permitted."`
+	Yes                     bool          `short:"y" long:"yes" env:"YES" description:"Skip the confirmation prompt when deleting from a terminal."`
+	Force                   bool          `long:"force" env:"FORCE" description:"The same as --yes."`
+	Interactive             bool          `long:"interactive" env:"INTERACTIVE" description:"With --delete, show each AMI to be purged and ask whether to keep or delete it, in place of the confirmation prompt. Ignored unless running in a terminal."`
+	Owners                  []string      `long:"owner" env:"OWNER" env-delim:"," default:"self" description:"Account ID whose AMIs to look at, for cross-account cleanup. May be given more than once; include self to keep looking at this account's AMIs too."`
+	NamePrefix              string        `long:"prefix" env:"NAME_PREFIX" description:"Name prefix to filter on (not affected by --invert)."`
+	NameSuffix              string        `long:"name-suffix" env:"NAME_SUFFIX" description:"Name suffix to filter on, such as -debug; with --prefix as well, names have to match both (not affected by --invert)."`
+	RetentionDays           int           `long:"days" default:"30" env:"RETENTION_DAYS" description:"Age of AMI in days before it is a candidate for removal."`
+	OlderThan               string        `long:"older-than" env:"OLDER_THAN" description:"Age of AMI before it is a candidate for removal, as a duration such as 12h, 90d or 6w. Overrides --days."`
+	MaxAgeGuard             int           `long:"max-age-guard" env:"MAX_AGE_GUARD" default:"1" description:"Refuse a --days, --older-than or tag filter rule days value below this many days, unless --allow-aggressive is given."`
+	AllowAggressive         bool          `long:"allow-aggressive" env:"ALLOW_AGGRESSIVE" description:"Allow a --days, --older-than or tag filter rule days value below --max-age-guard."`
+	LifecycleTagKey         string        `long:"lifecycle-tag-key" env:"LIFECYCLE_TAG_KEY" description:"Tag key whose JSON value, e.g. {\"ttlDays\":30,\"keepMin\":3}, is that AMI's retention policy, overriding --days, --ttl-tag-key and --min-retain."`
+	TTLTagKey               string        `long:"ttl-tag-key" env:"TTL_TAG_KEY" description:"Tag key whose value is the number of days to keep that AMI, or the date it expires at (e.g. 2019-06-01), overriding --days."`
+	Tag                     string        `long:"tag" env:"TAG" description:"Tag to operate on, as key=value; with just a key, any image with that tag key set matches."`
+	TagKey                  string        `long:"tag-key" env:"TAG_KEY" description:"Key of tag to operate on. Without a Value, any image with this tag key set matches."`
+	TagValue                string        `long:"tag-value" env:"TAG_VALUE" description:"Value of tag to operate on. If you specify a Value, you must also specify a Key."`
+	Branch                  string        `long:"branch" env:"BRANCH" description:"Branch to operate on, as the value of the --branch-tag-key tag. Prefix it with ! to purge AMIs that are NOT on that branch."`
+	BranchTagKey            string        `long:"branch-tag-key" env:"BRANCH_TAG_KEY" default:"branch" description:"Tag key that holds the branch, for --branch."`
+	Invert                  bool          `short:"i" long:"invert" env:"INVERT" description:"Operate in inverted mode -- only purge AMIs that do NOT match the Tag provided."`
+	TagFilterFile           string        `long:"tag-filter-file" env:"TAG_FILTER_FILE" description:"Path to a JSON or YAML policy of rules, each with a tag key and values, name prefix or regex, and retention in days; AMIs matching any rule are purged. Replaces --tag, --prefix and the age flags."`
+	MinRetain               int           `long:"min-retain" env:"MIN_RETAIN" description:"Always keep this many of the newest matching AMIs, purging only older ones."`
+	GroupByTagKey           string        `long:"group-by-tag-key" env:"GROUP_BY_TAG_KEY" value-name:"TAG_KEY" description:"With --min-retain, keep that many of the newest matching AMIs for each value of this tag, with untagged AMIs as one more group."`
+	MinImagesRetained       int           `long:"min-images-retained" env:"MIN_IMAGES_RETAINED" description:"Never leave fewer than this many AMIs in all, matching or not; if purging every match would, the newest matches are kept back."`
+	States                  []string      `long:"state" env:"STATE" env-delim:"," default:"available" choice:"available" choice:"pending" choice:"failed" choice:"error" choice:"invalid" choice:"transient" choice:"disabled" description:"Only purge AMIs in this state. May be given more than once."`
+	CleanFailed             bool          `long:"clean-failed" env:"CLEAN_FAILED" description:"Purge AMIs whose build failed, instead of available ones. Shorthand for --state=failed that also counts as a selection criterion."`
+	ExcludeAMI              []string      `long:"exclude-ami" env:"EXCLUDE_AMI" env-delim:"," description:"An AMI ID to never purge, even if it matches everything else. May be given more than once."`
+	ExcludeFile             string        `long:"exclude-file" env:"EXCLUDE_FILE" description:"Path to a file of AMI IDs to never purge, one per line."`
+	ExcludeAMIIDs           []string      `long:"exclude-ami-ids" env:"EXCLUDE_AMI_IDS" env-delim:"," description:"The same as --exclude-ami."`
+	ExcludeIDsFile          string        `long:"exclude-ids-file" env:"EXCLUDE_IDS_FILE" description:"The same as --exclude-file."`
+	IDsFile                 string        `long:"ids-file" env:"IDS_FILE" description:"Path to a file of AMI IDs to purge, one per line. Purges exactly those, in place of the name, tag and age checks; excluded AMIs are still left alone."`
+	CreatedAfter            string        `long:"created-after" env:"CREATED_AFTER" description:"Only purge AMIs created at or after this date (2006-01-02) or RFC 3339 time, instead of using --days."`
+	CreatedBefore           string        `long:"created-before" env:"CREATED_BEFORE" description:"Only purge AMIs created at or before this date (2006-01-02) or RFC 3339 time, instead of using --days."`
+	InvertAge               bool          `long:"invert-age" env:"INVERT_AGE" description:"Flip the age check, so only AMIs newer than --days are purged. Unrelated to --invert, which flips the tag check."`
+	IncludeDeprecated       bool          `long:"include-deprecated" env:"INCLUDE_DEPRECATED" description:"Ask DescribeImages for deprecated AMIs too. AWS always returns your own deprecated AMIs, but for other --owner accounts it leaves them out unless asked. This is the default; see --exclude-deprecated."`
+	ExcludeDeprecated       bool          `long:"exclude-deprecated" env:"EXCLUDE_DEPRECATED" description:"Do not ask DescribeImages for other --owner accounts' deprecated AMIs, leaving them out of the run."`
+	DeprecatedOnly          bool          `long:"deprecated-only" env:"DEPRECATED_ONLY" description:"Only purge AMIs whose deprecation time has passed, instead of using --days."`
+	AllowShared             bool          `long:"allow-shared" env:"ALLOW_SHARED" description:"Also purge AMIs that are public or shared with other accounts, which are skipped by default."`
+	IgnoreSharedUsage       []string      `long:"ignore-shared-usage" env:"IGNORE_SHARED_USAGE" env-delim:"," value-name:"AMI_ID" description:"Purge this AMI even if it is shared with other accounts, because you know nothing there uses it. May be given more than once. Dangerous: anything those accounts launch from it will break."`
+	IgnoreSharedUsageTag    string        `long:"ignore-shared-usage-tag" env:"IGNORE_SHARED_USAGE_TAG" value-name:"TAG_KEY" description:"Like --ignore-shared-usage, for every AMI with this tag key."`
+	RevokeLaunchPermissions bool          `long:"revoke-launch-permissions" env:"REVOKE_LAUNCH_PERMISSIONS" description:"Remove the launch permissions of each AMI purged under --ignore-shared-usage or --ignore-shared-usage-tag just before deregistering it."`
+	Unused                  bool          `long:"unused" env:"UNUSED" description:"Only purge AMIs for which no running instances were built from."`
+	RecheckUnused           bool          `long:"recheck-unused" env:"RECHECK_UNUSED" description:"With --unused, check again for instances right before deregistering each AMI, and skip it if one has appeared."`
+	CheckFleets             bool          `long:"check-fleets" env:"CHECK_FLEETS" description:"With --unused, also treat AMIs referenced by Spot Fleet or EC2 Fleet requests as in use."`
+	CheckImageBuilder       bool          `long:"check-imagebuilder" env:"CHECK_IMAGEBUILDER" description:"With --unused, also treat AMIs that EC2 Image Builder recipes use as their parent image as in use."`
+	Encrypted               string        `long:"encrypted" env:"ENCRYPTED" choice:"true" choice:"false" description:"Only purge AMIs whose EBS snapshots are all encrypted (true) or all unencrypted (false)."`
+	VolumeType              string        `long:"volume-type" env:"VOLUME_TYPE" description:"Only purge AMIs whose root EBS volume is of this type (e.g. io1), for sweeping up images after a volume type migration."`
+	MinSnapshots            int           `long:"min-snapshots" env:"MIN_SNAPSHOTS" description:"Only purge AMIs backed by at least this many EBS snapshots, to go after the multi-volume images that cost the most to keep."`
+	CheckCloudTrailDays     int           `long:"check-cloudtrail-days" env:"CHECK_CLOUDTRAIL_DAYS" description:"With --unused, also treat AMIs launched via RunInstances within this many days (per CloudTrail) as in use."`
+	Profile                 string        `short:"p" long:"profile" env:"AWS_PROFILE" required:"false" description:"The AWS profile to use."`
+	Region                  string        `short:"r" long:"region" env:"AWS_REGION" required:"false" description:"The AWS region to use."`
+	Regions                 []string      `long:"regions" env:"REGIONS" env-delim:"," description:"Regions to clean, instead of --region, each as a run of its own, several at once. May be given more than once."`
+	RegionConcurrency       int           `long:"region-concurrency" env:"REGION_CONCURRENCY" default:"4" description:"With --regions, how many regions to clean at once."`
+	Org                     bool          `long:"org" env:"ORG" description:"Clean every active account of the AWS Organization, assuming --org-role in each. Must be run from the management account or a delegated administrator."`
+	OrgRole                 string        `long:"org-role" env:"ORG_ROLE" default:"ami-cleaner" description:"With --org, the name of the role to assume in each account."`
+	OrgAccounts             []string      `long:"org-account" env:"ORG_ACCOUNTS" env-delim:"," description:"With --org, only clean this account. May be given more than once."`
+	OrgExcludeAccounts      []string      `long:"org-exclude-account" env:"ORG_EXCLUDE_ACCOUNTS" env-delim:"," description:"With --org, leave this account alone. May be given more than once."`
+	OrgConcurrency          int           `long:"org-concurrency" env:"ORG_CONCURRENCY" default:"4" description:"With --org, how many accounts to clean at once. With --regions as well, this is how many account and region pairs."`
+	Lambda                  bool          `long:"lambda" required:"false" env:"LAMBDA" description:"Run as an AWS Lambda function."`
+	StartupJitter           time.Duration `long:"startup-jitter" env:"STARTUP_JITTER" description:"Sleep for a random duration up to this long (e.g. 5m) before starting, to spread out scheduled runs."`
+	ForceSelectAll          bool          `long:"force-select-all" env:"FORCE_SELECT_ALL" description:"Allow running without a tag or name prefix, which makes every AMI old enough a candidate."`
+	SnapshotCost            float64       `long:"snapshot-gb-month-cost" env:"SNAPSHOT_GB_MONTH_COST" description:"Cost of a GiB-month of snapshot storage, used to estimate monthly savings in the summary."`
+	SnapshotGracePeriod     time.Duration `long:"snapshot-grace-period" env:"SNAPSHOT_GRACE_PERIOD" description:"Tag snapshots for deletion after this long (e.g. 72h) instead of deleting them, and delete previously tagged snapshots that are due."`
+	RetainSnapshots         bool          `long:"retain-snapshots" env:"RETAIN_SNAPSHOTS" description:"Deregister matching AMIs but keep their snapshots."`
+	TagRetainedSnapshots    bool          `long:"tag-retained-snapshots" env:"TAG_RETAINED_SNAPSHOTS" description:"With --retain-snapshots, tag each kept snapshot with retained-from-ami and the ID of the AMI it came from."`
+	BatchSnapshots          bool          `long:"batch-snapshots" env:"BATCH_SNAPSHOTS" description:"Deregister every matching AMI before deleting any snapshots, and keep snapshots still used by another AMI. Ignored with --snapshot-grace-period."`
+	MarkOnly                bool          `long:"mark-only" env:"MARK_ONLY" description:"Tag matching AMIs with scheduled-for-deletion instead of purging them, so a later --purge-marked run can purge them once --mark-grace-period has passed."`
+	MarkGracePeriod         time.Duration `long:"mark-grace-period" env:"MARK_GRACE_PERIOD" default:"168h" description:"With --mark-only, how long marked AMIs are kept before --purge-marked can purge them."`
+	MarkerTemplate          string        `long:"marker-template" env:"MARKER_TEMPLATE" description:"With --mark-only, a text/template for the scheduled-for-deletion value, given .RunID, .Now, .DeleteAfter, .Region and .Branch. The time the AMI can go is then kept in scheduled-for-deletion-after."`
+	PurgeMarked             bool          `long:"purge-marked" env:"PURGE_MARKED" description:"Only purge matching AMIs that a --mark-only run marked, and whose grace period has passed."`
+	Deprecate               bool          `long:"deprecate" env:"DEPRECATE" description:"Deprecate matching AMIs, as of when they expire, instead of purging them, so they drop out of default lookups but can still be brought back."`
+	TagBeforeDelete         bool          `long:"tag-before-delete" env:"TAG_BEFORE_DELETE" description:"Tag each AMI and its snapshots with PurgedBy and PurgedAt just before purging them, to leave a trail in CloudTrail."`
+	Archive                 bool          `long:"archive" env:"ARCHIVE" description:"Copy each AMI to --archive-region and/or --archive-account-id, and wait for the copy, before deregistering it."`
+	ArchiveAccountID        string        `long:"archive-account-id" env:"ARCHIVE_ACCOUNT_ID" description:"With --archive, share each AMI and its snapshots with this account and make the copy there."`
+	ArchiveRegion           string        `long:"archive-region" env:"ARCHIVE_REGION" description:"With --archive, the region to copy AMIs to. Defaults to the region being cleaned."`
+	ArchiveProfile          string        `long:"archive-profile" env:"ARCHIVE_PROFILE" description:"With --archive, the AWS profile to make the copy with. Defaults to --profile; needs to be for the archive account if there is one."`
+	ArchiveTimeout          time.Duration `long:"archive-timeout" env:"ARCHIVE_TIMEOUT" default:"30m" description:"With --archive, how long to wait for each copy to become available before giving up on that AMI."`
+	VerifyDeletion          bool          `long:"verify-deletion" env:"VERIFY_DELETION" description:"After deleting snapshots, keep checking with DescribeSnapshots until they're gone or --verify-deletion-timeout passes, and fail the run if any are still there."`
+	VerifyDeletionTimeout   time.Duration `long:"verify-deletion-timeout" env:"VERIFY_DELETION_TIMEOUT" default:"5m" description:"With --verify-deletion, how long to wait for deleted snapshots to go."`
+	SlowCallThreshold       time.Duration `long:"slow-threshold" env:"SLOW_THRESHOLD" description:"Log a warning for any AWS API call while purging that takes longer than this (e.g. 5s)."`
+	PushgatewayURL          string        `long:"pushgateway-url" env:"PUSHGATEWAY_URL" description:"URL of a Prometheus Pushgateway to push run metrics to when we finish."`
+	PushgatewayJob          string        `long:"pushgateway-job" env:"PUSHGATEWAY_JOB" default:"ami-cleaner" description:"Job name to push metrics under."`
+	PromTextfile            string        `long:"prom-textfile" env:"PROM_TEXTFILE" description:"Path of a file to write run metrics to for the node_exporter textfile collector, labeled by region and branch (the --branch or --tag value)."`
+	Explain                 string        `long:"explain" env:"EXPLAIN" value-name:"AMI_ID" description:"Print how each selection check came out for this AMI, and exit without purging anything."`
+	SummaryFile             string        `long:"summary-file" env:"SUMMARY_FILE" description:"At the end of the run, write its summary as JSON to this file, with a breakdown by region or account for a sweep."`
+	AgeHistogram            bool          `long:"age-histogram" env:"AGE_HISTOGRAM" description:"Add a histogram of the AMIs scanned to the summary, counting how many of each age (up to 7 days, 30, 90, and older) were kept and purged."`
+	Report                  string        `long:"report" env:"REPORT" description:"Write a report of what happened to each AMI processed to this file, or - for stdout."`
+	ReportGroupTag          string        `long:"report-group-tag" env:"REPORT_GROUP_TAG" description:"Group the report and the summary by the value of this tag key, such as the pipeline that made each AMI, with a subtotal of the AMIs purged and snapshot storage reclaimed for each group."`
+	ReportFormat            string        `long:"report-format" env:"REPORT_FORMAT" default:"json" choice:"json" choice:"jsonl" description:"Format of the --report: json writes one array at the end of the run, jsonl writes a line for each AMI as soon as it is processed."`
+	FailOnEmpty             bool          `long:"fail-on-empty" env:"FAIL_ON_EMPTY" description:"Exit with status 3 if no AMIs match, so a scheduled run can alert when a filter stops finding anything."`
+	Output                  string        `long:"output" env:"OUTPUT" choice:"table" choice:"json" description:"How to show the candidate AMIs: table prints an aligned table to stdout, json leaves it to the JSON logs. Defaults to table on a terminal and json otherwise."`
+	PrintIDs                bool          `long:"print-ids" env:"PRINT_IDS" description:"After the run, print the IDs of the AMIs purged (or that would have been) to stdout, one per line."`
+	Concurrency             int           `long:"concurrency" env:"CONCURRENCY" default:"1" description:"How many AMIs to purge at once."`
+	UsageCheckConcurrency   int           `long:"usage-check-concurrency" env:"USAGE_CHECK_CONCURRENCY" description:"How many --unused checks, each a DescribeInstances call, to make at once while purging. By default, every one of the --concurrency workers can have one out."`
+	RateLimit               float64       `long:"rate-limit" env:"RATE_LIMIT" description:"Make at most this many AWS API calls a second in each account and region the run cleans, to stay under EC2's request quotas."`
+	ContinueOnError         bool          `long:"continue-on-error" env:"CONTINUE_ON_ERROR" description:"Keep purging the remaining AMIs when one fails, then report every failure and exit non-zero at the end."`
+	ContinueOnDenied        bool          `long:"continue-on-denied" env:"CONTINUE_ON_DENIED" description:"When AWS denies permission to deregister an AMI or delete a snapshot, log it and carry on, then list every denied call in the summary and exit non-zero."`
+	ImageCacheTTL           time.Duration `long:"image-cache-ttl" env:"IMAGE_CACHE_TTL" description:"Reuse the list of AMIs fetched by an earlier run in the same process (e.g. a warm Lambda) for this long."`
+	ConfirmStable           bool          `long:"confirm-stable" env:"CONFIRM_STABLE" description:"List the AMIs a second time after --confirm-stable-delay, and purge only if the same ones match both times, so an eventually consistent listing can't make us purge the wrong ones."`
+	ConfirmStableDelay      time.Duration `long:"confirm-stable-delay" env:"CONFIRM_STABLE_DELAY" default:"10s" description:"With --confirm-stable, how long to wait before the second listing."`
+	LogFormat               string        `long:"log-format" env:"LOG_FORMAT" choice:"console" choice:"json" description:"How to write the logs: json for log aggregation, or console for people to read. Defaults to console on a terminal and json otherwise, including in Lambda."`
+	Quiet                   bool          `long:"quiet" env:"QUIET" description:"Only log warnings, errors, and the summary, leaving out the per-image lines."`
+	RunID                   string        `long:"run-id" env:"RUN_ID" description:"ID to put on every log line from this run. Defaults to the Lambda request ID, or a random UUID."`
+	Config                  string        `long:"config" env:"CONFIG" description:"Path to a JSON or YAML file of options keyed by long flag name; flags and environment variables override it."`
+	PreviousReport          string        `long:"previous-report" env:"PREVIOUS_REPORT" description:"A previous run's --report file to diff the purge candidates against, listing new candidates and earlier ones that are gone or now protected."`
+	DiffAgainst             string        `long:"diff-against" env:"DIFF_AGAINST" description:"S3 URL (s3://bucket/key) of a previous run's manifest to diff the purge candidates against."`
+
+	// These are parsed from CreatedAfter, CreatedBefore, OlderThan,
+	// MarkerTemplate and Encrypted by validateOptions.
+	createdAfter   time.Time
+	createdBefore  time.Time
+	olderThan      time.Duration
+	markerTemplate *template.Template
+	encrypted      *bool
 }
 
 var options Options
 var logger *zap.Logger
 
-// This function is for establishing our session with AWS.
-func makeEC2Client(region, profile string) *ec2.EC2 {
-	sess := session.MustMakeSession(region, profile)
+// summaryLogger is the same as logger, except that --quiet doesn't
+// raise its level, so the summary is always logged.
+var summaryLogger *zap.Logger
+
+// baseLogger and baseSummaryLogger are the loggers before we add the
+// fields for a particular run. A warm Lambda container runs many times,
+// and each run needs its own fields.
+var baseLogger, baseSummaryLogger *zap.Logger
+
+// imageCache is only set up with --image-cache-ttl. It lives as long as
+// the process, which in Lambda can span several invocations.
+var imageCache *amiclean.ImageCache
+
+// rateLimiters is only set up with --rate-limit. AWS's request quotas
+// are per service per account per Region, so there's a limiter for
+// each, shared by every client and worker calling that service in that
+// account and region. Like
+// imageCache, they live as long as the process.
+var rateLimiters *amiclean.RateLimiters
+
+// rateLimiterFor returns the limiter for service in the account we
+// reach with profile and roleARN, in region. The role names the account
+// if there is one; otherwise it's the profile's.
+func rateLimiterFor(service, region, profile, roleARN string) *amiclean.RateLimiter {
+	account := roleARN
+	if account == "" {
+		account = "profile:" + profile
+	}
+	return rateLimiters.For(service, account, region)
+}
+
+// This function is for establishing our session with AWS. With a role,
+// the calls are made as that role.
+func makeEC2Client(region, profile, roleARN string) *ec2.EC2 {
+	sess := session.MustMakeRoleSession(region, profile, roleARN)
+	rateLimiterFor(ec2.ServiceName, aws.StringValue(sess.Config.Region), profile, roleARN).Attach(&sess.Handlers)
 	ec2Client := ec2.New(sess)
 	return ec2Client
 }
 
-func cleanImages() {
+// parseTag splits a tag given as key=value into its key and value. If
+// there's no "=", the whole thing is the key and the value is empty.
+func parseTag(tag string) (string, string) {
+	parts := strings.SplitN(tag, "=", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// makeCloudTrailClient establishes a CloudTrail session for usage
+// lookups.
+func makeCloudTrailClient(region, profile, roleARN string) *cloudtrail.CloudTrail {
+	sess := session.MustMakeRoleSession(region, profile, roleARN)
+	rateLimiterFor(cloudtrail.ServiceName, aws.StringValue(sess.Config.Region), profile, roleARN).Attach(&sess.Handlers)
+	cloudTrailClient := cloudtrail.New(sess)
+	return cloudTrailClient
+}
+
+// makeImageBuilderClient establishes an Image Builder session for
+// looking up recipes.
+func makeImageBuilderClient(region, profile, roleARN string) *imagebuilder.Imagebuilder {
+	sess := session.MustMakeRoleSession(region, profile, roleARN)
+	rateLimiterFor(imagebuilder.ServiceName, aws.StringValue(sess.Config.Region), profile, roleARN).Attach(&sess.Handlers)
+	return imagebuilder.New(sess)
+}
+
+// makeS3Client establishes an S3 session for fetching manifests.
+func makeS3Client(region, profile string) *s3.S3 {
+	sess := session.MustMakeSession(region, profile)
+	s3Client := s3.New(sess)
+	return s3Client
+}
+
+// getManifest downloads a manifest of AMI IDs from an s3://bucket/key
+// URL.
+func getManifest(s3Client *s3.S3, manifestURL string) ([]string, error) {
+	u, err := url.Parse(manifestURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "s3" || u.Host == "" || strings.TrimPrefix(u.Path, "/") == "" {
+		return nil, fmt.Errorf("manifest URL must be of the form s3://bucket/key: %v", manifestURL)
+	}
+
+	output, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(u.Host),
+		Key:    aws.String(strings.TrimPrefix(u.Path, "/")),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	return amiclean.ReadManifest(output.Body)
+}
+
+// getExcludedImageIDs builds the set of AMI IDs we should never purge
+// from the IDs given on the command line and, if set, a file of IDs in
+// the same one-per-line format as a manifest.
+func getExcludedImageIDs(imageIDs []string, excludeFile string) (map[string]bool, error) {
+	if excludeFile != "" {
+		f, err := os.Open(excludeFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		fileIDs, err := amiclean.ReadManifest(f)
+		if err != nil {
+			return nil, err
+		}
+		imageIDs = append(imageIDs, fileIDs...)
+	}
+
+	excluded := make(map[string]bool, len(imageIDs))
+	for _, imageID := range imageIDs {
+		excluded[imageID] = true
+	}
+	return excluded, nil
+}
+
+// getListedImageIDs reads the AMI IDs to purge from an --ids-file.
+func getListedImageIDs(idsFile string) ([]string, error) {
+	f, err := os.Open(idsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return amiclean.ReadManifest(f)
+}
+
+// getPreviousReport reads the report a previous run wrote with --report.
+func getPreviousReport(path string) ([]amiclean.ImageReport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return amiclean.ReadReport(f)
+}
+
+// getRules reads the policy of rules in the tag filter file, if we have
+// one. Like --config, it's YAML if named .yaml or .yml, and JSON
+// otherwise.
+func getRules(tagFilterFile string) ([]amiclean.Rule, error) {
+	if tagFilterFile == "" {
+		return nil, nil
+	}
+	f, err := os.Open(tagFilterFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if configFormat(tagFilterFile) == "yaml" {
+		return amiclean.ReadRulesYAML(f)
+	}
+	return amiclean.ReadRules(f)
+}
+
+// cleanImages does a run against the --region, or with --regions, each
+// of those, and exits with the status the run calls for. With --org, it
+// does that in each account of the organization.
+func cleanImages(ctx context.Context) {
+	if options.Org {
+		cleanOrg(ctx)
+		return
+	}
+	if len(options.Regions) > 0 {
+		cleanRegions(ctx, options.Regions, options.RegionConcurrency)
+		return
+	}
+	runID := getRunID(ctx)
+	ctx = context.WithValue(ctx, runIDKey{}, runID)
+	summary, err := cleanRegion(ctx, options.Region, nil)
+	if options.SummaryFile != "" {
+		file := summaryFile{RunID: runID, DryRun: !options.Delete, Summary: summary}
+		if err != nil {
+			file.ExitStatus, file.Error = 1, err.Error()
+			if rerr, ok := err.(*runError); ok {
+				file.ExitStatus = rerr.status
+			}
+		}
+		if werr := writeSummaryFile(options.SummaryFile, file); werr != nil && err == nil {
+			err = &runError{
+				msg:    "unable to write summary file",
+				fields: []zap.Field{zap.String("summary-file", options.SummaryFile), zap.Error(werr)},
+				status: 1,
+			}
+		}
+	}
+	if err != nil {
+		exitWith(err)
+	}
+}
+
+// runError is what cleanRegion returns when it stops: what to log about
+// it, if anything, and the exit status to end with.
+type runError struct {
+	msg    string
+	fields []zap.Field
+	status int
+}
+
+func (e *runError) Error() string {
+	return e.msg
+}
+
+// exitWith logs err and exits with its status. A status of 1 is a plain
+// failure, and is logged as fatal.
+func exitWith(err error) {
+	rerr, ok := err.(*runError)
+	if !ok {
+		logger.Fatal(err.Error())
+	}
+	if rerr.status == 1 {
+		logger.Fatal(rerr.msg, rerr.fields...)
+	}
+	if rerr.msg != "" {
+		logger.Error(rerr.msg, rerr.fields...)
+	}
+	logger.Sync()
+	os.Exit(rerr.status)
+}
+
+// promptMu keeps the regions of a run from asking for confirmation at
+// the same time.
+var promptMu sync.Mutex
+
+// targetPath is where a file we were given a path for goes for one
+// run of a sweep. With --regions, each region gets its own, named for the
+// region, so that they don't write over each other: report.json becomes
+// report.us-east-1.json. With --org, the account ID goes in the name
+// too, before the region. Otherwise, and for stdout, it's the path as is.
+func targetPath(path, region, accountID string) string {
+	if (len(options.Regions) == 0 && !options.Org) || path == "" || path == "-" {
+		return path
+	}
+	var names []string
+	if options.Org {
+		names = append(names, accountID)
+	}
+	if len(options.Regions) > 0 {
+		names = append(names, region)
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + strings.Join(names, ".") + ext
+}
+
+// cleanRegion does a run against one region, and returns its summary. If
+// the run can't go on, or should end with a particular exit status, it
+// returns a runError saying why; whether that ends the process or just
+// this region is up to the caller. With an account, the run is against
+// that account of the organization, as the role we assume in it.
+func cleanRegion(ctx context.Context, regionName string, account *orgAccount) (amiclean.Summary, error) {
 	now := time.Now().UTC()
-	// We need to check to make sure that if we have a Tag Key, we also have
-	// a Tag Value.
-	if (options.TagKey == "") != (options.TagValue == "") {
-		logger.Fatal("must specify both a tag Key and tag Value")
+	accountID, roleARN := "", ""
+	if account != nil {
+		accountID, roleARN = account.id, account.roleARN
+	}
+
+	// Everything we log for this run carries the same fields, so the
+	// lines can be picked out when logs from many runs are put together.
+	ec2Client := makeEC2Client(regionName, options.Profile, roleARN)
+	region := aws.StringValue(ec2Client.Config.Region)
+	runFields := []zap.Field{
+		zap.String("run-id", getRunID(ctx)),
+		zap.String("region", region),
+		zap.String("profile", options.Profile),
+		zap.Bool("dry-run", !options.Delete),
+	}
+	if account != nil {
+		runFields = append(runFields,
+			zap.String("account-id", account.id),
+			zap.String("account-name", account.name),
+		)
+	}
+	logger := baseLogger.With(runFields...)
+	summaryLogger := baseSummaryLogger.With(runFields...)
+	fail := func(status int, msg string, fields ...zap.Field) error {
+		return &runError{
+			msg:    msg,
+			fields: append(append([]zap.Field(nil), runFields...), fields...),
+			status: status,
+		}
+	}
+
+	// Without a tag key, we don't filter on tags at all.
+	var tag *ec2.Tag
+	if options.TagKey != "" {
+		tag = &ec2.Tag{Key: aws.String(options.TagKey)}
+		if options.TagValue != "" {
+			tag.Value = aws.String(options.TagValue)
+		}
+	}
+
+	excluded, err := getExcludedImageIDs(options.ExcludeAMI, options.ExcludeFile)
+	if err != nil {
+		return amiclean.Summary{}, fail(1, "unable to read excluded AMI IDs",
+			zap.String("exclude-file", options.ExcludeFile),
+			zap.Error(err),
+		)
+	}
+
+	ignoreShared := make(map[string]bool, len(options.IgnoreSharedUsage))
+	for _, imageID := range options.IgnoreSharedUsage {
+		ignoreShared[imageID] = true
+	}
+	var ignoreSharedTag *ec2.Tag
+	if options.IgnoreSharedUsageTag != "" {
+		ignoreSharedTag = &ec2.Tag{Key: aws.String(options.IgnoreSharedUsageTag)}
+	}
+
+	rules, err := getRules(options.TagFilterFile)
+	if err != nil {
+		return amiclean.Summary{}, fail(1, "unable to read tag filter rules",
+			zap.String("tag-filter-file", options.TagFilterFile),
+			zap.Error(err),
+		)
+	}
+	if err := checkRuleAges(rules, &options); err != nil {
+		return amiclean.Summary{}, fail(1, "refusing tag filter rules",
+			zap.String("tag-filter-file", options.TagFilterFile),
+			zap.Error(err),
+		)
 	}
 
 	a := amiclean.AMIClean{
-		NamePrefix:     options.NamePrefix,
-		Tag:            &ec2.Tag{Key: aws.String(options.TagKey), Value: aws.String(options.TagValue)},
-		Delete:         options.Delete,
-		Invert:         options.Invert,
-		Unused:         options.Unused,
-		ExpirationDate: now.AddDate(0, 0, -int(options.RetentionDays)),
-		Logger:         logger,
-		EC2Client:      makeEC2Client(options.Region, options.Profile),
+		NamePrefix:              options.NamePrefix,
+		NameSuffix:              options.NameSuffix,
+		Owners:                  options.Owners,
+		Region:                  region,
+		AccountID:               accountID,
+		ImageCache:              imageCache,
+		Tag:                     tag,
+		Delete:                  options.Delete,
+		Invert:                  options.Invert,
+		InvertAge:               options.InvertAge,
+		TTLTagKey:               options.TTLTagKey,
+		LifecycleTagKey:         options.LifecycleTagKey,
+		IncludeDeprecated:       !options.ExcludeDeprecated,
+		DeprecatedOnly:          options.DeprecatedOnly,
+		Unused:                  options.Unused,
+		RecheckUnused:           options.RecheckUnused,
+		UsageCheckConcurrency:   options.UsageCheckConcurrency,
+		CheckFleets:             options.CheckFleets,
+		CheckImageBuilder:       options.CheckImageBuilder,
+		Encrypted:               options.encrypted,
+		BackingVolumeType:       options.VolumeType,
+		MinSnapshots:            options.MinSnapshots,
+		SkipShared:              !options.AllowShared,
+		IgnoreSharedImageIDs:    ignoreShared,
+		IgnoreSharedTag:         ignoreSharedTag,
+		RevokeLaunchPermissions: options.RevokeLaunchPermissions,
+		CloudTrailDays:          options.CheckCloudTrailDays,
+		ExcludeImageIDs:         excluded,
+		Rules:                   rules,
+		States:                  options.States,
+		MinRetain:               options.MinRetain,
+		GroupByTagKey:           options.GroupByTagKey,
+		MinImagesRetained:       options.MinImagesRetained,
+		SnapshotCost:            options.SnapshotCost,
+		ReportGroupTagKey:       options.ReportGroupTag,
+		SnapshotGracePeriod:     options.SnapshotGracePeriod,
+		BatchSnapshots:          options.BatchSnapshots,
+		RetainSnapshots:         options.RetainSnapshots,
+		TagRetainedSnapshots:    options.TagRetainedSnapshots,
+		SlowCallThreshold:       options.SlowCallThreshold,
+		TagBeforeDelete:         options.TagBeforeDelete,
+		Archive:                 options.Archive,
+		ArchiveAccountID:        options.ArchiveAccountID,
+		ArchiveRegion:           options.ArchiveRegion,
+		ArchiveTimeout:          options.ArchiveTimeout,
+		MarkGracePeriod:         options.MarkGracePeriod,
+		RequireMarked:           options.PurgeMarked,
+		MarkerTemplate:          options.markerTemplate,
+		MarkerData: amiclean.MarkerData{
+			RunID:  getRunID(ctx),
+			Region: region,
+			Branch: options.Branch,
+		},
+		ContinueOnError:     options.ContinueOnError,
+		ContinueOnDenied:    options.ContinueOnDenied,
+		Concurrency:         options.Concurrency,
+		ValidatePermissions: options.ValidatePermissions,
+		ExpirationDate:      expirationDate(now),
+		CreatedAfter:        options.createdAfter,
+		CreatedBefore:       options.createdBefore,
+		Logger:              logger,
+		EC2Client:           ec2Client,
+	}
+
+	// The expiration date is the easiest thing to get badly wrong, so
+	// show it up front, even with --quiet.
+	if !a.DeprecatedOnly && a.CreatedAfter.IsZero() && a.CreatedBefore.IsZero() {
+		summaryLogger.Info("purging AMIs created before the expiration date",
+			zap.Int("retention-days", options.RetentionDays),
+			zap.String("older-than", options.OlderThan),
+			zap.String("expiration-date", a.ExpirationDate.Format(amiclean.RFC8601)),
+			zap.Bool("invert-age", a.InvertAge),
+		)
+	}
+
+	// Archive copies are made by a client for the archive account and
+	// region, which are this one's unless we've been told otherwise.
+	if a.Archive {
+		if a.ArchiveRegion == "" {
+			a.ArchiveRegion = region
+		}
+		archiveProfile, archiveRole := options.ArchiveProfile, ""
+		if archiveProfile == "" {
+			archiveProfile, archiveRole = options.Profile, roleARN
+		}
+		a.ArchiveEC2Client = makeEC2Client(a.ArchiveRegion, archiveProfile, archiveRole)
+	}
+
+	// We only need a CloudTrail client if we're going to look there.
+	if a.Unused && a.CloudTrailDays > 0 {
+		a.CloudTrailClient = makeCloudTrailClient(regionName, options.Profile, roleARN)
+	}
+	if a.Unused && a.CheckImageBuilder {
+		a.ImageBuilderClient = makeImageBuilderClient(regionName, options.Profile, roleARN)
+	}
+
+	// Before a cleanup is scheduled, someone may just want to know that
+	// the role can do everything it has to.
+	if options.Preflight {
+		checks := a.Preflight()
+		var out bytes.Buffer
+		printPreflight(&out, checks)
+		os.Stdout.Write(out.Bytes())
+		for _, check := range checks {
+			if check.Status != amiclean.PreflightAllowed {
+				return amiclean.Summary{}, fail(1, "preflight checks failed")
+			}
+		}
+		return amiclean.Summary{}, nil
+	}
+
+	// With an IDs file, those images are all we fetch, and they're
+	// purged as they are.
+	var listedImageIDs []string
+	if options.IDsFile != "" {
+		listedImageIDs, err = getListedImageIDs(options.IDsFile)
+		if err != nil {
+			return amiclean.Summary{}, fail(1, "unable to read AMI IDs to purge",
+				zap.String("ids-file", options.IDsFile),
+				zap.Error(err),
+			)
+		}
 	}
 
 	// Get the list of images that we want to evaluate from AWS.
-	availableImages, err := a.GetImages()
+	var availableImages *ec2.DescribeImagesOutput
+	if options.IDsFile != "" {
+		availableImages, err = a.GetListedImages(listedImageIDs)
+	} else {
+		availableImages, err = a.GetImages()
+	}
 	if err != nil {
-		logger.Fatal("unable to get list of available images",
+		return amiclean.Summary{}, fail(1, "unable to get list of available images",
 			zap.Error(err),
 		)
 	}
 
+	// If we've been asked about one image, say how it fared against
+	// each check and stop there.
+	if options.Explain != "" {
+		for _, image := range availableImages.Images {
+			if aws.StringValue(image.ImageId) == options.Explain {
+				printDecision(os.Stdout, a.ExplainImage(image))
+				return amiclean.Summary{}, nil
+			}
+		}
+		return amiclean.Summary{}, fail(1, "image to explain not found",
+			zap.String("ami-id", options.Explain),
+			zap.Strings("owners", options.Owners),
+		)
+	}
+
 	// For each image in the list, check to see if it matches the criteria.
-	for _, image := range availableImages.Images {
-		if a.CheckImage(image) {
-			// If it matches the criteria, we want to delete it.
-			retVal, err := a.PurgeImage(image)
-			// If we get an error, we stop the train.
-			if err != nil {
-				logger.Fatal("Failed to purge image",
-					zap.String("ami-id", *image.ImageId),
-					zap.String("failure", retVal),
-					zap.Error(err),
+	// The images from an IDs file were picked by whoever wrote it.
+	purgeList := availableImages.Images
+	if options.IDsFile == "" {
+		purgeList = a.SelectImages(availableImages.Images)
+	}
+
+	// DescribeImages is eventually consistent, so if we've been asked to,
+	// list the images again after a moment and make sure the same ones
+	// match before we act on any of them.
+	if options.ConfirmStable {
+		added, removed, err := a.ConfirmStable(ctx, purgeList, options.ConfirmStableDelay)
+		if err != nil {
+			return amiclean.Summary{}, fail(1, "unable to confirm the purge candidates are stable",
+				zap.Error(err),
+			)
+		}
+		if len(added) > 0 || len(removed) > 0 {
+			return amiclean.Summary{}, fail(1, "purge candidates changed between listings; not purging anything",
+				zap.Duration("confirm-stable-delay", options.ConfirmStableDelay),
+				zap.Strings("new-ami-ids", added),
+				zap.Strings("gone-ami-ids", removed),
+			)
+		}
+		logger.Info("purge candidates are stable",
+			zap.Duration("confirm-stable-delay", options.ConfirmStableDelay),
+			zap.Int("images-matched", len(purgeList)),
+		)
+	}
+
+	// If we were given a previous manifest, show how today's candidates
+	// differ from it. This is informational only and doesn't change what
+	// gets purged. The manifest is ours rather than the account's, so
+	// in org mode we still fetch it as ourselves.
+	if options.DiffAgainst != "" {
+		previousIDs, err := getManifest(makeS3Client(regionName, options.Profile), options.DiffAgainst)
+		if err != nil {
+			return amiclean.Summary{}, fail(1, "unable to get previous manifest",
+				zap.String("manifest", options.DiffAgainst),
+				zap.Error(err),
+			)
+		}
+		var currentIDs []string
+		for _, image := range purgeList {
+			currentIDs = append(currentIDs, *image.ImageId)
+		}
+		added, removed := amiclean.DiffImageIDs(previousIDs, currentIDs)
+		logger.Info("purge candidates compared to previous manifest",
+			zap.String("manifest", options.DiffAgainst),
+			zap.Strings("added-ami-ids", added),
+			zap.Strings("removed-ami-ids", removed),
+		)
+	}
+
+	// Purging another account's images is unusual enough that we want
+	// it to stand out in the logs.
+	if len(purgeList) > 0 {
+		for _, owner := range options.Owners {
+			if owner != "self" {
+				logger.Warn("purging images owned by another account",
+					zap.Strings("owners", options.Owners),
 				)
+				break
 			}
-			// No error, so log success (based on whether we're in
-			// delete mode or not).
-			if a.Delete {
-				logger.Info("Successfully purged image",
-					zap.String("ami-id", retVal),
-				)
-			} else {
-				logger.Info("Would have purged image",
-					zap.String("ami-id", retVal),
+		}
+	}
+
+	// A scheduled run that stops finding anything more often means a
+	// broken filter than a clean account, so it can be made to fail.
+	if options.FailOnEmpty && len(purgeList) == 0 {
+		summary := amiclean.Summary{
+			ImagesScanned: len(availableImages.Images),
+		}
+		logSummary(summaryLogger, summary)
+		reportMetrics(region, accountID, summary)
+		// CI wants to tell this apart from other failures without
+		// reading the message, and to see which filter came up empty.
+		return summary, fail(exitNothingMatched, "no AMIs matched the selection criteria",
+			zap.String("error-code", "no-matches"),
+			zap.Int("exit-status", exitNothingMatched),
+			zap.Int("images-scanned", summary.ImagesScanned),
+			zap.String("name-prefix", options.NamePrefix),
+			zap.String("name-suffix", options.NameSuffix),
+			zap.String("tag-key", options.TagKey),
+			zap.String("tag-value", options.TagValue),
+			zap.String("tag-filter-file", options.TagFilterFile),
+			zap.String("ids-file", options.IDsFile),
+		)
+	}
+
+	// Keep back the newest of what matched, if we've been asked to,
+	// and remember why so the summary can say where they went.
+	matched := len(purgeList)
+	retainedByPolicy := make(map[string]int)
+	purgeList, retained := a.ApplyLifecycleKeepMin(purgeList)
+	if len(retained) > 0 {
+		retainedByPolicy[amiclean.RetainReasonLifecycle] = len(retained)
+	}
+	purgeList, retainedMin := a.ApplyMinRetain(purgeList)
+	if len(retainedMin) > 0 {
+		retainedByPolicy[amiclean.RetainReasonMinRetain] = len(retainedMin)
+	}
+	retained = append(retained, retainedMin...)
+	// The floor has to count every image in the account. With an IDs
+	// file we only fetched the listed ones, which would make it keep
+	// back far too many, so validateOptions doesn't allow the two
+	// together; this makes sure a floor never works from that count.
+	var retainedFloor []*ec2.Image
+	if options.IDsFile == "" {
+		purgeList, retainedFloor = a.ApplyMinImagesRetained(purgeList, len(availableImages.Images))
+	}
+	if len(retainedFloor) > 0 {
+		retainedByPolicy[amiclean.RetainReasonMinImagesRetained] = len(retainedFloor)
+		logger.Warn("keeping back AMIs to stay above --min-images-retained",
+			zap.Int("min-images-retained", options.MinImagesRetained),
+			zap.Int("images-scanned", len(availableImages.Images)),
+			zap.Int("images-retained", len(retainedFloor)),
+		)
+	}
+	retained = append(retained, retainedFloor...)
+
+	// With a previous run's report, reviewers only need to look at what
+	// changed since. Like --diff-against, this doesn't change what gets
+	// purged. It's read before we open this run's report, so both can be
+	// the same file.
+	if options.PreviousReport != "" {
+		previousReport := targetPath(options.PreviousReport, region, accountID)
+		previous, err := getPreviousReport(previousReport)
+		if err != nil {
+			return amiclean.Summary{}, fail(1, "unable to read previous report",
+				zap.String("previous-report", previousReport),
+				zap.Error(err),
+			)
+		}
+		var scannedIDs, candidateIDs []string
+		for _, image := range availableImages.Images {
+			scannedIDs = append(scannedIDs, aws.StringValue(image.ImageId))
+		}
+		for _, image := range purgeList {
+			candidateIDs = append(candidateIDs, aws.StringValue(image.ImageId))
+		}
+		diff := amiclean.DiffReport(previous, scannedIDs, candidateIDs)
+		logger.Info("purge candidates compared to previous report",
+			zap.String("previous-report", previousReport),
+			zap.Strings("new-ami-ids", diff.New),
+			zap.Strings("gone-ami-ids", diff.Gone),
+			zap.Strings("protected-ami-ids", diff.Protected),
+		)
+	}
+
+	// Someone at a terminal would rather read a table than pick through
+	// JSON logs for what's about to happen.
+	output := options.Output
+	if output == "" {
+		output = "json"
+		if isTerminal(os.Stdout) {
+			output = "table"
+		}
+	}
+	if output == "table" {
+		action := "purge"
+		if options.MarkOnly {
+			action = "mark"
+		}
+		if options.Deprecate {
+			action = "deprecate"
+		}
+		if !options.Delete {
+			action = "would " + action
+		}
+		// Other regions may be printing theirs at the same time.
+		var out bytes.Buffer
+		printCandidates(&out, now, purgeList, retained, action)
+		os.Stdout.Write(out.Bytes())
+	}
+
+	// In soft-delete mode, we only tag what we'd purge. Tags are easy
+	// to take off again, so there's nothing to confirm.
+	if options.MarkOnly {
+		marked, err := a.MarkImages(purgeList)
+		if err != nil {
+			return amiclean.Summary{}, fail(1, "Failed to mark images for deletion",
+				zap.Error(err),
+			)
+		}
+		summary := amiclean.Summary{
+			ImagesScanned:    len(availableImages.Images),
+			ImagesMatched:    matched,
+			RetainedByPolicy: retainedByPolicy,
+			ImagesMarked:     len(marked),
+		}
+		logSummary(summaryLogger, summary)
+		reportMetrics(region, accountID, summary)
+		if options.PrintIDs {
+			printImageIDs(os.Stdout, marked)
+		}
+		return summary, nil
+	}
+
+	// Deprecating is a step short of purging that can be taken back with
+	// DisableImageDeprecation, so like marking, there's nothing to
+	// confirm.
+	if options.Deprecate {
+		deprecated, err := a.DeprecateImages(purgeList)
+		summary := amiclean.Summary{
+			ImagesScanned:    len(availableImages.Images),
+			ImagesMatched:    matched,
+			RetainedByPolicy: retainedByPolicy,
+			ImagesDeprecated: len(deprecated),
+		}
+		if err != nil {
+			summary.Errors = 1
+			logSummary(summaryLogger, summary)
+			reportMetrics(region, accountID, summary)
+			return summary, fail(1, "Failed to deprecate images",
+				zap.Error(err),
+			)
+		}
+		logSummary(summaryLogger, summary)
+		reportMetrics(region, accountID, summary)
+		if options.PrintIDs {
+			printImageIDs(os.Stdout, deprecated)
+		}
+		return summary, nil
+	}
+
+	// Someone curating a borderline set by hand gets asked about each
+	// image in turn, which stands in for confirming the lot. There's
+	// nobody to ask unless we're in a terminal.
+	reviewed := false
+	var keptByOperator []*ec2.Image
+	if options.Delete && options.Interactive {
+		if options.Lambda || !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+			logger.Warn("not running in a terminal; --interactive is disabled")
+		} else {
+			// With several regions, each one asks in turn.
+			promptMu.Lock()
+			approved, kept, ok := reviewCandidates(os.Stdin, os.Stdout, now, purgeList)
+			promptMu.Unlock()
+			if !ok {
+				logger.Info("review quit; exiting without deleting anything")
+				return amiclean.Summary{}, nil
+			}
+			if len(kept) > 0 {
+				retainedByPolicy[amiclean.RetainReasonOperator] = len(kept)
+			}
+			purgeList, keptByOperator, reviewed = approved, kept, true
+		}
+	}
+
+	// If we know what snapshot storage costs, work out roughly what this
+	// run saves, before anyone is asked to confirm it. We have to look
+	// the sizes up before the snapshots are gone anyway. Each group's
+	// subtotal needs the sizes too.
+	var snapshotGiB int64
+	var savings float64
+	if (options.SnapshotCost > 0 || options.ReportGroupTag != "") && !options.RetainSnapshots {
+		snapshotGiB, savings, err = a.EstimatePurgeSavings(purgeList)
+		if err != nil {
+			return amiclean.Summary{}, fail(1, "unable to get snapshot sizes",
+				zap.Error(err),
+			)
+		}
+		summaryLogger.Info("estimated snapshot storage to reclaim",
+			zap.Int("images", len(purgeList)),
+			zap.Int64("snapshot-gib", snapshotGiB),
+			zap.Float64("estimated-monthly-savings", savings),
+		)
+	}
+
+	// If a person is running this by hand, make them confirm before we
+	// actually delete anything.
+	if options.Delete && !options.Yes && !options.Lambda && !reviewed {
+		var imageIDs []string
+		for _, image := range purgeList {
+			imageIDs = append(imageIDs, *image.ImageId)
+		}
+		// With several regions, each one asks in turn.
+		promptMu.Lock()
+		confirmed := confirmPurge(os.Stdin, os.Stdout, isTerminal(os.Stdout), imageIDs)
+		promptMu.Unlock()
+		if !confirmed {
+			logger.Info("purge not confirmed; exiting without deleting anything")
+			return amiclean.Summary{}, nil
+		}
+	}
+
+	summary := amiclean.Summary{
+		ImagesScanned:    len(availableImages.Images),
+		ImagesMatched:    matched,
+		RetainedByPolicy: retainedByPolicy,
+	}
+
+	summary.SnapshotGiB, summary.EstimatedMonthlySavings = snapshotGiB, savings
+
+	// We want to delete each image that matched the criteria. If we get
+	// an error, we stop the train, unless we've been asked to carry on
+	// and report the failures at the end.
+	closeReport := func() {}
+	if options.Report != "" {
+		reportPath := targetPath(options.Report, region, accountID)
+		report, closer, err := openReport(reportPath, options.ReportFormat)
+		if err != nil {
+			return amiclean.Summary{}, fail(1, "unable to open report",
+				zap.String("report", reportPath),
+				zap.Error(err),
+			)
+		}
+		a.Report = report
+		closeReport = func() {
+			if err := closer(); err != nil {
+				logger.Warn("unable to write report",
+					zap.String("report", reportPath),
+					zap.Error(err),
 				)
 			}
 		}
 	}
+	a.ReportKeptByOperator(keptByOperator)
+	purgeCtx, stop := withShutdownSignals(ctx)
+	defer stop()
+	results, purgeErr := a.Run(purgeCtx, purgeList)
+	closeReport()
+	summary.Interrupted = purgeCtx.Err() != nil
+	summary.ImagesPurged = len(results.ImageIDs)
+	summary.ImagesProtected = len(results.ProtectedImageIDs)
+	summary.Groups = a.GroupTotals(purgeList, results)
+	if options.AgeHistogram {
+		summary.AgeHistogram = a.AgeHistogram(availableImages.Images, results.ImageIDs)
+	}
+	var deletedSnapshots []string
+	switch {
+	case a.RetainSnapshots:
+		summary.SnapshotsRetained = len(results.SnapshotIDs)
+	case a.SnapshotGracePeriod > 0:
+		summary.SnapshotsDeferred = len(results.SnapshotIDs)
+	default:
+		summary.SnapshotsDeleted = len(results.SnapshotIDs)
+		deletedSnapshots = results.SnapshotIDs
+	}
+	if purgeErr != nil {
+		summary.Errors += len(multierr.Errors(purgeErr))
+		summary.ErrorCodes = logErrorGroups(logger, amiclean.GroupErrors(purgeErr))
+		if !a.ContinueOnError {
+			reportMetrics(region, accountID, summary)
+			return summary, fail(1, "Failed to purge image",
+				zap.Error(purgeErr),
+			)
+		}
+	}
+
+	// With a grace period, this is also the pass that deletes the
+	// snapshots marked by earlier runs once their time is up. If we've
+	// been told to stop, that can wait for the next run.
+	if a.SnapshotGracePeriod > 0 && !summary.Interrupted {
+		deleted, err := a.DeletePendingSnapshots()
+		summary.SnapshotsDeleted += len(deleted)
+		deletedSnapshots = append(deletedSnapshots, deleted...)
+		if err != nil {
+			summary.Errors++
+			reportMetrics(region, accountID, summary)
+			return summary, fail(1, "Failed to delete pending snapshots",
+				zap.Error(err),
+			)
+		}
+	}
+
+	// Deleting a snapshot only starts it going, so for an audit trail,
+	// check that the ones we deleted really have gone.
+	if options.VerifyDeletion && options.Delete && len(deletedSnapshots) > 0 && !summary.Interrupted {
+		remaining, err := a.VerifySnapshotsDeleted(purgeCtx, deletedSnapshots, options.VerifyDeletionTimeout)
+		if err != nil {
+			summary.Errors++
+			reportMetrics(region, accountID, summary)
+			return summary, fail(1, "unable to verify snapshots were deleted",
+				zap.Error(err),
+			)
+		}
+		summary.SnapshotsNotDeleted = remaining
+		if len(remaining) == 0 {
+			logger.Info("verified snapshots were deleted",
+				zap.Int("snapshots", len(deletedSnapshots)),
+			)
+		}
+	}
+
+	for _, d := range a.DeniedActions() {
+		summary.DeniedActions = append(summary.DeniedActions, d.Action+":"+d.ResourceID)
+	}
+	logSummary(summaryLogger, summary)
+	logGroupTotals(summaryLogger, summary.Groups)
+	reportMetrics(region, accountID, summary)
+
+	// Our logs go to stderr, so stdout is left with nothing but the IDs
+	// for anything downstream to read.
+	if options.PrintIDs {
+		printImageIDs(os.Stdout, results.ImageIDs)
+	}
+
+	// Finding actions we aren't permitted to make should fail the run,
+	// so a permissions check can gate a real one.
+	if len(summary.DeniedActions) > 0 {
+		return summary, fail(1, "found actions we are not permitted to make",
+			zap.Int("denied", len(summary.DeniedActions)),
+			zap.Strings("denied-actions", summary.DeniedActions),
+		)
+	}
+	if len(summary.SnapshotsNotDeleted) > 0 {
+		return summary, fail(1, "snapshots still exist after deletion",
+			zap.Duration("verify-deletion-timeout", options.VerifyDeletionTimeout),
+			zap.Strings("snapshot-ids", summary.SnapshotsNotDeleted),
+		)
+	}
+	if purgeErr != nil {
+		return summary, fail(1, "finished with errors purging images",
+			zap.Int("errors", summary.Errors),
+			zap.Error(purgeErr),
+		)
+	}
+	// In Lambda, the runtime takes care of things once we return.
+	if summary.Interrupted && !options.Lambda {
+		return summary, fail(exitInterrupted, "")
+	}
+	return summary, nil
+}
+
+// exitInterrupted is our exit status when a signal stops the run early,
+// following the shell convention for SIGINT.
+const exitInterrupted = 130
+
+// exitNothingMatched is our exit status with --fail-on-empty when no
+// AMIs match, distinct from the 1 we exit with on errors.
+const exitNothingMatched = 3
+
+// withShutdownSignals returns a context that is cancelled when we get a
+// SIGINT or SIGTERM, so that we can stop between images and still
+// report what we did. Once the first signal arrives we stop catching
+// them, so a second one kills us the usual way.
+func withShutdownSignals(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			logger.Warn("received signal; stopping after the current image",
+				zap.String("signal", sig.String()),
+			)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+
+	return ctx, cancel
+}
+
+// printImageIDs writes AMI IDs to w, one per line, with nothing else.
+func printImageIDs(w io.Writer, imageIDs []string) {
+	for _, imageID := range imageIDs {
+		fmt.Fprintln(w, imageID)
+	}
+}
+
+// printCandidates writes an aligned table of the images we matched and
+// what we're doing with each one: the action given, or keeping them back
+// by policy.
+func printCandidates(w io.Writer, now time.Time, purge, retained []*ec2.Image, action string) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "AMI ID\tNAME\tAGE\tTAGS\tSNAPSHOTS\tDECISION")
+	row := func(image *ec2.Image, decision string) {
+		age := "?"
+		if created, err := amiclean.ParseCreationDate(aws.StringValue(image.CreationDate)); err == nil {
+			age = fmt.Sprintf("%dd", int(now.Sub(created).Hours()/24))
+		}
+		var tags []string
+		for _, tag := range image.Tags {
+			tags = append(tags, aws.StringValue(tag.Key)+"="+aws.StringValue(tag.Value))
+		}
+		sort.Strings(tags)
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%d\t%v\n",
+			aws.StringValue(image.ImageId),
+			aws.StringValue(image.Name),
+			age,
+			strings.Join(tags, ","),
+			len(amiclean.ImageSnapshotIDs(image)),
+			decision,
+		)
+	}
+	for _, image := range purge {
+		row(image, action)
+	}
+	for _, image := range retained {
+		row(image, "retain")
+	}
+	tw.Flush()
+}
+
+// expirationDate works out the cutoff for the age check: --older-than
+// before now if we got one, and --days before now if not.
+func expirationDate(now time.Time) time.Time {
+	if options.OlderThan != "" {
+		return now.Add(-options.olderThan)
+	}
+	return now.AddDate(0, 0, -options.RetentionDays)
+}
+
+// printDecision writes out how an image fared against each selection
+// check, one check per line.
+func printDecision(w io.Writer, d amiclean.Decision) {
+	outcome := "spared"
+	if d.Selected {
+		outcome = "selected"
+	}
+	fmt.Fprintf(w, "%v: %v\n", d.ImageID, outcome)
+	for _, gate := range d.Gates {
+		result := "pass"
+		if !gate.Passed {
+			result = "FAIL"
+		}
+		fmt.Fprintf(w, "  %v %v: %v\n", result, gate.Name, gate.Detail)
+	}
+}
+
+// printPreflight writes out the result of each preflight check as a
+// checklist.
+func printPreflight(w io.Writer, checks []amiclean.PreflightCheck) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tRESOURCE\tSTATUS\tERROR")
+	for _, check := range checks {
+		detail := ""
+		if check.Err != nil {
+			detail = check.Err.Error()
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", check.Action, check.ResourceID, check.Status, detail)
+	}
+	tw.Flush()
+}
+
+// openReport opens the report file, or stdout for "-", and returns a
+// ReportWriter for it in the given format. The returned func finishes
+// the report and closes the file.
+func openReport(path, format string) (amiclean.ReportWriter, func() error, error) {
+	var f io.WriteCloser = os.Stdout
+	if path != "-" {
+		var err error
+		f, err = os.Create(path)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var report amiclean.ReportWriter
+	if format == "jsonl" {
+		report = amiclean.NewJSONLinesReportWriter(f)
+	} else {
+		report = amiclean.NewJSONReportWriter(f)
+	}
+	closer := func() error {
+		err := report.Close()
+		if path != "-" {
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}
+	return report, closer, nil
+}
 
+// reportMetrics writes the run's metrics to a textfile and pushes them
+// to a Pushgateway, for whichever of those we were given. On the
+// textfile, the branch label is the tag value we filtered on.
+func reportMetrics(region, accountID string, summary amiclean.Summary) {
+	if options.PromTextfile != "" {
+		writeTextfile(targetPath(options.PromTextfile, region, accountID), region, accountID, options.TagValue, summary)
+	}
+	if options.PushgatewayURL == "" {
+		return
+	}
+	pushMetrics(options.PushgatewayURL, options.PushgatewayJob, region, accountID, summary)
 }
 
-func lambdaHandler() {
-	lambda.Start(cleanImages)
+// getRunID returns the ID we use to tie together the log lines from a
+// single run. It's --run-id if we were given one, then the request ID if
+// we're running in Lambda, and otherwise a new random UUID.
+func getRunID(ctx context.Context) string {
+	// The regions of a sweep share the run ID of the sweep.
+	if runID, ok := ctx.Value(runIDKey{}).(string); ok {
+		return runID
+	}
+	if options.RunID != "" {
+		return options.RunID
+	}
+	if lc, ok := lambdacontext.FromContext(ctx); ok && lc.AwsRequestID != "" {
+		return lc.AwsRequestID
+	}
+	return newUUID()
+}
+
+// runIDKey is the context key for the run ID a sweep of several regions
+// hands down to each of them.
+type runIDKey struct{}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	b := make([]byte, 16)
+	// crypto/rand only fails if the system's random source does, in
+	// which case a run ID is the least of our worries.
+	cryptorand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// newLoggers creates our usual production logger and the one we use for
+// the summary. When quiet, the usual logger only logs warnings and
+// errors, which keeps the per-image lines out of the logs. The console
+// format is the same logs, laid out for a person at a terminal.
+func newLoggers(quiet bool, format string) (*zap.Logger, *zap.Logger, error) {
+	config := zap.NewProductionConfig()
+	if format == "console" {
+		config.Encoding = "console"
+		config.EncoderConfig = zap.NewDevelopmentEncoderConfig()
+	}
+	summary, err := config.Build()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !quiet {
+		return summary, summary, nil
+	}
+
+	config.Level = zap.NewAtomicLevelAt(zap.WarnLevel)
+	quietLogger, err := config.Build()
+	if err != nil {
+		return nil, nil, err
+	}
+	return quietLogger, summary, nil
+}
+
+// defaultLogFormat is the log format when --log-format isn't given. JSON
+// is what log aggregation wants, so it's only at a terminal, outside
+// Lambda, that we write logs for people to read. Logs go to stderr, so
+// that's the terminal that counts.
+func defaultLogFormat(lambda, terminal bool) string {
+	if terminal && !lambda {
+		return "console"
+	}
+	return "json"
+}
+
+// logErrorGroups logs each kind of error once, with what to do about it
+// and the resources it happened to, rather than leaving the same advice
+// buried in every error. It returns the count for each code.
+func logErrorGroups(logger *zap.Logger, groups []amiclean.ErrorGroup) map[string]int {
+	codes := make(map[string]int, len(groups))
+	for _, group := range groups {
+		codes[group.Code] = group.Count
+		fields := []zap.Field{
+			zap.String("error-code", group.Code),
+			zap.Int("count", group.Count),
+			zap.Strings("resource-ids", group.ResourceIDs),
+		}
+		if group.Guidance != "" {
+			fields = append(fields, zap.String("guidance", group.Guidance))
+		}
+		logger.Warn("errors purging images", fields...)
+	}
+	return codes
+}
+
+// logSummary logs the results of the run in a single line.
+func logSummary(summaryLogger *zap.Logger, summary amiclean.Summary) {
+	summaryLogger.Info("cleanup summary", summaryFields(summary)...)
+}
+
+// logGroupTotals logs each group's subtotal of the run on a line of its
+// own, in order of the group name, so each team can find theirs.
+func logGroupTotals(summaryLogger *zap.Logger, groups map[string]amiclean.GroupTotal) {
+	var names []string
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		total := groups[name]
+		fields := []zap.Field{
+			zap.String("group-tag-key", options.ReportGroupTag),
+			zap.String("group", name),
+			zap.Int("images-purged", total.ImagesPurged),
+			zap.Int64("snapshot-gib", total.SnapshotGiB),
+		}
+		if options.SnapshotCost > 0 {
+			fields = append(fields, zap.Float64("estimated-monthly-savings", total.EstimatedMonthlySavings))
+		}
+		summaryLogger.Info("cleanup summary for group", fields...)
+	}
+}
+
+// summaryFields are the fields we log a summary with. Those that only
+// mean something with particular options are left out without them.
+func summaryFields(summary amiclean.Summary) []zap.Field {
+	fields := []zap.Field{
+		zap.Int("images-scanned", summary.ImagesScanned),
+		zap.Int("images-matched", summary.ImagesMatched),
+		zap.Int("images-purged", summary.ImagesPurged),
+		zap.Int("snapshots-deleted", summary.SnapshotsDeleted),
+	}
+	if len(summary.RetainedByPolicy) > 0 {
+		retained := 0
+		for _, count := range summary.RetainedByPolicy {
+			retained += count
+		}
+		fields = append(fields,
+			zap.Int("images-retained", retained),
+			zap.Any("retained-by-policy", summary.RetainedByPolicy),
+		)
+	}
+	if summary.ImagesProtected > 0 {
+		fields = append(fields, zap.Int("images-protected", summary.ImagesProtected))
+	}
+	if options.MarkOnly {
+		fields = append(fields, zap.Int("images-marked", summary.ImagesMarked))
+	}
+	if options.Deprecate {
+		fields = append(fields, zap.Int("images-deprecated", summary.ImagesDeprecated))
+	}
+	if options.SnapshotGracePeriod > 0 {
+		fields = append(fields, zap.Int("snapshots-deferred", summary.SnapshotsDeferred))
+	}
+	if options.RetainSnapshots {
+		fields = append(fields, zap.Int("snapshots-retained", summary.SnapshotsRetained))
+	}
+	if summary.Interrupted {
+		fields = append(fields, zap.Bool("interrupted", true))
+	}
+	if summary.AgeHistogram != nil {
+		fields = append(fields, zap.Any("age-histogram", summary.AgeHistogram))
+	}
+	if len(summary.SnapshotsNotDeleted) > 0 {
+		fields = append(fields, zap.Strings("snapshots-not-deleted", summary.SnapshotsNotDeleted))
+	}
+	if len(summary.DeniedActions) > 0 {
+		fields = append(fields, zap.Strings("denied-actions", summary.DeniedActions))
+	}
+	if len(summary.ErrorCodes) > 0 {
+		fields = append(fields, zap.Any("error-codes", summary.ErrorCodes))
+	}
+	if options.SnapshotCost > 0 {
+		fields = append(fields,
+			zap.Int64("snapshot-gib", summary.SnapshotGiB),
+			zap.Float64("estimated-monthly-savings", summary.EstimatedMonthlySavings),
+		)
+	}
+	return fields
+}
+
+// confirmSampleSize is how many AMI IDs we show when asking for
+// confirmation.
+const confirmSampleSize = 10
+
+// isTerminal returns true if the file is a terminal rather than a pipe
+// or a regular file.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// confirmPurge shows how many images we're about to purge, along with a
+// sample of their IDs, and asks for "yes" before going ahead. When we
+// aren't running interactively there's nobody to ask, so it returns true
+// without prompting.
+func confirmPurge(in io.Reader, out io.Writer, interactive bool, imageIDs []string) bool {
+	if !interactive || len(imageIDs) == 0 {
+		return true
+	}
+
+	fmt.Fprintf(out, "About to deregister %d AMIs and delete their snapshots:\n", len(imageIDs))
+	for i, imageID := range imageIDs {
+		if i == confirmSampleSize {
+			fmt.Fprintf(out, "  ... and %d more\n", len(imageIDs)-confirmSampleSize)
+			break
+		}
+		fmt.Fprintf(out, "  %s\n", imageID)
+	}
+	fmt.Fprint(out, "Type \"yes\" to continue: ")
+
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	return strings.TrimSpace(answer) == "yes"
+}
+
+// reviewCandidates shows each of the images in turn, and asks whether
+// to keep or delete it. It returns the images to go ahead and purge, and
+// the ones to keep, each in their original order. If the answer is to
+// quit, or there's no answer at all, ok is false and nothing should be
+// purged.
+func reviewCandidates(in io.Reader, out io.Writer, now time.Time, images []*ec2.Image) (purge, kept []*ec2.Image, ok bool) {
+	reader := bufio.NewReader(in)
+	for i, image := range images {
+		fmt.Fprintf(out, "[%d/%d] %s %s\n", i+1, len(images), aws.StringValue(image.ImageId), aws.StringValue(image.Name))
+		created := aws.StringValue(image.CreationDate)
+		if date, err := amiclean.ParseCreationDate(created); err == nil {
+			created = fmt.Sprintf("%s (%dd old)", created, int(now.Sub(date).Hours()/24))
+		}
+		fmt.Fprintf(out, "  created:   %s\n", created)
+		var tags []string
+		for _, tag := range image.Tags {
+			tags = append(tags, aws.StringValue(tag.Key)+"="+aws.StringValue(tag.Value))
+		}
+		sort.Strings(tags)
+		fmt.Fprintf(out, "  tags:      %s\n", strings.Join(tags, ","))
+		fmt.Fprintf(out, "  snapshots: %s\n", strings.Join(amiclean.ImageSnapshotIDs(image), ","))
+
+		for {
+			fmt.Fprint(out, "Keep, delete or quit? [k/d/q]: ")
+			answer, err := reader.ReadString('\n')
+			switch strings.ToLower(strings.TrimSpace(answer)) {
+			case "k", "keep":
+				kept = append(kept, image)
+			case "d", "delete":
+				purge = append(purge, image)
+			case "q", "quit":
+				return nil, nil, false
+			default:
+				if err != nil {
+					fmt.Fprintln(out)
+					return nil, nil, false
+				}
+				continue
+			}
+			break
+		}
+	}
+	return purge, kept, true
+}
+
+// jitterLimit caps the startup jitter so that it takes no more than a
+// quarter of the time we have left, leaving the rest for the cleanup
+// itself. A zero remaining time means there's no deadline to respect.
+func jitterLimit(max, remaining time.Duration) time.Duration {
+	if remaining > 0 && max > remaining/4 {
+		return remaining / 4
+	}
+	return max
+}
+
+// sleepJitter sleeps for a random duration up to max.
+func sleepJitter(max time.Duration) {
+	if max <= 0 {
+		return
+	}
+	jitter := time.Duration(rand.Int63n(int64(max)))
+	logger.Info("sleeping before starting",
+		zap.Duration("jitter", jitter),
+	)
+	time.Sleep(jitter)
+}
+
+// lambdaHandler runs a cleanup for each invocation, with the policy in
+// the EventBridge event it was invoked with, if there is one, in place
+// of the options we were deployed with. deployed are those options as
+// they were given, before validateOptions filled them in. A malformed
+// event is returned as the invocation's error, without cleaning
+// anything.
+func lambdaHandler(deployed Options) {
+	lambda.Start(func(ctx context.Context, payload json.RawMessage) error {
+		event, err := parseCleanupEvent(payload)
+		if err != nil {
+			logger.Error("rejecting event", zap.Error(err))
+			return err
+		}
+		opts, err := event.apply(deployed)
+		if err != nil {
+			logger.Error("rejecting event", zap.Error(err))
+			return err
+		}
+		options = opts
+
+		// Lambda gives us a deadline, so make sure the jitter can't
+		// push us past the function timeout.
+		var remaining time.Duration
+		if deadline, ok := ctx.Deadline(); ok {
+			remaining = time.Until(deadline)
+		}
+		sleepJitter(jitterLimit(options.StartupJitter, remaining))
+		cleanImages(ctx)
+		return nil
+	})
 }
 
 func main() {
@@ -106,18 +1541,55 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// If we were given a config file, fill in anything the flags
+	// didn't set from it.
+	if options.Config != "" {
+		configFile, err := os.Open(options.Config)
+		if err != nil {
+			log.Fatalf("could not open config file: %v", err)
+		}
+		err = loadConfig(parser, &options, configFile, configFormat(options.Config))
+		configFile.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Make sure our options make sense before we touch anything. Each
+	// Lambda invocation starts again from them as they were given.
+	deployed := options
+	err = validateOptions(&options)
+	if err != nil {
+		log.Fatalf("invalid options: %v", err)
+	}
+
+	// Seed the random source for the startup jitter.
+	rand.Seed(time.Now().UnixNano())
+
 	// Initialize the zap logger:
-	logger, err = zap.NewProduction()
+	logFormat := options.LogFormat
+	if logFormat == "" {
+		logFormat = defaultLogFormat(options.Lambda, isTerminal(os.Stderr))
+	}
+	baseLogger, baseSummaryLogger, err = newLoggers(options.Quiet, logFormat)
 	if err != nil {
 		log.Fatalf("can't initialize zap logger: %v", err)
 	}
+	logger, summaryLogger = baseLogger, baseSummaryLogger
+	defer logger.Sync()
+
+	if options.ImageCacheTTL > 0 {
+		imageCache = amiclean.NewImageCache(options.ImageCacheTTL)
+	}
+	rateLimiters = amiclean.NewRateLimiters(options.RateLimit)
 
 	// We need to check to see if we were called as a Lambda function.
 	if options.Lambda {
 		logger.Info("Running Lambda handler.")
-		lambdaHandler()
+		lambdaHandler(deployed)
 	} else {
-		cleanImages()
+		sleepJitter(options.StartupJitter)
+		cleanImages(context.Background())
 	}
 
 }
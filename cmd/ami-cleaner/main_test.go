@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/trussworks/truss-aws-tools/pkg/amiclean"
+	"go.uber.org/zap"
+)
+
+func TestParseTag(t *testing.T) {
+	cases := []struct {
+		in    string
+		key   string
+		value string
+	}{
+		{"Branch=master", "Branch", "master"},
+		{"Branch", "Branch", ""},
+		{"Branch=", "Branch", ""},
+		{"Expr=a=b", "Expr", "a=b"},
+	}
+	for _, c := range cases {
+		key, value := parseTag(c.in)
+		if key != c.key || value != c.value {
+			t.Errorf("parseTag(%q) == %q, %q, want %q, %q", c.in, key, value, c.key, c.value)
+		}
+	}
+}
+
+func TestJitterLimit(t *testing.T) {
+	cases := []struct {
+		max       time.Duration
+		remaining time.Duration
+		want      time.Duration
+	}{
+		{5 * time.Minute, 0, 5 * time.Minute},
+		{5 * time.Minute, 15 * time.Minute, 225 * time.Second},
+		{time.Minute, 15 * time.Minute, time.Minute},
+		{0, 15 * time.Minute, 0},
+	}
+	for _, c := range cases {
+		got := jitterLimit(c.max, c.remaining)
+		if got != c.want {
+			t.Errorf("jitterLimit(%v, %v) == %v, want %v", c.max, c.remaining, got, c.want)
+		}
+	}
+}
+
+// errReader fails any read, so we can tell if something tried to prompt.
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("should not have read from input")
+}
+
+func TestConfirmPurge(t *testing.T) {
+	imageIDs := []string{"ami-11111111111111111", "ami-22222222222222222"}
+
+	// Without a terminal, we go ahead without prompting at all.
+	var out bytes.Buffer
+	if !confirmPurge(errReader{}, &out, false, imageIDs) {
+		t.Errorf("confirmPurge() without a terminal == false, want true")
+	}
+	if out.Len() != 0 {
+		t.Errorf("confirmPurge() without a terminal printed %q, want nothing", out.String())
+	}
+
+	cases := []struct {
+		answer string
+		want   bool
+	}{
+		{"yes\n", true},
+		{"  yes  \n", true},
+		{"y\n", false},
+		{"no\n", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		out.Reset()
+		got := confirmPurge(strings.NewReader(c.answer), &out, true, imageIDs)
+		if got != c.want {
+			t.Errorf("confirmPurge() with answer %q == %v, want %v", c.answer, got, c.want)
+		}
+		if !strings.Contains(out.String(), "ami-22222222222222222") {
+			t.Errorf("confirmPurge() prompt %q does not list the AMI IDs", out.String())
+		}
+	}
+}
+
+func TestReviewCandidates(t *testing.T) {
+	image := func(id string) *ec2.Image {
+		return &ec2.Image{
+			ImageId:      aws.String(id),
+			Name:         aws.String("devimage-" + id),
+			CreationDate: aws.String("2019-03-01T00:00:00.000Z"),
+		}
+	}
+	images := []*ec2.Image{image("ami-1"), image("ami-2"), image("ami-3")}
+	now := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	ids := func(images []*ec2.Image) []string {
+		var imageIDs []string
+		for _, image := range images {
+			imageIDs = append(imageIDs, aws.StringValue(image.ImageId))
+		}
+		return imageIDs
+	}
+
+	cases := []struct {
+		answers string
+		purge   []string
+		kept    []string
+		ok      bool
+	}{
+		{"d\nk\nd\n", []string{"ami-1", "ami-3"}, []string{"ami-2"}, true},
+		{"keep\nKEEP\nkeep\n", nil, []string{"ami-1", "ami-2", "ami-3"}, true},
+		// Anything else is asked again.
+		{"maybe\n\nd\nd\nd", []string{"ami-1", "ami-2", "ami-3"}, nil, true},
+		// Quitting, or running out of answers, purges nothing.
+		{"d\nq\n", nil, nil, false},
+		{"d\n", nil, nil, false},
+	}
+	for _, c := range cases {
+		var out bytes.Buffer
+		purge, kept, ok := reviewCandidates(strings.NewReader(c.answers), &out, now, images)
+		if !reflect.DeepEqual(ids(purge), c.purge) || !reflect.DeepEqual(ids(kept), c.kept) || ok != c.ok {
+			t.Errorf("reviewCandidates() with answers %q == %v, %v, %v, want %v, %v, %v",
+				c.answers, ids(purge), ids(kept), ok, c.purge, c.kept, c.ok)
+		}
+		if !strings.Contains(out.String(), "[1/3] ami-1 devimage-ami-1") || !strings.Contains(out.String(), "(31d old)") {
+			t.Errorf("reviewCandidates() prompt %q does not describe the AMIs", out.String())
+		}
+	}
+}
+
+func TestPrintImageIDs(t *testing.T) {
+	var out bytes.Buffer
+	printImageIDs(&out, []string{"ami-11111111111111111", "ami-22222222222222222"})
+	want := "ami-11111111111111111\nami-22222222222222222\n"
+	if got := out.String(); got != want {
+		t.Errorf("printImageIDs() wrote %q, want %q", got, want)
+	}
+}
+
+func TestPrintCandidates(t *testing.T) {
+	now := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	image := func(id, name, creationDate string, tags ...*ec2.Tag) *ec2.Image {
+		return &ec2.Image{
+			ImageId:        aws.String(id),
+			Name:           aws.String(name),
+			CreationDate:   aws.String(creationDate),
+			Tags:           tags,
+			RootDeviceType: aws.String("ebs"),
+			BlockDeviceMappings: []*ec2.BlockDeviceMapping{
+				{Ebs: &ec2.EbsBlockDevice{SnapshotId: aws.String("snap-1")}},
+			},
+		}
+	}
+	purge := []*ec2.Image{
+		image("ami-1", "base-1", "2019-02-01T00:00:00.000Z",
+			&ec2.Tag{Key: aws.String("Owner"), Value: aws.String("ops")},
+			&ec2.Tag{Key: aws.String("Branch"), Value: aws.String("master")},
+		),
+	}
+	retained := []*ec2.Image{
+		image("ami-22", "base-22", "bogus"),
+	}
+
+	var out bytes.Buffer
+	printCandidates(&out, now, purge, retained, "would purge")
+	want := "AMI ID  NAME     AGE  TAGS                     SNAPSHOTS  DECISION\n" +
+		"ami-1   base-1   59d  Branch=master,Owner=ops  1          would purge\n" +
+		"ami-22  base-22  ?                             1          retain\n"
+	if got := out.String(); got != want {
+		t.Errorf("printCandidates() wrote:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestPrintPreflight(t *testing.T) {
+	var out bytes.Buffer
+	printPreflight(&out, []amiclean.PreflightCheck{
+		{Action: "DescribeImages", ResourceID: "self", Status: amiclean.PreflightAllowed},
+		{Action: "DeleteSnapshot", ResourceID: "snap-1", Status: amiclean.PreflightDenied, Err: errors.New("UnauthorizedOperation")},
+	})
+	want := "ACTION          RESOURCE  STATUS   ERROR\n" +
+		"DescribeImages  self      allowed  \n" +
+		"DeleteSnapshot  snap-1    denied   UnauthorizedOperation\n"
+	if got := out.String(); got != want {
+		t.Errorf("printPreflight() wrote:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestPrintDecision(t *testing.T) {
+	var out bytes.Buffer
+	printDecision(&out, amiclean.Decision{
+		ImageID: "ami-11111111111111111",
+		Gates: []amiclean.Gate{
+			{Name: "prefix", Passed: true, Detail: `name "base-1", prefix "base-"`},
+			{Name: "age", Passed: false, Detail: "created 2019-03-31T21:04:57.000Z, expired false, invert-age false"},
+		},
+	})
+	want := "ami-11111111111111111: spared\n" +
+		"  pass prefix: name \"base-1\", prefix \"base-\"\n" +
+		"  FAIL age: created 2019-03-31T21:04:57.000Z, expired false, invert-age false\n"
+	if got := out.String(); got != want {
+		t.Errorf("printDecision() wrote %q, want %q", got, want)
+	}
+}
+
+func TestOpenReport(t *testing.T) {
+	for _, format := range []string{"json", "jsonl"} {
+		f, err := ioutil.TempFile("", "report")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		defer os.Remove(f.Name())
+
+		report, closer, err := openReport(f.Name(), format)
+		if err != nil {
+			t.Fatalf("openReport(%q) returned error: %v", format, err)
+		}
+		report.Write(amiclean.ImageReport{ImageID: "ami-11111111111111111", Action: amiclean.ReportActionPurged})
+		if err := closer(); err != nil {
+			t.Fatalf("closing %v report returned error: %v", format, err)
+		}
+
+		got, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		record := `{"ami-id":"ami-11111111111111111","ami-name":"","action":"purged"}`
+		want := record + "\n"
+		if format == "json" {
+			want = "[" + record + "]\n"
+		}
+		if string(got) != want {
+			t.Errorf("openReport(%q) wrote %q, want %q", format, got, want)
+		}
+	}
+}
+
+func TestGetExcludedImageIDs(t *testing.T) {
+	excludeFile, err := ioutil.TempFile("", "exclude-ids")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(excludeFile.Name())
+	excludeFile.WriteString("ami-22222222222222222\n\nami-33333333333333333\n")
+	excludeFile.Close()
+
+	got, err := getExcludedImageIDs([]string{"ami-11111111111111111", "ami-22222222222222222"}, excludeFile.Name())
+	if err != nil {
+		t.Fatalf("getExcludedImageIDs() returned error: %v", err)
+	}
+	want := map[string]bool{
+		"ami-11111111111111111": true,
+		"ami-22222222222222222": true,
+		"ami-33333333333333333": true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("getExcludedImageIDs() == %v, want %v", got, want)
+	}
+
+	_, err = getExcludedImageIDs(nil, excludeFile.Name()+"-missing")
+	if err == nil {
+		t.Errorf("getExcludedImageIDs() with a missing file returned no error")
+	}
+}
+
+func TestNewLoggers(t *testing.T) {
+	cases := []struct {
+		quiet  bool
+		format string
+		info   bool
+	}{
+		{false, "json", true},
+		{true, "json", false},
+		{false, "console", true},
+		{true, "console", false},
+	}
+	for _, c := range cases {
+		l, summary, err := newLoggers(c.quiet, c.format)
+		if err != nil {
+			t.Fatalf("newLoggers(%v, %q) returned error: %v", c.quiet, c.format, err)
+		}
+		if got := l.Core().Enabled(zap.InfoLevel); got != c.info {
+			t.Errorf("newLoggers(%v, %q) logger info enabled == %v, want %v", c.quiet, c.format, got, c.info)
+		}
+		if !summary.Core().Enabled(zap.InfoLevel) {
+			t.Errorf("newLoggers(%v, %q) summary logger info enabled == false, want true", c.quiet, c.format)
+		}
+	}
+}
+
+func TestDefaultLogFormat(t *testing.T) {
+	cases := []struct {
+		lambda   bool
+		terminal bool
+		want     string
+	}{
+		{false, true, "console"},
+		{false, false, "json"},
+		{true, true, "json"},
+		{true, false, "json"},
+	}
+	for _, c := range cases {
+		if got := defaultLogFormat(c.lambda, c.terminal); got != c.want {
+			t.Errorf("defaultLogFormat(%v, %v) == %q, want %q", c.lambda, c.terminal, got, c.want)
+		}
+	}
+}
+
+func TestNewUUID(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	first, second := newUUID(), newUUID()
+	if !uuid.MatchString(first) {
+		t.Errorf("newUUID() == %q, want a version 4 UUID", first)
+	}
+	if first == second {
+		t.Errorf("newUUID() returned %q twice", first)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"github.com/trussworks/truss-aws-tools/pkg/amiclean"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"go.uber.org/zap"
+
+	"time"
+)
+
+// newMetricsRegistry builds a registry holding a gauge for each of the
+// numbers we report about a run. The region and job name aren't included
+// here; they are added as grouping labels when we push.
+func newMetricsRegistry(summary amiclean.Summary, now time.Time) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+
+	gauges := []struct {
+		name  string
+		help  string
+		value float64
+	}{
+		{"images_scanned", "Number of AMIs looked at in the last run.", float64(summary.ImagesScanned)},
+		{"images_deleted", "Number of AMIs purged (or that would have been, in dry run mode) in the last run.", float64(summary.ImagesPurged)},
+		{"snapshots_deleted", "Number of snapshots deleted (or that would have been, in dry run mode) in the last run.", float64(summary.SnapshotsDeleted)},
+		{"errors", "Number of errors encountered in the last run.", float64(summary.Errors)},
+		{"last_run_timestamp", "Unix time at which the last run finished.", float64(now.Unix())},
+	}
+	for _, g := range gauges {
+		gauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "ami_cleaner",
+			Name:      g.name,
+			Help:      g.help,
+		})
+		gauge.Set(g.value)
+		registry.MustRegister(gauge)
+	}
+
+	return registry
+}
+
+// pushMetrics pushes the metrics for a run to a Prometheus Pushgateway,
+// grouped by job name and region, and with --org, account. Metrics are
+// nice to have, so a failed push is logged rather than failing the run.
+func pushMetrics(pushgatewayURL, job, region, accountID string, summary amiclean.Summary) {
+	pusher := push.New(pushgatewayURL, job).
+		Gatherer(newMetricsRegistry(summary, time.Now())).
+		Grouping("region", region)
+	if accountID != "" {
+		pusher = pusher.Grouping("account", accountID)
+	}
+	err := pusher.Push()
+	if err != nil {
+		logger.Warn("unable to push metrics to Pushgateway",
+			zap.String("pushgateway-url", pushgatewayURL),
+			zap.Error(err),
+		)
+	}
+}
+
+// newTextfileRegistry builds a registry for the node_exporter textfile
+// collector. There's nothing to group by when the file is scraped, so
+// the region and branch, and any account, go on each gauge as labels
+// instead.
+func newTextfileRegistry(summary amiclean.Summary, region, accountID, branch string, now time.Time) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	labels := prometheus.Labels{"region": region, "branch": branch}
+	if accountID != "" {
+		labels["account"] = accountID
+	}
+
+	gauges := []struct {
+		name  string
+		help  string
+		value float64
+	}{
+		{"deregistered_total", "Number of AMIs deregistered (or that would have been, in dry run mode) in the last run.", float64(summary.ImagesPurged)},
+		{"snapshots_deleted_total", "Number of snapshots deleted (or that would have been, in dry run mode) in the last run.", float64(summary.SnapshotsDeleted)},
+		{"last_run_timestamp", "Unix time at which the last run finished.", float64(now.Unix())},
+	}
+	for _, g := range gauges {
+		gauge := prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   "ami_cleaner",
+			Name:        g.name,
+			Help:        g.help,
+			ConstLabels: labels,
+		})
+		gauge.Set(g.value)
+		registry.MustRegister(gauge)
+	}
+
+	return registry
+}
+
+// writeTextfile writes the metrics for a run to a file for the
+// node_exporter textfile collector. The file is written under a
+// temporary name and renamed into place, so a scrape never sees half of
+// it. Like pushing, this is logged rather than failing the run.
+func writeTextfile(path, region, accountID, branch string, summary amiclean.Summary) {
+	err := prometheus.WriteToTextfile(path, newTextfileRegistry(summary, region, accountID, branch, time.Now()))
+	if err != nil {
+		logger.Warn("unable to write Prometheus textfile",
+			zap.String("prom-textfile", path),
+			zap.Error(err),
+		)
+	}
+}
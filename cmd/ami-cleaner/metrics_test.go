@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/trussworks/truss-aws-tools/pkg/amiclean"
+	"go.uber.org/zap"
+)
+
+func TestNewMetricsRegistry(t *testing.T) {
+	summary := amiclean.Summary{
+		ImagesScanned:    10,
+		ImagesMatched:    4,
+		ImagesPurged:     3,
+		SnapshotsDeleted: 5,
+		Errors:           1,
+	}
+	now := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	want := map[string]float64{
+		"ami_cleaner_images_scanned":     10,
+		"ami_cleaner_images_deleted":     3,
+		"ami_cleaner_snapshots_deleted":  5,
+		"ami_cleaner_errors":             1,
+		"ami_cleaner_last_run_timestamp": float64(now.Unix()),
+	}
+
+	families, err := newMetricsRegistry(summary, now).Gather()
+	if err != nil {
+		t.Fatalf("Gather() returned error: %v", err)
+	}
+	if len(families) != len(want) {
+		t.Errorf("len(families) == %v, want %v", len(families), len(want))
+	}
+	for _, family := range families {
+		got := family.GetMetric()[0].GetGauge().GetValue()
+		if got != want[family.GetName()] {
+			t.Errorf("%v == %v, want %v", family.GetName(), got, want[family.GetName()])
+		}
+	}
+}
+
+func TestWriteTextfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prom-textfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger = zap.NewNop()
+	path := filepath.Join(dir, "ami_cleaner.prom")
+	writeTextfile(path, "us-east-1", "", "master", amiclean.Summary{ImagesPurged: 3, SnapshotsDeleted: 5})
+
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() returned error: %v", err)
+	}
+	for _, want := range []string{
+		`ami_cleaner_deregistered_total{branch="master",region="us-east-1"} 3`,
+		`ami_cleaner_snapshots_deleted_total{branch="master",region="us-east-1"} 5`,
+		`ami_cleaner_last_run_timestamp{branch="master",region="us-east-1"} `,
+	} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("textfile %q does not contain %q", got, want)
+		}
+	}
+
+	// Only the finished file should be left behind.
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("textfile directory has %v files, want 1", len(files))
+	}
+}
+
+func TestWriteTextfileAccount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prom-textfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger = zap.NewNop()
+	path := filepath.Join(dir, "ami_cleaner.prom")
+	writeTextfile(path, "us-east-1", "111111111111", "master", amiclean.Summary{ImagesPurged: 3})
+
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() returned error: %v", err)
+	}
+	want := `ami_cleaner_deregistered_total{account="111111111111",branch="master",region="us-east-1"} 3`
+	if !strings.Contains(string(got), want) {
+		t.Errorf("textfile %q does not contain %q", got, want)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"github.com/trussworks/truss-aws-tools/internal/aws/session"
+	"github.com/trussworks/truss-aws-tools/pkg/amiclean"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"go.uber.org/zap"
+
+	"context"
+	"fmt"
+	"os"
+)
+
+// orgAccount is an account of the organization that we clean, and the
+// role we assume in it to do so.
+type orgAccount struct {
+	id      string
+	name    string
+	roleARN string
+}
+
+// orgTarget is one run of an org sweep: an account, in a region.
+type orgTarget struct {
+	name    string
+	region  string
+	account orgAccount
+}
+
+// makeOrganizationsClient establishes an Organizations session for
+// listing the accounts to clean.
+func makeOrganizationsClient(region, profile string) *organizations.Organizations {
+	sess := session.MustMakeSession(region, profile)
+	organizationsClient := organizations.New(sess)
+	return organizationsClient
+}
+
+// orgRoleARN is the ARN of the role named roleName in an account. Role
+// ARNs are different in GovCloud and China, so the partition is the one
+// region is in.
+func orgRoleARN(region, accountID, roleName string) string {
+	partition := endpoints.AwsPartitionID
+	if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		partition = p.ID()
+	}
+	return fmt.Sprintf("arn:%v:iam::%v:role/%v", partition, accountID, roleName)
+}
+
+// orgTargets pairs each account with each of the regions, assuming the
+// role named roleName in each account. A target is named for its
+// account, and with more than one region, its region too, as
+// "111111111111/us-east-1".
+func orgTargets(accounts []*organizations.Account, regions []string, partitionRegion, roleName string) []orgTarget {
+	var targets []orgTarget
+	for _, account := range accounts {
+		accountID := aws.StringValue(account.Id)
+		a := orgAccount{
+			id:      accountID,
+			name:    aws.StringValue(account.Name),
+			roleARN: orgRoleARN(partitionRegion, accountID, roleName),
+		}
+		for _, region := range regions {
+			name := accountID
+			if len(regions) > 1 {
+				name += "/" + region
+			}
+			targets = append(targets, orgTarget{name: name, region: region, account: a})
+		}
+	}
+	return targets
+}
+
+// cleanOrg sweeps the accounts of the organization, up to
+// --org-concurrency at a time, assuming --org-role in each of them. Each
+// account (or with --regions, each account and region) is a run of its
+// own, with its own summary, and one failing doesn't stop the rest.
+func cleanOrg(ctx context.Context) {
+	organizationsClient := makeOrganizationsClient(options.Region, options.Profile)
+	allAccounts, err := amiclean.ListAccounts(organizationsClient)
+	if err != nil {
+		logger.Fatal("unable to list the accounts of the organization",
+			zap.Error(err),
+		)
+	}
+	accounts := amiclean.FilterAccounts(allAccounts, options.OrgAccounts, options.OrgExcludeAccounts)
+	logger.Info("cleaning accounts of the organization",
+		zap.Int("accounts-listed", len(allAccounts)),
+		zap.Int("accounts", len(accounts)),
+		zap.String("org-role", options.OrgRole),
+	)
+	if len(accounts) == 0 {
+		logger.Warn("no accounts of the organization to clean")
+		logger.Sync()
+		os.Exit(exitNothingMatched)
+	}
+
+	regions := options.Regions
+	if len(regions) == 0 {
+		regions = []string{options.Region}
+	}
+	targets := orgTargets(accounts, regions, aws.StringValue(organizationsClient.Config.Region), options.OrgRole)
+	byName := make(map[string]orgTarget, len(targets))
+	var names []string
+	for _, target := range targets {
+		byName[target.name] = target
+		names = append(names, target.name)
+	}
+
+	sweep(ctx, "account", names, options.OrgConcurrency, func(ctx context.Context, name string) (amiclean.Summary, error) {
+		target := byName[name]
+		return cleanRegion(ctx, target.region, &target.account)
+	})
+}
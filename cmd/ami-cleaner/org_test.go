@@ -0,0 +1,87 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudtrail"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/imagebuilder"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/trussworks/truss-aws-tools/pkg/amiclean"
+)
+
+func TestOrgRoleARN(t *testing.T) {
+	cases := []struct {
+		region string
+		want   string
+	}{
+		{"us-east-1", "arn:aws:iam::111111111111:role/ami-cleaner"},
+		{"us-gov-west-1", "arn:aws-us-gov:iam::111111111111:role/ami-cleaner"},
+		{"cn-north-1", "arn:aws-cn:iam::111111111111:role/ami-cleaner"},
+		// Without a region we know of, it's the standard partition.
+		{"", "arn:aws:iam::111111111111:role/ami-cleaner"},
+	}
+	for _, c := range cases {
+		if got := orgRoleARN(c.region, "111111111111", "ami-cleaner"); got != c.want {
+			t.Errorf("orgRoleARN(%q) == %q, want %q", c.region, got, c.want)
+		}
+	}
+}
+
+func TestOrgTargets(t *testing.T) {
+	accounts := []*organizations.Account{
+		{Id: aws.String("111111111111"), Name: aws.String("dev")},
+		{Id: aws.String("222222222222"), Name: aws.String("prod")},
+	}
+	dev := orgAccount{id: "111111111111", name: "dev", roleARN: "arn:aws:iam::111111111111:role/ami-cleaner"}
+	prod := orgAccount{id: "222222222222", name: "prod", roleARN: "arn:aws:iam::222222222222:role/ami-cleaner"}
+
+	cases := []struct {
+		regions []string
+		want    []orgTarget
+	}{
+		{[]string{"us-east-1"}, []orgTarget{
+			{name: "111111111111", region: "us-east-1", account: dev},
+			{name: "222222222222", region: "us-east-1", account: prod},
+		}},
+		{[]string{"us-east-1", "us-west-2"}, []orgTarget{
+			{name: "111111111111/us-east-1", region: "us-east-1", account: dev},
+			{name: "111111111111/us-west-2", region: "us-west-2", account: dev},
+			{name: "222222222222/us-east-1", region: "us-east-1", account: prod},
+			{name: "222222222222/us-west-2", region: "us-west-2", account: prod},
+		}},
+	}
+	for _, c := range cases {
+		got := orgTargets(accounts, c.regions, "us-east-1", "ami-cleaner")
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("orgTargets(%v) == %+v, want %+v", c.regions, got, c.want)
+		}
+	}
+}
+
+func TestRateLimiterFor(t *testing.T) {
+	saved := rateLimiters
+	defer func() { rateLimiters = saved }()
+	rateLimiters = amiclean.NewRateLimiters(10)
+
+	dev := "arn:aws:iam::111111111111:role/ami-cleaner"
+	prod := "arn:aws:iam::222222222222:role/ami-cleaner"
+	limiter := rateLimiterFor(ec2.ServiceName, "us-east-1", "ops", dev)
+	if rateLimiterFor(ec2.ServiceName, "us-east-1", "ops", dev) != limiter {
+		t.Errorf("rateLimiterFor(ec2, us-east-1, dev) gave two limiters, want one")
+	}
+	// Each account in an --org run has its own quota, and so does the
+	// profile's own account.
+	if rateLimiterFor(ec2.ServiceName, "us-east-1", "ops", prod) == limiter || rateLimiterFor(ec2.ServiceName, "us-east-1", "ops", "") == limiter {
+		t.Errorf("rateLimiterFor shared a limiter between accounts, want one each")
+	}
+	if rateLimiterFor(ec2.ServiceName, "us-west-2", "ops", dev) == limiter {
+		t.Errorf("rateLimiterFor shared a limiter between regions, want one each")
+	}
+	// CloudTrail and Image Builder have quotas apart from EC2's.
+	if rateLimiterFor(cloudtrail.ServiceName, "us-east-1", "ops", dev) == limiter || rateLimiterFor(imagebuilder.ServiceName, "us-east-1", "ops", dev) == limiter {
+		t.Errorf("rateLimiterFor shared a limiter between services, want one each")
+	}
+}
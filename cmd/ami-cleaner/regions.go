@@ -0,0 +1,155 @@
+package main
+
+import (
+	"github.com/trussworks/truss-aws-tools/pkg/amiclean"
+
+	"go.uber.org/zap"
+
+	"context"
+	"os"
+	"sync"
+)
+
+// targetResult is how the run against one of the targets of a sweep,
+// such as a region, went.
+type targetResult struct {
+	target  string
+	summary amiclean.Summary
+	err     error
+}
+
+// fanOut calls run for each of the targets, with at most limit of them
+// going at once, and returns how each went, in the order given. One
+// target failing doesn't stop the others.
+func fanOut(ctx context.Context, targets []string, limit int, run func(context.Context, string) (amiclean.Summary, error)) []targetResult {
+	if limit < 1 {
+		limit = 1
+	}
+	results := make([]targetResult, len(targets))
+	slots := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, target string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			summary, err := run(ctx, target)
+			results[i] = targetResult{target: target, summary: summary, err: err}
+		}(i, target)
+	}
+	wg.Wait()
+	return results
+}
+
+// combineResults totals the summaries of a sweep, and works out the
+// status it should exit with: that of an interruption, if there was one,
+// then that of any other failure, then that of a region with nothing
+// matched.
+func combineResults(results []targetResult) (amiclean.Summary, int) {
+	var total amiclean.Summary
+	status := 0
+	rank := map[int]int{exitInterrupted: 3, 1: 2, exitNothingMatched: 1}
+	for _, result := range results {
+		total.Add(result.summary)
+		if result.err == nil {
+			continue
+		}
+		resultStatus := 1
+		if rerr, ok := result.err.(*runError); ok {
+			resultStatus = rerr.status
+		}
+		if rank[resultStatus] > rank[status] {
+			status = resultStatus
+		}
+	}
+	return total, status
+}
+
+// cleanRegions sweeps several regions at once, up to concurrency at a
+// time. Each region is a run of its own, with its own summary.
+func cleanRegions(ctx context.Context, regions []string, concurrency int) {
+	sweep(ctx, "region", regions, concurrency, func(ctx context.Context, region string) (amiclean.Summary, error) {
+		return cleanRegion(ctx, region, nil)
+	})
+}
+
+// sweep runs each of the targets, up to concurrency at a time; a target
+// that fails is logged and doesn't stop the rest. At the end, we log the
+// totals along with each target's summary, under fields named for what
+// the targets are, and exit non-zero if any target failed.
+func sweep(ctx context.Context, kind string, targets []string, concurrency int, run func(context.Context, string) (amiclean.Summary, error)) {
+	runID := getRunID(ctx)
+	ctx = context.WithValue(ctx, runIDKey{}, runID)
+
+	// A signal stops the targets that are going, and the ones still
+	// waiting their turn don't start.
+	ctx, stop := withShutdownSignals(ctx)
+	defer stop()
+
+	results := fanOut(ctx, targets, concurrency, func(ctx context.Context, target string) (amiclean.Summary, error) {
+		if ctx.Err() != nil {
+			return amiclean.Summary{Interrupted: true}, &runError{status: exitInterrupted}
+		}
+		return run(ctx, target)
+	})
+
+	targetSummaries := make(map[string]amiclean.Summary, len(results))
+	targetErrors := make(map[string]string)
+	var failed []string
+	for _, result := range results {
+		targetSummaries[result.target] = result.summary
+		if result.err == nil {
+			continue
+		}
+		failed = append(failed, result.target)
+		rerr, ok := result.err.(*runError)
+		if !ok {
+			rerr = &runError{msg: result.err.Error(), status: 1}
+		}
+		targetErrors[result.target] = rerr.msg
+		if rerr.msg != "" {
+			logger.Error(rerr.msg, rerr.fields...)
+		}
+	}
+
+	total, status := combineResults(results)
+	fields := append([]zap.Field{
+		zap.String("run-id", runID),
+		zap.Int(kind+"s", len(targets)),
+		zap.Strings(kind+"s-failed", failed),
+	}, summaryFields(total)...)
+	fields = append(fields,
+		zap.Any(kind+"-summaries", targetSummaries),
+		zap.Any(kind+"-errors", targetErrors),
+	)
+	summaryLogger.Info("combined cleanup summary", fields...)
+
+	if options.SummaryFile != "" {
+		file := summaryFile{
+			RunID:      runID,
+			DryRun:     !options.Delete,
+			ExitStatus: status,
+			Summary:    total,
+			Regions:    targetSummaries,
+			Failures:   targetErrors,
+		}
+		if kind == "account" {
+			file.Regions, file.Accounts = nil, targetSummaries
+		}
+		if err := writeSummaryFile(options.SummaryFile, file); err != nil {
+			logger.Error("unable to write summary file",
+				zap.String("summary-file", options.SummaryFile),
+				zap.Error(err),
+			)
+			if status == 0 {
+				status = 1
+			}
+		}
+	}
+
+	if status != 0 && !(status == exitInterrupted && options.Lambda) {
+		logger.Sync()
+		os.Exit(status)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/trussworks/truss-aws-tools/pkg/amiclean"
+)
+
+func TestFanOut(t *testing.T) {
+	regions := []string{"us-east-1", "us-west-2", "eu-west-1", "ap-south-1", "sa-east-1"}
+
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	results := fanOut(context.Background(), regions, 2, func(ctx context.Context, region string) (amiclean.Summary, error) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+
+		if region == "eu-west-1" {
+			return amiclean.Summary{ImagesScanned: 1}, errors.New("unable to get list of available images")
+		}
+		return amiclean.Summary{ImagesScanned: len(region)}, nil
+	})
+
+	if maxInFlight != 2 {
+		t.Errorf("fanOut() ran %v regions at once, want 2", maxInFlight)
+	}
+	for i, result := range results {
+		if result.target != regions[i] {
+			t.Errorf("fanOut() result %v is for %v, want %v", i, result.target, regions[i])
+		}
+		// The failed region doesn't stop the others.
+		if (result.err != nil) != (result.target == "eu-west-1") {
+			t.Errorf("fanOut() result for %v has error %v", result.target, result.err)
+		}
+	}
+}
+
+func TestCombineResults(t *testing.T) {
+	nothingMatched := &runError{msg: "no AMIs matched the selection criteria", status: exitNothingMatched}
+	failed := &runError{msg: "unable to get list of available images", status: 1}
+	interrupted := &runError{status: exitInterrupted}
+
+	tables := []struct {
+		errs   []error
+		status int
+	}{
+		{[]error{nil, nil}, 0},
+		{[]error{nil, nothingMatched}, exitNothingMatched},
+		{[]error{nothingMatched, failed}, 1},
+		{[]error{errors.New("boom"), nil}, 1},
+		{[]error{failed, interrupted, nothingMatched}, exitInterrupted},
+	}
+
+	for _, table := range tables {
+		var results []targetResult
+		for _, err := range table.errs {
+			results = append(results, targetResult{summary: amiclean.Summary{ImagesScanned: 2, ImagesPurged: 1}, err: err})
+		}
+		total, status := combineResults(results)
+		if status != table.status {
+			t.Errorf("combineResults(%v) status == %v, want %v", table.errs, status, table.status)
+		}
+		want := amiclean.Summary{ImagesScanned: 2 * len(results), ImagesPurged: len(results)}
+		if !reflect.DeepEqual(total, want) {
+			t.Errorf("combineResults(%v) total == %+v, want %+v", table.errs, total, want)
+		}
+	}
+}
+
+func TestTargetPath(t *testing.T) {
+	defer func(regions []string, org bool) { options.Regions, options.Org = regions, org }(options.Regions, options.Org)
+
+	tables := []struct {
+		regions []string
+		org     bool
+		path    string
+		want    string
+	}{
+		{nil, false, "report.json", "report.json"},
+		{[]string{"us-east-1", "us-west-2"}, false, "report.json", "report.us-west-2.json"},
+		{[]string{"us-east-1", "us-west-2"}, false, "/var/lib/node_exporter/ami-cleaner.prom", "/var/lib/node_exporter/ami-cleaner.us-west-2.prom"},
+		{[]string{"us-east-1", "us-west-2"}, false, "report", "report.us-west-2"},
+		{[]string{"us-east-1", "us-west-2"}, false, "-", "-"},
+		{[]string{"us-east-1", "us-west-2"}, false, "", ""},
+		{nil, true, "report.json", "report.111111111111.json"},
+		{[]string{"us-east-1", "us-west-2"}, true, "report.json", "report.111111111111.us-west-2.json"},
+		{nil, true, "-", "-"},
+	}
+
+	for _, table := range tables {
+		options.Regions, options.Org = table.regions, table.org
+		if got := targetPath(table.path, "us-west-2", "111111111111"); got != table.want {
+			t.Errorf("targetPath(%q) with regions %v and org %v == %q, want %q", table.path, table.regions, table.org, got, table.want)
+		}
+	}
+}
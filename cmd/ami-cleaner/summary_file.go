@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/trussworks/truss-aws-tools/pkg/amiclean"
+
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// summaryFile is what we write to --summary-file: the summary of the
+// run, and for a sweep, the summary of each region or account in it.
+type summaryFile struct {
+	RunID      string `json:"run-id"`
+	DryRun     bool   `json:"dry-run"`
+	ExitStatus int    `json:"exit-status"`
+	// Error is why a run of a single region failed.
+	Error string `json:"error,omitempty"`
+	amiclean.Summary
+	Regions  map[string]amiclean.Summary `json:"regions,omitempty"`
+	Accounts map[string]amiclean.Summary `json:"accounts,omitempty"`
+	// Failures is why each region or account of a sweep that failed
+	// did so.
+	Failures map[string]string `json:"failures,omitempty"`
+}
+
+// writeSummaryFile writes the summary to path as JSON. It's written to a
+// temporary file in the same directory and renamed into place, so that
+// anything reading it never sees half a summary.
+func writeSummaryFile(path string, summary summaryFile) error {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
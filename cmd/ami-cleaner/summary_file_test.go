@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/trussworks/truss-aws-tools/pkg/amiclean"
+)
+
+func TestWriteSummaryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "summary-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	want := summaryFile{
+		RunID:      "run-1",
+		DryRun:     true,
+		ExitStatus: 1,
+		Summary: amiclean.Summary{
+			ImagesScanned:    15,
+			ImagesMatched:    4,
+			ImagesPurged:     3,
+			SnapshotsDeleted: 5,
+			Errors:           1,
+		},
+		Regions: map[string]amiclean.Summary{
+			"us-east-1": {ImagesScanned: 10, ImagesMatched: 4, ImagesPurged: 3, SnapshotsDeleted: 5},
+			"us-west-2": {ImagesScanned: 5, Errors: 1},
+		},
+		Failures: map[string]string{"us-west-2": "Failed to purge image"},
+	}
+	path := filepath.Join(dir, "summary.json")
+	if err := writeSummaryFile(path, want); err != nil {
+		t.Fatalf("writeSummaryFile() returned error: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() returned error: %v", err)
+	}
+	var got summaryFile
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("summary file %q isn't JSON: %v", data, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("summary file == %+v, want %+v", got, want)
+	}
+	// The summary's counts are at the top level, not nested.
+	if !strings.Contains(string(data), `"images-purged": 3`) {
+		t.Errorf("summary file %q does not contain the images purged", data)
+	}
+
+	// Only the finished file should be left behind.
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("summary file directory has %v files, want 1", len(files))
+	}
+}
+
+func TestWriteSummaryFileMissingDirectory(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "no-such-directory", "summary.json")
+	if err := writeSummaryFile(path, summaryFile{}); err == nil {
+		t.Errorf("writeSummaryFile(%q) returned no error", path)
+	}
+}
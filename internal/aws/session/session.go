@@ -1,25 +1,65 @@
 package session
 
 import (
+	"net/http"
+	"time"
+
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
 )
 
+// RoleSessionName is the session name we use when assuming a role, so
+// that our calls are easy to pick out in CloudTrail.
+const RoleSessionName = "truss-aws-tools"
+
+// metadataTimeout is how long we give the instance metadata service to
+// answer each request when looking up the region. Off EC2, nothing
+// answers at all, and we'd rather carry on without a region straight
+// away than wait on retries.
+const metadataTimeout = time.Second
+
 // MakeSession creates an AWS Session, with appropriate defaults,
 // using shared credentials, and with region and profile overrides.
+// Endpoints come from the partition the region is in, so GovCloud and
+// China regions get their own, and STS (which assume-role profiles use)
+// is called at the region's endpoint rather than the global one, which
+// only exists in the standard partition.
+//
+// The region comes from the override if there is one, and otherwise
+// from AWS_REGION or the profile, as usual. If none of them has one and
+// we're on EC2, we use the instance's region, from the instance metadata
+// service. Off EC2, that lookup fails quickly, without retrying, and the
+// session is left without a region, as it was before.
 func MakeSession(region, profile string) (*session.Session, error) {
 	sessOpts := session.Options{
 		SharedConfigState: session.SharedConfigEnable,
+		Config: aws.Config{
+			STSRegionalEndpoint: endpoints.RegionalSTSEndpoint,
+		},
 	}
 	if profile != "" {
 		sessOpts.Profile = profile
 	}
 	if region != "" {
-		sessOpts.Config = aws.Config{
-			Region: aws.String(region),
-		}
+		sessOpts.Config.Region = aws.String(region)
+	}
+	sess, err := session.NewSessionWithOptions(sessOpts)
+	if err != nil || aws.StringValue(sess.Config.Region) != "" {
+		return sess, err
 	}
-	return session.NewSessionWithOptions(sessOpts)
+	metadata := ec2metadata.New(sess, &aws.Config{
+		HTTPClient: &http.Client{Timeout: metadataTimeout},
+		MaxRetries: aws.Int(0),
+	})
+	if region, err := metadata.Region(); err == nil {
+		sess = sess.Copy(&aws.Config{Region: aws.String(region)})
+	}
+	return sess, nil
 }
 
 // MustMakeSession creates an AWS Session using MakeSession and ensures
@@ -27,3 +67,33 @@ func MakeSession(region, profile string) (*session.Session, error) {
 func MustMakeSession(region, profile string) *session.Session {
 	return session.Must(MakeSession(region, profile))
 }
+
+// MakeRoleSession creates an AWS Session like MakeSession, except that it
+// assumes roleARN with the profile's credentials, and makes its calls as
+// that role. Without a role, it's the same as MakeSession. The role is
+// only assumed once a call needs credentials.
+func MakeRoleSession(region, profile, roleARN string) (*session.Session, error) {
+	sess, err := MakeSession(region, profile)
+	if err != nil || roleARN == "" {
+		return sess, err
+	}
+	provider := newAssumeRoleProvider(sess, roleARN)
+	return sess.Copy(&aws.Config{Credentials: credentials.NewCredentials(provider)}), nil
+}
+
+// MustMakeRoleSession creates an AWS Session using MakeRoleSession and
+// ensures that it is valid.
+func MustMakeRoleSession(region, profile, roleARN string) *session.Session {
+	return session.Must(MakeRoleSession(region, profile, roleARN))
+}
+
+// newAssumeRoleProvider makes the provider that assumes roleARN, calling
+// STS with the credentials of sess.
+func newAssumeRoleProvider(sess *session.Session, roleARN string) *stscreds.AssumeRoleProvider {
+	return &stscreds.AssumeRoleProvider{
+		Client:          sts.New(sess),
+		RoleARN:         roleARN,
+		RoleSessionName: RoleSessionName,
+		Duration:        stscreds.DefaultDuration,
+	}
+}
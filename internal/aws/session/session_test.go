@@ -0,0 +1,184 @@
+package session
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+func TestMakeSessionEndpoints(t *testing.T) {
+	cases := []struct {
+		region  string
+		service string
+		want    string
+	}{
+		{"us-east-1", "ec2", "https://ec2.us-east-1.amazonaws.com"},
+		{"us-gov-west-1", "ec2", "https://ec2.us-gov-west-1.amazonaws.com"},
+		{"us-gov-west-1", "sts", "https://sts.us-gov-west-1.amazonaws.com"},
+		{"cn-north-1", "ec2", "https://ec2.cn-north-1.amazonaws.com.cn"},
+		{"cn-north-1", "sts", "https://sts.cn-north-1.amazonaws.com.cn"},
+		{"us-west-2", "sts", "https://sts.us-west-2.amazonaws.com"},
+	}
+	for _, c := range cases {
+		sess, err := MakeSession(c.region, "")
+		if err != nil {
+			t.Fatalf("MakeSession(%q) returned error %v", c.region, err)
+		}
+		got := sess.ClientConfig(c.service).Endpoint
+		if got != c.want {
+			t.Errorf("%v endpoint in %v == %q, want %q", c.service, c.region, got, c.want)
+		}
+	}
+}
+
+func TestMakeRoleSession(t *testing.T) {
+	const roleARN = "arn:aws:iam::123456789012:role/ami-cleaner"
+
+	base, err := MakeSession("us-west-2", "")
+	if err != nil {
+		t.Fatalf("MakeSession returned error %v", err)
+	}
+	sess, err := MakeRoleSession("us-west-2", "", roleARN)
+	if err != nil {
+		t.Fatalf("MakeRoleSession returned error %v", err)
+	}
+	if sess.Config.Credentials == base.Config.Credentials {
+		t.Errorf("MakeRoleSession(%q) kept the profile's credentials", roleARN)
+	}
+	if got := sess.ClientConfig("ec2").Endpoint; got != "https://ec2.us-west-2.amazonaws.com" {
+		t.Errorf("ec2 endpoint with a role == %q, want %q", got, "https://ec2.us-west-2.amazonaws.com")
+	}
+
+	// Without a role, we get the profile's credentials as usual.
+	plain, err := MakeRoleSession("us-west-2", "", "")
+	if err != nil {
+		t.Fatalf("MakeRoleSession without a role returned error %v", err)
+	}
+	if plain.Config.Credentials == nil || plain.Config.Region == nil || *plain.Config.Region != "us-west-2" {
+		t.Errorf("MakeRoleSession without a role == %+v, want a session like MakeSession's", plain.Config)
+	}
+}
+
+func TestNewAssumeRoleProvider(t *testing.T) {
+	const roleARN = "arn:aws-us-gov:iam::123456789012:role/ami-cleaner"
+
+	sess, err := MakeSession("us-gov-west-1", "")
+	if err != nil {
+		t.Fatalf("MakeSession returned error %v", err)
+	}
+	provider := newAssumeRoleProvider(sess, roleARN)
+	if provider.RoleARN != roleARN {
+		t.Errorf("provider role == %q, want %q", provider.RoleARN, roleARN)
+	}
+	if provider.RoleSessionName != RoleSessionName {
+		t.Errorf("provider session name == %q, want %q", provider.RoleSessionName, RoleSessionName)
+	}
+	// The role is assumed through the region's own STS endpoint.
+	client, ok := provider.Client.(*sts.STS)
+	if !ok {
+		t.Fatalf("provider client is a %T, want *sts.STS", provider.Client)
+	}
+	if got := client.Endpoint; got != "https://sts.us-gov-west-1.amazonaws.com" {
+		t.Errorf("provider STS endpoint == %q, want %q", got, "https://sts.us-gov-west-1.amazonaws.com")
+	}
+}
+
+// fakeMetadataService serves just enough of the instance metadata
+// service for a region lookup.
+func fakeMetadataService(region string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/api/token":
+			w.Write([]byte("token"))
+		case "/latest/dynamic/instance-identity/document":
+			fmt.Fprintf(w, `{"region": %q}`, region)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestMakeSessionRegion(t *testing.T) {
+	server := fakeMetadataService("eu-west-1")
+	defer server.Close()
+	// Keep whatever is on this machine out of it.
+	t.Setenv("AWS_CONFIG_FILE", "/nonexistent")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/nonexistent")
+	t.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", server.URL)
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "")
+
+	cases := []struct {
+		region    string
+		envRegion string
+		want      string
+	}{
+		// Nothing else says, so it's the instance's region.
+		{"", "", "eu-west-1"},
+		// The flag and the environment still come first.
+		{"us-west-2", "", "us-west-2"},
+		{"", "us-east-2", "us-east-2"},
+		{"us-west-2", "us-east-2", "us-west-2"},
+	}
+	for _, c := range cases {
+		t.Setenv("AWS_REGION", c.envRegion)
+		t.Setenv("AWS_DEFAULT_REGION", "")
+		sess, err := MakeSession(c.region, "")
+		if err != nil {
+			t.Fatalf("MakeSession(%q) returned error %v", c.region, err)
+		}
+		if got := aws.StringValue(sess.Config.Region); got != c.want {
+			t.Errorf("MakeSession(%q) with AWS_REGION=%q region == %q, want %q", c.region, c.envRegion, got, c.want)
+		}
+	}
+
+	// Off EC2, there's no region to be had, and that's not an error
+	// until something needs one.
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	sess, err := MakeSession("", "")
+	if err != nil {
+		t.Fatalf("MakeSession without metadata returned error %v", err)
+	}
+	if got := aws.StringValue(sess.Config.Region); got != "" {
+		t.Errorf("MakeSession without metadata region == %q, want none", got)
+	}
+}
+
+func TestMakeSessionRegionUnanswered(t *testing.T) {
+	// Something that takes the connection and never answers, as a
+	// firewalled metadata address can.
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(time.Minute):
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+	t.Setenv("AWS_CONFIG_FILE", "/nonexistent")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/nonexistent")
+	t.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", server.URL)
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "")
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+
+	start := time.Now()
+	sess, err := MakeSession("", "")
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatalf("MakeSession with no metadata answer returned error %v", err)
+	}
+	if got := aws.StringValue(sess.Config.Region); got != "" {
+		t.Errorf("MakeSession with no metadata answer region == %q, want none", got)
+	}
+	// One try for a token and one for the region, with no retries.
+	if limit := 2*metadataTimeout + time.Second; elapsed > limit {
+		t.Errorf("MakeSession with no metadata answer took %v, want at most %v", elapsed, limit)
+	}
+}
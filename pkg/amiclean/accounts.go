@@ -0,0 +1,52 @@
+package amiclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+)
+
+// ListAccounts lists the accounts of the AWS Organization that are
+// active, leaving out those that are suspended or on their way out,
+// since there's no assuming a role in them. It has to be called from the
+// management account, or one that's a delegated administrator.
+func ListAccounts(client organizationsiface.OrganizationsAPI) ([]*organizations.Account, error) {
+	var accounts []*organizations.Account
+	err := client.ListAccountsPages(&organizations.ListAccountsInput{},
+		func(page *organizations.ListAccountsOutput, lastPage bool) bool {
+			for _, account := range page.Accounts {
+				if aws.StringValue(account.Status) == organizations.AccountStatusActive {
+					accounts = append(accounts, account)
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// FilterAccounts picks out the accounts to clean. With include, only
+// those accounts are kept; any in exclude are left out either way. Both
+// are lists of account IDs.
+func FilterAccounts(accounts []*organizations.Account, include, exclude []string) []*organizations.Account {
+	included := make(map[string]bool, len(include))
+	for _, accountID := range include {
+		included[accountID] = true
+	}
+	excluded := make(map[string]bool, len(exclude))
+	for _, accountID := range exclude {
+		excluded[accountID] = true
+	}
+
+	var filtered []*organizations.Account
+	for _, account := range accounts {
+		accountID := aws.StringValue(account.Id)
+		if excluded[accountID] || (len(included) > 0 && !included[accountID]) {
+			continue
+		}
+		filtered = append(filtered, account)
+	}
+	return filtered
+}
@@ -0,0 +1,105 @@
+package amiclean
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+)
+
+// We set up a mock Organizations client that hands out its accounts a
+// page at a time.
+type mockOrganizationsClient struct {
+	organizationsiface.OrganizationsAPI
+	pages [][]*organizations.Account
+	err   error
+}
+
+func (m *mockOrganizationsClient) ListAccountsPages(input *organizations.ListAccountsInput, fn func(*organizations.ListAccountsOutput, bool) bool) error {
+	if m.err != nil {
+		return m.err
+	}
+	for i, page := range m.pages {
+		if !fn(&organizations.ListAccountsOutput{Accounts: page}, i == len(m.pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func testAccount(id, status string) *organizations.Account {
+	return &organizations.Account{
+		Id:     aws.String(id),
+		Name:   aws.String("account-" + id),
+		Status: aws.String(status),
+	}
+}
+
+func accountIDs(accounts []*organizations.Account) []string {
+	var ids []string
+	for _, account := range accounts {
+		ids = append(ids, *account.Id)
+	}
+	return ids
+}
+
+func TestListAccounts(t *testing.T) {
+	client := &mockOrganizationsClient{
+		pages: [][]*organizations.Account{
+			{
+				testAccount("111111111111", organizations.AccountStatusActive),
+				testAccount("222222222222", organizations.AccountStatusSuspended),
+			},
+			{
+				testAccount("333333333333", organizations.AccountStatusActive),
+				testAccount("444444444444", organizations.AccountStatusPendingClosure),
+			},
+		},
+	}
+
+	accounts, err := ListAccounts(client)
+	if err != nil {
+		t.Fatalf("ERROR: ListAccounts returned error: %v", err)
+	}
+	expected := []string{"111111111111", "333333333333"}
+	if got := accountIDs(accounts); !reflect.DeepEqual(got, expected) {
+		t.Errorf("ERROR: ListAccounts;\n\texpected: %v\n\tgot: %v", expected, got)
+	}
+
+	client.err = errors.New("AWSOrganizationsNotInUseException")
+	if _, err := ListAccounts(client); err == nil {
+		t.Errorf("ERROR: ListAccounts ignored the error listing accounts")
+	}
+}
+
+func TestFilterAccounts(t *testing.T) {
+	accounts := []*organizations.Account{
+		testAccount("111111111111", organizations.AccountStatusActive),
+		testAccount("222222222222", organizations.AccountStatusActive),
+		testAccount("333333333333", organizations.AccountStatusActive),
+	}
+
+	tables := []struct {
+		include  []string
+		exclude  []string
+		expected []string
+	}{
+		{nil, nil, []string{"111111111111", "222222222222", "333333333333"}},
+		{[]string{"222222222222", "333333333333"}, nil, []string{"222222222222", "333333333333"}},
+		{nil, []string{"111111111111"}, []string{"222222222222", "333333333333"}},
+		// Excluding wins over including.
+		{[]string{"222222222222", "333333333333"}, []string{"333333333333"}, []string{"222222222222"}},
+		{[]string{"999999999999"}, nil, nil},
+	}
+
+	for _, table := range tables {
+		got := accountIDs(FilterAccounts(accounts, table.include, table.exclude))
+		if !reflect.DeepEqual(got, table.expected) {
+			t.Errorf("ERROR: FilterAccounts including %v and excluding %v;\n\texpected: %v\n\tgot: %v",
+				table.include, table.exclude, table.expected, got)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package amiclean
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// day is how long a day is, for the age buckets.
+const day = 24 * time.Hour
+
+// AgeBucket counts the images whose age falls in one range, split by
+// whether they were purged.
+type AgeBucket struct {
+	Label string `json:"label"`
+	// MaxAge is the age the bucket stops at, exclusive. The last bucket
+	// has none, and takes in everything older.
+	MaxAge time.Duration `json:"-"`
+	Kept   int           `json:"kept"`
+	Purged int           `json:"purged"`
+}
+
+// AgeHistogram counts the images a run scanned by how old they are, so
+// that it's easy to see whether a retention is purging about what was
+// intended: too aggressive, and the younger buckets are losing images;
+// too lax, and the older ones are still full. Images whose creation
+// date can't be parsed are counted as Unknown.
+type AgeHistogram struct {
+	Buckets []AgeBucket `json:"buckets"`
+	Unknown int         `json:"unknown,omitempty"`
+}
+
+// NewAgeHistogram returns an empty histogram with buckets for up to a
+// week, a month, 90 days, and older.
+func NewAgeHistogram() *AgeHistogram {
+	return &AgeHistogram{
+		Buckets: []AgeBucket{
+			{Label: "0-7d", MaxAge: 7 * day},
+			{Label: "7-30d", MaxAge: 30 * day},
+			{Label: "30-90d", MaxAge: 90 * day},
+			{Label: "90d+"},
+		},
+	}
+}
+
+// Add counts an image of the given age.
+func (h *AgeHistogram) Add(age time.Duration, purged bool) {
+	for i := range h.Buckets {
+		bucket := &h.Buckets[i]
+		if bucket.MaxAge != 0 && age >= bucket.MaxAge {
+			continue
+		}
+		if purged {
+			bucket.Purged++
+		} else {
+			bucket.Kept++
+		}
+		return
+	}
+}
+
+// Merge adds another histogram's counts to this one's, bucket by bucket,
+// such as when totalling the summaries of several regions. Both have to
+// have the same buckets.
+func (h *AgeHistogram) Merge(other *AgeHistogram) {
+	for i := range h.Buckets {
+		if i < len(other.Buckets) {
+			h.Buckets[i].Kept += other.Buckets[i].Kept
+			h.Buckets[i].Purged += other.Buckets[i].Purged
+		}
+	}
+	h.Unknown += other.Unknown
+}
+
+// AgeHistogram counts the images scanned by the age they had at the
+// start of the run, by their CreationDate, and by whether they were
+// among those purged (or that would have been, in dry run mode).
+func (a *AMIClean) AgeHistogram(scanned []*ec2.Image, purgedIDs []string) *AgeHistogram {
+	purged := make(map[string]bool, len(purgedIDs))
+	for _, imageID := range purgedIDs {
+		purged[imageID] = true
+	}
+
+	h := NewAgeHistogram()
+	now := a.now()
+	for _, image := range scanned {
+		creationTime := imageCreationTime(image)
+		if creationTime.IsZero() {
+			h.Unknown++
+			continue
+		}
+		h.Add(now.Sub(creationTime), purged[aws.StringValue(image.ImageId)])
+	}
+	return h
+}
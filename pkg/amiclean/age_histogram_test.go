@@ -0,0 +1,104 @@
+package amiclean
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// ageHistogramCounts flattens a histogram's buckets into label: kept/purged
+// pairs, for comparing.
+func ageHistogramCounts(h *AgeHistogram) map[string][2]int {
+	counts := make(map[string][2]int)
+	for _, bucket := range h.Buckets {
+		counts[bucket.Label] = [2]int{bucket.Kept, bucket.Purged}
+	}
+	return counts
+}
+
+func TestAgeHistogram(t *testing.T) {
+	// Images from a day to a year old, by days before now, with the ones
+	// purged flagged.
+	ages := []struct {
+		days   int
+		purged bool
+	}{
+		{1, false}, {6, false},
+		{7, false}, {20, false}, {29, true},
+		{30, true}, {45, true}, {89, true}, {89, false},
+		{90, true}, {365, true},
+	}
+	var images []*ec2.Image
+	var purged []string
+	for index, age := range ages {
+		imageID := fmt.Sprintf("ami-%d", index)
+		images = append(images, &ec2.Image{
+			ImageId:      aws.String(imageID),
+			CreationDate: aws.String(now.AddDate(0, 0, -age.days).Format(RFC8601)),
+		})
+		if age.purged {
+			purged = append(purged, imageID)
+		}
+	}
+	images = append(images, &ec2.Image{ImageId: aws.String("ami-bad"), CreationDate: aws.String("yesterday")})
+
+	a := AMIClean{Now: stoppedClock}
+	h := a.AgeHistogram(images, purged)
+
+	expected := map[string][2]int{
+		"0-7d":   {2, 0},
+		"7-30d":  {2, 1},
+		"30-90d": {1, 3},
+		"90d+":   {0, 2},
+	}
+	if got := ageHistogramCounts(h); !reflect.DeepEqual(got, expected) {
+		t.Errorf("ERROR: AgeHistogram kept and purged by bucket;\n\texpected: %v\n\tgot: %v", expected, got)
+	}
+	if h.Unknown != 1 {
+		t.Errorf("ERROR: AgeHistogram unknown;\n\texpected: 1\n\tgot: %v", h.Unknown)
+	}
+
+	// The buckets stay in order in JSON, without their bounds.
+	out, err := json.Marshal(h)
+	if err != nil {
+		t.Fatalf("ERROR: json.Marshal returned error: %v", err)
+	}
+	expectedJSON := `{"buckets":[{"label":"0-7d","kept":2,"purged":0},{"label":"7-30d","kept":2,"purged":1},` +
+		`{"label":"30-90d","kept":1,"purged":3},{"label":"90d+","kept":0,"purged":2}],"unknown":1}`
+	if string(out) != expectedJSON {
+		t.Errorf("ERROR: AgeHistogram JSON;\n\texpected: %v\n\tgot: %v", expectedJSON, string(out))
+	}
+}
+
+func TestSummaryAddAgeHistogram(t *testing.T) {
+	first := NewAgeHistogram()
+	first.Add(day, true)
+	first.Add(100*day, false)
+	second := NewAgeHistogram()
+	second.Add(2*day, true)
+	second.Unknown = 2
+
+	var total Summary
+	total.Add(Summary{AgeHistogram: first})
+	total.Add(Summary{})
+	total.Add(Summary{AgeHistogram: second})
+
+	expected := map[string][2]int{
+		"0-7d":   {0, 2},
+		"7-30d":  {0, 0},
+		"30-90d": {0, 0},
+		"90d+":   {1, 0},
+	}
+	if got := ageHistogramCounts(total.AgeHistogram); !reflect.DeepEqual(got, expected) || total.AgeHistogram.Unknown != 2 {
+		t.Errorf("ERROR: Summary.Add with age histograms;\n\texpected: %v, 2 unknown\n\tgot: %v, %v unknown",
+			expected, got, total.AgeHistogram.Unknown)
+	}
+	// Adding mustn't change the histograms added in.
+	if first.Buckets[0].Purged != 1 {
+		t.Errorf("ERROR: Summary.Add changed a histogram it added in: %+v", first.Buckets[0])
+	}
+}
@@ -1,11 +1,19 @@
 package amiclean
 
 import (
+	"errors"
+
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudtrail/cloudtrailiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/imagebuilder/imagebuilderiface"
 	"go.uber.org/zap"
 
+	"path/filepath"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 )
 
@@ -14,45 +22,243 @@ const (
 	RFC8601 = "2006-01-02T15:04:05.000Z"
 )
 
+// ErrImageInUse is returned by PurgeImage when RecheckUnused finds that
+// an image has started being used since it was checked.
+var ErrImageInUse = errors.New("image is now in use")
+
+// ErrNotEBSBacked is returned by PurgeImage for an image whose root
+// device isn't EBS, which we don't know how to purge.
+var ErrNotEBSBacked = errors.New("image root device is not EBS")
+
+// activeInstanceStates are the instance states in which an instance still
+// counts as using its AMI. Terminated instances don't count.
+var activeInstanceStates = []string{
+	ec2.InstanceStateNamePending,
+	ec2.InstanceStateNameRunning,
+	ec2.InstanceStateNameShuttingDown,
+	ec2.InstanceStateNameStopping,
+	ec2.InstanceStateNameStopped,
+}
+
 // AMIClean defines parameters for cleaning up AMIs based on a tag and
-// expiration date.
+// expiration date. NewAMIClient is the easiest way to make one, with
+// sensible defaults and its options checked; filling in the fields
+// directly still works. A nil Tag means images are selected without
+// regard to their tags. If NameSuffix is set, names have to end with it
+// as well as start with NamePrefix. Images whose IDs are in
+// ExcludeImageIDs are never selected, and if States is set, only images
+// in one of those states are. If Encrypted is set, only images whose EBS
+// volumes all have that encryption state are selected, if
+// BackingVolumeType is set, only images whose root volume is of that
+// type, and if MinSnapshots is set, only images backed by at least that
+// many snapshots. With SkipShared, images that are public or shared with
+// other accounts are never selected, except for those in
+// IgnoreSharedImageIDs or with IgnoreSharedTag, which we know nobody
+// else uses; with RevokeLaunchPermissions, those are made private before
+// they're deregistered. Owners are the accounts whose images we look at;
+// they default to just "self". If TTLTagKey is set, images tagged with
+// it are kept for the number of days in the tag instead of until
+// ExpirationDate. If LifecycleTagKey is set, images tagged with it
+// follow the Lifecycle policy in the tag instead of the global ones. If
+// CreatedAfter or CreatedBefore is set, they replace ExpirationDate with
+// a window of creation times, inclusive at both ends. If there are
+// Rules, an image has to match one of them as well, and they take the
+// place of the age checks, with ExpirationDate for a rule without Days;
+// NamePrefix, NameSuffix and Tag still apply.
+//
+// ApplyMinRetain keeps back the MinRetain newest of the images selected,
+// or of each group of them by GroupByTagKey, and ApplyMinImagesRetained
+// enough of them to leave MinImagesRetained images in all. With
+// RequireMarked, only images marked by MarkImages whose grace period has
+// passed are selected. If UsageCheckConcurrency is set, no more than
+// that many CheckUnused calls run at once, however many images Run is
+// working on. With CheckImageBuilder, images that Image Builder recipes
+// build on count as in use, as found with ImageBuilderClient.
+//
+// RetainSnapshots deregisters images but leaves their snapshots alone,
+// tagging them with RetainedFromTagKey if TagRetainedSnapshots is set.
+// BatchSnapshots leaves snapshot deletion to Run, which does it once the
+// whole batch is deregistered. With ContinueOnDenied, a deregistration
+// or snapshot deletion we don't have permission for is recorded in
+// DeniedActions and the purge goes on without it. With Archive, each
+// image is copied to ArchiveRegion, in ArchiveAccountID if that's set,
+// using ArchiveEC2Client before it's deregistered. If there is a Report,
+// Run sends it what happened to each image, with the snapshot GiB and
+// savings at SnapshotCost if EstimatePurgeSavings was run, and the group
+// each image is in if ReportGroupTagKey is set; GroupTotals adds the
+// groups up.
+//
+// Region is the region the images are in; it keys the ImageCache and is
+// where archive copies come from. AccountID, if set, is the account
+// they're in, and keys the ImageCache too, so that runs against
+// different accounts can share one. To rate limit the calls we make,
+// attach a RateLimiter to the clients. Now is where we get the current
+// time; it defaults to time.Now, and is mostly there so that tests can
+// stop the clock.
 type AMIClean struct {
-	NamePrefix     string
-	Delete         bool
-	Tag            *ec2.Tag
-	Invert         bool
-	Unused         bool
-	ExpirationDate time.Time
-	Logger         *zap.Logger
-	EC2Client      *ec2.EC2
+	NamePrefix              string
+	NameSuffix              string
+	Owners                  []string
+	Region                  string
+	AccountID               string
+	ImageCache              *ImageCache
+	Delete                  bool
+	Tag                     *ec2.Tag
+	Invert                  bool
+	InvertAge               bool
+	TTLTagKey               string
+	LifecycleTagKey         string
+	ExcludeImageIDs         map[string]bool
+	States                  []string
+	Rules                   []Rule
+	MinRetain               int
+	GroupByTagKey           string
+	MinImagesRetained       int
+	IncludeDeprecated       bool
+	DeprecatedOnly          bool
+	Unused                  bool
+	RecheckUnused           bool
+	UsageCheckConcurrency   int
+	CheckFleets             bool
+	CheckImageBuilder       bool
+	Encrypted               *bool
+	BackingVolumeType       string
+	MinSnapshots            int
+	SkipShared              bool
+	IgnoreSharedImageIDs    map[string]bool
+	IgnoreSharedTag         *ec2.Tag
+	RevokeLaunchPermissions bool
+	CloudTrailDays          int
+	SnapshotGracePeriod     time.Duration
+	RetainSnapshots         bool
+	TagRetainedSnapshots    bool
+	BatchSnapshots          bool
+	SlowCallThreshold       time.Duration
+	TagBeforeDelete         bool
+	Archive                 bool
+	ArchiveAccountID        string
+	ArchiveRegion           string
+	ArchiveTimeout          time.Duration
+	MarkGracePeriod         time.Duration
+	RequireMarked           bool
+	MarkerTemplate          *template.Template
+	MarkerData              MarkerData
+	ContinueOnError         bool
+	ContinueOnDenied        bool
+	Concurrency             int
+	ValidatePermissions     bool
+	Report                  ReportWriter
+	ReportGroupTagKey       string
+	SnapshotCost            float64
+	ExpirationDate          time.Time
+	CreatedAfter            time.Time
+	CreatedBefore           time.Time
+	Now                     func() time.Time
+	Logger                  *zap.Logger
+	EC2Client               ec2iface.EC2API
+	ArchiveEC2Client        ec2iface.EC2API
+	CloudTrailClient        cloudtrailiface.CloudTrailAPI
+	ImageBuilderClient      imagebuilderiface.ImagebuilderAPI
+
+	// fleetImageIDs caches the AMIs referenced by Spot Fleet and EC2
+	// Fleet requests so we only fetch them once per run.
+	fleetImageIDs map[string]bool
+	// imageBuilderParents does the same for the parent images of Image
+	// Builder recipes.
+	imageBuilderParents map[string]bool
+	// cloudTrailUsage caches the result of the CloudTrail lookup for
+	// each AMI ID.
+	cloudTrailUsage map[string]bool
+	// deniedActions collects the calls we found we aren't allowed to
+	// make, and deletedSnapshots the snapshots we've already deleted
+	// (or would have) in this run. Both are guarded by mu, since Run
+	// can purge several images at once, as is usageChecks, which holds
+	// the UsageCheckConcurrency slots once it's made.
+	mu               sync.Mutex
+	deniedActions    []DeniedAction
+	deletedSnapshots map[string]bool
+	usageChecks      chan struct{}
+	// dryRunReferences maps the candidates' snapshots that other images
+	// still use to one of those images, in dry run mode. Run fills it
+	// in before purging anything, so it needs no lock.
+	dryRunReferences map[string]string
+	// snapshotSizes holds the snapshot sizes EstimatePurgeSavings looked
+	// up, for the Report.
+	snapshotSizes map[string]int64
 }
 
 // GetImages gets us all the private AMIs on our account so that they can be
 // looked through later. We have to do this here because the AWS API does not
 // allow you to search for AMIs by creation date or by *not* having a tag set to
 // a certain value, which would speed this up considerably.
+//
+// AWS leaves other accounts' deprecated images out unless we ask for
+// them, which we do with IncludeDeprecated, or when we're only looking
+// at deprecated images. If we have an ImageCache, a recent enough result
+// for the same region and owners is reused instead.
 func (a *AMIClean) GetImages() (*ec2.DescribeImagesOutput, error) {
-	var output *ec2.DescribeImagesOutput
-
-	input := &ec2.DescribeImagesInput{
-		Owners: []*string{aws.String("self")},
+	owners := a.owners()
+	includeDeprecated := a.IncludeDeprecated || a.DeprecatedOnly
+	// "self" is a different account for every AccountID.
+	cacheKey := a.AccountID + "/" + a.Region + "/" + strings.Join(owners, ",")
+	if includeDeprecated {
+		cacheKey += "/deprecated"
+	}
+	if a.ImageCache != nil {
+		if cached, ok := a.ImageCache.get(cacheKey, a.now()); ok {
+			a.Logger.Debug("using cached image list",
+				zap.String("region", a.Region),
+				zap.Strings("owners", owners),
+			)
+			return cached, nil
+		}
 	}
 
-	output, err := a.EC2Client.DescribeImages(input)
-
+	output, err := a.describeImages()
 	if err != nil {
 		return nil, err
 	}
 
+	if a.ImageCache != nil {
+		a.ImageCache.set(cacheKey, output, a.now())
+	}
 	return output, nil
 }
 
+// describeImages asks AWS for the images GetImages returns, leaving the
+// ImageCache out of it.
+func (a *AMIClean) describeImages() (*ec2.DescribeImagesOutput, error) {
+	input := &ec2.DescribeImagesInput{
+		Owners: aws.StringSlice(a.owners()),
+	}
+	if a.IncludeDeprecated || a.DeprecatedOnly {
+		input.IncludeDeprecated = aws.Bool(true)
+	}
+	return a.EC2Client.DescribeImages(input)
+}
+
+// owners returns the accounts whose images we look at.
+func (a *AMIClean) owners() []string {
+	if len(a.Owners) == 0 {
+		return []string{"self"}
+	}
+	return a.Owners
+}
+
 // MatchTags lets us see if an arbitrary tag is set to the appropriate value
-// within an image.
+// within an image. If the tag we're looking for has no value, any image
+// with that tag key set matches, whatever its value. If the value
+// contains a "*" or "?", it is treated as a glob using filepath.Match
+// semantics.
 func matchTags(image *ec2.Image, tag *ec2.Tag) (bool, *ec2.Tag) {
 	for _, imageTag := range image.Tags {
 		if *tag.Key == *imageTag.Key {
-			if *tag.Value == *imageTag.Value {
+			if tag.Value == nil || *tag.Value == "" {
+				// If we only care about the key, finding it
+				// is enough.
+				return true, imageTag
+			}
+			if matchTagValue(*tag.Value, *imageTag.Value) {
 				// If the tag exists, and has the value we're
 				// looking for, return true and the image tag.
 				return true, imageTag
@@ -70,6 +276,47 @@ func matchTags(image *ec2.Image, tag *ec2.Tag) (bool, *ec2.Tag) {
 	return false, &ec2.Tag{Key: tag.Key, Value: aws.String("not found")}
 }
 
+// matchTagValue compares a tag value against the value we're looking
+// for, which may be a glob pattern.
+func matchTagValue(pattern, value string) bool {
+	if !strings.ContainsAny(pattern, "*?") {
+		return pattern == value
+	}
+	// A malformed pattern can't match anything, so we treat the error
+	// as a non-match.
+	matched, err := filepath.Match(pattern, value)
+	if err != nil {
+		return false
+	}
+	return matched
+}
+
+// isDeprecated returns true if the image has a deprecation time set and
+// that time has already passed.
+func isDeprecated(image *ec2.Image, now time.Time) bool {
+	if image.DeprecationTime == nil {
+		return false
+	}
+	deprecationTime, err := time.Parse(RFC8601, *image.DeprecationTime)
+	if err != nil {
+		return false
+	}
+	return deprecationTime.Before(now)
+}
+
+// inCreationWindow returns true if the creation time falls between
+// CreatedAfter and CreatedBefore, inclusive. Either end can be left
+// unset to leave that side open.
+func (a *AMIClean) inCreationWindow(creationTime time.Time) bool {
+	if !a.CreatedAfter.IsZero() && creationTime.Before(a.CreatedAfter) {
+		return false
+	}
+	if !a.CreatedBefore.IsZero() && creationTime.After(a.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
 // CheckUnused takes an image and then checks to see if it is in use
 // as an instance. If the image is in use, it should return false; if it
 // is not in use, it should return true. Note that we're only checking for
@@ -87,10 +334,18 @@ func (a *AMIClean) CheckUnused(image *ec2.Image) (bool, error) {
 		Name:   aws.String("image-id"),
 		Values: []*string{image.ImageId},
 	}
-	// Now, we use that filter to create an input into DescribeInstances.
+	// Terminated instances stick around in DescribeInstances for a while
+	// after they're gone, so we only count the ones that still exist.
+	stateFilter := &ec2.Filter{
+		Name:   aws.String("instance-state-name"),
+		Values: aws.StringSlice(activeInstanceStates),
+	}
+	// Now, we use those filters to create an input into DescribeInstances.
 	findInstancesInput := &ec2.DescribeInstancesInput{
-		Filters: []*ec2.Filter{amiFilter},
+		Filters: []*ec2.Filter{amiFilter, stateFilter},
 	}
+	release := a.acquireUsageCheck()
+	defer release()
 	output, err := a.EC2Client.DescribeInstances(findInstancesInput)
 	if err != nil {
 		return false, err
@@ -109,19 +364,111 @@ func (a *AMIClean) CheckUnused(image *ec2.Image) (bool, error) {
 // CheckImage compares a given image to the purge criteria and returns true
 // if the image matches the criteria.
 func (a *AMIClean) CheckImage(image *ec2.Image) bool {
-	// First look at the name and see if it matches our prefix. If it
-	// does not, we can bail out quickly with a false result.
-	if !strings.HasPrefix(*image.Name, a.NamePrefix) {
+	// Images on the deny list are never purged, whatever else is true
+	// about them.
+	if a.ExcludeImageIDs[*image.ImageId] {
+		a.Logger.Debug("ami excluded by id",
+			zap.String("ami-id", *image.ImageId),
+		)
+		return false
+	}
+
+	// Images still being built, or whose build failed, only count if
+	// we're looking at their state.
+	if !a.matchState(image) {
+		return false
+	}
+
+	// Next look at the name and see if it matches our prefix and
+	// suffix. If it does not, we can bail out quickly with a false
+	// result. Without either, the name doesn't matter, so images
+	// registered without one can still be selected by their tags.
+	name := aws.StringValue(image.Name)
+	if a.NamePrefix != "" && !strings.HasPrefix(name, a.NamePrefix) {
+		return false
+	}
+	if a.NameSuffix != "" && !strings.HasSuffix(name, a.NameSuffix) {
 		return false
 	}
 
 	// Next, check the image's age and compare it to our expiration date.
-	// If it's not old enough, we can again return false.
-	imageCreationTime, _ := time.Parse(RFC8601, *image.CreationDate)
-	if imageCreationTime.After(a.ExpirationDate) {
+	// If it's not old enough, we can again return false. If we're only
+	// looking at deprecated images, their deprecation time takes the
+	// place of our expiration date. With InvertAge, this flips around
+	// and only images that haven't expired yet get through. An image
+	// with a creation date we can't parse is never selected.
+	imageCreationTime, ok := a.creationTime(image)
+	if !ok {
+		return false
+	}
+	if len(a.Rules) > 0 {
+		if _, match := a.matchRule(image, imageCreationTime); !match {
+			return false
+		}
+	} else if a.DeprecatedOnly {
+		if !isDeprecated(image, a.now()) {
+			return false
+		}
+	} else if !a.CreatedAfter.IsZero() || !a.CreatedBefore.IsZero() {
+		if !a.inCreationWindow(imageCreationTime) {
+			return false
+		}
+	} else if a.isExpired(image, imageCreationTime) == a.InvertAge {
+		return false
+	}
+
+	// In the second half of soft-delete mode, only images that an
+	// earlier run marked, and whose time is up, can go.
+	if a.RequireMarked && !a.markExpired(image, a.now()) {
 		return false
 	}
 
+	// If we care about encryption, the image's volumes have to match.
+	if a.Encrypted != nil && !matchEncryption(image, *a.Encrypted) {
+		return false
+	}
+
+	// If we're sweeping up images of one volume type, the root volume
+	// has to be of that type.
+	if a.BackingVolumeType != "" && rootVolumeType(image) != a.BackingVolumeType {
+		return false
+	}
+
+	// Images with many volumes cost the most to keep, so we may only be
+	// after those. We count the snapshots the same way PurgeImage finds
+	// the ones to delete.
+	if a.MinSnapshots > 0 && len(ImageSnapshotIDs(image)) < a.MinSnapshots {
+		return false
+	}
+
+	// An image that's public or shared with other accounts may be used
+	// by people we can't see, so with SkipShared we leave it alone.
+	if a.SkipShared {
+		sharedWith, err := a.CheckShared(image)
+		if err != nil {
+			a.Logger.Error("Could not check whether image is shared",
+				zap.String("ami-id", *image.ImageId),
+				zap.Error(err),
+			)
+			return false
+		}
+		if len(sharedWith) > 0 {
+			// Unless we've been told that nobody it's shared with
+			// uses it.
+			if !a.ignoresSharedUsage(image) {
+				a.Logger.Info("skipping shared ami",
+					zap.String("ami-id", *image.ImageId),
+					zap.Strings("shared-with", sharedWith),
+				)
+				return false
+			}
+			a.Logger.Warn("ignoring shared usage of ami",
+				zap.String("ami-id", *image.ImageId),
+				zap.Strings("shared-with", sharedWith),
+			)
+		}
+	}
+
 	// If we've gotten this far, we want to see if the "unused" flag was
 	// set. If so, we need to see if it's being used.
 	if a.Unused {
@@ -139,6 +486,67 @@ func (a *AMIClean) CheckImage(image *ec2.Image) bool {
 		if !unused {
 			return false
 		}
+
+		// A fleet scaled to zero won't show up as an instance, but
+		// it will still launch from this image later.
+		if a.CheckFleets {
+			inUse, err := a.CheckFleetUsage(image)
+			if err != nil {
+				a.Logger.Error("Could not check for image in use by fleets",
+					zap.String("ami-id", *image.ImageId),
+					zap.Error(err),
+				)
+				return false
+			}
+			if inUse {
+				return false
+			}
+		}
+
+		// Neither is an Image Builder pipeline, between builds.
+		if a.CheckImageBuilder {
+			inUse, err := a.CheckImageBuilderUsage(image)
+			if err != nil {
+				a.Logger.Error("Could not check for image in use by Image Builder",
+					zap.String("ami-id", *image.ImageId),
+					zap.Error(err),
+				)
+				return false
+			}
+			if inUse {
+				a.Logger.Info("skipping ami used as an Image Builder parent image",
+					zap.String("ami-id", *image.ImageId),
+				)
+				return false
+			}
+		}
+
+		// For extra assurance, we can also look back through
+		// CloudTrail for anything launched from this image recently.
+		if a.CloudTrailDays > 0 {
+			used, err := a.CheckCloudTrailUsage(image)
+			if err != nil {
+				a.Logger.Error("Could not check CloudTrail for image usage",
+					zap.String("ami-id", *image.ImageId),
+					zap.Error(err),
+				)
+				return false
+			}
+			if used {
+				return false
+			}
+		}
+	}
+
+	// If we don't have a tag to look at, the image has passed all of our
+	// criteria already.
+	if a.Tag == nil {
+		a.Logger.Debug("ami matched selection criteria",
+			zap.String("ami-id", *image.ImageId),
+			zap.String("ami-name", name),
+			zap.String("ami-creation-date", imageCreationTime.String()),
+		)
+		return true
 	}
 
 	// We want to check against the tags we're looking at.
@@ -150,7 +558,7 @@ func (a *AMIClean) CheckImage(image *ec2.Image) bool {
 	if a.Invert != match {
 		a.Logger.Debug("ami matched selection criteria",
 			zap.String("ami-id", *image.ImageId),
-			zap.String("ami-name", *image.Name),
+			zap.String("ami-name", name),
 			zap.String("ami-tag-key", *matchedTag.Key),
 			zap.String("ami-tag-value", *matchedTag.Value),
 			zap.String("ami-creation-date", imageCreationTime.String()),
@@ -162,25 +570,85 @@ func (a *AMIClean) CheckImage(image *ec2.Image) bool {
 	return false
 }
 
+// SelectImages runs CheckImage over the images and returns the ones
+// selected for purging.
+func (a *AMIClean) SelectImages(images []*ec2.Image) []*ec2.Image {
+	var selected []*ec2.Image
+	for _, image := range images {
+		if a.CheckImage(image) {
+			selected = append(selected, image)
+		}
+	}
+	return selected
+}
+
 // PurgeImage operates on a single image, registering the image and
-// deleting any associated snapshots. We return the ID of the AMI
-// we deleted (in case that is interesting) and any errors.
+// deleting any associated snapshots (or marking them for deletion later,
+// if SnapshotGracePeriod is set). We return the ID of the AMI we deleted
+// (in case that is interesting) and any errors. With Unused and
+// RecheckUnused set, an image that has come into use since it was
+// checked is left alone and we return ErrImageInUse. An image with
+// deregistration protection is left alone too, and we return
+// ErrDeregistrationProtected, as is one that isn't EBS-backed, for
+// which we return ErrNotEBSBacked.
 func (a *AMIClean) PurgeImage(image *ec2.Image) (string, error) {
 	// This is a circuit breaker because we currently assume all
 	// AMIs have EBS volumes. This is the case right now, but it
 	// isn't true in a more general case. More functionality would
 	// need to be added to handle instance-store backed AMIs.
-	if *image.RootDeviceType != "ebs" {
+	if aws.StringValue(image.RootDeviceType) != "ebs" {
 		a.Logger.Info("image root device not EBS; will not purge",
 			zap.String("ami-id", *image.ImageId),
 		)
+		return "Image root device is not EBS", ErrNotEBSBacked
+	} else if hasDeregistrationProtection(image) {
+		// Checking first keeps tombstone tags off the image, as well
+		// as saving a call that would fail.
+		a.skipProtected(image, "protection is enabled")
+		return "Image has deregistration protection", ErrDeregistrationProtected
 	} else {
 		// There may be multiple snapshots attached to a single AMI,
 		// so we need to build a list and iterate on them.
-		var snapshotIds []*string
-		for _, blockDevice := range image.BlockDeviceMappings {
-			snapshotID := *blockDevice.Ebs.SnapshotId
-			snapshotIds = append(snapshotIds, &snapshotID)
+		snapshotIds := ImageSnapshotIDs(image)
+		// Something could have been launched from the image since we
+		// checked, so look again before we do anything to it. This
+		// only reads, so a dry run does it too, and skips the same
+		// images a real run would.
+		if a.Unused && a.RecheckUnused {
+			unused, err := a.CheckUnused(image)
+			if err != nil {
+				return "Failed to recheck image usage", err
+			}
+			if !unused {
+				a.Logger.Warn("image came into use after it was checked; skipping",
+					zap.String("ami-id", *image.ImageId),
+				)
+				return "Image came into use", ErrImageInUse
+			}
+		}
+		// Tombstone tags go on before anything is changed, so they're
+		// recorded even if the purge fails partway through.
+		if a.TagBeforeDelete {
+			err := a.tagPurged(*image.ImageId, snapshotIds)
+			if err != nil {
+				return "Failed to tag image before purging", err
+			}
+		}
+		// An archive copy has to be safely made before we get rid of
+		// the original.
+		if a.Archive {
+			if err := a.archiveImage(image, snapshotIds); err != nil {
+				return "Failed to archive image", err
+			}
+		}
+		// Nothing else should be able to launch an image once we've
+		// decided its sharing doesn't matter. This waits for the
+		// archive copy, so that a failed one doesn't leave the image
+		// unshared but still registered.
+		if a.RevokeLaunchPermissions && a.ignoresSharedUsage(image) {
+			if err := a.revokeLaunchPermissions(image); err != nil {
+				return "Failed to revoke launch permissions", err
+			}
 		}
 		deregisterInput := &ec2.DeregisterImageInput{
 			DryRun:  aws.Bool(!a.Delete),
@@ -190,34 +658,163 @@ func (a *AMIClean) PurgeImage(image *ec2.Image) (string, error) {
 			a.Logger.Info("deregistering ami",
 				zap.String("ami-id", *image.ImageId),
 			)
-			_, err := a.EC2Client.DeregisterImage(deregisterInput)
+			err := a.timeCall("DeregisterImage", zap.String("ami-id", *image.ImageId), func() error {
+				_, err := a.EC2Client.DeregisterImage(deregisterInput)
+				return err
+			})
 			if err != nil {
+				// Without the image gone, its snapshots have to stay.
+				if a.recordDenied("DeregisterImage", *image.ImageId, err) {
+					return "Permission denied to deregister image", ErrPermissionDenied
+				}
+				if isDeregistrationProtected(err) {
+					a.skipProtected(image, err.Error())
+					return "Image has deregistration protection", ErrDeregistrationProtected
+				}
 				return "Failed to deregister image", err
 			}
 		} else {
 			a.Logger.Info("would deregister ami",
 				zap.String("ami-id", *image.ImageId),
 			)
+			// We can still ask AWS whether we'd be allowed to.
+			if a.ValidatePermissions {
+				err := a.checkPermission("DeregisterImage", *image.ImageId, func() error {
+					_, err := a.EC2Client.DeregisterImage(deregisterInput)
+					return err
+				})
+				if err != nil {
+					return "Failed to validate permission to deregister image", err
+				}
+			}
 		}
-		for _, snapshot := range snapshotIds {
-			deleteInput := &ec2.DeleteSnapshotInput{
-				DryRun:     aws.Bool(!a.Delete),
-				SnapshotId: aws.String(*snapshot),
+		// Some teams keep snapshots for longer than the images made
+		// from them, in which case we're done.
+		if a.RetainSnapshots {
+			if err := a.retainSnapshots(*image.ImageId, snapshotIds); err != nil {
+				return "Failed to tag retained snapshots", err
 			}
-			if a.Delete {
-				a.Logger.Info("deleting snapshot",
-					zap.String("snapshot-id", *deleteInput.SnapshotId),
-				)
+			return *image.ImageId, nil
+		}
+		// If we have a grace period, the snapshots get marked now and
+		// deleted by a later pass instead.
+		if a.SnapshotGracePeriod > 0 {
+			err := a.MarkSnapshotsPending(snapshotIds)
+			if err != nil {
+				return "Failed to mark snapshots for later deletion", err
+			}
+			return *image.ImageId, nil
+		}
+		// When Run is batching snapshots, it deletes them once every
+		// image is deregistered.
+		if a.BatchSnapshots {
+			return *image.ImageId, nil
+		}
+		return a.deleteSnapshots(*image.ImageId, snapshotIds)
+	}
+}
+
+// deleteSnapshots deletes the snapshots that belonged to an image, or in
+// dry run mode, logs what it would delete. It returns the image ID, or
+// what failed if there was an error, in the same way as PurgeImage.
+func (a *AMIClean) deleteSnapshots(imageID string, snapshotIds []string) (string, error) {
+	for _, snapshot := range snapshotIds {
+		// Images can share snapshots, and a second delete would only
+		// fail with InvalidSnapshot.NotFound.
+		if !a.claimSnapshot(snapshot) {
+			a.Logger.Debug("snapshot already deleted in this run",
+				zap.String("snapshot-id", snapshot),
+			)
+			continue
+		}
+		deleteInput := &ec2.DeleteSnapshotInput{
+			DryRun:     aws.Bool(!a.Delete),
+			SnapshotId: aws.String(snapshot),
+		}
+		if a.Delete {
+			a.Logger.Info("deleting snapshot",
+				zap.String("snapshot-id", *deleteInput.SnapshotId),
+			)
+			err := a.timeCall("DeleteSnapshot", zap.String("snapshot-id", snapshot), func() error {
 				_, err := a.EC2Client.DeleteSnapshot(deleteInput)
-				if err != nil {
-					return "Failed to delete snapshot", err
+				return err
+			})
+			if err != nil {
+				if a.recordDenied("DeleteSnapshot", snapshot, err) {
+					continue
 				}
-			} else {
-				a.Logger.Info("would delete snapshot",
-					zap.String("snapshot-id", *deleteInput.SnapshotId),
+				return "Failed to delete snapshot", err
+			}
+		} else {
+			if referencedBy := a.dryRunReferences[snapshot]; referencedBy != "" {
+				a.Logger.Info("would retain snapshot; still used by another image",
+					zap.String("snapshot-id", snapshot),
+					zap.String("referenced-by", referencedBy),
 				)
+				continue
+			}
+			a.Logger.Info("would delete snapshot",
+				zap.String("snapshot-id", *deleteInput.SnapshotId),
+			)
+			if a.ValidatePermissions {
+				err := a.checkPermission("DeleteSnapshot", snapshot, func() error {
+					_, err := a.EC2Client.DeleteSnapshot(deleteInput)
+					return err
+				})
+				if err != nil {
+					return "Failed to validate permission to delete snapshot", err
+				}
 			}
 		}
 	}
-	return *image.ImageId, nil
+	return imageID, nil
+}
+
+// now returns the current time in UTC, from Now if it's set.
+func (a *AMIClean) now() time.Time {
+	if a.Now != nil {
+		return a.Now().UTC()
+	}
+	return time.Now().UTC()
+}
+
+// claimSnapshot returns true the first time it's called for a snapshot
+// in this run, and false after that.
+func (a *AMIClean) claimSnapshot(snapshotID string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.deletedSnapshots[snapshotID] {
+		return false
+	}
+	if a.deletedSnapshots == nil {
+		a.deletedSnapshots = make(map[string]bool)
+	}
+	a.deletedSnapshots[snapshotID] = true
+	return true
+}
+
+// timeCall runs an AWS API call and logs how long it took. If it took
+// longer than SlowCallThreshold, we log at warn so that throttling or a
+// degraded region stands out without needing debug logging. Any wait
+// for a RateLimiter attached to the client is counted too.
+func (a *AMIClean) timeCall(action string, resource zap.Field, call func() error) error {
+	start := time.Now()
+	err := call()
+	elapsed := time.Since(start)
+
+	if a.SlowCallThreshold > 0 && elapsed > a.SlowCallThreshold {
+		a.Logger.Warn("slow AWS API call",
+			zap.String("action", action),
+			resource,
+			zap.Duration("elapsed", elapsed),
+		)
+	} else {
+		a.Logger.Debug("AWS API call finished",
+			zap.String("action", action),
+			resource,
+			zap.Duration("elapsed", elapsed),
+		)
+	}
+	return wrapAWSError(action, resource.String, err)
 }
@@ -1,14 +1,212 @@
 package amiclean
 
 import (
+	"context"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 )
 
+// We set up a mock EC2Client so that we can mock API calls for our code.
+// Each field holds the canned data returned by the matching API call.
+type mockEC2Client struct {
+	ec2iface.EC2API
+	// mu guards calls, since Run can purge from several goroutines.
+	mu           sync.Mutex
+	reservations []*ec2.Reservation
+	// reservationsPerCall, if set, is used up one DescribeInstances
+	// call at a time before falling back to reservations.
+	reservationsPerCall     [][]*ec2.Reservation
+	spotFleetRequestConfigs []*ec2.SpotFleetRequestConfig
+	fleets                  []*ec2.FleetData
+	launchTemplateVersions  map[string]*ec2.LaunchTemplateVersion
+	snapshotPages           [][]*ec2.Snapshot
+	// snapshotPagesPerCall, if set, is used up one DescribeSnapshots
+	// call at a time before falling back to snapshotPages.
+	snapshotPagesPerCall [][][]*ec2.Snapshot
+	// images, if set, is what DescribeImages returns instead of
+	// testImages.
+	images []*ec2.Image
+	// imagesPerCall, if set, is used up one DescribeImages call at a
+	// time before falling back to images.
+	imagesPerCall [][]*ec2.Image
+	// launchPermissions are what DescribeImageAttribute returns for
+	// each image ID.
+	launchPermissions map[string][]*ec2.LaunchPermission
+
+	describeSnapshotsInput *ec2.DescribeSnapshotsInput
+	describeSnapshotsCalls int
+	describeSnapshotsErr   error
+	describeInstancesInput *ec2.DescribeInstancesInput
+	describeImagesInput    *ec2.DescribeImagesInput
+	describeImagesCalls    int
+	deregisterErrors       map[string]error
+	deleteSnapshotErrors   map[string]error
+	describeImagesErr      error
+	dryRunDenied           map[string]bool
+	// calls records the mutating API calls made, in order, as
+	// "Action:resource-id" strings.
+	calls            []string
+	createTagsInputs []*ec2.CreateTagsInput
+	// deprecateAt records the time each image was deprecated at.
+	deprecateAt          map[string]time.Time
+	deprecateImageErrors map[string]error
+	// describeCalls counts the read-only calls the usage checks make,
+	// by action.
+	describeCalls map[string]int
+}
+
+// recordDescribe counts a read-only call.
+func (m *mockEC2Client) recordDescribe(action string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.describeCalls == nil {
+		m.describeCalls = make(map[string]int)
+	}
+	m.describeCalls[action]++
+}
+
+// dryRunError returns the error AWS gives for a DryRun call, depending on
+// whether we've set up the action to be denied.
+func (m *mockEC2Client) dryRunError(action string) error {
+	if m.dryRunDenied[action] {
+		return awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil)
+	}
+	return awserr.New("DryRunOperation", "Request would have succeeded, but DryRun flag is set.", nil)
+}
+
+func (m *mockEC2Client) DeregisterImage(input *ec2.DeregisterImageInput) (*ec2.DeregisterImageOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, "DeregisterImage:"+aws.StringValue(input.ImageId))
+	if aws.BoolValue(input.DryRun) {
+		return nil, m.dryRunError("DeregisterImage")
+	}
+	if err := m.deregisterErrors[aws.StringValue(input.ImageId)]; err != nil {
+		return nil, err
+	}
+	return &ec2.DeregisterImageOutput{}, nil
+}
+
+func (m *mockEC2Client) DeleteSnapshot(input *ec2.DeleteSnapshotInput) (*ec2.DeleteSnapshotOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, "DeleteSnapshot:"+aws.StringValue(input.SnapshotId))
+	if aws.BoolValue(input.DryRun) {
+		return nil, m.dryRunError("DeleteSnapshot")
+	}
+	if err := m.deleteSnapshotErrors[aws.StringValue(input.SnapshotId)]; err != nil {
+		return nil, err
+	}
+	return &ec2.DeleteSnapshotOutput{}, nil
+}
+
+func (m *mockEC2Client) EnableImageDeprecation(input *ec2.EnableImageDeprecationInput) (*ec2.EnableImageDeprecationOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	imageID := aws.StringValue(input.ImageId)
+	m.calls = append(m.calls, "EnableImageDeprecation:"+imageID)
+	if err := m.deprecateImageErrors[imageID]; err != nil {
+		return nil, err
+	}
+	if m.deprecateAt == nil {
+		m.deprecateAt = make(map[string]time.Time)
+	}
+	m.deprecateAt[imageID] = aws.TimeValue(input.DeprecateAt)
+	return &ec2.EnableImageDeprecationOutput{}, nil
+}
+
+func (m *mockEC2Client) CreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, resource := range input.Resources {
+		m.calls = append(m.calls, "CreateTags:"+aws.StringValue(resource))
+	}
+	m.createTagsInputs = append(m.createTagsInputs, input)
+	if aws.BoolValue(input.DryRun) {
+		return nil, m.dryRunError("CreateTags")
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (m *mockEC2Client) DescribeImages(input *ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+	m.describeImagesInput = input
+	m.describeImagesCalls++
+	if m.describeImagesErr != nil {
+		return nil, m.describeImagesErr
+	}
+	if len(m.imagesPerCall) > 0 {
+		images := m.imagesPerCall[0]
+		m.imagesPerCall = m.imagesPerCall[1:]
+		return &ec2.DescribeImagesOutput{Images: images}, nil
+	}
+	if m.images != nil {
+		return &ec2.DescribeImagesOutput{Images: m.images}, nil
+	}
+	return &ec2.DescribeImagesOutput{Images: testImages}, nil
+}
+
+func (m *mockEC2Client) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	m.recordDescribe("DescribeInstances")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.describeInstancesInput = input
+	if len(m.reservationsPerCall) > 0 {
+		reservations := m.reservationsPerCall[0]
+		m.reservationsPerCall = m.reservationsPerCall[1:]
+		return &ec2.DescribeInstancesOutput{Reservations: reservations}, nil
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: m.reservations}, nil
+}
+
+func (m *mockEC2Client) DescribeSpotFleetRequestsPages(input *ec2.DescribeSpotFleetRequestsInput, fn func(*ec2.DescribeSpotFleetRequestsOutput, bool) bool) error {
+	m.recordDescribe("DescribeSpotFleetRequests")
+	fn(&ec2.DescribeSpotFleetRequestsOutput{SpotFleetRequestConfigs: m.spotFleetRequestConfigs}, true)
+	return nil
+}
+
+func (m *mockEC2Client) DescribeFleets(input *ec2.DescribeFleetsInput) (*ec2.DescribeFleetsOutput, error) {
+	m.recordDescribe("DescribeFleets")
+	return &ec2.DescribeFleetsOutput{Fleets: m.fleets}, nil
+}
+
+func (m *mockEC2Client) DescribeSnapshotsPages(input *ec2.DescribeSnapshotsInput, fn func(*ec2.DescribeSnapshotsOutput, bool) bool) error {
+	m.describeSnapshotsInput = input
+	m.describeSnapshotsCalls++
+	snapshotPages := m.snapshotPages
+	if len(m.snapshotPagesPerCall) > 0 {
+		snapshotPages = m.snapshotPagesPerCall[0]
+		m.snapshotPagesPerCall = m.snapshotPagesPerCall[1:]
+	}
+	if m.describeSnapshotsErr != nil {
+		return m.describeSnapshotsErr
+	}
+	for index, page := range snapshotPages {
+		if !fn(&ec2.DescribeSnapshotsOutput{Snapshots: page}, index == len(snapshotPages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (m *mockEC2Client) DescribeLaunchTemplateVersions(input *ec2.DescribeLaunchTemplateVersionsInput) (*ec2.DescribeLaunchTemplateVersionsOutput, error) {
+	m.recordDescribe("DescribeLaunchTemplateVersions")
+	output := &ec2.DescribeLaunchTemplateVersionsOutput{}
+	if version, ok := m.launchTemplateVersions[aws.StringValue(input.LaunchTemplateId)]; ok {
+		output.LaunchTemplateVersions = []*ec2.LaunchTemplateVersion{version}
+	}
+	return output, nil
+}
+
 var newMasterImage = &ec2.Image{
 	Name:         aws.String("masterimage-alpha"),
 	Description:  aws.String("New Master Image"),
@@ -89,12 +287,149 @@ var noEbsImage = &ec2.Image{
 	RootDeviceType: aws.String("instance-store"),
 }
 
+// ephemeralImage has an instance store volume mapped alongside its EBS
+// root volume; the instance store mapping has no Ebs stanza at all.
+var ephemeralImage = &ec2.Image{
+	Name:         aws.String("devimage-echo"),
+	Description:  aws.String("Dev Image With Ephemeral Storage"),
+	ImageId:      aws.String("ami-88888888888888888"),
+	CreationDate: aws.String("2019-03-01T21:04:57.000Z"),
+	BlockDeviceMappings: []*ec2.BlockDeviceMapping{
+		{
+			DeviceName: aws.String("/dev/xvda"),
+			Ebs: &ec2.EbsBlockDevice{
+				SnapshotId: aws.String("snap-88888888888888888"),
+			},
+		},
+		{
+			DeviceName:  aws.String("/dev/xvdb"),
+			VirtualName: aws.String("ephemeral0"),
+		},
+	},
+	RootDeviceType: aws.String("ebs"),
+}
+
 var testImages = []*ec2.Image{newMasterImage, newishDevImage, oldDevImage, noEbsImage}
 
 var now = time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
 
+// stoppedClock always says it's now, for AMIClean.Now.
+func stoppedClock() time.Time {
+	return now
+}
+
 var logger, _ = zap.NewProduction()
 
+func TestGetImages(t *testing.T) {
+	tables := []struct {
+		owners   []string
+		expected []string
+	}{
+		{nil, []string{"self"}},
+		{[]string{"self"}, []string{"self"}},
+		{[]string{"123456789012"}, []string{"123456789012"}},
+		{[]string{"self", "123456789012"}, []string{"self", "123456789012"}},
+	}
+
+	for _, table := range tables {
+		mock := &mockEC2Client{}
+		a := AMIClean{
+			Owners:    table.owners,
+			Logger:    logger,
+			EC2Client: mock,
+		}
+		if _, err := a.GetImages(); err != nil {
+			t.Fatalf("ERROR: GetImages returned error: %v", err)
+		}
+		owners := aws.StringValueSlice(mock.describeImagesInput.Owners)
+		if !reflect.DeepEqual(owners, table.expected) {
+			t.Errorf("ERROR: GetImages with owners %v;\n\texpected: %v\n\tgot: %v", table.owners, table.expected, owners)
+		}
+	}
+}
+
+func TestGetImagesIncludeDeprecated(t *testing.T) {
+	tables := []struct {
+		includeDeprecated bool
+		deprecatedOnly    bool
+		expected          *bool
+	}{
+		{false, false, nil},
+		{true, false, aws.Bool(true)},
+		{false, true, aws.Bool(true)},
+	}
+
+	for _, table := range tables {
+		mock := &mockEC2Client{}
+		a := AMIClean{
+			IncludeDeprecated: table.includeDeprecated,
+			DeprecatedOnly:    table.deprecatedOnly,
+			Logger:            logger,
+			EC2Client:         mock,
+		}
+		if _, err := a.GetImages(); err != nil {
+			t.Fatalf("ERROR: GetImages returned error: %v", err)
+		}
+		if got := mock.describeImagesInput.IncludeDeprecated; !reflect.DeepEqual(got, table.expected) {
+			t.Errorf("ERROR: GetImages with IncludeDeprecated %v, DeprecatedOnly %v;\n\texpected: %v\n\tgot: %v",
+				table.includeDeprecated, table.deprecatedOnly, aws.BoolValue(table.expected), aws.BoolValue(got))
+		}
+	}
+}
+
+func TestGetImagesCached(t *testing.T) {
+	mock := &mockEC2Client{}
+	cache := NewImageCache(time.Hour)
+	newAMIClean := func(region string) *AMIClean {
+		return &AMIClean{
+			Region:     region,
+			ImageCache: cache,
+			Logger:     logger,
+			EC2Client:  mock,
+		}
+	}
+
+	// The second call in the same region should come from the cache,
+	// but a different region needs its own fetch.
+	east, west := newAMIClean("us-east-1"), newAMIClean("us-west-2")
+	for _, a := range []*AMIClean{east, east, west} {
+		if _, err := a.GetImages(); err != nil {
+			t.Fatalf("ERROR: GetImages returned error: %v", err)
+		}
+	}
+	if mock.describeImagesCalls != 2 {
+		t.Errorf("ERROR: expected 2 DescribeImages calls with the cache, got %v", mock.describeImagesCalls)
+	}
+
+	// Nor can one account of an org sweep reuse another's images, even
+	// though both are "self".
+	other := newAMIClean("us-east-1")
+	other.AccountID = "222222222222"
+	if _, err := other.GetImages(); err != nil {
+		t.Fatalf("ERROR: GetImages returned error: %v", err)
+	}
+	if mock.describeImagesCalls != 3 {
+		t.Errorf("ERROR: expected a DescribeImages call for another account, got %v calls", mock.describeImagesCalls)
+	}
+
+	cache.Invalidate()
+	if _, err := east.GetImages(); err != nil {
+		t.Fatalf("ERROR: GetImages returned error: %v", err)
+	}
+	if mock.describeImagesCalls != 4 {
+		t.Errorf("ERROR: expected a DescribeImages call after Invalidate, got %v calls", mock.describeImagesCalls)
+	}
+
+	// Once the TTL is up, we fetch again.
+	cache.TTL = 0
+	if _, err := east.GetImages(); err != nil {
+		t.Fatalf("ERROR: GetImages returned error: %v", err)
+	}
+	if mock.describeImagesCalls != 5 {
+		t.Errorf("ERROR: expected a DescribeImages call after the TTL, got %v calls", mock.describeImagesCalls)
+	}
+}
+
 func TestCheckImage(t *testing.T) {
 	tables := []struct {
 		imageSet      []*ec2.Image
@@ -111,6 +446,13 @@ func TestCheckImage(t *testing.T) {
 		{testImages, "devimage", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("master")}, true, 1, []bool{false, true, true, false}},
 		{testImages, "", &ec2.Tag{Key: aws.String("Foozle"), Value: aws.String("Whatsit")}, false, 1, []bool{false, false, false, true}},
 		{testImages, "", &ec2.Tag{Key: aws.String("Foozle"), Value: aws.String("Whatsit")}, true, 0, []bool{true, true, true, false}},
+		{testImages, "", &ec2.Tag{Key: aws.String("Foozle")}, false, 1, []bool{false, false, true, true}},
+		{testImages, "", &ec2.Tag{Key: aws.String("Foozle"), Value: aws.String("")}, true, 1, []bool{false, true, false, false}},
+		{testImages, "", nil, false, 1, []bool{false, true, true, true}},
+		{testImages, "devimage", nil, true, 1, []bool{false, true, true, false}},
+		{testImages, "", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("dev*")}, false, 1, []bool{false, true, true, false}},
+		{testImages, "", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("ma?ter")}, true, 1, []bool{false, true, true, true}},
+		{testImages, "", &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("[dev*")}, false, 1, []bool{false, false, false, false}},
 	}
 
 	for _, table := range tables {
@@ -140,6 +482,326 @@ func TestCheckImage(t *testing.T) {
 	}
 }
 
+var deprecatedPastImage = &ec2.Image{
+	Name:            aws.String("devimage-charlie"),
+	Description:     aws.String("Deprecated Dev Image"),
+	ImageId:         aws.String("ami-55555555555555555"),
+	CreationDate:    aws.String("2019-03-31T21:04:57.000Z"),
+	DeprecationTime: aws.String("2019-03-31T22:00:00.000Z"),
+	Tags: []*ec2.Tag{
+		{Key: aws.String("Branch"), Value: aws.String("development")},
+	},
+	RootDeviceType: aws.String("ebs"),
+}
+
+var deprecatedFutureImage = &ec2.Image{
+	Name:            aws.String("devimage-delta"),
+	Description:     aws.String("Soon To Be Deprecated Dev Image"),
+	ImageId:         aws.String("ami-66666666666666666"),
+	CreationDate:    aws.String("2019-03-01T21:04:57.000Z"),
+	DeprecationTime: aws.String("2019-04-02T00:00:00.000Z"),
+	Tags: []*ec2.Tag{
+		{Key: aws.String("Branch"), Value: aws.String("development")},
+	},
+	RootDeviceType: aws.String("ebs"),
+}
+
+func TestCheckImageDeprecatedOnly(t *testing.T) {
+	a := AMIClean{
+		Tag:            &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("development")},
+		DeprecatedOnly: true,
+		// The expiration date would select everything here, so this
+		// makes sure DeprecatedOnly replaces it.
+		ExpirationDate: now,
+		Now:            stoppedClock,
+		Logger:         logger,
+	}
+
+	images := []*ec2.Image{deprecatedPastImage, deprecatedFutureImage, oldDevImage}
+	expected := []bool{true, false, false}
+	for index, image := range images {
+		if a.CheckImage(image) != expected[index] {
+			t.Errorf("ERROR: CheckImage with DeprecatedOnly for %v;\n\texpected: %v\n\tgot: %v",
+				*image.Name,
+				expected[index],
+				!expected[index],
+			)
+		}
+	}
+}
+
+func TestMatchTagsKeyOnly(t *testing.T) {
+	// Only oldDevImage and noEbsImage have a Foozle tag at all.
+	tables := []struct {
+		tag      *ec2.Tag
+		matched  []bool
+		tagValue []string
+	}{
+		{&ec2.Tag{Key: aws.String("Foozle")}, []bool{false, false, true, true},
+			[]string{"not found", "not found", "Fizzbin", "Whatsit"}},
+		// An empty value is the same as none.
+		{&ec2.Tag{Key: aws.String("Foozle"), Value: aws.String("")}, []bool{false, false, true, true},
+			[]string{"not found", "not found", "Fizzbin", "Whatsit"}},
+		{&ec2.Tag{Key: aws.String("Missing")}, []bool{false, false, false, false},
+			[]string{"not found", "not found", "not found", "not found"}},
+	}
+
+	for _, table := range tables {
+		for index, image := range testImages {
+			match, matchedTag := matchTags(image, table.tag)
+			if match != table.matched[index] || aws.StringValue(matchedTag.Value) != table.tagValue[index] {
+				t.Errorf("ERROR: matchTags for %v with key %v;\n\texpected: %v, %v\n\tgot: %v, %v",
+					*image.Name,
+					*table.tag.Key,
+					table.matched[index],
+					table.tagValue[index],
+					match,
+					aws.StringValue(matchedTag.Value),
+				)
+			}
+		}
+	}
+}
+
+func TestCheckImageTagKeyPresence(t *testing.T) {
+	// Only oldDevImage and noEbsImage have a Foozle tag; inverting
+	// selects the images without one.
+	tables := []struct {
+		invert    bool
+		resultSet []bool
+	}{
+		{false, []bool{false, false, true, true}},
+		{true, []bool{true, true, false, false}},
+	}
+
+	for _, table := range tables {
+		a := AMIClean{
+			Tag:            &ec2.Tag{Key: aws.String("Foozle")},
+			Invert:         table.invert,
+			ExpirationDate: now,
+			Logger:         logger,
+		}
+		for index, image := range testImages {
+			if a.CheckImage(image) != table.resultSet[index] {
+				t.Errorf("ERROR: CheckImage of Foozle key with Invert %v for %v;\n\texpected: %v\n\tgot: %v",
+					table.invert,
+					*image.Name,
+					table.resultSet[index],
+					!table.resultSet[index],
+				)
+			}
+		}
+	}
+}
+
+func TestCheckImageInvertAge(t *testing.T) {
+	a := AMIClean{
+		Tag:            &ec2.Tag{Key: aws.String("Branch")},
+		InvertAge:      true,
+		ExpirationDate: now.AddDate(0, 0, -7),
+		Logger:         logger,
+	}
+
+	// Only the two images from the last week are newer than the
+	// expiration date.
+	expected := []bool{true, true, false, false}
+	for index, image := range testImages {
+		if a.CheckImage(image) != expected[index] {
+			t.Errorf("ERROR: CheckImage with InvertAge for %v;\n\texpected: %v\n\tgot: %v",
+				*image.Name,
+				expected[index],
+				!expected[index],
+			)
+		}
+	}
+}
+
+func TestCheckImageCreationWindow(t *testing.T) {
+	// oldDevImage and noEbsImage were both created at this time.
+	created := time.Date(2019, 3, 1, 21, 4, 57, 0, time.UTC)
+	tables := []struct {
+		after     time.Time
+		before    time.Time
+		resultSet []bool
+	}{
+		// Both ends of the window are inclusive.
+		{created, created, []bool{false, false, true, true}},
+		{created.Add(time.Nanosecond), time.Time{}, []bool{true, true, false, false}},
+		{time.Time{}, created.Add(-time.Nanosecond), []bool{false, false, false, false}},
+		{created, now, []bool{true, true, true, true}},
+		// Just the newishDevImage, from 2019-03-30.
+		{now.AddDate(0, 0, -3), now.AddDate(0, 0, -1), []bool{false, true, false, false}},
+	}
+
+	for _, table := range tables {
+		a := AMIClean{
+			Tag:           &ec2.Tag{Key: aws.String("Branch")},
+			CreatedAfter:  table.after,
+			CreatedBefore: table.before,
+			// The window replaces the expiration date, which would
+			// otherwise select nothing.
+			ExpirationDate: created.AddDate(0, 0, -1),
+			Logger:         logger,
+		}
+		for index, image := range testImages {
+			if a.CheckImage(image) != table.resultSet[index] {
+				t.Errorf("ERROR: after: %v, before: %v, image %v;\n\texpected: %v\n\tgot: %v",
+					table.after,
+					table.before,
+					*image.Name,
+					table.resultSet[index],
+					!table.resultSet[index],
+				)
+			}
+		}
+	}
+}
+
+func TestCheckImageExcluded(t *testing.T) {
+	// Without the deny list, this would select every image, including
+	// passing the unused check.
+	a := AMIClean{
+		Tag:            &ec2.Tag{Key: aws.String("Branch")},
+		Unused:         true,
+		ExpirationDate: now,
+		ExcludeImageIDs: map[string]bool{
+			"ami-22222222222222222": true,
+		},
+		Logger:    logger,
+		EC2Client: &mockEC2Client{},
+	}
+
+	expected := []bool{true, false, true, true}
+	for index, image := range testImages {
+		if a.CheckImage(image) != expected[index] {
+			t.Errorf("ERROR: CheckImage with ExcludeImageIDs for %v;\n\texpected: %v\n\tgot: %v",
+				*image.Name,
+				expected[index],
+				!expected[index],
+			)
+		}
+	}
+}
+
+func TestCheckImageNameless(t *testing.T) {
+	// Some older images were registered without a name, but still
+	// carry tags we can select them by.
+	image := &ec2.Image{
+		ImageId:      aws.String("ami-99999999999999999"),
+		CreationDate: aws.String("2019-01-01T00:00:00.000Z"),
+		Tags: []*ec2.Tag{
+			{Key: aws.String("branch"), Value: aws.String("feature-foo")},
+		},
+		RootDeviceType: aws.String("ebs"),
+	}
+
+	tables := []struct {
+		namePrefix string
+		expected   bool
+	}{
+		{"", true},
+		{"devimage", false},
+	}
+
+	for _, table := range tables {
+		a := AMIClean{
+			NamePrefix:     table.namePrefix,
+			Tag:            &ec2.Tag{Key: aws.String("branch"), Value: aws.String("feature-foo")},
+			ExpirationDate: now,
+			Logger:         logger,
+		}
+		if got := a.CheckImage(image); got != table.expected {
+			t.Errorf("ERROR: CheckImage of a nameless image with prefix %q;\n\texpected: %v\n\tgot: %v",
+				table.namePrefix,
+				table.expected,
+				got,
+			)
+		}
+	}
+}
+
+func TestCheckImageNameSuffix(t *testing.T) {
+	image := func(name *string) *ec2.Image {
+		return &ec2.Image{
+			Name:           name,
+			ImageId:        aws.String("ami-99999999999999999"),
+			CreationDate:   aws.String("2019-01-01T00:00:00.000Z"),
+			RootDeviceType: aws.String("ebs"),
+		}
+	}
+	release := image(aws.String("app-1.2.3-release"))
+	debug := image(aws.String("app-1.2.3-debug"))
+	other := image(aws.String("worker-1.2.3-debug"))
+	nameless := image(nil)
+
+	tables := []struct {
+		namePrefix string
+		nameSuffix string
+		image      *ec2.Image
+		expected   bool
+	}{
+		// Suffix only.
+		{"", "-debug", debug, true},
+		{"", "-debug", other, true},
+		{"", "-debug", release, false},
+		// Prefix and suffix both have to match.
+		{"app-", "-debug", debug, true},
+		{"app-", "-debug", other, false},
+		{"app-", "-debug", release, false},
+		{"app-", "", release, true},
+		// An image without a name can't end with anything.
+		{"", "-debug", nameless, false},
+	}
+
+	for _, table := range tables {
+		a := AMIClean{
+			NamePrefix:     table.namePrefix,
+			NameSuffix:     table.nameSuffix,
+			ExpirationDate: now,
+			Logger:         logger,
+		}
+		if got := a.CheckImage(table.image); got != table.expected {
+			t.Errorf("ERROR: CheckImage of %q with prefix %q and suffix %q;\n\texpected: %v\n\tgot: %v",
+				aws.StringValue(table.image.Name),
+				table.namePrefix,
+				table.nameSuffix,
+				table.expected,
+				got,
+			)
+		}
+	}
+}
+
+func TestCheckUnusedStateFilter(t *testing.T) {
+	mock := &mockEC2Client{}
+	a := AMIClean{
+		Logger:    logger,
+		EC2Client: mock,
+	}
+
+	unused, err := a.CheckUnused(oldDevImage)
+	if err != nil || !unused {
+		t.Fatalf("ERROR: CheckUnused expected unused with no error, got %v, %v", unused, err)
+	}
+
+	// Terminated instances shouldn't keep an image in use, so we need
+	// to be filtering on instance state as well as image ID.
+	var states []string
+	for _, filter := range mock.describeInstancesInput.Filters {
+		if *filter.Name == "instance-state-name" {
+			states = aws.StringValueSlice(filter.Values)
+		}
+	}
+	for _, state := range states {
+		if state == ec2.InstanceStateNameTerminated {
+			t.Errorf("ERROR: terminated instances included in state filter %v", states)
+		}
+	}
+	if len(states) == 0 {
+		t.Errorf("ERROR: DescribeInstances called without an instance-state-name filter")
+	}
+}
+
 // Testing the image purging is a little difficult; since we're not acting
 // on the actual AWS API, it's probably not going to error out. But this
 // does at least ensure that we're acting on the right types and parsing
@@ -156,8 +818,166 @@ func TestPurgeImage(t *testing.T) {
 
 	for _, image := range testImages {
 		deletedImage, err := a.PurgeImage(image)
+		// An image that isn't EBS-backed is left alone.
+		if image == noEbsImage {
+			if err != ErrNotEBSBacked {
+				t.Errorf("ERROR: PurgeImage of a non-EBS image;\n\texpected: %v\n\tgot: %v, %v", ErrNotEBSBacked, deletedImage, err)
+			}
+			continue
+		}
 		if !(deletedImage == *image.ImageId && err == nil) {
 			t.Errorf("ERROR: PurgeImage test failed for %v", *image.ImageId)
 		}
 	}
 }
+
+func TestPurgeImageRecheckUnused(t *testing.T) {
+	// Unused when CheckImage looks, then in use by the time we purge.
+	mock := &mockEC2Client{
+		reservationsPerCall: [][]*ec2.Reservation{
+			nil,
+			{{ReservationId: aws.String("r-11111111111111111")}},
+		},
+	}
+	a := AMIClean{
+		Delete:          true,
+		Unused:          true,
+		RecheckUnused:   true,
+		TagBeforeDelete: true,
+		ExpirationDate:  now,
+		Logger:          logger,
+		EC2Client:       mock,
+	}
+
+	if !a.CheckImage(oldDevImage) {
+		t.Fatalf("ERROR: expected CheckImage to select %v", *oldDevImage.ImageId)
+	}
+	_, err := a.PurgeImage(oldDevImage)
+	if err != ErrImageInUse {
+		t.Errorf("ERROR: PurgeImage expected ErrImageInUse, got %v", err)
+	}
+	if len(mock.calls) != 0 {
+		t.Errorf("ERROR: PurgeImage purged an image that came into use: %v", mock.calls)
+	}
+	// Nor should it be left tombstoned.
+	if len(mock.createTagsInputs) != 0 {
+		t.Errorf("ERROR: PurgeImage tagged an image that came into use: %v", mock.createTagsInputs)
+	}
+}
+
+func TestUsageChecksInDryRun(t *testing.T) {
+	// The usage checks only read, so a dry run should make the same
+	// calls as a real one, and skip the same images.
+	tables := []struct {
+		del bool
+	}{
+		{false},
+		{true},
+	}
+
+	var describeCalls []map[string]int
+	for _, table := range tables {
+		// Both images are unused when selected, then newishDevImage
+		// is in use when rechecked.
+		mock := &mockEC2Client{
+			reservationsPerCall: [][]*ec2.Reservation{
+				nil,
+				nil,
+				{{ReservationId: aws.String("r-11111111111111111")}},
+			},
+		}
+		a := AMIClean{
+			NamePrefix:     "devimage",
+			Delete:         table.del,
+			Unused:         true,
+			RecheckUnused:  true,
+			CheckFleets:    true,
+			ExpirationDate: now,
+			Logger:         logger,
+			EC2Client:      mock,
+		}
+
+		var selected []*ec2.Image
+		for _, image := range []*ec2.Image{newishDevImage, oldDevImage} {
+			if a.CheckImage(image) {
+				selected = append(selected, image)
+			}
+		}
+		results, err := a.Run(context.Background(), selected)
+		if err != nil {
+			t.Fatalf("ERROR: Run with Delete %v returned error: %v", table.del, err)
+		}
+		expected := []string{*oldDevImage.ImageId}
+		if len(selected) != 2 || !reflect.DeepEqual(results.ImageIDs, expected) {
+			t.Errorf("ERROR: Run with Delete %v;\n\texpected: %v\n\tgot: %v", table.del, expected, results.ImageIDs)
+		}
+		describeCalls = append(describeCalls, mock.describeCalls)
+	}
+
+	// Two checks when selecting, and two rechecks.
+	if describeCalls[0]["DescribeInstances"] != 4 {
+		t.Errorf("ERROR: dry run DescribeInstances calls;\n\texpected: 4\n\tgot: %v", describeCalls[0]["DescribeInstances"])
+	}
+	if describeCalls[0]["DescribeSpotFleetRequests"] == 0 || describeCalls[0]["DescribeFleets"] == 0 {
+		t.Errorf("ERROR: dry run skipped the fleet checks: %v", describeCalls[0])
+	}
+	if !reflect.DeepEqual(describeCalls[0], describeCalls[1]) {
+		t.Errorf("ERROR: usage checks differ between dry run and delete;\n\tdry run: %v\n\tdelete: %v", describeCalls[0], describeCalls[1])
+	}
+}
+
+func TestPurgeImageEphemeral(t *testing.T) {
+	mock := &mockEC2Client{}
+	a := AMIClean{
+		Delete:    true,
+		Logger:    logger,
+		EC2Client: mock,
+	}
+
+	_, err := a.PurgeImage(ephemeralImage)
+	if err != nil {
+		t.Fatalf("ERROR: PurgeImage returned error: %v", err)
+	}
+	expected := []string{
+		"DeregisterImage:ami-88888888888888888",
+		"DeleteSnapshot:snap-88888888888888888",
+	}
+	if !reflect.DeepEqual(mock.calls, expected) {
+		t.Errorf("ERROR: PurgeImage with ephemeral mapping;\n\texpected: %v\n\tgot: %v", expected, mock.calls)
+	}
+}
+
+func TestTimeCall(t *testing.T) {
+	tables := []struct {
+		threshold time.Duration
+		sleep     time.Duration
+		warned    bool
+	}{
+		{0, time.Millisecond, false},
+		{time.Hour, time.Millisecond, false},
+		{time.Nanosecond, time.Millisecond, true},
+	}
+
+	for _, table := range tables {
+		core, logs := observer.New(zapcore.DebugLevel)
+		a := &AMIClean{
+			SlowCallThreshold: table.threshold,
+			Logger:            zap.New(core),
+		}
+		err := a.timeCall("DeleteSnapshot", zap.String("snapshot-id", "snap-1"), func() error {
+			time.Sleep(table.sleep)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("ERROR: timeCall returned error: %v", err)
+		}
+		warned := logs.FilterMessage("slow AWS API call").Len() == 1
+		if warned != table.warned {
+			t.Errorf("ERROR: threshold %v: expected warning %t, got %t",
+				table.threshold,
+				table.warned,
+				warned,
+			)
+		}
+	}
+}
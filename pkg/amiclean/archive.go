@@ -0,0 +1,117 @@
+package amiclean
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+// DefaultArchiveTimeout is how long archiveImage waits for a copy to
+// become available if ArchiveTimeout isn't set.
+const DefaultArchiveTimeout = 30 * time.Minute
+
+// archiveWaiterDelay is how long we wait between checks on an archive
+// copy. It's the SDK's default, but the SDK also gives up after 40
+// checks, which is only 10 minutes; we leave that to ArchiveTimeout.
+const archiveWaiterDelay = 15 * time.Second
+
+// archiveImage copies an image to the archive account and region before
+// we deregister it. If the archive is in another account, the image and
+// its snapshots are shared with that account first, and
+// ArchiveEC2Client, which has to be a client for that account, makes
+// the copy. We wait for the copy to become available, so that the
+// original is never deregistered before the archive is safe.
+func (a *AMIClean) archiveImage(image *ec2.Image, snapshotIDs []string) error {
+	imageID := *image.ImageId
+	if !a.Delete {
+		a.Logger.Info("would archive ami before deregistering",
+			zap.String("ami-id", imageID),
+			zap.String("archive-account-id", a.ArchiveAccountID),
+			zap.String("archive-region", a.ArchiveRegion),
+		)
+		return nil
+	}
+
+	if a.ArchiveAccountID != "" {
+		a.Logger.Info("sharing ami with archive account",
+			zap.String("ami-id", imageID),
+			zap.String("archive-account-id", a.ArchiveAccountID),
+		)
+		err := a.timeCall("ModifyImageAttribute", zap.String("ami-id", imageID), func() error {
+			_, err := a.EC2Client.ModifyImageAttribute(&ec2.ModifyImageAttributeInput{
+				ImageId: aws.String(imageID),
+				LaunchPermission: &ec2.LaunchPermissionModifications{
+					Add: []*ec2.LaunchPermission{{UserId: aws.String(a.ArchiveAccountID)}},
+				},
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		// CopyImage needs to read the snapshots, not just the image.
+		for _, snapshotID := range snapshotIDs {
+			err := a.timeCall("ModifySnapshotAttribute", zap.String("snapshot-id", snapshotID), func() error {
+				_, err := a.EC2Client.ModifySnapshotAttribute(&ec2.ModifySnapshotAttributeInput{
+					SnapshotId: aws.String(snapshotID),
+					CreateVolumePermission: &ec2.CreateVolumePermissionModifications{
+						Add: []*ec2.CreateVolumePermission{{UserId: aws.String(a.ArchiveAccountID)}},
+					},
+				})
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	a.Logger.Info("copying ami to archive",
+		zap.String("ami-id", imageID),
+		zap.String("archive-account-id", a.ArchiveAccountID),
+		zap.String("archive-region", a.ArchiveRegion),
+	)
+	var output *ec2.CopyImageOutput
+	err := a.timeCall("CopyImage", zap.String("ami-id", imageID), func() error {
+		var err error
+		output, err = a.ArchiveEC2Client.CopyImage(&ec2.CopyImageInput{
+			Name:          image.Name,
+			Description:   aws.String(fmt.Sprintf("Archived copy of %v from %v", imageID, a.Region)),
+			SourceImageId: aws.String(imageID),
+			SourceRegion:  aws.String(a.Region),
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	timeout := a.ArchiveTimeout
+	if timeout <= 0 {
+		timeout = DefaultArchiveTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	archivedID := aws.StringValue(output.ImageId)
+	err = a.timeCall("WaitUntilImageAvailable", zap.String("ami-id", archivedID), func() error {
+		return a.ArchiveEC2Client.WaitUntilImageAvailableWithContext(ctx,
+			&ec2.DescribeImagesInput{ImageIds: []*string{output.ImageId}},
+			request.WithWaiterMaxAttempts(0),
+			request.WithWaiterDelay(request.ConstantWaiterDelay(archiveWaiterDelay)),
+		)
+	})
+	if err != nil {
+		return fmt.Errorf("archive copy %v did not become available: %v", archivedID, err)
+	}
+
+	a.Logger.Info("archived ami",
+		zap.String("ami-id", imageID),
+		zap.String("archived-ami-id", archivedID),
+	)
+	return nil
+}
@@ -0,0 +1,204 @@
+package amiclean
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func (m *mockEC2Client) ModifyImageAttribute(input *ec2.ModifyImageAttributeInput) (*ec2.ModifyImageAttributeOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if add := input.LaunchPermission.Add; len(add) > 0 {
+		m.calls = append(m.calls, "ModifyImageAttribute:"+*input.ImageId+":"+*add[0].UserId)
+	}
+	// Revoked permissions are recorded as -account, or -all for the
+	// public one.
+	for _, permission := range input.LaunchPermission.Remove {
+		if permission.UserId != nil {
+			m.calls = append(m.calls, "ModifyImageAttribute:"+*input.ImageId+":-"+*permission.UserId)
+		} else {
+			m.calls = append(m.calls, "ModifyImageAttribute:"+*input.ImageId+":-"+aws.StringValue(permission.Group))
+		}
+	}
+	return &ec2.ModifyImageAttributeOutput{}, nil
+}
+
+func (m *mockEC2Client) ModifySnapshotAttribute(input *ec2.ModifySnapshotAttributeInput) (*ec2.ModifySnapshotAttributeOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, "ModifySnapshotAttribute:"+*input.SnapshotId+":"+*input.CreateVolumePermission.Add[0].UserId)
+	return &ec2.ModifySnapshotAttributeOutput{}, nil
+}
+
+// mockArchiveClient stands in for the archive account's client. It
+// records its calls in the source account's mock, so we can check the
+// order of everything together.
+type mockArchiveClient struct {
+	*mockEC2Client
+	copyImageInput *ec2.CopyImageInput
+	waitError      error
+	// waitAttempts is how many checks the copy takes to become
+	// available.
+	waitAttempts int
+}
+
+func (m *mockArchiveClient) CopyImage(input *ec2.CopyImageInput) (*ec2.CopyImageOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, "CopyImage:"+*input.SourceImageId)
+	m.copyImageInput = input
+	return &ec2.CopyImageOutput{ImageId: aws.String("ami-archived")}, nil
+}
+
+func (m *mockArchiveClient) WaitUntilImageAvailableWithContext(ctx aws.Context, input *ec2.DescribeImagesInput, opts ...request.WaiterOption) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, "WaitUntilImageAvailable:"+*input.ImageIds[0])
+	if m.waitError != nil {
+		return m.waitError
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		return errors.New("expected a deadline")
+	}
+	// Start from the SDK's own waiter settings, and give up the same
+	// way it would.
+	w := request.Waiter{MaxAttempts: 40, Delay: request.ConstantWaiterDelay(15 * time.Second)}
+	w.ApplyOptions(opts...)
+	if w.MaxAttempts > 0 && w.MaxAttempts < m.waitAttempts {
+		return awserr.New(request.WaiterResourceNotReadyErrorCode, "exceeded wait attempts", nil)
+	}
+	return nil
+}
+
+func TestPurgeImageArchive(t *testing.T) {
+	mock := &mockEC2Client{}
+	archive := &mockArchiveClient{mockEC2Client: mock}
+	a := AMIClean{
+		Delete:           true,
+		Archive:          true,
+		ArchiveAccountID: "210987654321",
+		ArchiveRegion:    "us-west-2",
+		ArchiveTimeout:   time.Minute,
+		Region:           "us-east-1",
+		Logger:           logger,
+		EC2Client:        mock,
+		ArchiveEC2Client: archive,
+	}
+
+	if _, err := a.PurgeImage(oldDevImage); err != nil {
+		t.Fatalf("ERROR: PurgeImage returned error: %v", err)
+	}
+	expected := []string{
+		"ModifyImageAttribute:ami-33333333333333333:210987654321",
+		"ModifySnapshotAttribute:snap-33333333333333333:210987654321",
+		"CopyImage:ami-33333333333333333",
+		"WaitUntilImageAvailable:ami-archived",
+		"DeregisterImage:ami-33333333333333333",
+		"DeleteSnapshot:snap-33333333333333333",
+	}
+	if !reflect.DeepEqual(mock.calls, expected) {
+		t.Errorf("ERROR: PurgeImage with Archive;\n\texpected calls: %v\n\tgot: %v", expected, mock.calls)
+	}
+	if got := aws.StringValue(archive.copyImageInput.SourceRegion); got != "us-east-1" {
+		t.Errorf("ERROR: expected CopyImage from us-east-1, got %v", got)
+	}
+}
+
+func TestPurgeImageArchiveSlowCopy(t *testing.T) {
+	// 100 checks is 25 minutes, longer than the SDK waits by default
+	// but within ArchiveTimeout.
+	mock := &mockEC2Client{}
+	archive := &mockArchiveClient{mockEC2Client: mock, waitAttempts: 100}
+	a := AMIClean{
+		Delete:           true,
+		Archive:          true,
+		ArchiveRegion:    "us-west-2",
+		ArchiveTimeout:   30 * time.Minute,
+		Region:           "us-east-1",
+		Logger:           logger,
+		EC2Client:        mock,
+		ArchiveEC2Client: archive,
+	}
+
+	if _, err := a.PurgeImage(oldDevImage); err != nil {
+		t.Fatalf("ERROR: PurgeImage with a slow archive copy returned error: %v", err)
+	}
+	expected := []string{
+		"CopyImage:ami-33333333333333333",
+		"WaitUntilImageAvailable:ami-archived",
+		"DeregisterImage:ami-33333333333333333",
+		"DeleteSnapshot:snap-33333333333333333",
+	}
+	if !reflect.DeepEqual(mock.calls, expected) {
+		t.Errorf("ERROR: PurgeImage with a slow archive copy;\n\texpected calls: %v\n\tgot: %v", expected, mock.calls)
+	}
+}
+
+func TestPurgeImageArchiveFailed(t *testing.T) {
+	// Without a finished copy, the original has to stay.
+	mock := &mockEC2Client{}
+	archive := &mockArchiveClient{mockEC2Client: mock, waitError: context.DeadlineExceeded}
+	a := AMIClean{
+		Delete:           true,
+		Archive:          true,
+		ArchiveRegion:    "us-west-2",
+		Region:           "us-east-1",
+		Logger:           logger,
+		EC2Client:        mock,
+		ArchiveEC2Client: archive,
+	}
+
+	if _, err := a.PurgeImage(oldDevImage); err == nil {
+		t.Errorf("ERROR: PurgeImage with a failed archive copy returned no error")
+	}
+	// Without an archive account, there's nothing to share.
+	expected := []string{
+		"CopyImage:ami-33333333333333333",
+		"WaitUntilImageAvailable:ami-archived",
+	}
+	if !reflect.DeepEqual(mock.calls, expected) {
+		t.Errorf("ERROR: PurgeImage with a failed archive copy;\n\texpected calls: %v\n\tgot: %v", expected, mock.calls)
+	}
+}
+
+func TestPurgeImageArchiveFailedKeepsLaunchPermissions(t *testing.T) {
+	// An image that couldn't be archived is still registered, so
+	// whoever it's shared with should still be able to use it.
+	image := sharedTestImage("ami-listed", false)
+	mock := &mockEC2Client{
+		launchPermissions: map[string][]*ec2.LaunchPermission{
+			"ami-listed": {{UserId: aws.String("123456789012")}},
+		},
+	}
+	archive := &mockArchiveClient{mockEC2Client: mock, waitError: context.DeadlineExceeded}
+	a := AMIClean{
+		Delete:                  true,
+		Archive:                 true,
+		ArchiveRegion:           "us-west-2",
+		RevokeLaunchPermissions: true,
+		IgnoreSharedImageIDs:    map[string]bool{"ami-listed": true},
+		Region:                  "us-east-1",
+		Logger:                  logger,
+		EC2Client:               mock,
+		ArchiveEC2Client:        archive,
+	}
+
+	if _, err := a.PurgeImage(image); err == nil {
+		t.Errorf("ERROR: PurgeImage with a failed archive copy returned no error")
+	}
+	expected := []string{
+		"CopyImage:ami-listed",
+		"WaitUntilImageAvailable:ami-archived",
+	}
+	if !reflect.DeepEqual(mock.calls, expected) {
+		t.Errorf("ERROR: PurgeImage with a failed archive copy and RevokeLaunchPermissions;\n\texpected calls: %v\n\tgot: %v", expected, mock.calls)
+	}
+}
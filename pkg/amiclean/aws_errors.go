@@ -0,0 +1,128 @@
+package amiclean
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"go.uber.org/multierr"
+)
+
+// AWSError is an error from an AWS call, along with the call and the
+// resource it was about. For the error codes we know, it also says what
+// to do about it. It's still an awserr.Error, so its code can be checked
+// the usual way.
+type AWSError struct {
+	Action     string
+	ResourceID string
+	Err        awserr.Error
+}
+
+// Code is the AWS error code.
+func (e *AWSError) Code() string { return e.Err.Code() }
+
+// Message is the message AWS sent with the error.
+func (e *AWSError) Message() string { return e.Err.Message() }
+
+// OrigErr is the error underneath the AWS one, if any.
+func (e *AWSError) OrigErr() error { return e.Err.OrigErr() }
+
+func (e *AWSError) Error() string {
+	msg := fmt.Sprintf("%v %v: %v: %v", e.Action, e.ResourceID, e.Code(), e.Message())
+	if guidance := e.Guidance(); guidance != "" {
+		msg += " (" + guidance + ")"
+	}
+	return msg
+}
+
+// Guidance is what to do about the error, or nothing if we don't know.
+func (e *AWSError) Guidance() string {
+	return errorGuidance(e.Code(), e.Action)
+}
+
+// errorGuidance says what to do about the EC2 error codes that come up
+// most, which on their own don't say much.
+func errorGuidance(code, action string) string {
+	switch code {
+	case "RequestLimitExceeded", "Throttling", "ThrottlingException":
+		return "AWS is throttling our calls; try a lower --concurrency or --rate-limit"
+	case "UnauthorizedOperation", "AccessDenied", "AccessDeniedException":
+		return fmt.Sprintf("the role needs permission for ec2:%v", action)
+	case "InvalidAMIID.NotFound", "InvalidAMIID.Unavailable":
+		return "the AMI is gone; something else may have deregistered it since we listed it"
+	case "InvalidSnapshot.NotFound":
+		return "the snapshot is already gone"
+	case "InvalidSnapshot.InUse":
+		return "another AMI or a volume still uses the snapshot; --batch-snapshots leaves those alone"
+	}
+	return ""
+}
+
+// wrapAWSError wraps err in an AWSError if it came from AWS, and returns
+// anything else as it is.
+func wrapAWSError(action, resourceID string, err error) error {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
+	if _, wrapped := err.(*AWSError); wrapped {
+		return err
+	}
+	return &AWSError{Action: action, ResourceID: resourceID, Err: aerr}
+}
+
+// ImageError is how Run reports an image it failed to purge: the image,
+// the step that failed, and what went wrong.
+type ImageError struct {
+	ImageID string
+	Failure string
+	Err     error
+}
+
+func (e *ImageError) Error() string {
+	return fmt.Sprintf("%v: %v: %v", e.ImageID, e.Failure, e.Err)
+}
+
+// ErrorGroup is every error in a run with the same code.
+type ErrorGroup struct {
+	Code        string
+	Count       int
+	Guidance    string
+	ResourceIDs []string
+}
+
+// GroupErrors sorts the errors Run returns by their AWS error code, so a
+// run that failed the same way for a hundred images says so once.
+// Errors that didn't come from AWS are grouped under "other". The groups
+// are sorted by code.
+func GroupErrors(err error) []ErrorGroup {
+	groups := make(map[string]*ErrorGroup)
+	for _, e := range multierr.Errors(err) {
+		resourceID := ""
+		if ierr, ok := e.(*ImageError); ok {
+			e = ierr.Err
+			resourceID = ierr.ImageID
+		}
+		code, guidance := "other", ""
+		if aerr, ok := e.(*AWSError); ok {
+			code, guidance = aerr.Code(), aerr.Guidance()
+			resourceID = aerr.ResourceID
+		}
+		group, ok := groups[code]
+		if !ok {
+			group = &ErrorGroup{Code: code, Guidance: guidance}
+			groups[code] = group
+		}
+		group.Count++
+		if resourceID != "" {
+			group.ResourceIDs = append(group.ResourceIDs, resourceID)
+		}
+	}
+
+	var sorted []ErrorGroup
+	for _, group := range groups {
+		sorted = append(sorted, *group)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Code < sorted[j].Code })
+	return sorted
+}
@@ -0,0 +1,85 @@
+package amiclean
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestAWSError(t *testing.T) {
+	tables := []struct {
+		action   string
+		code     string
+		expected string
+	}{
+		{"DeregisterImage", "RequestLimitExceeded",
+			"DeregisterImage ami-1: RequestLimitExceeded: failed (AWS is throttling our calls; try a lower --concurrency or --rate-limit)"},
+		{"DeleteSnapshot", "Throttling",
+			"DeleteSnapshot ami-1: Throttling: failed (AWS is throttling our calls; try a lower --concurrency or --rate-limit)"},
+		{"DeregisterImage", "UnauthorizedOperation",
+			"DeregisterImage ami-1: UnauthorizedOperation: failed (the role needs permission for ec2:DeregisterImage)"},
+		{"CreateTags", "AccessDenied",
+			"CreateTags ami-1: AccessDenied: failed (the role needs permission for ec2:CreateTags)"},
+		{"DeregisterImage", "InvalidAMIID.NotFound",
+			"DeregisterImage ami-1: InvalidAMIID.NotFound: failed (the AMI is gone; something else may have deregistered it since we listed it)"},
+		{"DeleteSnapshot", "InvalidSnapshot.InUse",
+			"DeleteSnapshot ami-1: InvalidSnapshot.InUse: failed (another AMI or a volume still uses the snapshot; --batch-snapshots leaves those alone)"},
+		// Codes we don't know about get no guidance.
+		{"DeregisterImage", "InternalError", "DeregisterImage ami-1: InternalError: failed"},
+	}
+
+	for _, table := range tables {
+		err := wrapAWSError(table.action, "ami-1", awserr.New(table.code, "failed", nil))
+		if err.Error() != table.expected {
+			t.Errorf("ERROR: %v error for %v;\n\texpected: %v\n\tgot: %v", table.code, table.action, table.expected, err)
+		}
+		// The code is still there for anything checking it.
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != table.code {
+			t.Errorf("ERROR: %v error for %v lost its code: %#v", table.code, table.action, err)
+		}
+	}
+
+	// Errors that didn't come from AWS are left as they are.
+	plain := errors.New("failed")
+	if err := wrapAWSError("DeregisterImage", "ami-1", plain); err != plain {
+		t.Errorf("ERROR: wrapAWSError of a plain error;\n\texpected: %v\n\tgot: %v", plain, err)
+	}
+}
+
+func TestGroupErrors(t *testing.T) {
+	mock := &mockEC2Client{
+		deregisterErrors: map[string]error{
+			*newMasterImage.ImageId: awserr.New("RequestLimitExceeded", "slow down", nil),
+			*newishDevImage.ImageId: awserr.New("RequestLimitExceeded", "slow down", nil),
+			*oldDevImage.ImageId:    errors.New("connection reset"),
+		},
+	}
+	a := AMIClean{
+		Delete:          true,
+		ContinueOnError: true,
+		Logger:          logger,
+		EC2Client:       mock,
+	}
+
+	_, err := a.Run(context.Background(), []*ec2.Image{newMasterImage, newishDevImage, oldDevImage})
+	expected := []ErrorGroup{
+		{
+			Code:        "RequestLimitExceeded",
+			Count:       2,
+			Guidance:    errorGuidance("RequestLimitExceeded", "DeregisterImage"),
+			ResourceIDs: []string{*newMasterImage.ImageId, *newishDevImage.ImageId},
+		},
+		{
+			Code:        "other",
+			Count:       1,
+			ResourceIDs: []string{*oldDevImage.ImageId},
+		},
+	}
+	if groups := GroupErrors(err); !reflect.DeepEqual(groups, expected) {
+		t.Errorf("ERROR: GroupErrors;\n\texpected: %+v\n\tgot: %+v", expected, groups)
+	}
+}
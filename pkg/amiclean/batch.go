@@ -0,0 +1,157 @@
+package amiclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// snapshotFilterBatchSize is how many snapshot IDs we put in a single
+// DescribeImages filter, to stay well under the API's limits.
+const snapshotFilterBatchSize = 200
+
+// referencedSnapshots returns the snapshots in snapshotIDs that are still
+// used by an image other than the ones in purged, each mapped to one of
+// the images using it. In delete mode the purged images are already
+// gone, but in dry run mode they're still registered, and either way
+// they shouldn't keep their own snapshots alive.
+func (a *AMIClean) referencedSnapshots(snapshotIDs []string, purged map[string]bool) (map[string]string, error) {
+	wanted := make(map[string]bool)
+	for _, snapshotID := range snapshotIDs {
+		wanted[snapshotID] = true
+	}
+
+	referenced := make(map[string]string)
+	for start := 0; start < len(snapshotIDs); start += snapshotFilterBatchSize {
+		end := start + snapshotFilterBatchSize
+		if end > len(snapshotIDs) {
+			end = len(snapshotIDs)
+		}
+		output, err := a.EC2Client.DescribeImages(&ec2.DescribeImagesInput{
+			Owners: aws.StringSlice(a.owners()),
+			Filters: []*ec2.Filter{
+				{
+					Name:   aws.String("block-device-mapping.snapshot-id"),
+					Values: aws.StringSlice(snapshotIDs[start:end]),
+				},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range output.Images {
+			if purged[aws.StringValue(image.ImageId)] {
+				continue
+			}
+			for _, snapshotID := range ImageSnapshotIDs(image) {
+				if wanted[snapshotID] && referenced[snapshotID] == "" {
+					referenced[snapshotID] = aws.StringValue(image.ImageId)
+				}
+			}
+		}
+	}
+	return referenced, nil
+}
+
+// deleteBatchSnapshots deletes the snapshots of the images Run
+// deregistered, now that they're all gone, skipping any snapshot that
+// another image still uses. It returns the snapshots it deleted (or
+// would have, in dry run mode).
+func (a *AMIClean) deleteBatchSnapshots(results Results) ([]string, error) {
+	if len(results.SnapshotIDs) == 0 {
+		return nil, nil
+	}
+
+	purged := make(map[string]bool)
+	for _, imageID := range results.ImageIDs {
+		purged[imageID] = true
+	}
+	// More than one of the images we purged can share a snapshot, but
+	// we only need to delete it once.
+	seen := make(map[string]bool)
+	var snapshotIDs []string
+	for _, snapshotID := range results.SnapshotIDs {
+		if !seen[snapshotID] {
+			seen[snapshotID] = true
+			snapshotIDs = append(snapshotIDs, snapshotID)
+		}
+	}
+
+	referenced, err := a.referencedSnapshots(snapshotIDs, purged)
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []string
+	var errs error
+	for _, snapshotID := range snapshotIDs {
+		if referencedBy := referenced[snapshotID]; referencedBy != "" {
+			a.Logger.Info("snapshot still used by another image; not deleting",
+				zap.String("snapshot-id", snapshotID),
+				zap.String("referenced-by", referencedBy),
+			)
+			continue
+		}
+		retVal, err := a.deleteSnapshots(snapshotID, []string{snapshotID})
+		if err != nil {
+			a.Logger.Error("Failed to delete snapshot",
+				zap.String("snapshot-id", snapshotID),
+				zap.String("failure", retVal),
+				zap.Error(err),
+			)
+			errs = multierr.Append(errs, err)
+			if !a.ContinueOnError {
+				break
+			}
+			continue
+		}
+		deleted = append(deleted, snapshotID)
+	}
+	return deleted, errs
+}
+
+// findDryRunReferences looks up which of the candidates' snapshots are
+// still used by images that aren't candidates. For real, deleting one of
+// those would fail with InvalidSnapshot.InUse, so a dry run shouldn't
+// count it as deleted. We only warn if the lookup fails, since all it
+// changes is the preview.
+func (a *AMIClean) findDryRunReferences(images []*ec2.Image) {
+	candidates := make(map[string]bool)
+	seen := make(map[string]bool)
+	var snapshotIDs []string
+	for _, image := range images {
+		candidates[aws.StringValue(image.ImageId)] = true
+		for _, snapshotID := range ImageSnapshotIDs(image) {
+			if !seen[snapshotID] {
+				seen[snapshotID] = true
+				snapshotIDs = append(snapshotIDs, snapshotID)
+			}
+		}
+	}
+	if len(snapshotIDs) == 0 {
+		return
+	}
+
+	referenced, err := a.referencedSnapshots(snapshotIDs, candidates)
+	if err != nil {
+		a.Logger.Warn("could not check for snapshots used by other images; dry run may overcount deletions",
+			zap.Error(err),
+		)
+		return
+	}
+	a.dryRunReferences = referenced
+}
+
+// deletableSnapshots returns the snapshots of an image we'd actually
+// delete: all of them, less any a dry run found are used by another
+// image.
+func (a *AMIClean) deletableSnapshots(image *ec2.Image) []string {
+	var snapshotIDs []string
+	for _, snapshotID := range ImageSnapshotIDs(image) {
+		if a.dryRunReferences[snapshotID] == "" {
+			snapshotIDs = append(snapshotIDs, snapshotID)
+		}
+	}
+	return snapshotIDs
+}
@@ -0,0 +1,116 @@
+package amiclean
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func batchTestImage(imageID string, snapshotIDs ...string) *ec2.Image {
+	image := &ec2.Image{
+		Name:           aws.String("batch-" + imageID),
+		ImageId:        aws.String(imageID),
+		CreationDate:   aws.String("2019-03-01T21:04:57.000Z"),
+		RootDeviceType: aws.String("ebs"),
+	}
+	for _, snapshotID := range snapshotIDs {
+		image.BlockDeviceMappings = append(image.BlockDeviceMappings, &ec2.BlockDeviceMapping{
+			Ebs: &ec2.EbsBlockDevice{SnapshotId: aws.String(snapshotID)},
+		})
+	}
+	return image
+}
+
+func TestRunBatchSnapshots(t *testing.T) {
+	// The first two images share a snapshot, and the image we aren't
+	// purging still uses another one.
+	first := batchTestImage("ami-batch1", "snap-shared", "snap-first")
+	second := batchTestImage("ami-batch2", "snap-shared", "snap-kept")
+	survivor := batchTestImage("ami-survivor", "snap-kept")
+
+	mock := &mockEC2Client{
+		images: []*ec2.Image{first, second, survivor},
+	}
+	a := AMIClean{
+		Delete:         true,
+		BatchSnapshots: true,
+		Logger:         logger,
+		EC2Client:      mock,
+	}
+
+	results, err := a.Run(context.Background(), []*ec2.Image{first, second})
+	if err != nil {
+		t.Fatalf("ERROR: Run returned error: %v", err)
+	}
+
+	expected := []string{
+		"DeregisterImage:ami-batch1",
+		"DeregisterImage:ami-batch2",
+		"DeleteSnapshot:snap-shared",
+		"DeleteSnapshot:snap-first",
+	}
+	if !reflect.DeepEqual(mock.calls, expected) {
+		t.Errorf("ERROR: Run with BatchSnapshots;\n\texpected calls: %v\n\tgot: %v", expected, mock.calls)
+	}
+	expectedSnapshots := []string{"snap-shared", "snap-first"}
+	if !reflect.DeepEqual(results.SnapshotIDs, expectedSnapshots) {
+		t.Errorf("ERROR: Run with BatchSnapshots;\n\texpected snapshots: %v\n\tgot: %v", expectedSnapshots, results.SnapshotIDs)
+	}
+
+	// We only ask about the snapshots we're thinking of deleting.
+	filter := mock.describeImagesInput.Filters[0]
+	if *filter.Name != "block-device-mapping.snapshot-id" {
+		t.Errorf("ERROR: expected a block-device-mapping.snapshot-id filter, got %v", *filter.Name)
+	}
+	if got := strings.Join(aws.StringValueSlice(filter.Values), ","); got != "snap-shared,snap-first,snap-kept" {
+		t.Errorf("ERROR: expected snapshot filter values snap-shared,snap-first,snap-kept, got %v", got)
+	}
+}
+
+func TestRunDryRunReferencedSnapshots(t *testing.T) {
+	// The candidates share one snapshot between them, which we can
+	// delete, and another with an image we aren't purging, which we
+	// can't.
+	first := batchTestImage("ami-candidate1", "snap-shared", "snap-first")
+	second := batchTestImage("ami-candidate2", "snap-shared", "snap-kept")
+	survivor := batchTestImage("ami-survivor", "snap-kept")
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	a := AMIClean{
+		Logger: zap.New(core),
+		EC2Client: &mockEC2Client{
+			images: []*ec2.Image{first, second, survivor},
+		},
+	}
+
+	results, err := a.Run(context.Background(), []*ec2.Image{first, second})
+	if err != nil {
+		t.Fatalf("ERROR: Run returned error: %v", err)
+	}
+
+	expectedSnapshots := []string{"snap-shared", "snap-first"}
+	if !reflect.DeepEqual(results.SnapshotIDs, expectedSnapshots) {
+		t.Errorf("ERROR: dry run Run;\n\texpected snapshots: %v\n\tgot: %v", expectedSnapshots, results.SnapshotIDs)
+	}
+
+	retained := logs.FilterMessage("would retain snapshot; still used by another image").All()
+	if len(retained) != 1 {
+		t.Fatalf("ERROR: dry run Run;\n\texpected: 1 retained snapshot\n\tgot: %v", len(retained))
+	}
+	fields := retained[0].ContextMap()
+	if fields["snapshot-id"] != "snap-kept" || fields["referenced-by"] != "ami-survivor" {
+		t.Errorf("ERROR: dry run Run;\n\texpected: snap-kept retained, referenced by ami-survivor\n\tgot: %v", fields)
+	}
+	for _, entry := range logs.FilterMessage("would delete snapshot").All() {
+		if entry.ContextMap()["snapshot-id"] == "snap-kept" {
+			t.Errorf("ERROR: dry run Run said it would delete snap-kept")
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package amiclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudtrail"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+// CheckCloudTrailUsage looks through the last CloudTrailDays of CloudTrail
+// history for RunInstances calls that launched from the image. This is
+// stronger evidence that an image is unused than CheckUnused, which only
+// sees instances that exist right now. If the image was launched in
+// that window, it returns true. CloudTrail lookups are slow and rate
+// limited, so each image's result is cached for the rest of the run.
+func (a *AMIClean) CheckCloudTrailUsage(image *ec2.Image) (bool, error) {
+	if used, ok := a.cloudTrailUsage[*image.ImageId]; ok {
+		return used, nil
+	}
+
+	now := a.now()
+	input := &cloudtrail.LookupEventsInput{
+		LookupAttributes: []*cloudtrail.LookupAttribute{
+			{
+				AttributeKey:   aws.String(cloudtrail.LookupAttributeKeyResourceName),
+				AttributeValue: image.ImageId,
+			},
+		},
+		StartTime: aws.Time(now.AddDate(0, 0, -a.CloudTrailDays)),
+		EndTime:   aws.Time(now),
+	}
+
+	// CloudTrail only lets us filter on a single attribute, so we look
+	// up events for the AMI and pick out the RunInstances calls.
+	used := false
+	err := a.CloudTrailClient.LookupEventsPages(input,
+		func(page *cloudtrail.LookupEventsOutput, lastPage bool) bool {
+			for _, event := range page.Events {
+				if aws.StringValue(event.EventName) == "RunInstances" {
+					a.Logger.Debug("found recent RunInstances for ami",
+						zap.String("ami-id", *image.ImageId),
+						zap.String("event-id", aws.StringValue(event.EventId)),
+						zap.Time("event-time", aws.TimeValue(event.EventTime)),
+					)
+					used = true
+					// One hit is all we need; stop paging.
+					return false
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return false, err
+	}
+
+	if a.cloudTrailUsage == nil {
+		a.cloudTrailUsage = make(map[string]bool)
+	}
+	a.cloudTrailUsage[*image.ImageId] = used
+	return used, nil
+}
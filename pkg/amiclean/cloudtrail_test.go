@@ -0,0 +1,67 @@
+package amiclean
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudtrail"
+	"github.com/aws/aws-sdk-go/service/cloudtrail/cloudtrailiface"
+)
+
+// We set up a mock CloudTrail client that returns canned events for each
+// AMI and counts how many lookups we make.
+type mockCloudTrailClient struct {
+	cloudtrailiface.CloudTrailAPI
+	events  map[string][]*cloudtrail.Event
+	lookups int
+}
+
+func (m *mockCloudTrailClient) LookupEventsPages(input *cloudtrail.LookupEventsInput, fn func(*cloudtrail.LookupEventsOutput, bool) bool) error {
+	m.lookups++
+	imageID := aws.StringValue(input.LookupAttributes[0].AttributeValue)
+	fn(&cloudtrail.LookupEventsOutput{Events: m.events[imageID]}, true)
+	return nil
+}
+
+func TestCheckCloudTrailUsage(t *testing.T) {
+	mock := &mockCloudTrailClient{
+		events: map[string][]*cloudtrail.Event{
+			// Only a RunInstances call counts as usage.
+			*newishDevImage.ImageId: {
+				{EventName: aws.String("CreateTags")},
+			},
+			*oldDevImage.ImageId: {
+				{EventName: aws.String("CreateTags")},
+				{EventName: aws.String("RunInstances")},
+			},
+		},
+	}
+	a := AMIClean{
+		CloudTrailDays:   30,
+		Logger:           logger,
+		CloudTrailClient: mock,
+	}
+
+	expected := []bool{false, false, true, false}
+	for index, image := range testImages {
+		used, err := a.CheckCloudTrailUsage(image)
+		if err != nil {
+			t.Fatalf("ERROR: CheckCloudTrailUsage returned error: %v", err)
+		}
+		if used != expected[index] {
+			t.Errorf("ERROR: CheckCloudTrailUsage for %v;\n\texpected: %v\n\tgot: %v",
+				*image.ImageId,
+				expected[index],
+				used,
+			)
+		}
+	}
+
+	// Checking the same images again should come from the cache.
+	for _, image := range testImages {
+		a.CheckCloudTrailUsage(image)
+	}
+	if mock.lookups != len(testImages) {
+		t.Errorf("ERROR: expected %v CloudTrail lookups, got %v", len(testImages), mock.lookups)
+	}
+}
@@ -0,0 +1,75 @@
+package amiclean
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+// creationDateLayouts are the layouts we try a CreationDate in, in
+// order. AWS normally gives RFC8601, which RFC3339 takes in as well,
+// but images imported from elsewhere, among others, can have one in
+// another layout.
+var creationDateLayouts = []struct {
+	name   string
+	layout string
+}{
+	{"RFC3339", time.RFC3339},
+	{"RFC3339Nano", time.RFC3339Nano},
+	{"RFC8601", RFC8601},
+}
+
+// ParseCreationDate parses an image's CreationDate, in whichever of the
+// layouts we know it's in.
+func ParseCreationDate(value string) (time.Time, error) {
+	creationTime, _, err := parseCreationDate(value)
+	return creationTime, err
+}
+
+// parseCreationDate is ParseCreationDate, also returning the name of the
+// layout it was in.
+func parseCreationDate(value string) (time.Time, string, error) {
+	for _, layout := range creationDateLayouts {
+		if creationTime, err := time.Parse(layout.layout, value); err == nil {
+			return creationTime, layout.name, nil
+		}
+	}
+	return time.Time{}, "", fmt.Errorf("creation date %q is in none of the layouts we know", value)
+}
+
+// creationTime parses an image's CreationDate for CheckImage, saying at
+// debug which layout it was in. One we can't parse gets a warning, and
+// ok is false: without knowing how old the image is, we can't say it's
+// old enough to go, so it's skipped. Failed builds can have no
+// CreationDate at all; those still come out as the zero time, as they
+// always have.
+func (a *AMIClean) creationTime(image *ec2.Image) (creationTime time.Time, ok bool) {
+	value := aws.StringValue(image.CreationDate)
+	if value == "" {
+		return time.Time{}, true
+	}
+	creationTime, layout, err := parseCreationDate(value)
+	if err != nil {
+		a.Logger.Warn("could not parse ami creation date; skipping",
+			zap.String("ami-id", aws.StringValue(image.ImageId)),
+			zap.String("ami-creation-date", value),
+		)
+		return time.Time{}, false
+	}
+	a.Logger.Debug("parsed ami creation date",
+		zap.String("ami-id", aws.StringValue(image.ImageId)),
+		zap.String("layout", layout),
+	)
+	return creationTime, true
+}
+
+// imageCreationTime parses an image's creation date without logging
+// anything, for sorting images by age and the like. One we can't parse
+// comes out as the zero time, so it sorts as the oldest.
+func imageCreationTime(image *ec2.Image) time.Time {
+	creationTime, _, _ := parseCreationDate(aws.StringValue(image.CreationDate))
+	return creationTime
+}
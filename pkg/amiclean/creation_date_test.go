@@ -0,0 +1,93 @@
+package amiclean
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestParseCreationDate(t *testing.T) {
+	tables := []struct {
+		value    string
+		layout   string
+		expected time.Time
+	}{
+		// What AWS normally gives us.
+		{"2019-01-01T12:30:00.000Z", "RFC3339", time.Date(2019, 1, 1, 12, 30, 0, 0, time.UTC)},
+		{"2019-01-01T12:30:00Z", "RFC3339", time.Date(2019, 1, 1, 12, 30, 0, 0, time.UTC)},
+		{"2019-01-01T12:30:00+02:00", "RFC3339", time.Date(2019, 1, 1, 10, 30, 0, 0, time.UTC)},
+		{"2019-01-01T12:30:00.123456789Z", "RFC3339", time.Date(2019, 1, 1, 12, 30, 0, 123456789, time.UTC)},
+	}
+
+	for _, table := range tables {
+		got, layout, err := parseCreationDate(table.value)
+		if err != nil || layout != table.layout || !got.Equal(table.expected) {
+			t.Errorf("ERROR: parseCreationDate of %q;\n\texpected: %v in %v\n\tgot: %v in %v, error %v",
+				table.value,
+				table.expected,
+				table.layout,
+				got,
+				layout,
+				err,
+			)
+		}
+	}
+
+	// RFC3339 takes in everything the later layouts do, so check that
+	// each of them still parses on its own.
+	for _, layout := range creationDateLayouts {
+		value := time.Date(2019, 1, 1, 12, 30, 0, 0, time.UTC).Format(layout.layout)
+		if _, err := time.Parse(layout.layout, value); err != nil {
+			t.Errorf("ERROR: %v layout doesn't parse its own %q: %v", layout.name, value, err)
+		}
+	}
+
+	for _, value := range []string{"", "01/01/2019", "2019-01-01", "last tuesday"} {
+		if got, err := ParseCreationDate(value); err == nil {
+			t.Errorf("ERROR: ParseCreationDate of %q;\n\texpected: an error\n\tgot: %v", value, got)
+		}
+	}
+}
+
+func TestCheckImageUnparseableCreationDate(t *testing.T) {
+	image := func(id, creationDate string) *ec2.Image {
+		return &ec2.Image{
+			ImageId:        aws.String(id),
+			Name:           aws.String("devimage-" + id),
+			State:          aws.String(ec2.ImageStateAvailable),
+			CreationDate:   aws.String(creationDate),
+			RootDeviceType: aws.String("ebs"),
+		}
+	}
+
+	tables := []struct {
+		image    *ec2.Image
+		expected bool
+	}{
+		{image("ami-rfc3339", "2019-01-01T00:00:00Z"), true},
+		{image("ami-nano", "2019-01-01T00:00:00.123456789Z"), true},
+		{image("ami-rfc8601", "2019-01-01T00:00:00.000Z"), true},
+		// Without an age we can trust, the image isn't old enough to go,
+		// even though the zero time would be.
+		{image("ami-unparseable", "01/01/2019"), false},
+	}
+
+	for _, table := range tables {
+		a := AMIClean{
+			NamePrefix:     "devimage",
+			ExpirationDate: now.AddDate(0, 0, -30),
+			Now:            stoppedClock,
+			Logger:         logger,
+		}
+		if got := a.CheckImage(table.image); got != table.expected {
+			t.Errorf("ERROR: CheckImage of %v created %v;\n\texpected: %v\n\tgot: %v",
+				*table.image.ImageId,
+				*table.image.CreationDate,
+				table.expected,
+				got,
+			)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package amiclean
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+// DeprecateImages deprecates images with EnableImageDeprecation instead
+// of purging them, as a gentler step before they go. A deprecated image
+// drops out of the default DescribeImages results, so new launches stop
+// finding it, but it can still be launched by ID and its deprecation
+// taken back. Each is deprecated from when it expires: its creation
+// date plus its retention. AWS won't take a time in the past, though,
+// so an image that has already expired, as the ones we select have, is
+// deprecated a minute from now. Images that are already deprecated are
+// left with the time they have. It returns the IDs of the images it
+// deprecated (or would have, in dry run mode); after an error, it stops
+// and returns the ones deprecated so far.
+func (a *AMIClean) DeprecateImages(images []*ec2.Image) ([]string, error) {
+	earliest := a.now().UTC().Add(time.Minute).Truncate(time.Minute)
+
+	var imageIDs []string
+	for _, image := range images {
+		if aws.StringValue(image.DeprecationTime) != "" {
+			continue
+		}
+		imageID := aws.StringValue(image.ImageId)
+		deprecateAt := a.expirationTime(image, imageCreationTime(image))
+		if deprecateAt.Before(earliest) {
+			deprecateAt = earliest
+		}
+
+		if !a.Delete {
+			a.Logger.Info("would deprecate ami",
+				zap.String("ami-id", imageID),
+				zap.String("deprecate-at", deprecateAt.UTC().Format(RFC8601)),
+			)
+			imageIDs = append(imageIDs, imageID)
+			continue
+		}
+		a.Logger.Info("deprecating ami",
+			zap.String("ami-id", imageID),
+			zap.String("deprecate-at", deprecateAt.UTC().Format(RFC8601)),
+		)
+		err := a.timeCall("EnableImageDeprecation", zap.String("ami-id", imageID), func() error {
+			_, err := a.EC2Client.EnableImageDeprecation(&ec2.EnableImageDeprecationInput{
+				ImageId:     aws.String(imageID),
+				DeprecateAt: aws.Time(deprecateAt),
+			})
+			return err
+		})
+		if err != nil {
+			return imageIDs, err
+		}
+		imageIDs = append(imageIDs, imageID)
+	}
+	return imageIDs, nil
+}
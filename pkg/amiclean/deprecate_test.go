@@ -0,0 +1,92 @@
+package amiclean
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestDeprecateImages(t *testing.T) {
+	expired := &ec2.Image{
+		ImageId:      aws.String("ami-1"),
+		CreationDate: aws.String("2019-01-01T00:00:00.000Z"),
+	}
+	// Kept until a date after now by its TTL tag.
+	tagged := &ec2.Image{
+		ImageId:      aws.String("ami-2"),
+		CreationDate: aws.String("2019-03-01T00:00:00.000Z"),
+		Tags:         []*ec2.Tag{{Key: aws.String("ttl"), Value: aws.String("60")}},
+	}
+	deprecated := &ec2.Image{
+		ImageId:         aws.String("ami-3"),
+		CreationDate:    aws.String("2019-01-01T00:00:00.000Z"),
+		DeprecationTime: aws.String("2019-02-01T00:00:00.000Z"),
+	}
+	images := []*ec2.Image{expired, tagged, deprecated}
+
+	for _, del := range []bool{false, true} {
+		mock := &mockEC2Client{}
+		a := AMIClean{
+			Delete:         del,
+			TTLTagKey:      "ttl",
+			ExpirationDate: now.AddDate(0, 0, -30),
+			Now:            stoppedClock,
+			Logger:         logger,
+			EC2Client:      mock,
+		}
+		imageIDs, err := a.DeprecateImages(images)
+		if err != nil {
+			t.Fatalf("ERROR: DeprecateImages with Delete %v returned error: %v", del, err)
+		}
+		if expected := []string{"ami-1", "ami-2"}; !reflect.DeepEqual(imageIDs, expected) {
+			t.Errorf("ERROR: DeprecateImages with Delete %v;\n\texpected: %v\n\tgot: %v", del, expected, imageIDs)
+		}
+
+		var expected map[string]time.Time
+		if del {
+			expected = map[string]time.Time{
+				// Already past its retention, so as soon as AWS allows.
+				"ami-1": now.Add(time.Minute),
+				"ami-2": time.Date(2019, 4, 30, 0, 0, 0, 0, time.UTC),
+			}
+		}
+		if !reflect.DeepEqual(mock.deprecateAt, expected) {
+			t.Errorf("ERROR: DeprecateAt with Delete %v;\n\texpected: %v\n\tgot: %v", del, expected, mock.deprecateAt)
+		}
+	}
+}
+
+func TestDeprecateImagesError(t *testing.T) {
+	mock := &mockEC2Client{
+		deprecateImageErrors: map[string]error{
+			"ami-2": awserr.New("UnauthorizedOperation", "not allowed", nil),
+		},
+	}
+	a := AMIClean{
+		Delete:         true,
+		ExpirationDate: now.AddDate(0, 0, -30),
+		Now:            stoppedClock,
+		Logger:         logger,
+		EC2Client:      mock,
+	}
+	images := []*ec2.Image{
+		{ImageId: aws.String("ami-1"), CreationDate: aws.String("2019-01-01T00:00:00.000Z")},
+		{ImageId: aws.String("ami-2"), CreationDate: aws.String("2019-01-01T00:00:00.000Z")},
+		{ImageId: aws.String("ami-3"), CreationDate: aws.String("2019-01-01T00:00:00.000Z")},
+	}
+
+	imageIDs, err := a.DeprecateImages(images)
+	if err == nil {
+		t.Fatalf("ERROR: DeprecateImages didn't return the EnableImageDeprecation error")
+	}
+	if expected := []string{"ami-1"}; !reflect.DeepEqual(imageIDs, expected) {
+		t.Errorf("ERROR: DeprecateImages after an error;\n\texpected: %v\n\tgot: %v", expected, imageIDs)
+	}
+	if expected := []string{"EnableImageDeprecation:ami-1", "EnableImageDeprecation:ami-2"}; !reflect.DeepEqual(mock.calls, expected) {
+		t.Errorf("ERROR: calls after an error;\n\texpected: %v\n\tgot: %v", expected, mock.calls)
+	}
+}
@@ -0,0 +1,25 @@
+package amiclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// matchEncryption returns true if every EBS volume in the image has the
+// given encryption state. An image with a mix of encrypted and
+// unencrypted volumes doesn't match either way, and neither does one
+// with no EBS volumes at all, since we can't say anything about its
+// encryption.
+func matchEncryption(image *ec2.Image, encrypted bool) bool {
+	found := false
+	for _, blockDevice := range image.BlockDeviceMappings {
+		if blockDevice.Ebs == nil {
+			continue
+		}
+		if aws.BoolValue(blockDevice.Ebs.Encrypted) != encrypted {
+			return false
+		}
+		found = true
+	}
+	return found
+}
@@ -0,0 +1,60 @@
+package amiclean
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func encryptionTestImage(name string, encrypted ...bool) *ec2.Image {
+	image := &ec2.Image{
+		Name:           aws.String(name),
+		ImageId:        aws.String("ami-77777777777777777"),
+		CreationDate:   aws.String("2019-03-01T21:04:57.000Z"),
+		RootDeviceType: aws.String("ebs"),
+	}
+	for _, e := range encrypted {
+		image.BlockDeviceMappings = append(image.BlockDeviceMappings, &ec2.BlockDeviceMapping{
+			Ebs: &ec2.EbsBlockDevice{
+				SnapshotId: aws.String("snap-77777777777777777"),
+				Encrypted:  aws.Bool(e),
+			},
+		})
+	}
+	return image
+}
+
+func TestCheckImageEncrypted(t *testing.T) {
+	encryptedImage := encryptionTestImage("encrypted", true, true)
+	unencryptedImage := encryptionTestImage("unencrypted", false)
+	mixedImage := encryptionTestImage("mixed", true, false)
+	images := []*ec2.Image{encryptedImage, unencryptedImage, mixedImage, noEbsImage}
+
+	tables := []struct {
+		encrypted *bool
+		resultSet []bool
+	}{
+		{nil, []bool{true, true, true, true}},
+		{aws.Bool(true), []bool{true, false, false, false}},
+		{aws.Bool(false), []bool{false, true, false, false}},
+	}
+
+	for _, table := range tables {
+		a := AMIClean{
+			Encrypted:      table.encrypted,
+			ExpirationDate: now,
+			Logger:         logger,
+		}
+		for index, image := range images {
+			if a.CheckImage(image) != table.resultSet[index] {
+				t.Errorf("ERROR: encrypted: %v, image %v;\n\texpected: %v\n\tgot: %v",
+					aws.BoolValue(table.encrypted),
+					*image.Name,
+					table.resultSet[index],
+					!table.resultSet[index],
+				)
+			}
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package amiclean
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Gate is the outcome of one of the checks CheckImage makes.
+type Gate struct {
+	Name   string
+	Passed bool
+	Detail string
+}
+
+// Decision records how ExplainImage got to its answer for an image: the
+// outcome of every check that applies, in the order CheckImage makes
+// them, then the deregistration protection PurgeImage checks, and
+// whether the image would be purged as a result.
+type Decision struct {
+	ImageID  string
+	Selected bool
+	Gates    []Gate
+}
+
+// ExplainImage runs the same checks as CheckImage, but records the
+// outcome of each one instead of stopping at the first that fails. It's
+// meant for answering "why was (or wasn't) this AMI selected?", so it's
+// happy to make every usage check's API calls; CheckImage stays the fast
+// path for a full run.
+func (a *AMIClean) ExplainImage(image *ec2.Image) Decision {
+	d := Decision{ImageID: aws.StringValue(image.ImageId)}
+	add := func(name string, passed bool, format string, args ...interface{}) {
+		d.Gates = append(d.Gates, Gate{Name: name, Passed: passed, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	excluded := a.ExcludeImageIDs[d.ImageID]
+	if excluded {
+		add("exclude", false, "image ID is on the exclude list")
+	} else {
+		add("exclude", true, "image ID is not on the exclude list")
+	}
+
+	if len(a.States) > 0 {
+		add("state", a.matchState(image), "state %q, want one of %v", aws.StringValue(image.State), strings.Join(a.States, ", "))
+	}
+
+	name := aws.StringValue(image.Name)
+	add("prefix", strings.HasPrefix(name, a.NamePrefix), "name %q, prefix %q", name, a.NamePrefix)
+	if a.NameSuffix != "" {
+		add("suffix", strings.HasSuffix(name, a.NameSuffix), "name %q, suffix %q", name, a.NameSuffix)
+	}
+
+	now := a.now()
+	creationTime, err := ParseCreationDate(aws.StringValue(image.CreationDate))
+	if err != nil && aws.StringValue(image.CreationDate) != "" {
+		add("creation-date", false, "%v", err)
+	}
+	if len(a.Rules) > 0 {
+		if i, match := a.matchRule(image, creationTime); match {
+			add("rules", true, "matched rule %d", i+1)
+		} else {
+			add("rules", false, "matched none of %d rules", len(a.Rules))
+		}
+	} else if a.DeprecatedOnly {
+		add("age", isDeprecated(image, now), "deprecation time %v", aws.StringValue(image.DeprecationTime))
+	} else if !a.CreatedAfter.IsZero() || !a.CreatedBefore.IsZero() {
+		add("age", a.inCreationWindow(creationTime), "created %v, window %v to %v",
+			aws.StringValue(image.CreationDate), formatWindowEnd(a.CreatedAfter), formatWindowEnd(a.CreatedBefore))
+	} else {
+		expired := a.isExpired(image, creationTime)
+		add("age", expired != a.InvertAge, "created %v, expired %v, invert-age %v",
+			aws.StringValue(image.CreationDate), expired, a.InvertAge)
+	}
+
+	if a.RequireMarked {
+		deleteAfter, marked := scheduledDeletionTime(image)
+		switch {
+		case !marked:
+			add("marked", false, "not marked for deletion")
+		case deleteAfter.IsZero():
+			add("marked", false, "could not parse %v tag", ScheduledDeletionTagKey)
+		default:
+			add("marked", deleteAfter.Before(now), "marked for deletion after %v", deleteAfter.Format(RFC8601))
+		}
+	}
+
+	if a.Encrypted != nil {
+		add("encryption", matchEncryption(image, *a.Encrypted), "want encrypted %v", *a.Encrypted)
+	}
+
+	if a.BackingVolumeType != "" {
+		volumeType := rootVolumeType(image)
+		add("volume-type", volumeType == a.BackingVolumeType, "root volume type %q, want %q", volumeType, a.BackingVolumeType)
+	}
+
+	if a.MinSnapshots > 0 {
+		snapshots := len(ImageSnapshotIDs(image))
+		add("min-snapshots", snapshots >= a.MinSnapshots, "%d snapshots, want at least %d", snapshots, a.MinSnapshots)
+	}
+
+	if a.SkipShared {
+		sharedWith, err := a.CheckShared(image)
+		switch {
+		case err != nil:
+			add("shared", false, "could not check launch permissions: %v", err)
+		case len(sharedWith) > 0 && a.ignoresSharedUsage(image):
+			add("shared", true, "shared with %v, but its shared usage is ignored", strings.Join(sharedWith, ", "))
+		case len(sharedWith) > 0:
+			add("shared", false, "shared with %v", strings.Join(sharedWith, ", "))
+		default:
+			add("shared", true, "not shared")
+		}
+	}
+
+	if a.Unused {
+		unused, err := a.CheckUnused(image)
+		switch {
+		case err != nil:
+			add("unused", false, "could not check for instances: %v", err)
+		case !unused:
+			add("unused", false, "in use by an instance")
+		default:
+			add("unused", true, "no instances use it")
+		}
+		if a.CheckFleets {
+			inUse, err := a.CheckFleetUsage(image)
+			switch {
+			case err != nil:
+				add("fleets", false, "could not check fleets: %v", err)
+			case inUse:
+				add("fleets", false, "in use by a fleet")
+			default:
+				add("fleets", true, "no fleets use it")
+			}
+		}
+		if a.CheckImageBuilder {
+			inUse, err := a.CheckImageBuilderUsage(image)
+			switch {
+			case err != nil:
+				add("imagebuilder", false, "could not check Image Builder recipes: %v", err)
+			case inUse:
+				add("imagebuilder", false, "parent image of an Image Builder recipe")
+			default:
+				add("imagebuilder", true, "no Image Builder recipes build on it")
+			}
+		}
+		if a.CloudTrailDays > 0 {
+			used, err := a.CheckCloudTrailUsage(image)
+			switch {
+			case err != nil:
+				add("cloudtrail", false, "could not check CloudTrail: %v", err)
+			case used:
+				add("cloudtrail", false, "launched within the last %d days", a.CloudTrailDays)
+			default:
+				add("cloudtrail", true, "not launched within the last %d days", a.CloudTrailDays)
+			}
+		}
+	}
+
+	if a.Tag != nil {
+		match, _ := matchTags(image, a.Tag)
+		add("tag", a.Invert != match, "tag %v=%v matched %v, invert %v",
+			aws.StringValue(a.Tag.Key), aws.StringValue(a.Tag.Value), match, a.Invert)
+	}
+
+	// CheckImage may select a protected image, but PurgeImage leaves it
+	// alone, so it isn't going anywhere.
+	if hasDeregistrationProtection(image) {
+		add("protection", false, "deregistration protection is %v", aws.StringValue(image.DeregistrationProtection))
+	} else {
+		add("protection", true, "no deregistration protection")
+	}
+
+	d.Selected = true
+	for _, gate := range d.Gates {
+		if !gate.Passed {
+			d.Selected = false
+		}
+	}
+	return d
+}
+
+// formatWindowEnd shows one end of a creation window, or "open" if it
+// isn't set.
+func formatWindowEnd(t time.Time) string {
+	if t.IsZero() {
+		return "open"
+	}
+	return t.Format(RFC8601)
+}
@@ -0,0 +1,109 @@
+package amiclean
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// protectedDevImage is an old development image, like oldDevImage, but
+// with deregistration protection on.
+var protectedDevImage = &ec2.Image{
+	Name:                     aws.String("devimage-charlie"),
+	ImageId:                  aws.String("ami-12121212121212121"),
+	CreationDate:             aws.String("2019-03-01T21:04:57.000Z"),
+	DeregistrationProtection: aws.String("enabled-with-cooldown"),
+	Tags: []*ec2.Tag{
+		{Key: aws.String("Branch"), Value: aws.String("development")},
+	},
+	BlockDeviceMappings: []*ec2.BlockDeviceMapping{
+		{
+			DeviceName: aws.String("/dev/xvda"),
+			Ebs:        &ec2.EbsBlockDevice{SnapshotId: aws.String("snap-12121212121212121")},
+		},
+	},
+	RootDeviceType: aws.String("ebs"),
+}
+
+func gateOutcomes(d Decision) map[string]bool {
+	outcomes := make(map[string]bool)
+	for _, gate := range d.Gates {
+		outcomes[gate.Name] = gate.Passed
+	}
+	return outcomes
+}
+
+func TestExplainImage(t *testing.T) {
+	a := AMIClean{
+		NamePrefix:     "devimage",
+		Tag:            &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("development")},
+		Unused:         true,
+		ExpirationDate: now.AddDate(0, 0, -7),
+		Logger:         logger,
+		EC2Client:      &mockEC2Client{},
+	}
+
+	// An old development image gets through everything.
+	selected := a.ExplainImage(oldDevImage)
+	if !selected.Selected {
+		t.Errorf("ERROR: ExplainImage for %v: expected selected, got %+v", *oldDevImage.ImageId, selected)
+	}
+	expected := map[string]bool{"exclude": true, "prefix": true, "age": true, "unused": true, "tag": true, "protection": true}
+	if got := gateOutcomes(selected); !reflect.DeepEqual(got, expected) {
+		t.Errorf("ERROR: ExplainImage for %v;\n\texpected: %v\n\tgot: %v", *oldDevImage.ImageId, expected, got)
+	}
+
+	// The master image is spared for its name, age and tag, and we see
+	// all three rather than just the first.
+	spared := a.ExplainImage(newMasterImage)
+	if spared.Selected {
+		t.Errorf("ERROR: ExplainImage for %v: expected spared, got %+v", *newMasterImage.ImageId, spared)
+	}
+	expected = map[string]bool{"exclude": true, "prefix": false, "age": false, "unused": true, "tag": false, "protection": true}
+	if got := gateOutcomes(spared); !reflect.DeepEqual(got, expected) {
+		t.Errorf("ERROR: ExplainImage for %v;\n\texpected: %v\n\tgot: %v", *newMasterImage.ImageId, expected, got)
+	}
+}
+
+func TestExplainImageProtection(t *testing.T) {
+	a := AMIClean{
+		NamePrefix:     "devimage",
+		ExpirationDate: now.AddDate(0, 0, -7),
+		Logger:         logger,
+	}
+
+	// CheckImage would pick it, but PurgeImage won't touch it, so it
+	// isn't selected.
+	d := a.ExplainImage(protectedDevImage)
+	if d.Selected {
+		t.Errorf("ERROR: ExplainImage for %v: expected spared, got %+v", *protectedDevImage.ImageId, d)
+	}
+	expected := map[string]bool{"exclude": true, "prefix": true, "age": true, "protection": false}
+	if got := gateOutcomes(d); !reflect.DeepEqual(got, expected) {
+		t.Errorf("ERROR: ExplainImage for %v;\n\texpected: %v\n\tgot: %v", *protectedDevImage.ImageId, expected, got)
+	}
+}
+
+func TestExplainImageMatchesCheckImage(t *testing.T) {
+	configs := []AMIClean{
+		{ExpirationDate: now, Logger: logger},
+		{NamePrefix: "devimage", ExpirationDate: now.AddDate(0, 0, -7), Logger: logger},
+		{Tag: &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("master")}, Invert: true, ExpirationDate: now, Logger: logger},
+		{InvertAge: true, ExpirationDate: now.AddDate(0, 0, -7), Logger: logger},
+		{Encrypted: aws.Bool(false), ExcludeImageIDs: map[string]bool{"ami-33333333333333333": true}, ExpirationDate: now, Logger: logger},
+	}
+	images := append([]*ec2.Image{protectedDevImage}, testImages...)
+	for index := range configs {
+		a := &configs[index]
+		for _, image := range images {
+			// Protection isn't one of CheckImage's checks, but
+			// PurgeImage skips protected images all the same.
+			want := a.CheckImage(image) && !hasDeregistrationProtection(image)
+			if got := a.ExplainImage(image).Selected; got != want {
+				t.Errorf("ERROR: config %d, image %v: ExplainImage selected %v, CheckImage %v", index, *image.ImageId, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package amiclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+// inactiveFleetStates are the Spot Fleet and EC2 Fleet states in which a
+// fleet will never launch another instance, so the AMIs it references
+// aren't really in use.
+var inactiveFleetStates = map[string]bool{
+	ec2.BatchStateCancelled:              true,
+	ec2.BatchStateCancelledRunning:       true,
+	ec2.BatchStateCancelledTerminating:   true,
+	ec2.BatchStateFailed:                 true,
+	ec2.FleetStateCodeDeleted:            true,
+	ec2.FleetStateCodeDeletedRunning:     true,
+	ec2.FleetStateCodeDeletedTerminating: true,
+}
+
+// CheckFleetUsage checks to see if an image is referenced by any active
+// Spot Fleet or EC2 Fleet request, either directly in a launch
+// specification or a launch template override, or through a launch
+// template. A fleet that has been
+// scaled to zero has no running instances, so CheckUnused won't catch
+// it, but it will still launch from the AMI when it scales back up. If
+// the image is referenced, it returns true. The fleet configurations are
+// fetched once and cached for the rest of the run.
+func (a *AMIClean) CheckFleetUsage(image *ec2.Image) (bool, error) {
+	if a.fleetImageIDs == nil {
+		fleetImageIDs, err := a.getFleetImageIDs()
+		if err != nil {
+			return false, err
+		}
+		a.fleetImageIDs = fleetImageIDs
+	}
+
+	return a.fleetImageIDs[*image.ImageId], nil
+}
+
+// getFleetImageIDs builds a set of every AMI ID referenced by an active
+// Spot Fleet or EC2 Fleet request.
+func (a *AMIClean) getFleetImageIDs() (map[string]bool, error) {
+	imageIDs := make(map[string]bool)
+	var templates []*ec2.FleetLaunchTemplateSpecification
+
+	// Spot Fleets can use either launch specifications, which name the
+	// AMI directly, or launch templates.
+	err := a.EC2Client.DescribeSpotFleetRequestsPages(&ec2.DescribeSpotFleetRequestsInput{},
+		func(page *ec2.DescribeSpotFleetRequestsOutput, lastPage bool) bool {
+			for _, request := range page.SpotFleetRequestConfigs {
+				if inactiveFleetStates[aws.StringValue(request.SpotFleetRequestState)] ||
+					request.SpotFleetRequestConfig == nil {
+					continue
+				}
+				for _, spec := range request.SpotFleetRequestConfig.LaunchSpecifications {
+					if spec.ImageId != nil {
+						imageIDs[*spec.ImageId] = true
+					}
+				}
+				for _, config := range request.SpotFleetRequestConfig.LaunchTemplateConfigs {
+					if config.LaunchTemplateSpecification != nil {
+						templates = append(templates, config.LaunchTemplateSpecification)
+					}
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	// EC2 Fleets only use launch templates. There's no paginator for
+	// DescribeFleets, so we follow the NextToken ourselves.
+	fleetsInput := &ec2.DescribeFleetsInput{}
+	for {
+		output, err := a.EC2Client.DescribeFleets(fleetsInput)
+		if err != nil {
+			return nil, err
+		}
+		for _, fleet := range output.Fleets {
+			if inactiveFleetStates[aws.StringValue(fleet.FleetState)] {
+				continue
+			}
+			for _, config := range fleet.LaunchTemplateConfigs {
+				if config.LaunchTemplateSpecification != nil {
+					templates = append(templates, config.LaunchTemplateSpecification)
+				}
+				// An instant fleet's overrides can name an AMI in
+				// place of the template's. We still look up the
+				// template's too, since overrides that don't name one
+				// launch from it.
+				for _, override := range config.Overrides {
+					if override.ImageId != nil {
+						imageIDs[*override.ImageId] = true
+					}
+				}
+			}
+		}
+		if aws.StringValue(output.NextToken) == "" {
+			break
+		}
+		fleetsInput.NextToken = output.NextToken
+	}
+
+	// Now look up the AMI each of the launch templates points at.
+	for _, template := range templates {
+		imageID, err := a.getLaunchTemplateImageID(template)
+		if err != nil {
+			return nil, err
+		}
+		if imageID != "" {
+			imageIDs[imageID] = true
+		}
+	}
+
+	a.Logger.Debug("found AMIs referenced by fleets",
+		zap.Int("ami-count", len(imageIDs)),
+	)
+	return imageIDs, nil
+}
+
+// getLaunchTemplateImageID returns the AMI ID used by the given launch
+// template version, or an empty string if it doesn't set one.
+func (a *AMIClean) getLaunchTemplateImageID(template *ec2.FleetLaunchTemplateSpecification) (string, error) {
+	// Fleets that don't name a version use the template's default.
+	version := aws.StringValue(template.Version)
+	if version == "" {
+		version = "$Default"
+	}
+	input := &ec2.DescribeLaunchTemplateVersionsInput{
+		Versions: []*string{aws.String(version)},
+	}
+	if template.LaunchTemplateId != nil {
+		input.LaunchTemplateId = template.LaunchTemplateId
+	} else {
+		input.LaunchTemplateName = template.LaunchTemplateName
+	}
+
+	output, err := a.EC2Client.DescribeLaunchTemplateVersions(input)
+	if err != nil {
+		return "", err
+	}
+	for _, templateVersion := range output.LaunchTemplateVersions {
+		if templateVersion.LaunchTemplateData != nil && templateVersion.LaunchTemplateData.ImageId != nil {
+			return *templateVersion.LaunchTemplateData.ImageId, nil
+		}
+	}
+	return "", nil
+}
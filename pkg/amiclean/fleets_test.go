@@ -0,0 +1,149 @@
+package amiclean
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// This mock has an EC2 Fleet that launches oldDevImage through a launch
+// template, a Spot Fleet that names noEbsImage directly, and a cancelled
+// Spot Fleet that still references newishDevImage.
+var fleetMock = &mockEC2Client{
+	spotFleetRequestConfigs: []*ec2.SpotFleetRequestConfig{
+		{
+			SpotFleetRequestState: aws.String(ec2.BatchStateActive),
+			SpotFleetRequestConfig: &ec2.SpotFleetRequestConfigData{
+				LaunchSpecifications: []*ec2.SpotFleetLaunchSpecification{
+					{ImageId: noEbsImage.ImageId},
+				},
+			},
+		},
+		{
+			SpotFleetRequestState: aws.String(ec2.BatchStateCancelled),
+			SpotFleetRequestConfig: &ec2.SpotFleetRequestConfigData{
+				LaunchSpecifications: []*ec2.SpotFleetLaunchSpecification{
+					{ImageId: newishDevImage.ImageId},
+				},
+			},
+		},
+	},
+	fleets: []*ec2.FleetData{
+		{
+			FleetState: aws.String(ec2.FleetStateCodeActive),
+			LaunchTemplateConfigs: []*ec2.FleetLaunchTemplateConfig{
+				{
+					LaunchTemplateSpecification: &ec2.FleetLaunchTemplateSpecification{
+						LaunchTemplateId: aws.String("lt-11111111111111111"),
+						Version:          aws.String("1"),
+					},
+				},
+			},
+		},
+	},
+	launchTemplateVersions: map[string]*ec2.LaunchTemplateVersion{
+		"lt-11111111111111111": {
+			LaunchTemplateData: &ec2.ResponseLaunchTemplateData{
+				ImageId: oldDevImage.ImageId,
+			},
+		},
+	},
+}
+
+func TestCheckFleetUsage(t *testing.T) {
+	a := AMIClean{
+		Logger:    logger,
+		EC2Client: fleetMock,
+	}
+
+	expected := []bool{false, false, true, true}
+	for index, image := range testImages {
+		inUse, err := a.CheckFleetUsage(image)
+		if err != nil {
+			t.Fatalf("ERROR: CheckFleetUsage returned error: %v", err)
+		}
+		if inUse != expected[index] {
+			t.Errorf("ERROR: CheckFleetUsage for %v;\n\texpected: %v\n\tgot: %v",
+				*image.ImageId,
+				expected[index],
+				inUse,
+			)
+		}
+	}
+}
+
+func TestCheckFleetUsageOverrides(t *testing.T) {
+	// An instant EC2 Fleet whose template launches oldDevImage, with an
+	// override that launches newMasterImage instead.
+	mock := &mockEC2Client{
+		fleets: []*ec2.FleetData{
+			{
+				FleetState: aws.String(ec2.FleetStateCodeActive),
+				Type:       aws.String(ec2.FleetTypeInstant),
+				LaunchTemplateConfigs: []*ec2.FleetLaunchTemplateConfig{
+					{
+						LaunchTemplateSpecification: &ec2.FleetLaunchTemplateSpecification{
+							LaunchTemplateId: aws.String("lt-11111111111111111"),
+						},
+						Overrides: []*ec2.FleetLaunchTemplateOverrides{
+							{ImageId: newMasterImage.ImageId, InstanceType: aws.String("m5.large")},
+							{InstanceType: aws.String("m5.xlarge")},
+						},
+					},
+				},
+			},
+		},
+		launchTemplateVersions: map[string]*ec2.LaunchTemplateVersion{
+			"lt-11111111111111111": {
+				LaunchTemplateData: &ec2.ResponseLaunchTemplateData{
+					ImageId: oldDevImage.ImageId,
+				},
+			},
+		},
+	}
+	a := AMIClean{
+		Logger:    logger,
+		EC2Client: mock,
+	}
+
+	expected := []bool{true, false, true, false}
+	for index, image := range testImages {
+		inUse, err := a.CheckFleetUsage(image)
+		if err != nil {
+			t.Fatalf("ERROR: CheckFleetUsage returned error: %v", err)
+		}
+		if inUse != expected[index] {
+			t.Errorf("ERROR: CheckFleetUsage with overrides for %v;\n\texpected: %v\n\tgot: %v",
+				*image.ImageId,
+				expected[index],
+				inUse,
+			)
+		}
+	}
+}
+
+func TestCheckImageFleets(t *testing.T) {
+	a := AMIClean{
+		Tag:            &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("master")},
+		Invert:         true,
+		Unused:         true,
+		CheckFleets:    true,
+		ExpirationDate: now.AddDate(0, 0, -1),
+		Logger:         logger,
+		EC2Client:      fleetMock,
+	}
+
+	// oldDevImage would otherwise be purged, but the EC2 Fleet launch
+	// template still uses it, so it has to be retained.
+	expected := []bool{false, true, false, false}
+	for index, image := range testImages {
+		if a.CheckImage(image) != expected[index] {
+			t.Errorf("ERROR: CheckImage with fleets for %v;\n\texpected: %v\n\tgot: %v",
+				*image.ImageId,
+				expected[index],
+				!expected[index],
+			)
+		}
+	}
+}
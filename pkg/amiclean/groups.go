@@ -0,0 +1,67 @@
+package amiclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// UntaggedGroup is the group of images without the tag they're grouped
+// by, whether that's ReportGroupTagKey or GroupByTagKey.
+const UntaggedGroup = "untagged"
+
+// GroupTotal is what a run purged of the images in one group: how many
+// there were, and with snapshot sizes looked up, how much snapshot
+// storage went with them.
+type GroupTotal struct {
+	ImagesPurged            int     `json:"images-purged"`
+	SnapshotGiB             int64   `json:"snapshot-gib,omitempty"`
+	EstimatedMonthlySavings float64 `json:"estimated-monthly-savings,omitempty"`
+}
+
+// imageGroup is the group an image is reported in: its value for the
+// ReportGroupTagKey tag, or UntaggedGroup without one.
+func (a *AMIClean) imageGroup(image *ec2.Image) string {
+	return tagGroup(image, a.ReportGroupTagKey)
+}
+
+// tagGroup is the image's value for the tag key, or UntaggedGroup if it
+// doesn't have one.
+func tagGroup(image *ec2.Image, key string) string {
+	for _, tag := range image.Tags {
+		if aws.StringValue(tag.Key) == key && aws.StringValue(tag.Value) != "" {
+			return aws.StringValue(tag.Value)
+		}
+	}
+	return UntaggedGroup
+}
+
+// GroupTotals adds up what Run purged of the images, grouped by their
+// ReportGroupTagKey tag, so that each team can see its own part of a
+// cleanup. Storage is only counted if EstimatePurgeSavings has looked up
+// the snapshot sizes. A group with nothing purged is left out, and
+// without ReportGroupTagKey, there are no groups at all.
+func (a *AMIClean) GroupTotals(images []*ec2.Image, results Results) map[string]GroupTotal {
+	if a.ReportGroupTagKey == "" {
+		return nil
+	}
+	purged := make(map[string]bool, len(results.ImageIDs))
+	for _, imageID := range results.ImageIDs {
+		purged[imageID] = true
+	}
+
+	groups := make(map[string]GroupTotal)
+	for _, image := range images {
+		if !purged[aws.StringValue(image.ImageId)] {
+			continue
+		}
+		group := a.imageGroup(image)
+		total := groups[group]
+		total.ImagesPurged++
+		for _, snapshotID := range a.deletableSnapshots(image) {
+			total.SnapshotGiB += a.snapshotSizes[snapshotID]
+		}
+		total.EstimatedMonthlySavings = float64(total.SnapshotGiB) * a.SnapshotCost
+		groups[group] = total
+	}
+	return groups
+}
@@ -0,0 +1,91 @@
+package amiclean
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestGroupTotals(t *testing.T) {
+	tagged := func(imageID, createdBy string, snapshotIDs ...string) *ec2.Image {
+		image := batchTestImage(imageID, snapshotIDs...)
+		image.Tags = []*ec2.Tag{{Key: aws.String("created-by"), Value: aws.String(createdBy)}}
+		return image
+	}
+	images := []*ec2.Image{
+		tagged("ami-web1", "web", "snap-web1"),
+		tagged("ami-web2", "web", "snap-web2"),
+		tagged("ami-db", "db", "snap-db"),
+		batchTestImage("ami-loose", "snap-loose"),
+		// Its purge fails, so the batch group has nothing purged.
+		tagged("ami-batch", "batch", "snap-batch"),
+	}
+	mock := &mockEC2Client{
+		snapshotPages: [][]*ec2.Snapshot{
+			{
+				{SnapshotId: aws.String("snap-web1"), VolumeSize: aws.Int64(8)},
+				{SnapshotId: aws.String("snap-web2"), VolumeSize: aws.Int64(16)},
+				{SnapshotId: aws.String("snap-db"), VolumeSize: aws.Int64(100)},
+				{SnapshotId: aws.String("snap-loose"), VolumeSize: aws.Int64(30)},
+				{SnapshotId: aws.String("snap-batch"), VolumeSize: aws.Int64(50)},
+			},
+		},
+		deregisterErrors: map[string]error{"ami-batch": errors.New("InternalError")},
+	}
+	var out bytes.Buffer
+	a := AMIClean{
+		Delete:            true,
+		ContinueOnError:   true,
+		ReportGroupTagKey: "created-by",
+		SnapshotCost:      0.5,
+		Report:            NewJSONLinesReportWriter(&out),
+		Logger:            logger,
+		EC2Client:         mock,
+	}
+
+	if _, _, err := a.EstimatePurgeSavings(images); err != nil {
+		t.Fatalf("ERROR: EstimatePurgeSavings returned error: %v", err)
+	}
+	results, _ := a.Run(context.Background(), images)
+	expected := map[string]GroupTotal{
+		"web":         {ImagesPurged: 2, SnapshotGiB: 24, EstimatedMonthlySavings: 12},
+		"db":          {ImagesPurged: 1, SnapshotGiB: 100, EstimatedMonthlySavings: 50},
+		UntaggedGroup: {ImagesPurged: 1, SnapshotGiB: 30, EstimatedMonthlySavings: 15},
+	}
+	if groups := a.GroupTotals(images, results); !reflect.DeepEqual(groups, expected) {
+		t.Errorf("ERROR: GroupTotals;\n\texpected: %v\n\tgot: %v", expected, groups)
+	}
+
+	// Each image in the report says which group it's in.
+	groups := make(map[string]string)
+	decoder := json.NewDecoder(&out)
+	for decoder.More() {
+		var r ImageReport
+		if err := decoder.Decode(&r); err != nil {
+			t.Fatalf("ERROR: could not decode report line: %v", err)
+		}
+		groups[r.ImageID] = r.Group
+	}
+	expectedGroups := map[string]string{
+		"ami-web1":  "web",
+		"ami-web2":  "web",
+		"ami-db":    "db",
+		"ami-loose": UntaggedGroup,
+		"ami-batch": "batch",
+	}
+	if !reflect.DeepEqual(groups, expectedGroups) {
+		t.Errorf("ERROR: report groups;\n\texpected: %v\n\tgot: %v", expectedGroups, groups)
+	}
+
+	// Without a tag key to group by, there are no groups.
+	a.ReportGroupTagKey = ""
+	if groups := a.GroupTotals(images, results); groups != nil {
+		t.Errorf("ERROR: GroupTotals without a tag key;\n\texpected: nil\n\tgot: %v", groups)
+	}
+}
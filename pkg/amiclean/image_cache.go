@@ -0,0 +1,63 @@
+package amiclean
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// ImageCache keeps the results of GetImages around for a while, so that
+// back-to-back runs in a long-lived process (such as a warm Lambda
+// container) don't have to fetch every image again. Entries are keyed by
+// account, region and owner. It is safe to share between AMIClean
+// values.
+type ImageCache struct {
+	TTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]imageCacheEntry
+}
+
+type imageCacheEntry struct {
+	output    *ec2.DescribeImagesOutput
+	fetchedAt time.Time
+}
+
+// NewImageCache returns an empty cache whose entries are good for ttl.
+func NewImageCache(ttl time.Duration) *ImageCache {
+	return &ImageCache{
+		TTL:     ttl,
+		entries: make(map[string]imageCacheEntry),
+	}
+}
+
+// get returns the cached images for key, if we have some that haven't
+// expired.
+func (c *ImageCache) get(key string, now time.Time) (*ec2.DescribeImagesOutput, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || now.Sub(entry.fetchedAt) >= c.TTL {
+		return nil, false
+	}
+	return entry.output, true
+}
+
+// set stores images for key.
+func (c *ImageCache) set(key string, output *ec2.DescribeImagesOutput, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = imageCacheEntry{output: output, fetchedAt: now}
+}
+
+// Invalidate throws away everything in the cache, so the next GetImages
+// call goes to AWS no matter how recent the last one was.
+func (c *ImageCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]imageCacheEntry)
+}
@@ -0,0 +1,52 @@
+package amiclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/imagebuilder"
+	"go.uber.org/zap"
+)
+
+// CheckImageBuilderUsage checks to see if an image is the parent image
+// of any of our EC2 Image Builder recipes. A pipeline builds new images
+// on top of its recipe's parent, so deleting the parent breaks the
+// pipeline the next time it runs, even though nothing is running from
+// the image now. If the image is a parent, it returns true. The recipes
+// are fetched once and cached for the rest of the run.
+func (a *AMIClean) CheckImageBuilderUsage(image *ec2.Image) (bool, error) {
+	if a.imageBuilderParents == nil {
+		parents, err := a.getImageBuilderParents()
+		if err != nil {
+			return false, err
+		}
+		a.imageBuilderParents = parents
+	}
+
+	return a.imageBuilderParents[*image.ImageId], nil
+}
+
+// getImageBuilderParents builds a set of the parent images of the Image
+// Builder recipes we own. A parent can also be an Image Builder image
+// ARN or an SSM parameter, which can't be one of our AMI IDs, so those
+// never match anything.
+func (a *AMIClean) getImageBuilderParents() (map[string]bool, error) {
+	parents := make(map[string]bool)
+	err := a.ImageBuilderClient.ListImageRecipesPages(&imagebuilder.ListImageRecipesInput{
+		Owner: aws.String(imagebuilder.OwnershipSelf),
+	}, func(page *imagebuilder.ListImageRecipesOutput, lastPage bool) bool {
+		for _, recipe := range page.ImageRecipeSummaryList {
+			if recipe.ParentImage != nil {
+				parents[*recipe.ParentImage] = true
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a.Logger.Debug("found parent images of Image Builder recipes",
+		zap.Int("ami-count", len(parents)),
+	)
+	return parents, nil
+}
@@ -0,0 +1,97 @@
+package amiclean
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/imagebuilder"
+	"github.com/aws/aws-sdk-go/service/imagebuilder/imagebuilderiface"
+)
+
+// We set up a mock Image Builder client with canned recipes, split over
+// two pages, counting how many times they're listed.
+type mockImageBuilderClient struct {
+	imagebuilderiface.ImagebuilderAPI
+	recipes [][]*imagebuilder.ImageRecipeSummary
+	lists   int
+}
+
+func (m *mockImageBuilderClient) ListImageRecipesPages(input *imagebuilder.ListImageRecipesInput, fn func(*imagebuilder.ListImageRecipesOutput, bool) bool) error {
+	m.lists++
+	for i, page := range m.recipes {
+		if !fn(&imagebuilder.ListImageRecipesOutput{ImageRecipeSummaryList: page}, i == len(m.recipes)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+// One recipe builds on oldDevImage, and the others on an Image Builder
+// image and an SSM parameter, which never match an AMI ID.
+func newImageBuilderMock() *mockImageBuilderClient {
+	return &mockImageBuilderClient{
+		recipes: [][]*imagebuilder.ImageRecipeSummary{
+			{
+				{Name: aws.String("app"), ParentImage: oldDevImage.ImageId},
+				{Name: aws.String("base"), ParentImage: aws.String("arn:aws:imagebuilder:us-east-1:aws:image/amazon-linux-2-x86/x.x.x")},
+			},
+			{
+				{Name: aws.String("ssm"), ParentImage: aws.String("ssm:/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-x86_64")},
+			},
+		},
+	}
+}
+
+func TestCheckImageBuilderUsage(t *testing.T) {
+	mock := newImageBuilderMock()
+	a := AMIClean{
+		Logger:             logger,
+		ImageBuilderClient: mock,
+	}
+
+	expected := []bool{false, false, true, false}
+	for index, image := range testImages {
+		inUse, err := a.CheckImageBuilderUsage(image)
+		if err != nil {
+			t.Fatalf("ERROR: CheckImageBuilderUsage returned error: %v", err)
+		}
+		if inUse != expected[index] {
+			t.Errorf("ERROR: CheckImageBuilderUsage for %v;\n\texpected: %v\n\tgot: %v",
+				*image.ImageId,
+				expected[index],
+				inUse,
+			)
+		}
+	}
+	// The recipes are only listed once per run.
+	if mock.lists != 1 {
+		t.Errorf("ERROR: expected 1 recipe listing, got %v", mock.lists)
+	}
+}
+
+func TestCheckImageImageBuilder(t *testing.T) {
+	a := AMIClean{
+		Tag:                &ec2.Tag{Key: aws.String("Branch"), Value: aws.String("master")},
+		Invert:             true,
+		Unused:             true,
+		CheckImageBuilder:  true,
+		ExpirationDate:     now.AddDate(0, 0, -1),
+		Logger:             logger,
+		EC2Client:          &mockEC2Client{},
+		ImageBuilderClient: newImageBuilderMock(),
+	}
+
+	// oldDevImage would otherwise be purged, but a recipe still builds
+	// on it, so it has to be retained.
+	expected := []bool{false, true, false, true}
+	for index, image := range testImages {
+		if a.CheckImage(image) != expected[index] {
+			t.Errorf("ERROR: CheckImage with Image Builder for %v;\n\texpected: %v\n\tgot: %v",
+				*image.ImageId,
+				expected[index],
+				!expected[index],
+			)
+		}
+	}
+}
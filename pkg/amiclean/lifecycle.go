@@ -0,0 +1,146 @@
+package amiclean
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+// RetainReasonLifecycle is the reason recorded for images kept back by
+// the keepMin in their lifecycle tag.
+const RetainReasonLifecycle = "lifecycle"
+
+// Lifecycle is the retention policy a build pipeline can stamp on an
+// image, as JSON in the tag named by LifecycleTagKey, e.g.
+// {"ttlDays":30,"keepMin":3}. Either field can be left out.
+type Lifecycle struct {
+	// TTLDays is how many days the image is kept, in place of the
+	// global retention and any TTL tag.
+	TTLDays *int `json:"ttlDays,omitempty"`
+	// KeepMin is how many of the newest images with the same policy
+	// are kept back, in place of MinRetain.
+	KeepMin *int `json:"keepMin,omitempty"`
+}
+
+// validate checks a policy we've parsed, since JSON is happy to give us
+// negative numbers.
+func (l Lifecycle) validate() error {
+	if l.TTLDays != nil && *l.TTLDays < 0 {
+		return errors.New("ttlDays must not be negative")
+	}
+	if l.KeepMin != nil && *l.KeepMin < 0 {
+		return errors.New("keepMin must not be negative")
+	}
+	return nil
+}
+
+// imageLifecycle returns the policy in an image's lifecycle tag, along
+// with the tag's value. It returns false if we don't have a
+// LifecycleTagKey or the image isn't tagged with it, and an error if the
+// tag can't be parsed.
+func (a *AMIClean) imageLifecycle(image *ec2.Image) (Lifecycle, string, bool, error) {
+	if a.LifecycleTagKey == "" {
+		return Lifecycle{}, "", false, nil
+	}
+	for _, tag := range image.Tags {
+		if aws.StringValue(tag.Key) != a.LifecycleTagKey {
+			continue
+		}
+		value := aws.StringValue(tag.Value)
+		var lifecycle Lifecycle
+		if err := json.Unmarshal([]byte(value), &lifecycle); err != nil {
+			return Lifecycle{}, value, false, err
+		}
+		if err := lifecycle.validate(); err != nil {
+			return Lifecycle{}, value, false, err
+		}
+		return lifecycle, value, true, nil
+	}
+	return Lifecycle{}, "", false, nil
+}
+
+// lifecycleTTL returns the ttlDays in an image's lifecycle tag, if it
+// has one. A tag we can't make sense of gets a warning, and the image
+// falls back to the global policy.
+func (a *AMIClean) lifecycleTTL(image *ec2.Image) (int, bool) {
+	lifecycle, value, ok, err := a.imageLifecycle(image)
+	if err != nil {
+		a.Logger.Warn("could not parse lifecycle tag; using the global policy",
+			zap.String("ami-id", aws.StringValue(image.ImageId)),
+			zap.String("lifecycle-tag-key", a.LifecycleTagKey),
+			zap.String("lifecycle-tag-value", value),
+			zap.Error(err),
+		)
+		return 0, false
+	}
+	if !ok || lifecycle.TTLDays == nil {
+		return 0, false
+	}
+	return *lifecycle.TTLDays, true
+}
+
+// hasKeepMin returns true if an image's lifecycle tag sets keepMin, in
+// which case MinRetain leaves it to ApplyLifecycleKeepMin.
+func (a *AMIClean) hasKeepMin(image *ec2.Image) bool {
+	lifecycle, _, ok, _ := a.imageLifecycle(image)
+	return ok && lifecycle.KeepMin != nil
+}
+
+// ApplyLifecycleKeepMin keeps back the newest images among those whose
+// lifecycle tag sets keepMin. Images are counted against others with the
+// same tag value, since those came from the same policy, and usually the
+// same pipeline. It returns the images left to purge, in their original
+// order, and the ones kept, newest first within each policy. Each image
+// kept is logged.
+func (a *AMIClean) ApplyLifecycleKeepMin(images []*ec2.Image) (purge, retained []*ec2.Image) {
+	if a.LifecycleTagKey == "" {
+		return images, nil
+	}
+
+	keepMin := make(map[string]int)
+	groups := make(map[string][]*ec2.Image)
+	var policies []string
+	for _, image := range images {
+		lifecycle, value, ok, _ := a.imageLifecycle(image)
+		if !ok || lifecycle.KeepMin == nil {
+			continue
+		}
+		if _, seen := groups[value]; !seen {
+			policies = append(policies, value)
+			keepMin[value] = *lifecycle.KeepMin
+		}
+		groups[value] = append(groups[value], image)
+	}
+
+	kept := make(map[*ec2.Image]bool)
+	for _, policy := range policies {
+		newest := groups[policy]
+		sort.SliceStable(newest, func(i, j int) bool {
+			return imageCreationTime(newest[i]).After(imageCreationTime(newest[j]))
+		})
+		if len(newest) > keepMin[policy] {
+			newest = newest[:keepMin[policy]]
+		}
+		for _, image := range newest {
+			kept[image] = true
+			a.Logger.Info("retaining ami by policy",
+				zap.String("ami-id", aws.StringValue(image.ImageId)),
+				zap.String("ami-name", aws.StringValue(image.Name)),
+				zap.String("ami-creation-date", aws.StringValue(image.CreationDate)),
+				zap.String("reason", RetainReasonLifecycle),
+				zap.String("lifecycle", policy),
+			)
+		}
+		retained = append(retained, newest...)
+	}
+	for _, image := range images {
+		if !kept[image] {
+			purge = append(purge, image)
+		}
+	}
+	return purge, retained
+}
@@ -0,0 +1,111 @@
+package amiclean
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func lifecycleTestImage(id, creationDate, lifecycle string) *ec2.Image {
+	image := &ec2.Image{
+		Name:           aws.String("devimage-" + id),
+		ImageId:        aws.String(id),
+		CreationDate:   aws.String(creationDate),
+		RootDeviceType: aws.String("ebs"),
+	}
+	if lifecycle != "" {
+		image.Tags = []*ec2.Tag{
+			{Key: aws.String("lifecycle"), Value: aws.String(lifecycle)},
+		}
+	}
+	return image
+}
+
+func TestCheckImageLifecycle(t *testing.T) {
+	tables := []struct {
+		lifecycle     string
+		ttlTag        bool
+		retentionDays int
+		expected      bool
+	}{
+		// The image is a month old, so a 60 day retention keeps it.
+		{`{"ttlDays":7}`, false, 60, true},
+		{`{"ttlDays":365}`, false, 0, false},
+		// The lifecycle wins over a year long TTL tag as well.
+		{`{"ttlDays":7,"keepMin":3}`, true, 60, true},
+		// Policies without a TTL, or that we can't parse, leave it to
+		// the global retention.
+		{`{"keepMin":3}`, false, 60, false},
+		{`{"keepMin":3}`, false, 0, true},
+		{`{"ttlDays":"seven"}`, false, 0, true},
+		{`{"ttlDays":-1}`, false, 60, false},
+		{`ttlDays=7`, false, 60, false},
+	}
+
+	for _, table := range tables {
+		image := lifecycleTestImage("ami-lifecycle", "2019-03-01T00:00:00.000Z", table.lifecycle)
+		a := AMIClean{
+			LifecycleTagKey: "lifecycle",
+			ExpirationDate:  now.AddDate(0, 0, -table.retentionDays),
+			Now:             stoppedClock,
+			Logger:          logger,
+		}
+		if table.ttlTag {
+			a.TTLTagKey = "ttl-days"
+			image.Tags = append(image.Tags, &ec2.Tag{Key: aws.String("ttl-days"), Value: aws.String("365")})
+		}
+		if a.CheckImage(image) != table.expected {
+			t.Errorf("ERROR: CheckImage with lifecycle %v and retention %v;\n\texpected: %v\n\tgot: %v",
+				table.lifecycle,
+				table.retentionDays,
+				table.expected,
+				!table.expected,
+			)
+		}
+	}
+}
+
+func TestApplyLifecycleKeepMin(t *testing.T) {
+	images := []*ec2.Image{
+		lifecycleTestImage("ami-a1", "2019-01-01T00:00:00.000Z", `{"keepMin":2}`),
+		lifecycleTestImage("ami-b1", "2019-01-01T00:00:00.000Z", `{"ttlDays":1,"keepMin":1}`),
+		lifecycleTestImage("ami-a2", "2019-02-01T00:00:00.000Z", `{"keepMin":2}`),
+		lifecycleTestImage("ami-n1", "2019-01-01T00:00:00.000Z", ""),
+		lifecycleTestImage("ami-a3", "2019-03-01T00:00:00.000Z", `{"keepMin":2}`),
+		lifecycleTestImage("ami-b2", "2019-02-01T00:00:00.000Z", `{"ttlDays":1,"keepMin":1}`),
+		lifecycleTestImage("ami-x1", "2019-03-01T00:00:00.000Z", `{"keepMin":`),
+		lifecycleTestImage("ami-n2", "2019-02-01T00:00:00.000Z", ""),
+	}
+	ids := func(images []*ec2.Image) []string {
+		var imageIDs []string
+		for _, image := range images {
+			imageIDs = append(imageIDs, *image.ImageId)
+		}
+		return imageIDs
+	}
+
+	a := AMIClean{
+		LifecycleTagKey: "lifecycle",
+		MinRetain:       1,
+		Logger:          logger,
+	}
+	purge, retained := a.ApplyLifecycleKeepMin(images)
+	expectedRetained := []string{"ami-a3", "ami-a2", "ami-b2"}
+	if !reflect.DeepEqual(ids(retained), expectedRetained) {
+		t.Errorf("ERROR: ApplyLifecycleKeepMin retained;\n\texpected: %v\n\tgot: %v", expectedRetained, ids(retained))
+	}
+
+	// MinRetain then only counts the images without a keepMin, which
+	// includes the one whose tag we couldn't parse.
+	purge, retained = a.ApplyMinRetain(purge)
+	expectedRetained = []string{"ami-x1"}
+	if !reflect.DeepEqual(ids(retained), expectedRetained) {
+		t.Errorf("ERROR: ApplyMinRetain after lifecycle retained;\n\texpected: %v\n\tgot: %v", expectedRetained, ids(retained))
+	}
+	expectedPurge := []string{"ami-a1", "ami-b1", "ami-n1", "ami-n2"}
+	if !reflect.DeepEqual(ids(purge), expectedPurge) {
+		t.Errorf("ERROR: purge after lifecycle and MinRetain;\n\texpected: %v\n\tgot: %v", expectedPurge, ids(purge))
+	}
+}
@@ -0,0 +1,140 @@
+package amiclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// DeregisterImageList deregisters each of the images with the given IDs
+// on its own, for callers that already know which images have to go.
+// One that fails doesn't stop the rest: every image is tried, and the
+// failures come back combined, each as an ImageError. In dry run mode,
+// it only logs what it would deregister, checking that it would be
+// allowed to if ValidatePermissions is set. Unlike PurgeImage, it
+// leaves the images' snapshots alone.
+func (a *AMIClean) DeregisterImageList(imageIDs []string) error {
+	var errs error
+	for _, imageID := range imageIDs {
+		input := &ec2.DeregisterImageInput{
+			DryRun:  aws.Bool(!a.Delete),
+			ImageId: aws.String(imageID),
+		}
+		if !a.Delete {
+			a.Logger.Info("would deregister ami",
+				zap.String("ami-id", imageID),
+			)
+			if a.ValidatePermissions {
+				err := a.checkPermission("DeregisterImage", imageID, func() error {
+					_, err := a.EC2Client.DeregisterImage(input)
+					return err
+				})
+				if err != nil {
+					errs = multierr.Append(errs, &ImageError{
+						ImageID: imageID,
+						Failure: "Failed to validate permission to deregister image",
+						Err:     err,
+					})
+				}
+			}
+			continue
+		}
+
+		a.Logger.Info("deregistering ami",
+			zap.String("ami-id", imageID),
+		)
+		err := a.timeCall("DeregisterImage", zap.String("ami-id", imageID), func() error {
+			_, err := a.EC2Client.DeregisterImage(input)
+			return err
+		})
+		if err != nil {
+			a.Logger.Error("Failed to deregister image",
+				zap.String("ami-id", imageID),
+				zap.Error(err),
+			)
+			errs = multierr.Append(errs, &ImageError{
+				ImageID: imageID,
+				Failure: "Failed to deregister image",
+				Err:     err,
+			})
+			continue
+		}
+		a.Logger.Info("deregistered ami",
+			zap.String("ami-id", imageID),
+		)
+	}
+	return errs
+}
+
+// DeleteSnapshotList deletes each of the snapshots with the given IDs on
+// its own, the way DeregisterImageList does images. A snapshot that's
+// listed more than once, as happens when images share it, is only
+// deleted once. One that another image or a volume still uses fails
+// with InvalidSnapshot.InUse; that's logged and skipped rather than
+// counted as a failure, since the snapshot is still needed. Every other
+// failure comes back in the combined error, and doesn't stop the rest.
+// In dry run mode, it only logs what it would delete, checking that it
+// would be allowed to if ValidatePermissions is set.
+func (a *AMIClean) DeleteSnapshotList(snapshotIDs []string) error {
+	seen := make(map[string]bool, len(snapshotIDs))
+	var errs error
+	for _, snapshotID := range snapshotIDs {
+		if seen[snapshotID] {
+			continue
+		}
+		seen[snapshotID] = true
+
+		input := &ec2.DeleteSnapshotInput{
+			DryRun:     aws.Bool(!a.Delete),
+			SnapshotId: aws.String(snapshotID),
+		}
+		if !a.Delete {
+			a.Logger.Info("would delete snapshot",
+				zap.String("snapshot-id", snapshotID),
+			)
+			if a.ValidatePermissions {
+				err := a.checkPermission("DeleteSnapshot", snapshotID, func() error {
+					_, err := a.EC2Client.DeleteSnapshot(input)
+					return err
+				})
+				errs = multierr.Append(errs, err)
+			}
+			continue
+		}
+
+		a.Logger.Info("deleting snapshot",
+			zap.String("snapshot-id", snapshotID),
+		)
+		err := a.timeCall("DeleteSnapshot", zap.String("snapshot-id", snapshotID), func() error {
+			_, err := a.EC2Client.DeleteSnapshot(input)
+			return err
+		})
+		switch {
+		case isSnapshotInUse(err):
+			a.Logger.Info("snapshot still in use; skipping",
+				zap.String("snapshot-id", snapshotID),
+				zap.Error(err),
+			)
+		case err != nil:
+			a.Logger.Error("Failed to delete snapshot",
+				zap.String("snapshot-id", snapshotID),
+				zap.Error(err),
+			)
+			errs = multierr.Append(errs, err)
+		default:
+			a.Logger.Info("deleted snapshot",
+				zap.String("snapshot-id", snapshotID),
+			)
+		}
+	}
+	return errs
+}
+
+// isSnapshotInUse says whether err is AWS refusing to delete a snapshot
+// that an image or volume still uses.
+func isSnapshotInUse(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == "InvalidSnapshot.InUse"
+}
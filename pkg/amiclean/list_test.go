@@ -0,0 +1,122 @@
+package amiclean
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"go.uber.org/multierr"
+)
+
+func TestDeregisterImageList(t *testing.T) {
+	mock := &mockEC2Client{
+		deregisterErrors: map[string]error{
+			"ami-2": awserr.New("InvalidAMIID.Unavailable", "gone", nil),
+		},
+	}
+	a := AMIClean{
+		Delete:    true,
+		Logger:    logger,
+		EC2Client: mock,
+	}
+
+	err := a.DeregisterImageList([]string{"ami-1", "ami-2", "ami-3"})
+	// The failure in the middle doesn't stop the last one.
+	expected := []string{"DeregisterImage:ami-1", "DeregisterImage:ami-2", "DeregisterImage:ami-3"}
+	if !reflect.DeepEqual(mock.calls, expected) {
+		t.Errorf("ERROR: DeregisterImageList calls;\n\texpected: %v\n\tgot: %v", expected, mock.calls)
+	}
+	errs := multierr.Errors(err)
+	if len(errs) != 1 {
+		t.Fatalf("ERROR: DeregisterImageList errors;\n\texpected: 1\n\tgot: %v", errs)
+	}
+	if ierr, ok := errs[0].(*ImageError); !ok || ierr.ImageID != "ami-2" {
+		t.Errorf("ERROR: DeregisterImageList error;\n\texpected: an ImageError for ami-2\n\tgot: %v", errs[0])
+	}
+	if groups := GroupErrors(err); len(groups) != 1 || groups[0].Code != "InvalidAMIID.Unavailable" {
+		t.Errorf("ERROR: GroupErrors of DeregisterImageList error;\n\texpected: InvalidAMIID.Unavailable\n\tgot: %v", groups)
+	}
+}
+
+func TestDeregisterImageListDryRun(t *testing.T) {
+	tables := []struct {
+		validatePermissions bool
+		expected            []string
+	}{
+		{false, nil},
+		// Only the DryRun calls that check permission.
+		{true, []string{"DeregisterImage:ami-1", "DeregisterImage:ami-2"}},
+	}
+
+	for _, table := range tables {
+		mock := &mockEC2Client{dryRunDenied: map[string]bool{"DeregisterImage": true}}
+		a := AMIClean{
+			ValidatePermissions: table.validatePermissions,
+			Logger:              logger,
+			EC2Client:           mock,
+		}
+		if err := a.DeregisterImageList([]string{"ami-1", "ami-2"}); err != nil {
+			t.Errorf("ERROR: DeregisterImageList in dry run returned error: %v", err)
+		}
+		if !reflect.DeepEqual(mock.calls, table.expected) {
+			t.Errorf("ERROR: DeregisterImageList in dry run with ValidatePermissions %v;\n\texpected calls: %v\n\tgot: %v",
+				table.validatePermissions,
+				table.expected,
+				mock.calls,
+			)
+		}
+		// A denial is recorded like any other, rather than failing.
+		if table.validatePermissions && len(a.DeniedActions()) != 2 {
+			t.Errorf("ERROR: DeregisterImageList denials;\n\texpected: 2\n\tgot: %v", a.DeniedActions())
+		}
+	}
+}
+
+func TestDeleteSnapshotList(t *testing.T) {
+	mock := &mockEC2Client{
+		deleteSnapshotErrors: map[string]error{
+			"snap-in-use": awserr.New("InvalidSnapshot.InUse", "in use by ami-9", nil),
+			"snap-failed": awserr.New("RequestLimitExceeded", "slow down", nil),
+		},
+	}
+	a := AMIClean{
+		Delete:    true,
+		Logger:    logger,
+		EC2Client: mock,
+	}
+
+	err := a.DeleteSnapshotList([]string{"snap-1", "snap-in-use", "snap-1", "snap-failed", "snap-2"})
+	// Each snapshot once, in order, carrying on past both failures.
+	expected := []string{
+		"DeleteSnapshot:snap-1",
+		"DeleteSnapshot:snap-in-use",
+		"DeleteSnapshot:snap-failed",
+		"DeleteSnapshot:snap-2",
+	}
+	if !reflect.DeepEqual(mock.calls, expected) {
+		t.Errorf("ERROR: DeleteSnapshotList calls;\n\texpected: %v\n\tgot: %v", expected, mock.calls)
+	}
+	// Only the failure that wasn't InvalidSnapshot.InUse counts.
+	groups := GroupErrors(err)
+	if len(groups) != 1 || groups[0].Code != "RequestLimitExceeded" ||
+		!reflect.DeepEqual(groups[0].ResourceIDs, []string{"snap-failed"}) {
+		t.Errorf("ERROR: DeleteSnapshotList errors;\n\texpected: RequestLimitExceeded for snap-failed\n\tgot: %v", groups)
+	}
+}
+
+func TestDeleteSnapshotListDryRun(t *testing.T) {
+	mock := &mockEC2Client{}
+	a := AMIClean{
+		ValidatePermissions: true,
+		Logger:              logger,
+		EC2Client:           mock,
+	}
+
+	if err := a.DeleteSnapshotList([]string{"snap-1", "snap-1", "snap-2"}); err != nil {
+		t.Errorf("ERROR: DeleteSnapshotList in dry run returned error: %v", err)
+	}
+	expected := []string{"DeleteSnapshot:snap-1", "DeleteSnapshot:snap-2"}
+	if !reflect.DeepEqual(mock.calls, expected) {
+		t.Errorf("ERROR: DeleteSnapshotList in dry run;\n\texpected calls: %v\n\tgot: %v", expected, mock.calls)
+	}
+}
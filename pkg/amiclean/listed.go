@@ -0,0 +1,78 @@
+package amiclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+// imageIDFilterBatchSize is how many image IDs we put in a single
+// DescribeImages filter, to stay well under the API's limits.
+const imageIDFilterBatchSize = 200
+
+// GetListedImages fetches the images with the given IDs, for when
+// someone has already decided exactly which ones to purge. None of the
+// name, tag or age checks apply, but images on ExcludeImageIDs are
+// still left out, and like GetImages, only images belonging to Owners
+// are fetched. IDs that are excluded, given more than once, or not
+// found are logged and skipped. The images come back in the order their
+// IDs were given, with block device mappings for PurgeImage to delete
+// their snapshots by.
+func (a *AMIClean) GetListedImages(imageIDs []string) (*ec2.DescribeImagesOutput, error) {
+	seen := make(map[string]bool, len(imageIDs))
+	var wanted []string
+	for _, imageID := range imageIDs {
+		if seen[imageID] {
+			continue
+		}
+		seen[imageID] = true
+		if a.ExcludeImageIDs[imageID] {
+			a.Logger.Info("not purging listed ami, it is excluded by id",
+				zap.String("ami-id", imageID),
+			)
+			continue
+		}
+		wanted = append(wanted, imageID)
+	}
+
+	found := make(map[string]*ec2.Image, len(wanted))
+	for start := 0; start < len(wanted); start += imageIDFilterBatchSize {
+		end := start + imageIDFilterBatchSize
+		if end > len(wanted) {
+			end = len(wanted)
+		}
+		// Filtering on image-id, rather than asking for ImageIds, means
+		// an ID that's already gone is just missing from the output,
+		// instead of failing the whole call.
+		input := &ec2.DescribeImagesInput{
+			Owners:            aws.StringSlice(a.owners()),
+			IncludeDeprecated: aws.Bool(true),
+			Filters: []*ec2.Filter{
+				{Name: aws.String("image-id"), Values: aws.StringSlice(wanted[start:end])},
+			},
+		}
+		output, err := a.EC2Client.DescribeImages(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range output.Images {
+			if image != nil && image.ImageId != nil {
+				found[*image.ImageId] = image
+			}
+		}
+	}
+
+	images := make([]*ec2.Image, 0, len(wanted))
+	for _, imageID := range wanted {
+		image, ok := found[imageID]
+		if !ok {
+			a.Logger.Warn("listed ami not found",
+				zap.String("ami-id", imageID),
+				zap.Strings("owners", a.owners()),
+			)
+			continue
+		}
+		images = append(images, image)
+	}
+	return &ec2.DescribeImagesOutput{Images: images}, nil
+}
@@ -0,0 +1,94 @@
+package amiclean
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestGetListedImages(t *testing.T) {
+	mock := &mockEC2Client{}
+	a := AMIClean{
+		Delete: true,
+		// Nothing about the listed images has to match, not even their
+		// age; newMasterImage is nowhere near old enough.
+		NamePrefix:      "devimage",
+		ExpirationDate:  now.AddDate(0, 0, -30),
+		ExcludeImageIDs: map[string]bool{"ami-22222222222222222": true},
+		Now:             stoppedClock,
+		Logger:          logger,
+		EC2Client:       mock,
+	}
+
+	listed := []string{
+		"ami-33333333333333333",
+		"ami-11111111111111111",
+		"ami-11111111111111111",
+		"ami-22222222222222222",
+		"ami-99999999999999999",
+	}
+	output, err := a.GetListedImages(listed)
+	if err != nil {
+		t.Fatalf("ERROR: GetListedImages returned error: %v", err)
+	}
+	var imageIDs []string
+	for _, image := range output.Images {
+		imageIDs = append(imageIDs, *image.ImageId)
+	}
+	// The mock lists every test image, whatever the filter says, so
+	// this is only what was asked for: once each, less the excluded
+	// image and the one that isn't there.
+	expectedIDs := []string{"ami-33333333333333333", "ami-11111111111111111"}
+	if !reflect.DeepEqual(imageIDs, expectedIDs) {
+		t.Errorf("ERROR: GetListedImages images;\n\texpected: %v\n\tgot: %v", expectedIDs, imageIDs)
+	}
+	expectedFilter := []*ec2.Filter{{
+		Name:   aws.String("image-id"),
+		Values: aws.StringSlice([]string{"ami-33333333333333333", "ami-11111111111111111", "ami-99999999999999999"}),
+	}}
+	if !reflect.DeepEqual(mock.describeImagesInput.Filters, expectedFilter) ||
+		!reflect.DeepEqual(aws.StringValueSlice(mock.describeImagesInput.Owners), []string{"self"}) {
+		t.Errorf("ERROR: GetListedImages DescribeImages input;\n\texpected: owners [self], filter %v\n\tgot: %v",
+			expectedFilter, mock.describeImagesInput)
+	}
+
+	if _, err := a.Run(context.Background(), output.Images); err != nil {
+		t.Fatalf("ERROR: Run returned error: %v", err)
+	}
+	expectedCalls := []string{
+		"DeleteSnapshot:snap-11111111111111111",
+		"DeleteSnapshot:snap-33333333333333333",
+		"DeregisterImage:ami-11111111111111111",
+		"DeregisterImage:ami-33333333333333333",
+	}
+	sort.Strings(mock.calls)
+	if !reflect.DeepEqual(mock.calls, expectedCalls) {
+		t.Errorf("ERROR: Run of listed images;\n\texpected calls: %v\n\tgot: %v", expectedCalls, mock.calls)
+	}
+}
+
+func TestGetListedImagesBatches(t *testing.T) {
+	mock := &mockEC2Client{images: []*ec2.Image{}}
+	a := AMIClean{
+		Logger:    logger,
+		EC2Client: mock,
+	}
+
+	var listed []string
+	for i := 0; i < imageIDFilterBatchSize+1; i++ {
+		listed = append(listed, fmt.Sprintf("ami-%017d", i))
+	}
+	output, err := a.GetListedImages(listed)
+	if err != nil {
+		t.Fatalf("ERROR: GetListedImages returned error: %v", err)
+	}
+	if mock.describeImagesCalls != 2 || len(output.Images) != 0 {
+		t.Errorf("ERROR: GetListedImages of %v IDs;\n\texpected: 2 DescribeImages calls, no images\n\tgot: %v calls, %v images",
+			len(listed), mock.describeImagesCalls, len(output.Images))
+	}
+}
@@ -0,0 +1,58 @@
+package amiclean
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ReadManifest reads a manifest of AMI IDs from r. A manifest is a plain
+// text file with one AMI ID per line; blank lines are ignored.
+func ReadManifest(r io.Reader) ([]string, error) {
+	var imageIDs []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		imageID := strings.TrimSpace(scanner.Text())
+		if imageID == "" {
+			continue
+		}
+		imageIDs = append(imageIDs, imageID)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return imageIDs, nil
+}
+
+// DiffImageIDs compares the AMI IDs from a previous run against the
+// current set of candidates. It returns the IDs that are new in the
+// current set (added) and the IDs that no longer match (removed), both
+// sorted so the output is stable.
+func DiffImageIDs(previous, current []string) (added, removed []string) {
+	previousSet := make(map[string]bool, len(previous))
+	for _, imageID := range previous {
+		previousSet[imageID] = true
+	}
+	currentSet := make(map[string]bool, len(current))
+	for _, imageID := range current {
+		currentSet[imageID] = true
+	}
+
+	for imageID := range currentSet {
+		if !previousSet[imageID] {
+			added = append(added, imageID)
+		}
+	}
+	for imageID := range previousSet {
+		if !currentSet[imageID] {
+			removed = append(removed, imageID)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
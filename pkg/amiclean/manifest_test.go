@@ -0,0 +1,49 @@
+package amiclean
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadManifest(t *testing.T) {
+	manifest := "ami-11111111111111111\n\n  ami-22222222222222222  \nami-33333333333333333"
+	expected := []string{"ami-11111111111111111", "ami-22222222222222222", "ami-33333333333333333"}
+
+	imageIDs, err := ReadManifest(strings.NewReader(manifest))
+	if err != nil {
+		t.Fatalf("ERROR: ReadManifest returned error: %v", err)
+	}
+	if !reflect.DeepEqual(imageIDs, expected) {
+		t.Errorf("ERROR: ReadManifest\n\texpected: %v\n\tgot: %v", expected, imageIDs)
+	}
+}
+
+func TestDiffImageIDs(t *testing.T) {
+	tables := []struct {
+		previous []string
+		current  []string
+		added    []string
+		removed  []string
+	}{
+		{nil, nil, nil, nil},
+		{[]string{"ami-1", "ami-2"}, []string{"ami-1", "ami-2"}, nil, nil},
+		{nil, []string{"ami-2", "ami-1"}, []string{"ami-1", "ami-2"}, nil},
+		{[]string{"ami-1", "ami-2"}, nil, nil, []string{"ami-1", "ami-2"}},
+		{[]string{"ami-1", "ami-2"}, []string{"ami-2", "ami-3"}, []string{"ami-3"}, []string{"ami-1"}},
+	}
+
+	for _, table := range tables {
+		added, removed := DiffImageIDs(table.previous, table.current)
+		if !reflect.DeepEqual(added, table.added) || !reflect.DeepEqual(removed, table.removed) {
+			t.Errorf("ERROR: previous: %v, current: %v;\n\texpected added: %v, removed: %v\n\tgot added: %v, removed: %v",
+				table.previous,
+				table.current,
+				table.added,
+				table.removed,
+				added,
+				removed,
+			)
+		}
+	}
+}
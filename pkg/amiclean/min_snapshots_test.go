@@ -0,0 +1,54 @@
+package amiclean
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestCheckImageMinSnapshots(t *testing.T) {
+	oneSnapshot := batchTestImage("ami-1", "snap-1")
+	threeSnapshots := batchTestImage("ami-3", "snap-31", "snap-32", "snap-33")
+	// An instance store volume and an EBS volume without a snapshot
+	// don't count, as they aren't anything PurgeImage would delete.
+	mixed := batchTestImage("ami-2", "snap-21", "snap-22")
+	mixed.BlockDeviceMappings = append(mixed.BlockDeviceMappings,
+		&ec2.BlockDeviceMapping{VirtualName: aws.String("ephemeral0")},
+		&ec2.BlockDeviceMapping{Ebs: &ec2.EbsBlockDevice{VolumeSize: aws.Int64(8)}},
+	)
+	images := []*ec2.Image{oneSnapshot, threeSnapshots, mixed, noEbsImage}
+
+	tables := []struct {
+		minSnapshots int
+		resultSet    []bool
+	}{
+		{0, []bool{true, true, true, true}},
+		{1, []bool{true, true, true, false}},
+		{2, []bool{false, true, true, false}},
+		{3, []bool{false, true, false, false}},
+		{4, []bool{false, false, false, false}},
+	}
+
+	for _, table := range tables {
+		a := AMIClean{
+			MinSnapshots:   table.minSnapshots,
+			ExpirationDate: now,
+			Logger:         logger,
+		}
+		for index, image := range images {
+			if a.CheckImage(image) != table.resultSet[index] {
+				t.Errorf("ERROR: CheckImage with MinSnapshots %v for %v;\n\texpected: %v\n\tgot: %v",
+					table.minSnapshots,
+					*image.ImageId,
+					table.resultSet[index],
+					!table.resultSet[index],
+				)
+			}
+			if a.ExplainImage(image).Selected != table.resultSet[index] {
+				t.Errorf("ERROR: ExplainImage with MinSnapshots %v for %v disagrees with CheckImage",
+					table.minSnapshots, *image.ImageId)
+			}
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package amiclean
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/imagebuilder/imagebuilderiface"
+	"go.uber.org/zap"
+)
+
+// DefaultRetention is how old an image made by NewAMIClient has to be
+// before it's purged, unless WithRetention says otherwise.
+const DefaultRetention = 30 * 24 * time.Hour
+
+// Option configures the AMIClean that NewAMIClient makes.
+type Option func(*clientConfig)
+
+// clientConfig is what the options build up. The retention is kept
+// apart from the AMIClean, since it only turns into an ExpirationDate
+// once we know which clock to read.
+type clientConfig struct {
+	a         AMIClean
+	retention time.Duration
+	selectAll bool
+}
+
+// NewAMIClient makes an AMIClean with the given options, checking that
+// they make sense together. Without options, it's a dry run over our own
+// available images, purging anything more than DefaultRetention old,
+// except those that are shared with other accounts. At least one of
+// WithNamePrefix, WithNameSuffix, WithTag or WithRules is needed, so
+// that nothing selects every image by accident; WithSelectAll says
+// that's really what's wanted.
+func NewAMIClient(ec2Client ec2iface.EC2API, logger *zap.Logger, opts ...Option) (*AMIClean, error) {
+	if ec2Client == nil {
+		return nil, errors.New("an EC2 client is required")
+	}
+	if logger == nil {
+		return nil, errors.New("a logger is required")
+	}
+
+	c := clientConfig{
+		a: AMIClean{
+			Owners:            []string{"self"},
+			States:            []string{ec2.ImageStateAvailable},
+			IncludeDeprecated: true,
+			SkipShared:        true,
+			Concurrency:       1,
+			Logger:            logger,
+			EC2Client:         ec2Client,
+		},
+		retention: DefaultRetention,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	a := &c.a
+
+	if c.retention < 0 {
+		return nil, errors.New("retention must not be negative")
+	}
+	a.ExpirationDate = a.now().Add(-c.retention)
+
+	if a.Concurrency < 1 {
+		return nil, fmt.Errorf("concurrency must be at least 1, got %d", a.Concurrency)
+	}
+	if a.UsageCheckConcurrency < 0 {
+		return nil, fmt.Errorf("usage check concurrency must not be negative, got %d", a.UsageCheckConcurrency)
+	}
+	if a.MinRetain < 0 {
+		return nil, fmt.Errorf("min-retain must not be negative, got %d", a.MinRetain)
+	}
+	if a.GroupByTagKey != "" && a.MinRetain <= 0 {
+		return nil, errors.New("grouping by tag needs min-retain")
+	}
+	if a.MinImagesRetained < 0 {
+		return nil, fmt.Errorf("min-images-retained must not be negative, got %d", a.MinImagesRetained)
+	}
+	if a.Invert && a.Tag == nil {
+		return nil, errors.New("invert needs a tag to invert")
+	}
+	if (a.RecheckUnused || a.CheckFleets || a.CheckImageBuilder) && !a.Unused {
+		return nil, errors.New("rechecking, fleet and Image Builder usage checks need the unused check")
+	}
+	if len(a.Rules) > 0 && (a.NamePrefix != "" || a.NameSuffix != "" || a.Tag != nil) {
+		return nil, errors.New("rules replace the name prefix, suffix and tag; use one or the other")
+	}
+	if a.NamePrefix == "" && a.NameSuffix == "" && a.Tag == nil && len(a.Rules) == 0 && !c.selectAll {
+		return nil, errors.New("no selection criteria: need a name prefix or suffix, tag, or rules, or WithSelectAll")
+	}
+	return a, nil
+}
+
+// WithNamePrefix only selects images whose names start with prefix.
+func WithNamePrefix(prefix string) Option {
+	return func(c *clientConfig) { c.a.NamePrefix = prefix }
+}
+
+// WithNameSuffix only selects images whose names end with suffix.
+func WithNameSuffix(suffix string) Option {
+	return func(c *clientConfig) { c.a.NameSuffix = suffix }
+}
+
+// WithTag only selects images with the tag key, and if value isn't
+// empty, that value, which may be a glob.
+func WithTag(key, value string) Option {
+	return func(c *clientConfig) {
+		c.a.Tag = &ec2.Tag{Key: aws.String(key)}
+		if value != "" {
+			c.a.Tag.Value = aws.String(value)
+		}
+	}
+}
+
+// WithInvert flips the tag check, selecting images that don't match.
+func WithInvert() Option {
+	return func(c *clientConfig) { c.a.Invert = true }
+}
+
+// WithRules selects images that match any of the rules, instead of by
+// name prefix, tag and age.
+func WithRules(rules ...Rule) Option {
+	return func(c *clientConfig) { c.a.Rules = rules }
+}
+
+// WithSelectAll allows selecting images without a name prefix, tag or
+// rules, so that every image old enough is purged.
+func WithSelectAll() Option {
+	return func(c *clientConfig) { c.selectAll = true }
+}
+
+// WithRetention sets how old an image has to be before it's purged.
+func WithRetention(retention time.Duration) Option {
+	return func(c *clientConfig) { c.retention = retention }
+}
+
+// WithOwners sets the accounts whose images we look at.
+func WithOwners(owners ...string) Option {
+	return func(c *clientConfig) { c.a.Owners = owners }
+}
+
+// WithRegion records the region the images are in.
+func WithRegion(region string) Option {
+	return func(c *clientConfig) { c.a.Region = region }
+}
+
+// WithStates sets the image states we look at, in place of just
+// available.
+func WithStates(states ...string) Option {
+	return func(c *clientConfig) { c.a.States = states }
+}
+
+// WithExcludeImageIDs never selects the given images.
+func WithExcludeImageIDs(imageIDs ...string) Option {
+	return func(c *clientConfig) {
+		if c.a.ExcludeImageIDs == nil {
+			c.a.ExcludeImageIDs = make(map[string]bool)
+		}
+		for _, imageID := range imageIDs {
+			c.a.ExcludeImageIDs[imageID] = true
+		}
+	}
+}
+
+// WithUnused only selects images no instance is using.
+func WithUnused() Option {
+	return func(c *clientConfig) { c.a.Unused = true }
+}
+
+// WithRecheckUnused checks again for instances right before each image
+// is deregistered. It needs WithUnused.
+func WithRecheckUnused() Option {
+	return func(c *clientConfig) { c.a.RecheckUnused = true }
+}
+
+// WithCheckFleets also counts images that fleet requests use as in use.
+// It needs WithUnused.
+func WithCheckFleets() Option {
+	return func(c *clientConfig) { c.a.CheckFleets = true }
+}
+
+// WithCheckImageBuilder also counts images that Image Builder recipes
+// build on as in use, listing the recipes with client. It needs
+// WithUnused.
+func WithCheckImageBuilder(client imagebuilderiface.ImagebuilderAPI) Option {
+	return func(c *clientConfig) {
+		c.a.CheckImageBuilder = true
+		c.a.ImageBuilderClient = client
+	}
+}
+
+// WithEncrypted only selects images whose EBS volumes are all
+// encrypted, or if encrypted is false, all unencrypted.
+func WithEncrypted(encrypted bool) Option {
+	return func(c *clientConfig) { c.a.Encrypted = aws.Bool(encrypted) }
+}
+
+// WithAllowShared also selects images that are public or shared with
+// other accounts.
+func WithAllowShared() Option {
+	return func(c *clientConfig) { c.a.SkipShared = false }
+}
+
+// WithMinRetain keeps back the newest n of the images selected.
+func WithMinRetain(n int) Option {
+	return func(c *clientConfig) { c.a.MinRetain = n }
+}
+
+// WithGroupByTagKey makes WithMinRetain keep back the newest n of the
+// images selected for each value of the tag key, rather than overall.
+func WithGroupByTagKey(key string) Option {
+	return func(c *clientConfig) { c.a.GroupByTagKey = key }
+}
+
+// WithMinImagesRetained spares enough of the images selected to leave
+// at least n images once they're purged.
+func WithMinImagesRetained(n int) Option {
+	return func(c *clientConfig) { c.a.MinImagesRetained = n }
+}
+
+// WithDelete makes the purge real, instead of a dry run.
+func WithDelete() Option {
+	return func(c *clientConfig) { c.a.Delete = true }
+}
+
+// WithConcurrency purges up to n images at once.
+func WithConcurrency(n int) Option {
+	return func(c *clientConfig) { c.a.Concurrency = n }
+}
+
+// WithUsageCheckConcurrency makes at most n CheckUnused calls at once.
+func WithUsageCheckConcurrency(n int) Option {
+	return func(c *clientConfig) { c.a.UsageCheckConcurrency = n }
+}
+
+// WithContinueOnError carries on past images that fail to purge.
+func WithContinueOnError() Option {
+	return func(c *clientConfig) { c.a.ContinueOnError = true }
+}
+
+// WithReport sends what happened to each image to report.
+func WithReport(report ReportWriter) Option {
+	return func(c *clientConfig) { c.a.Report = report }
+}
+
+// WithClock reads the current time from now instead of time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(c *clientConfig) { c.a.Now = now }
+}
@@ -0,0 +1,106 @@
+package amiclean
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewAMIClientDefaults(t *testing.T) {
+	mock := &mockEC2Client{}
+	a, err := NewAMIClient(mock, logger, WithNamePrefix("devimage"), WithClock(stoppedClock))
+	if err != nil {
+		t.Fatalf("ERROR: NewAMIClient returned error: %v", err)
+	}
+
+	if a.Delete {
+		t.Errorf("ERROR: NewAMIClient default;\n\texpected: dry run\n\tgot: Delete")
+	}
+	if !reflect.DeepEqual(a.Owners, []string{"self"}) || !reflect.DeepEqual(a.States, []string{"available"}) {
+		t.Errorf("ERROR: NewAMIClient default;\n\texpected: owners [self], states [available]\n\tgot: owners %v, states %v", a.Owners, a.States)
+	}
+	if !a.SkipShared || !a.IncludeDeprecated || a.Concurrency != 1 {
+		t.Errorf("ERROR: NewAMIClient default;\n\texpected: SkipShared, IncludeDeprecated, concurrency 1\n\tgot: %v, %v, %v",
+			a.SkipShared, a.IncludeDeprecated, a.Concurrency)
+	}
+	if expected := now.Add(-DefaultRetention); !a.ExpirationDate.Equal(expected) {
+		t.Errorf("ERROR: NewAMIClient default;\n\texpected: expiration %v\n\tgot: %v", expected, a.ExpirationDate)
+	}
+	if a.EC2Client != mock || a.Logger != logger {
+		t.Errorf("ERROR: NewAMIClient didn't keep its client and logger")
+	}
+}
+
+func TestNewAMIClientOptions(t *testing.T) {
+	a, err := NewAMIClient(&mockEC2Client{}, logger,
+		// The clock is read once every option is in, so the order
+		// doesn't matter.
+		WithRetention(7*24*time.Hour),
+		WithClock(stoppedClock),
+		WithTag("Branch", "feature-*"),
+		WithInvert(),
+		WithUnused(),
+		WithCheckFleets(),
+		WithEncrypted(false),
+		WithExcludeImageIDs("ami-1", "ami-2"),
+		WithConcurrency(4),
+		WithDelete(),
+	)
+	if err != nil {
+		t.Fatalf("ERROR: NewAMIClient returned error: %v", err)
+	}
+	if *a.Tag.Key != "Branch" || *a.Tag.Value != "feature-*" || !a.Invert {
+		t.Errorf("ERROR: NewAMIClient tag;\n\texpected: Branch=feature-*, inverted\n\tgot: %v, inverted %v", a.Tag, a.Invert)
+	}
+	if !a.Unused || !a.CheckFleets || !a.Delete || a.Concurrency != 4 {
+		t.Errorf("ERROR: NewAMIClient options;\n\texpected: unused, fleets, delete, concurrency 4\n\tgot: %v, %v, %v, %v",
+			a.Unused, a.CheckFleets, a.Delete, a.Concurrency)
+	}
+	if a.Encrypted == nil || *a.Encrypted {
+		t.Errorf("ERROR: NewAMIClient encryption;\n\texpected: unencrypted\n\tgot: %v", a.Encrypted)
+	}
+	if !reflect.DeepEqual(a.ExcludeImageIDs, map[string]bool{"ami-1": true, "ami-2": true}) {
+		t.Errorf("ERROR: NewAMIClient exclusions;\n\texpected: ami-1, ami-2\n\tgot: %v", a.ExcludeImageIDs)
+	}
+	if expected := now.AddDate(0, 0, -7); !a.ExpirationDate.Equal(expected) {
+		t.Errorf("ERROR: NewAMIClient retention;\n\texpected: expiration %v\n\tgot: %v", expected, a.ExpirationDate)
+	}
+}
+
+func TestNewAMIClientInvalid(t *testing.T) {
+	prefix := WithNamePrefix("devimage")
+	tables := []struct {
+		name string
+		opts []Option
+	}{
+		{"no selection criteria", nil},
+		{"negative retention", []Option{prefix, WithRetention(-time.Hour)}},
+		{"zero concurrency", []Option{prefix, WithConcurrency(0)}},
+		{"negative usage check concurrency", []Option{prefix, WithUsageCheckConcurrency(-1)}},
+		{"negative min-retain", []Option{prefix, WithMinRetain(-1)}},
+		{"group by tag without min-retain", []Option{prefix, WithGroupByTagKey("service")}},
+		{"negative min-images-retained", []Option{prefix, WithMinImagesRetained(-1)}},
+		{"invert without a tag", []Option{prefix, WithInvert()}},
+		{"recheck without unused", []Option{prefix, WithRecheckUnused()}},
+		{"fleets without unused", []Option{prefix, WithCheckFleets()}},
+		{"image builder without unused", []Option{prefix, WithCheckImageBuilder(&mockImageBuilderClient{})}},
+		{"rules with a prefix", []Option{prefix, WithRules(Rule{TagKey: "Branch"})}},
+		{"rules with a suffix", []Option{WithNameSuffix("-debug"), WithRules(Rule{TagKey: "Branch"})}},
+	}
+
+	for _, table := range tables {
+		if _, err := NewAMIClient(&mockEC2Client{}, logger, table.opts...); err == nil {
+			t.Errorf("ERROR: NewAMIClient with %v;\n\texpected: error\n\tgot: nil", table.name)
+		}
+	}
+
+	if _, err := NewAMIClient(nil, logger, prefix); err == nil {
+		t.Errorf("ERROR: NewAMIClient without a client;\n\texpected: error\n\tgot: nil")
+	}
+	if _, err := NewAMIClient(&mockEC2Client{}, nil, prefix); err == nil {
+		t.Errorf("ERROR: NewAMIClient without a logger;\n\texpected: error\n\tgot: nil")
+	}
+	if _, err := NewAMIClient(&mockEC2Client{}, logger, WithSelectAll()); err != nil {
+		t.Errorf("ERROR: NewAMIClient with WithSelectAll;\n\texpected: no error\n\tgot: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package amiclean
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+const (
+	// PendingDeleteTagKey is the tag we put on snapshots that should be
+	// deleted in a later pass. Its value is the time, in RFC8601 format,
+	// after which the snapshot can go.
+	PendingDeleteTagKey = "pending-delete-after"
+)
+
+// MarkSnapshotsPending tags snapshots to be deleted once the
+// SnapshotGracePeriod has passed, rather than deleting them right away.
+// This gives AWS time to release any references to them left over from
+// the AMI we just deregistered.
+func (a *AMIClean) MarkSnapshotsPending(snapshotIDs []string) error {
+	if len(snapshotIDs) == 0 {
+		return nil
+	}
+
+	deleteAfter := a.now().Add(a.SnapshotGracePeriod).Format(RFC8601)
+	if !a.Delete {
+		for _, snapshotID := range snapshotIDs {
+			a.Logger.Info("would mark snapshot for later deletion",
+				zap.String("snapshot-id", snapshotID),
+				zap.String("delete-after", deleteAfter),
+			)
+		}
+		return nil
+	}
+
+	for _, snapshotID := range snapshotIDs {
+		a.Logger.Info("marking snapshot for later deletion",
+			zap.String("snapshot-id", snapshotID),
+			zap.String("delete-after", deleteAfter),
+		)
+	}
+	return a.timeCall("CreateTags", zap.Strings("snapshot-ids", snapshotIDs), func() error {
+		_, err := a.EC2Client.CreateTags(&ec2.CreateTagsInput{
+			Resources: aws.StringSlice(snapshotIDs),
+			Tags: []*ec2.Tag{
+				{Key: aws.String(PendingDeleteTagKey), Value: aws.String(deleteAfter)},
+			},
+		})
+		return err
+	})
+}
+
+// DeletePendingSnapshots finds the snapshots marked by
+// MarkSnapshotsPending whose grace period has passed and deletes them.
+// It returns the IDs of the snapshots it deleted (or would have, in dry
+// run mode). Like DeleteSnapshotList, it skips snapshots that are still
+// in use, and carries on past other failures, which come back in the
+// combined error along with the snapshots that were deleted.
+func (a *AMIClean) DeletePendingSnapshots() ([]string, error) {
+	now := a.now()
+	var expired []string
+
+	input := &ec2.DescribeSnapshotsInput{
+		OwnerIds: []*string{aws.String("self")},
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String(PendingDeleteTagKey)},
+			},
+		},
+	}
+	err := a.EC2Client.DescribeSnapshotsPages(input,
+		func(page *ec2.DescribeSnapshotsOutput, lastPage bool) bool {
+			for _, snapshot := range page.Snapshots {
+				if snapshot == nil || snapshot.SnapshotId == nil {
+					continue
+				}
+				for _, tag := range snapshot.Tags {
+					if aws.StringValue(tag.Key) != PendingDeleteTagKey {
+						continue
+					}
+					deleteAfter, err := time.Parse(RFC8601, aws.StringValue(tag.Value))
+					if err != nil {
+						// We don't know when this one is due, so
+						// leave it alone.
+						a.Logger.Warn("could not parse pending deletion time on snapshot",
+							zap.String("snapshot-id", *snapshot.SnapshotId),
+							zap.String("delete-after", aws.StringValue(tag.Value)),
+						)
+						continue
+					}
+					if deleteAfter.Before(now) {
+						expired = append(expired, *snapshot.SnapshotId)
+					}
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	if !a.Delete {
+		for _, snapshotID := range expired {
+			a.Logger.Info("would delete pending snapshot",
+				zap.String("snapshot-id", snapshotID),
+			)
+		}
+		return expired, nil
+	}
+
+	var deleted []string
+	var errs error
+	for _, snapshotID := range expired {
+		a.Logger.Info("deleting pending snapshot",
+			zap.String("snapshot-id", snapshotID),
+		)
+		err := a.timeCall("DeleteSnapshot", zap.String("snapshot-id", snapshotID), func() error {
+			_, err := a.EC2Client.DeleteSnapshot(&ec2.DeleteSnapshotInput{
+				SnapshotId: aws.String(snapshotID),
+			})
+			return err
+		})
+		switch {
+		case isSnapshotInUse(err):
+			// The tag stays, so a later run will try it again.
+			a.Logger.Info("pending snapshot still in use; skipping",
+				zap.String("snapshot-id", snapshotID),
+				zap.Error(err),
+			)
+		case err != nil:
+			a.Logger.Error("Failed to delete pending snapshot",
+				zap.String("snapshot-id", snapshotID),
+				zap.Error(err),
+			)
+			errs = multierr.Append(errs, err)
+		default:
+			deleted = append(deleted, snapshotID)
+		}
+	}
+
+	return deleted, errs
+}
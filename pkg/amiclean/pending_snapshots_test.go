@@ -0,0 +1,130 @@
+package amiclean
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/multierr"
+)
+
+func TestPurgeImageDeferred(t *testing.T) {
+	mock := &mockEC2Client{}
+	a := AMIClean{
+		Delete:              true,
+		SnapshotGracePeriod: 24 * time.Hour,
+		Logger:              logger,
+		EC2Client:           mock,
+	}
+
+	_, err := a.PurgeImage(newishDevImage)
+	if err != nil {
+		t.Fatalf("ERROR: PurgeImage returned error: %v", err)
+	}
+
+	// The image should be deregistered and its snapshots tagged, but
+	// none of them deleted yet.
+	expected := []string{
+		"DeregisterImage:ami-22222222222222222",
+		"CreateTags:snap-22222222222222222",
+		"CreateTags:snap-22222222222222223",
+	}
+	if !reflect.DeepEqual(mock.calls, expected) {
+		t.Errorf("ERROR: PurgeImage with grace period;\n\texpected: %v\n\tgot: %v", expected, mock.calls)
+	}
+	tag := mock.createTagsInputs[0].Tags[0]
+	if *tag.Key != PendingDeleteTagKey {
+		t.Errorf("ERROR: expected tag key %v, got %v", PendingDeleteTagKey, *tag.Key)
+	}
+	if _, err := time.Parse(RFC8601, *tag.Value); err != nil {
+		t.Errorf("ERROR: could not parse pending deletion time %v: %v", *tag.Value, err)
+	}
+}
+
+func TestDeletePendingSnapshots(t *testing.T) {
+	pendingTag := func(value string) []*ec2.Tag {
+		return []*ec2.Tag{{Key: aws.String(PendingDeleteTagKey), Value: aws.String(value)}}
+	}
+	mock := &mockEC2Client{
+		snapshotPages: [][]*ec2.Snapshot{
+			{
+				{SnapshotId: aws.String("snap-11111111111111111"), Tags: pendingTag("2019-03-01T00:00:00.000Z")},
+				{SnapshotId: aws.String("snap-22222222222222222"), Tags: pendingTag("2019-04-02T00:00:00.000Z")},
+			},
+			{
+				{SnapshotId: aws.String("snap-33333333333333333"), Tags: pendingTag("next tuesday")},
+				{SnapshotId: aws.String("snap-44444444444444444"), Tags: pendingTag("2019-03-02T00:00:00.000Z")},
+			},
+		},
+	}
+
+	tables := []struct {
+		delete bool
+		calls  []string
+	}{
+		{false, nil},
+		{true, []string{"DeleteSnapshot:snap-11111111111111111", "DeleteSnapshot:snap-44444444444444444"}},
+	}
+
+	for _, table := range tables {
+		mock.calls = nil
+		a := AMIClean{
+			Delete:    table.delete,
+			Now:       stoppedClock,
+			Logger:    logger,
+			EC2Client: mock,
+		}
+		deleted, err := a.DeletePendingSnapshots()
+		if err != nil {
+			t.Fatalf("ERROR: DeletePendingSnapshots returned error: %v", err)
+		}
+		expected := []string{"snap-11111111111111111", "snap-44444444444444444"}
+		if !reflect.DeepEqual(deleted, expected) {
+			t.Errorf("ERROR: DeletePendingSnapshots;\n\texpected: %v\n\tgot: %v", expected, deleted)
+		}
+		if !reflect.DeepEqual(mock.calls, table.calls) {
+			t.Errorf("ERROR: DeletePendingSnapshots with delete %v;\n\texpected calls: %v\n\tgot: %v",
+				table.delete,
+				table.calls,
+				mock.calls,
+			)
+		}
+	}
+}
+
+func TestDeletePendingSnapshotsFailures(t *testing.T) {
+	pendingTag := []*ec2.Tag{{Key: aws.String(PendingDeleteTagKey), Value: aws.String("2019-03-01T00:00:00.000Z")}}
+	mock := &mockEC2Client{
+		snapshotPages: [][]*ec2.Snapshot{
+			{
+				{SnapshotId: aws.String("snap-in-use"), Tags: pendingTag},
+				{SnapshotId: aws.String("snap-failed"), Tags: pendingTag},
+				{SnapshotId: aws.String("snap-1"), Tags: pendingTag},
+			},
+		},
+		deleteSnapshotErrors: map[string]error{
+			"snap-in-use": awserr.New("InvalidSnapshot.InUse", "in use by ami-9", nil),
+			"snap-failed": awserr.New("RequestLimitExceeded", "slow down", nil),
+		},
+	}
+	a := AMIClean{
+		Delete:    true,
+		Now:       stoppedClock,
+		Logger:    logger,
+		EC2Client: mock,
+	}
+
+	deleted, err := a.DeletePendingSnapshots()
+	// Only the other failure is an error, and neither one stops the
+	// rest.
+	if errs := multierr.Errors(err); len(errs) != 1 {
+		t.Errorf("ERROR: DeletePendingSnapshots errors;\n\texpected: 1\n\tgot: %v", errs)
+	}
+	expected := []string{"snap-1"}
+	if !reflect.DeepEqual(deleted, expected) {
+		t.Errorf("ERROR: DeletePendingSnapshots;\n\texpected: %v\n\tgot: %v", expected, deleted)
+	}
+}
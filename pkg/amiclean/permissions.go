@@ -0,0 +1,102 @@
+package amiclean
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"go.uber.org/zap"
+)
+
+// ErrPermissionDenied is returned by PurgeImage when, with
+// ContinueOnDenied, we weren't allowed to deregister the image. The
+// denial is recorded, and Run carries on with the other images.
+var ErrPermissionDenied = errors.New("permission denied")
+
+// DeniedAction is an API call that a dry run found we don't have
+// permission to make.
+type DeniedAction struct {
+	Action     string
+	ResourceID string
+}
+
+// checkPermission makes an API call that has DryRun set and works out
+// from the result whether the real call would have been allowed. AWS
+// reports a permitted dry run as a DryRunOperation error and a denied
+// one as UnauthorizedOperation; denials are recorded rather than
+// returned, so that we can report all of them at the end. Anything
+// else is a real error.
+func (a *AMIClean) checkPermission(action, resourceID string, call func() error) error {
+	err := a.timeCall(action, zap.String("resource-id", resourceID), call)
+	if err == nil {
+		return nil
+	}
+
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "DryRunOperation":
+			a.Logger.Debug("dry run permitted",
+				zap.String("action", action),
+				zap.String("resource-id", resourceID),
+			)
+			return nil
+		case "UnauthorizedOperation":
+			a.Logger.Warn("dry run denied",
+				zap.String("action", action),
+				zap.String("resource-id", resourceID),
+			)
+			a.addDenied(action, resourceID)
+			return nil
+		}
+	}
+	return err
+}
+
+// recordDenied returns true if, with ContinueOnDenied, err is AWS
+// refusing us permission for a real call, after recording it as a
+// denied action. Going on past the denial lets a single run turn up
+// every permission the role is missing.
+func (a *AMIClean) recordDenied(action, resourceID string, err error) bool {
+	if !a.ContinueOnDenied || !isAccessDenied(err) {
+		return false
+	}
+	a.Logger.Warn("permission denied; continuing",
+		zap.String("action", action),
+		zap.String("resource-id", resourceID),
+		zap.Error(err),
+	)
+	a.addDenied(action, resourceID)
+	return true
+}
+
+// isAccessDenied returns true if err is one of the ways AWS says we
+// aren't allowed to do something.
+func isAccessDenied(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "UnauthorizedOperation", "AccessDenied", "AccessDeniedException":
+			return true
+		}
+	}
+	return false
+}
+
+// addDenied records an action we weren't allowed to make.
+func (a *AMIClean) addDenied(action, resourceID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.deniedActions = append(a.deniedActions, DeniedAction{
+		Action:     action,
+		ResourceID: resourceID,
+	})
+}
+
+// DeniedActions returns the calls that were found to be denied, either
+// when validating permissions during a dry run or, with
+// ContinueOnDenied, during a real one.
+func (a *AMIClean) DeniedActions() []DeniedAction {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return append([]DeniedAction(nil), a.deniedActions...)
+}
@@ -0,0 +1,102 @@
+package amiclean
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestPurgeImageValidatePermissions(t *testing.T) {
+	tables := []struct {
+		dryRunDenied map[string]bool
+		denied       []DeniedAction
+	}{
+		{nil, nil},
+		{
+			map[string]bool{"DeleteSnapshot": true},
+			[]DeniedAction{
+				{"DeleteSnapshot", "snap-22222222222222222"},
+				{"DeleteSnapshot", "snap-22222222222222223"},
+			},
+		},
+		{
+			map[string]bool{"DeregisterImage": true, "DeleteSnapshot": true},
+			[]DeniedAction{
+				{"DeregisterImage", "ami-22222222222222222"},
+				{"DeleteSnapshot", "snap-22222222222222222"},
+				{"DeleteSnapshot", "snap-22222222222222223"},
+			},
+		},
+	}
+
+	for _, table := range tables {
+		mock := &mockEC2Client{dryRunDenied: table.dryRunDenied}
+		a := AMIClean{
+			ValidatePermissions: true,
+			Logger:              logger,
+			EC2Client:           mock,
+		}
+
+		_, err := a.PurgeImage(newishDevImage)
+		if err != nil {
+			t.Fatalf("ERROR: PurgeImage returned error: %v", err)
+		}
+		if len(mock.calls) != 3 {
+			t.Errorf("ERROR: expected 3 dry run calls, got %v", mock.calls)
+		}
+		if !reflect.DeepEqual(a.DeniedActions(), table.denied) {
+			t.Errorf("ERROR: DeniedActions with %v denied;\n\texpected: %v\n\tgot: %v", table.dryRunDenied, table.denied, a.DeniedActions())
+		}
+	}
+}
+
+func TestRunContinueOnDenied(t *testing.T) {
+	images := []*ec2.Image{newMasterImage, newishDevImage, oldDevImage}
+	tables := []struct {
+		continueOnDenied bool
+		purged           []string
+		denied           []DeniedAction
+	}{
+		// Normally, the first denial stops the run like any other error.
+		{false, []string{"ami-11111111111111111"}, nil},
+		{
+			true,
+			[]string{"ami-11111111111111111", "ami-33333333333333333"},
+			[]DeniedAction{
+				{"DeregisterImage", "ami-22222222222222222"},
+				{"DeleteSnapshot", "snap-33333333333333333"},
+			},
+		},
+	}
+
+	for _, table := range tables {
+		mock := &mockEC2Client{
+			deregisterErrors: map[string]error{
+				"ami-22222222222222222": awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil),
+			},
+			deleteSnapshotErrors: map[string]error{
+				"snap-33333333333333333": awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil),
+			},
+		}
+		a := AMIClean{
+			Delete:           true,
+			ContinueOnDenied: table.continueOnDenied,
+			Logger:           logger,
+			EC2Client:        mock,
+		}
+
+		results, err := a.Run(context.Background(), images)
+		if (err == nil) != table.continueOnDenied {
+			t.Errorf("ERROR: Run with ContinueOnDenied %v returned error %v", table.continueOnDenied, err)
+		}
+		if !reflect.DeepEqual(results.ImageIDs, table.purged) {
+			t.Errorf("ERROR: Run with ContinueOnDenied %v;\n\texpected: %v\n\tgot: %v", table.continueOnDenied, table.purged, results.ImageIDs)
+		}
+		if !reflect.DeepEqual(a.DeniedActions(), table.denied) {
+			t.Errorf("ERROR: DeniedActions with ContinueOnDenied %v;\n\texpected: %v\n\tgot: %v", table.continueOnDenied, table.denied, a.DeniedActions())
+		}
+	}
+}
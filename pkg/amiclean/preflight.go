@@ -0,0 +1,121 @@
+package amiclean
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+// The statuses a PreflightCheck can have.
+const (
+	PreflightAllowed = "allowed"
+	PreflightDenied  = "denied"
+	// PreflightError is for a call that failed some other way, so we
+	// can't tell whether it's permitted.
+	PreflightError = "error"
+)
+
+// When there's no candidate to try the calls against, we use IDs that
+// can't exist. AWS usually checks permissions first, but may report
+// these as not found instead, which comes out as a PreflightError.
+const (
+	preflightImageID    = "ami-00000000000000000"
+	preflightSnapshotID = "snap-00000000000000000"
+)
+
+// PreflightCheck is whether one of the calls a run needs is permitted.
+type PreflightCheck struct {
+	Action     string
+	ResourceID string
+	Status     string
+	Err        error
+}
+
+// Preflight checks that we're allowed to make each of the calls a run
+// needs, without changing anything. The image list is fetched for real;
+// DeregisterImage, DeleteSnapshot and CreateTags are made with DryRun
+// set, against the first image that would be purged, or IDs that can't
+// exist if there isn't one. Unlike ValidatePermissions, every check is
+// returned, whatever its status.
+func (a *AMIClean) Preflight() []PreflightCheck {
+	imageID, snapshotID := preflightImageID, preflightSnapshotID
+
+	output, err := a.GetImages()
+	checks := []PreflightCheck{
+		preflightCheck("DescribeImages", strings.Join(a.owners(), ","), err),
+	}
+	if err == nil {
+		for _, image := range output.Images {
+			if !a.CheckImage(image) {
+				continue
+			}
+			imageID = aws.StringValue(image.ImageId)
+			if snapshotIDs := ImageSnapshotIDs(image); len(snapshotIDs) > 0 {
+				snapshotID = snapshotIDs[0]
+			}
+			break
+		}
+	}
+
+	err = a.timeCall("DeregisterImage", zap.String("ami-id", imageID), func() error {
+		_, err := a.EC2Client.DeregisterImage(&ec2.DeregisterImageInput{
+			ImageId: aws.String(imageID),
+			DryRun:  aws.Bool(true),
+		})
+		return err
+	})
+	checks = append(checks, preflightCheck("DeregisterImage", imageID, err))
+
+	err = a.timeCall("DeleteSnapshot", zap.String("snapshot-id", snapshotID), func() error {
+		_, err := a.EC2Client.DeleteSnapshot(&ec2.DeleteSnapshotInput{
+			SnapshotId: aws.String(snapshotID),
+			DryRun:     aws.Bool(true),
+		})
+		return err
+	})
+	checks = append(checks, preflightCheck("DeleteSnapshot", snapshotID, err))
+
+	err = a.timeCall("CreateTags", zap.String("ami-id", imageID), func() error {
+		_, err := a.EC2Client.CreateTags(&ec2.CreateTagsInput{
+			Resources: aws.StringSlice([]string{imageID}),
+			Tags: []*ec2.Tag{
+				{Key: aws.String(PurgedByTagKey), Value: aws.String(PurgedByTagValue)},
+			},
+			DryRun: aws.Bool(true),
+		})
+		return err
+	})
+	checks = append(checks, preflightCheck("CreateTags", imageID, err))
+
+	for _, check := range checks {
+		a.Logger.Info("preflight check",
+			zap.String("action", check.Action),
+			zap.String("resource-id", check.ResourceID),
+			zap.String("status", check.Status),
+			zap.Error(check.Err),
+		)
+	}
+	return checks
+}
+
+// preflightCheck works out from a call's result whether it's permitted.
+// A DryRun call that would have succeeded comes back as a
+// DryRunOperation error, and a real call that did succeed has no error.
+func preflightCheck(action, resourceID string, err error) PreflightCheck {
+	check := PreflightCheck{Action: action, ResourceID: resourceID, Err: err}
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "DryRunOperation" {
+		check.Err = nil
+	}
+	switch {
+	case check.Err == nil:
+		check.Status = PreflightAllowed
+	case isAccessDenied(err):
+		check.Status = PreflightDenied
+	default:
+		check.Status = PreflightError
+	}
+	return check
+}
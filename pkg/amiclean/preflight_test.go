@@ -0,0 +1,86 @@
+package amiclean
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestPreflightCheckStatus(t *testing.T) {
+	tables := []struct {
+		err      error
+		expected string
+	}{
+		{nil, PreflightAllowed},
+		{awserr.New("DryRunOperation", "Request would have succeeded, but DryRun flag is set.", nil), PreflightAllowed},
+		{awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil), PreflightDenied},
+		{awserr.New("AccessDenied", "Access Denied", nil), PreflightDenied},
+		{awserr.New("AccessDeniedException", "Access Denied", nil), PreflightDenied},
+		{awserr.New("InvalidAMIID.NotFound", "The image id does not exist", nil), PreflightError},
+		{errors.New("connection reset"), PreflightError},
+	}
+
+	for _, table := range tables {
+		check := preflightCheck("DeregisterImage", "ami-1", table.err)
+		if check.Status != table.expected {
+			t.Errorf("ERROR: preflight status for %v;\n\texpected: %v\n\tgot: %v", table.err, table.expected, check.Status)
+		}
+		if (check.Status == PreflightAllowed) != (check.Err == nil) {
+			t.Errorf("ERROR: preflight check for %v kept error %v with status %v", table.err, check.Err, check.Status)
+		}
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	statuses := func(checks []PreflightCheck) map[string]string {
+		got := make(map[string]string)
+		for _, check := range checks {
+			got[check.Action+":"+check.ResourceID] = check.Status
+		}
+		return got
+	}
+
+	// The calls are tried against the first image we'd purge.
+	mock := &mockEC2Client{
+		dryRunDenied: map[string]bool{"DeleteSnapshot": true},
+	}
+	a := AMIClean{
+		NamePrefix:     "devimage",
+		ExpirationDate: now.AddDate(0, 0, -30),
+		Now:            stoppedClock,
+		Logger:         logger,
+		EC2Client:      mock,
+	}
+	expected := map[string]string{
+		"DescribeImages:self":                   PreflightAllowed,
+		"DeregisterImage:ami-33333333333333333": PreflightAllowed,
+		"DeleteSnapshot:snap-33333333333333333": PreflightDenied,
+		"CreateTags:ami-33333333333333333":      PreflightAllowed,
+	}
+	if got := statuses(a.Preflight()); !reflect.DeepEqual(got, expected) {
+		t.Errorf("ERROR: Preflight;\n\texpected: %v\n\tgot: %v", expected, got)
+	}
+	for _, call := range mock.calls {
+		if call != "DeregisterImage:ami-33333333333333333" && call != "DeleteSnapshot:snap-33333333333333333" &&
+			call != "CreateTags:ami-33333333333333333" {
+			t.Errorf("ERROR: Preflight made an unexpected call: %v", call)
+		}
+	}
+
+	// Without a candidate, we fall back to IDs that can't exist.
+	mock = &mockEC2Client{
+		describeImagesErr: awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil),
+	}
+	a.EC2Client = mock
+	expected = map[string]string{
+		"DescribeImages:self":                   PreflightDenied,
+		"DeregisterImage:" + preflightImageID:   PreflightAllowed,
+		"DeleteSnapshot:" + preflightSnapshotID: PreflightAllowed,
+		"CreateTags:" + preflightImageID:        PreflightAllowed,
+	}
+	if got := statuses(a.Preflight()); !reflect.DeepEqual(got, expected) {
+		t.Errorf("ERROR: Preflight without images;\n\texpected: %v\n\tgot: %v", expected, got)
+	}
+}
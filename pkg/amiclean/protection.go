@@ -0,0 +1,44 @@
+package amiclean
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+// ErrDeregistrationProtected is returned by PurgeImage for an image with
+// deregistration protection turned on. Protection is how an account
+// marks images nobody should remove, so the image is left alone and Run
+// counts it apart from the failures.
+var ErrDeregistrationProtected = errors.New("image has deregistration protection")
+
+// hasDeregistrationProtection returns true if an image says it's
+// protected. AWS reports protection as "enabled", with or without a
+// cooldown, or "disabled".
+func hasDeregistrationProtection(image *ec2.Image) bool {
+	return strings.HasPrefix(aws.StringValue(image.DeregistrationProtection), "enabled")
+}
+
+// isDeregistrationProtected returns true if err is AWS refusing to
+// deregister an image because it's protected, for when protection was
+// turned on after we listed the images.
+func isDeregistrationProtected(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok || aerr.Code() != "OperationNotPermitted" {
+		return false
+	}
+	return strings.Contains(strings.ToLower(aerr.Message()), "deregistration protection")
+}
+
+// skipProtected logs that we're leaving a protected image alone.
+func (a *AMIClean) skipProtected(image *ec2.Image, reason string) {
+	a.Logger.Warn("skipping ami with deregistration protection",
+		zap.String("ami-id", aws.StringValue(image.ImageId)),
+		zap.String("deregistration-protection", aws.StringValue(image.DeregistrationProtection)),
+		zap.String("reason", reason),
+	)
+}
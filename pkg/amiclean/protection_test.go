@@ -0,0 +1,75 @@
+package amiclean
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestRunDeregistrationProtection(t *testing.T) {
+	// One image says it's protected, and the other only turns out to
+	// be when we try to deregister it.
+	protected := batchTestImage("ami-protected", "snap-protected")
+	protected.DeregistrationProtection = aws.String("enabled-with-cooldown")
+	late := batchTestImage("ami-late", "snap-late")
+	plain := batchTestImage("ami-plain", "snap-plain")
+	plain.DeregistrationProtection = aws.String("disabled")
+
+	mock := &mockEC2Client{
+		deregisterErrors: map[string]error{
+			"ami-late": awserr.New("OperationNotPermitted",
+				"Deregistration protection is enabled for this AMI. Disable deregistration protection and try again.", nil),
+		},
+	}
+	a := AMIClean{
+		Delete:          true,
+		TagBeforeDelete: true,
+		Logger:          logger,
+		EC2Client:       mock,
+	}
+
+	results, err := a.Run(context.Background(), []*ec2.Image{protected, late, plain})
+	if err != nil {
+		t.Fatalf("ERROR: Run returned error: %v", err)
+	}
+
+	expected := Results{
+		ImageIDs:          []string{"ami-plain"},
+		SnapshotIDs:       []string{"snap-plain"},
+		ProtectedImageIDs: []string{"ami-protected", "ami-late"},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("ERROR: Run with protected images;\n\texpected: %+v\n\tgot: %+v", expected, results)
+	}
+	// The image we knew about up front isn't touched at all.
+	for _, call := range mock.calls {
+		if call == "CreateTags:ami-protected" || call == "DeregisterImage:ami-protected" {
+			t.Errorf("ERROR: Run made %v on a protected image", call)
+		}
+		if call == "DeleteSnapshot:snap-late" {
+			t.Errorf("ERROR: Run deleted the snapshot of an image it couldn't deregister")
+		}
+	}
+}
+
+func TestIsDeregistrationProtected(t *testing.T) {
+	tables := []struct {
+		err      error
+		expected bool
+	}{
+		{awserr.New("OperationNotPermitted", "Deregistration protection is enabled for this AMI.", nil), true},
+		{awserr.New("OperationNotPermitted", "The AMI is in use.", nil), false},
+		{awserr.New("InvalidAMIID.Unavailable", "Deregistration protection is enabled for this AMI.", nil), false},
+		{awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil), false},
+	}
+
+	for _, table := range tables {
+		if got := isDeregistrationProtected(table.err); got != table.expected {
+			t.Errorf("ERROR: isDeregistrationProtected(%v);\n\texpected: %v\n\tgot: %v", table.err, table.expected, got)
+		}
+	}
+}
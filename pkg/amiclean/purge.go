@@ -0,0 +1,205 @@
+package amiclean
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// Run purges the given images, working on up to Concurrency of them at
+// once, and returns what it purged. Normally we stop handing out images
+// at the first failure; with ContinueOnError, we log it and carry on
+// with the rest, returning all of the failures combined at the end. If
+// ctx is cancelled, the images already being worked on are finished and
+// the rest are left alone; the caller can check ctx.Err() to tell that
+// apart from running out of images.
+//
+// With BatchSnapshots, every image is deregistered before any snapshot
+// is deleted, and a snapshot is only deleted if no remaining image uses
+// it. That way a snapshot shared between images in the batch doesn't
+// fail with InvalidSnapshot.InUse because of the order they came in.
+func (a *AMIClean) Run(ctx context.Context, images []*ec2.Image) (Results, error) {
+	concurrency := a.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	// Stopping after a failure shouldn't look like the caller cancelled
+	// us, so we use our own context for it.
+	runCtx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	// A dry run would otherwise count every candidate snapshot as
+	// deleted, including ones other images use. BatchSnapshots already
+	// leaves those alone.
+	if !a.Delete && !a.BatchSnapshots && a.dryRunReferences == nil {
+		a.findDryRunReferences(images)
+	}
+
+	var collector ResultCollector
+	var mu sync.Mutex
+	var errs error
+	attempted := 0
+
+	work := make(chan *ec2.Image)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for image := range work {
+				// We only check between images, so that we never
+				// leave one deregistered with its snapshots still
+				// around.
+				if runCtx.Err() != nil {
+					continue
+				}
+				mu.Lock()
+				attempted++
+				mu.Unlock()
+
+				err := a.purgeOne(image, &collector)
+				if err != nil {
+					mu.Lock()
+					errs = multierr.Append(errs, err)
+					mu.Unlock()
+					if !a.ContinueOnError {
+						stop()
+					}
+				}
+			}
+		}()
+	}
+
+	for _, image := range images {
+		if runCtx.Err() != nil {
+			break
+		}
+		work <- image
+	}
+	close(work)
+	wg.Wait()
+
+	if ctx.Err() != nil && attempted < len(images) {
+		a.Logger.Warn("stopped before purging the remaining images",
+			zap.Int("remaining", len(images)-attempted),
+			zap.Error(ctx.Err()),
+		)
+	}
+
+	results := collector.Snapshot()
+	// Even if we stopped early, the images we did deregister shouldn't
+	// leave their snapshots behind.
+	if a.BatchSnapshots && a.SnapshotGracePeriod == 0 && !a.RetainSnapshots {
+		deleted, err := a.deleteBatchSnapshots(results)
+		errs = multierr.Append(errs, err)
+		results.SnapshotIDs = deleted
+	}
+
+	return results, errs
+}
+
+// purgeOne purges a single image for Run, logging how it went and
+// adding it to the collector if it worked.
+func (a *AMIClean) purgeOne(image *ec2.Image, collector *ResultCollector) error {
+	retVal, err := a.PurgeImage(image)
+	// A near miss isn't a failure; the image just isn't purged. Nor is
+	// an image we don't know how to purge.
+	if err == ErrImageInUse || err == ErrNotEBSBacked {
+		a.report(image, ReportActionSkipped, nil)
+		return nil
+	}
+	// Neither is a denial we've been told to carry on past; it's
+	// reported with the other denied actions.
+	if err == ErrPermissionDenied {
+		a.report(image, ReportActionDenied, err)
+		return nil
+	}
+	if err == ErrDeregistrationProtected {
+		collector.AddProtected(*image.ImageId)
+		a.report(image, ReportActionProtected, nil)
+		return nil
+	}
+	if err != nil {
+		a.Logger.Error("Failed to purge image",
+			zap.String("ami-id", *image.ImageId),
+			zap.String("failure", retVal),
+			zap.Error(err),
+		)
+		err = &ImageError{ImageID: *image.ImageId, Failure: retVal, Err: err}
+		a.report(image, ReportActionFailed, err)
+		return err
+	}
+
+	// No error, so log success (based on whether we're in delete mode
+	// or not).
+	if a.Delete {
+		a.Logger.Info("Successfully purged image",
+			zap.String("ami-id", retVal),
+		)
+	} else {
+		a.Logger.Info("Would have purged image",
+			zap.String("ami-id", retVal),
+		)
+	}
+	collector.Add(*image.ImageId, a.deletableSnapshots(image))
+	switch {
+	case a.RetainSnapshots && a.Delete:
+		a.report(image, ReportActionDeregistered, nil)
+	case a.RetainSnapshots:
+		a.report(image, ReportActionWouldDeregister, nil)
+	case a.Delete:
+		a.report(image, ReportActionPurged, nil)
+	default:
+		a.report(image, ReportActionWouldPurge, nil)
+	}
+	return nil
+}
+
+// ReportKeptByOperator records in the report that each of the images was
+// kept by whoever reviewed the candidates, for callers that let someone
+// pick which to purge before calling Run with the rest.
+func (a *AMIClean) ReportKeptByOperator(images []*ec2.Image) {
+	for _, image := range images {
+		a.report(image, ReportActionKeptByOperator, nil)
+	}
+}
+
+// report sends what happened to an image to the ReportWriter, if we have
+// one. A report we can't write shouldn't stop the purge, so we only warn
+// about it.
+func (a *AMIClean) report(image *ec2.Image, action string, purgeErr error) {
+	if a.Report == nil {
+		return
+	}
+	r := ImageReport{
+		ImageID: aws.StringValue(image.ImageId),
+		Name:    aws.StringValue(image.Name),
+		Action:  action,
+	}
+	if action != ReportActionSkipped && action != ReportActionDenied && action != ReportActionProtected && action != ReportActionKeptByOperator {
+		r.SnapshotIDs = a.deletableSnapshots(image)
+		if a.snapshotSizes != nil {
+			for _, snapshotID := range r.SnapshotIDs {
+				r.SnapshotGiB += a.snapshotSizes[snapshotID]
+			}
+			r.EstimatedMonthlySavings = float64(r.SnapshotGiB) * a.SnapshotCost
+		}
+	}
+	if purgeErr != nil {
+		r.Error = purgeErr.Error()
+	}
+	if a.ReportGroupTagKey != "" {
+		r.Group = a.imageGroup(image)
+	}
+	if err := a.Report.Write(r); err != nil {
+		a.Logger.Warn("unable to write report",
+			zap.String("ami-id", r.ImageID),
+			zap.Error(err),
+		)
+	}
+}
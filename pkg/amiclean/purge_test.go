@@ -0,0 +1,146 @@
+package amiclean
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/multierr"
+)
+
+func TestRun(t *testing.T) {
+	images := []*ec2.Image{newMasterImage, newishDevImage, oldDevImage}
+	tables := []struct {
+		continueOnError bool
+		purged          []string
+		deregistered    int
+	}{
+		// By default, we stop at the failure.
+		{false, []string{"ami-11111111111111111"}, 1},
+		// Otherwise, the images on either side still get purged.
+		{true, []string{"ami-11111111111111111", "ami-33333333333333333"}, 2},
+	}
+
+	for _, table := range tables {
+		mock := &mockEC2Client{
+			deregisterErrors: map[string]error{
+				*newishDevImage.ImageId: errors.New("UnauthorizedOperation"),
+			},
+		}
+		a := AMIClean{
+			Delete:          true,
+			ContinueOnError: table.continueOnError,
+			Logger:          logger,
+			EC2Client:       mock,
+		}
+
+		results, err := a.Run(context.Background(), images)
+		if !reflect.DeepEqual(results.ImageIDs, table.purged) {
+			t.Errorf("ERROR: Run with ContinueOnError %v;\n\texpected: %v\n\tgot: %v", table.continueOnError, table.purged, results.ImageIDs)
+		}
+		if errs := multierr.Errors(err); len(errs) != 1 {
+			t.Errorf("ERROR: Run with ContinueOnError %v: expected 1 error, got %v", table.continueOnError, errs)
+		}
+		deregistered := 0
+		for _, call := range mock.calls {
+			if call == "DeregisterImage:"+*newMasterImage.ImageId || call == "DeregisterImage:"+*oldDevImage.ImageId {
+				deregistered++
+			}
+		}
+		if deregistered != table.deregistered {
+			t.Errorf("ERROR: Run with ContinueOnError %v: expected %v images deregistered, got %v", table.continueOnError, table.deregistered, deregistered)
+		}
+	}
+}
+
+func TestRunConcurrent(t *testing.T) {
+	mock := &mockEC2Client{}
+	a := AMIClean{
+		Delete:      true,
+		Concurrency: 3,
+		Logger:      logger,
+		EC2Client:   mock,
+	}
+
+	results, err := a.Run(context.Background(), testImages)
+	if err != nil {
+		t.Fatalf("ERROR: Run returned error: %v", err)
+	}
+
+	// The workers finish in whatever order they like.
+	sort.Strings(results.ImageIDs)
+	sort.Strings(results.SnapshotIDs)
+	expected := Results{
+		ImageIDs: []string{
+			"ami-11111111111111111",
+			"ami-22222222222222222",
+			"ami-33333333333333333",
+		},
+		SnapshotIDs: []string{
+			"snap-11111111111111111",
+			"snap-22222222222222222",
+			"snap-22222222222222223",
+			"snap-33333333333333333",
+		},
+	}
+	// noEbsImage is skipped, so it isn't counted as purged.
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("ERROR: Run with Concurrency 3;\n\texpected: %v\n\tgot: %v", expected, results)
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	mock := &mockEC2Client{}
+	a := AMIClean{
+		Delete:    true,
+		Logger:    logger,
+		EC2Client: mock,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err := a.Run(ctx, testImages)
+	if len(results.ImageIDs) != 0 || err != nil {
+		t.Errorf("ERROR: Run with a cancelled context: expected nothing purged and no error, got %v, %v", results.ImageIDs, err)
+	}
+	if len(mock.calls) != 0 {
+		t.Errorf("ERROR: Run with a cancelled context made API calls: %v", mock.calls)
+	}
+}
+
+func TestRunSharedSnapshots(t *testing.T) {
+	first := batchTestImage("ami-shared1", "snap-shared", "snap-first")
+	second := batchTestImage("ami-shared2", "snap-shared")
+
+	for _, concurrency := range []int{1, 2} {
+		mock := &mockEC2Client{}
+		a := AMIClean{
+			Delete:      true,
+			Concurrency: concurrency,
+			Logger:      logger,
+			EC2Client:   mock,
+		}
+		results, err := a.Run(context.Background(), []*ec2.Image{first, second})
+		if err != nil {
+			t.Fatalf("ERROR: Run returned error: %v", err)
+		}
+
+		deletes := 0
+		for _, call := range mock.calls {
+			if call == "DeleteSnapshot:snap-shared" {
+				deletes++
+			}
+		}
+		if deletes != 1 {
+			t.Errorf("ERROR: Run with concurrency %v: expected 1 delete of the shared snapshot, got %v in %v", concurrency, deletes, mock.calls)
+		}
+		sort.Strings(results.SnapshotIDs)
+		expected := []string{"snap-first", "snap-shared"}
+		if !reflect.DeepEqual(results.SnapshotIDs, expected) {
+			t.Errorf("ERROR: Run with concurrency %v;\n\texpected snapshots: %v\n\tgot: %v", concurrency, expected, results.SnapshotIDs)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package amiclean
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// RateLimiter spaces out the AWS API calls made through it, so that
+// there are at most a given number a second. EC2's request quotas are
+// per account per Region, so everything calling one account in one
+// region, such as the workers purging it, should share a RateLimiter to
+// keep their calls under the quota together.
+type RateLimiter struct {
+	interval time.Duration
+
+	// mu guards next, the earliest time the next call may go out.
+	mu   sync.Mutex
+	next time.Time
+}
+
+// NewRateLimiter allows perSecond calls a second. With perSecond zero
+// or less, there's no limit, and we return nil, which never waits.
+func NewRateLimiter(perSecond float64) *RateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &RateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// Wait blocks until it's our turn to make a call. Calls are let through
+// one interval apart, in the order they asked, with no bursts.
+func (r *RateLimiter) Wait() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	slot := r.next
+	r.next = slot.Add(r.interval)
+	r.mu.Unlock()
+
+	time.Sleep(time.Until(slot))
+}
+
+// rateLimiterHandlerName names the handler Attach adds.
+const rateLimiterHandlerName = "amiclean.RateLimiter"
+
+// Attach makes every request sent with handlers wait its turn first.
+// That covers each page of a paginated call, each retry and each check
+// a waiter makes, as well as anything else a client sends. Attaching it
+// to a session's handlers limits every client made from the session.
+func (r *RateLimiter) Attach(handlers *request.Handlers) {
+	if r == nil {
+		return
+	}
+	handlers.Send.PushFrontNamed(request.NamedHandler{
+		Name: rateLimiterHandlerName,
+		Fn:   func(*request.Request) { r.Wait() },
+	})
+}
+
+// RateLimiters hands out a RateLimiter for each service, account and
+// region, all allowing the same number of calls a second, so that a run
+// cleaning several accounts or regions at once keeps each one under its
+// own quota without slowing the others down. Each service has quotas of
+// its own as well, so calls to CloudTrail, say, don't hold up EC2's.
+type RateLimiters struct {
+	perSecond float64
+
+	mu       sync.Mutex
+	limiters map[string]*RateLimiter
+}
+
+// NewRateLimiters allows perSecond calls a second for each service,
+// account and region. With perSecond zero or less, there's no limit, and we return
+// nil, which only hands out nil RateLimiters.
+func NewRateLimiters(perSecond float64) *RateLimiters {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &RateLimiters{perSecond: perSecond, limiters: map[string]*RateLimiter{}}
+}
+
+// For returns the RateLimiter for service (such as ec2.ServiceName) in
+// account and region, making it the first time it's asked for. account
+// only has to tell accounts apart, so a role ARN or profile name does as
+// well as an account ID.
+func (r *RateLimiters) For(service, account, region string) *RateLimiter {
+	if r == nil {
+		return nil
+	}
+	key := service + "/" + account + "/" + region
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	limiter, ok := r.limiters[key]
+	if !ok {
+		limiter = NewRateLimiter(r.perSecond)
+		r.limiters[key] = limiter
+	}
+	return limiter
+}
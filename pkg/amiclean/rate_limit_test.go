@@ -0,0 +1,180 @@
+package amiclean
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestNewRateLimiter(t *testing.T) {
+	tables := []struct {
+		perSecond float64
+		interval  time.Duration
+	}{
+		{0, 0},
+		{-1, 0},
+		{10, 100 * time.Millisecond},
+		{0.5, 2 * time.Second},
+	}
+
+	for _, table := range tables {
+		limiter := NewRateLimiter(table.perSecond)
+		var interval time.Duration
+		if limiter != nil {
+			interval = limiter.interval
+		}
+		if interval != table.interval {
+			t.Errorf("ERROR: NewRateLimiter(%v) interval;\n\texpected: %v\n\tgot: %v",
+				table.perSecond, table.interval, interval)
+		}
+	}
+	// No limit has to be safe to wait on.
+	NewRateLimiter(0).Wait()
+}
+
+func TestRateLimiterAttach(t *testing.T) {
+	// Every request the server gets counts, pages included: the first
+	// DescribeInstances call has two more pages after it.
+	var mu sync.Mutex
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		r.ParseForm()
+		switch r.Form.Get("Action") {
+		case "DescribeInstances":
+			next := map[string]string{"": "page-2", "page-2": "page-3"}[r.Form.Get("NextToken")]
+			fmt.Fprintf(w, "<DescribeInstancesResponse><reservationSet/><nextToken>%v</nextToken></DescribeInstancesResponse>", next)
+		default:
+			fmt.Fprint(w, "<DescribeImagesResponse><imagesSet/></DescribeImagesResponse>")
+		}
+	}))
+	defer server.Close()
+
+	const perSecond = 40
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+	NewRateLimiter(perSecond).Attach(&sess.Handlers)
+	client := ec2.New(sess)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.DescribeImages(&ec2.DescribeImagesInput{}); err != nil {
+				t.Errorf("ERROR: DescribeImages returned error: %v", err)
+			}
+		}()
+	}
+	err := client.DescribeInstancesPages(&ec2.DescribeInstancesInput{},
+		func(page *ec2.DescribeInstancesOutput, lastPage bool) bool { return true })
+	if err != nil {
+		t.Errorf("ERROR: DescribeInstancesPages returned error: %v", err)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 7 {
+		t.Fatalf("ERROR: requests;\n\texpected: 7\n\tgot: %v", requests)
+	}
+	// The requests are let through one interval apart, so they can't
+	// all have finished any sooner than this.
+	minimum := time.Duration(requests-1) * time.Second / perSecond
+	if elapsed < minimum {
+		t.Errorf("ERROR: %v requests at %v a second;\n\texpected: at least %v\n\tgot: %v",
+			requests, perSecond, minimum, elapsed)
+	}
+
+	// No limit has to be safe to attach.
+	var limiter *RateLimiter
+	limiter.Attach(&sess.Handlers)
+}
+
+func TestRateLimiters(t *testing.T) {
+	limiters := NewRateLimiters(10)
+	limiter := limiters.For("ec2", "111111111111", "us-east-1")
+	if limiter == nil || limiter.interval != 100*time.Millisecond {
+		t.Fatalf("ERROR: RateLimiters.For;\n\texpected: a limiter at 10 a second\n\tgot: %+v", limiter)
+	}
+	if limiters.For("ec2", "111111111111", "us-east-1") != limiter {
+		t.Errorf("ERROR: RateLimiters.For gave the same service, account and region two limiters")
+	}
+	// Quotas are per service per account per Region, so each gets its
+	// own.
+	if limiters.For("ec2", "111111111111", "us-west-2") == limiter || limiters.For("ec2", "222222222222", "us-east-1") == limiter {
+		t.Errorf("ERROR: RateLimiters.For shared a limiter between accounts or regions")
+	}
+	if limiters.For("cloudtrail", "111111111111", "us-east-1") == limiter {
+		t.Errorf("ERROR: RateLimiters.For shared a limiter between services")
+	}
+
+	if NewRateLimiters(0).For("ec2", "111111111111", "us-east-1") != nil {
+		t.Errorf("ERROR: RateLimiters with no limit handed out a limiter")
+	}
+}
+
+func TestRateLimitersRegions(t *testing.T) {
+	// At 5 a second, 3 calls in one region take at least 400ms. One
+	// region's calls have to go out without waiting on the other's, so
+	// 3 calls in each of two regions at once should take no longer,
+	// where sharing a limiter would take a second.
+	const perSecond = 5
+	const calls = 3
+	limiters := NewRateLimiters(perSecond)
+	regions := []string{"us-east-1", "us-west-2"}
+
+	// Each call records how long after the start it was let through.
+	var mu sync.Mutex
+	slots := map[string][]time.Duration{}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, region := range regions {
+		limiter := limiters.For("ec2", "111111111111", region)
+		for i := 0; i < calls; i++ {
+			wg.Add(1)
+			go func(region string) {
+				defer wg.Done()
+				limiter.Wait()
+				mu.Lock()
+				slots[region] = append(slots[region], time.Since(start))
+				mu.Unlock()
+			}(region)
+		}
+	}
+	wg.Wait()
+
+	interval := time.Second / perSecond
+	for _, region := range regions {
+		// Within a region the calls are still spaced out, so the last
+		// one waits for two intervals, but no longer than that.
+		var last time.Duration
+		for _, slot := range slots[region] {
+			if slot > last {
+				last = slot
+			}
+		}
+		minimum := time.Duration(calls-1) * interval
+		maximum := time.Duration(calls) * interval
+		if last < minimum || last >= maximum {
+			t.Errorf("ERROR: last call in %v;\n\texpected: between %v and %v\n\tgot: %v",
+				region, minimum, maximum, last)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package amiclean
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// The actions an ImageReport can record.
+const (
+	ReportActionPurged     = "purged"
+	ReportActionWouldPurge = "would-purge"
+	// With RetainSnapshots, images are only deregistered.
+	ReportActionDeregistered    = "deregistered"
+	ReportActionWouldDeregister = "would-deregister"
+	ReportActionSkipped         = "skipped"
+	ReportActionFailed          = "failed"
+	ReportActionDenied          = "denied"
+	ReportActionProtected       = "protected"
+	// Images someone chose to keep when asked about each one.
+	ReportActionKeptByOperator = "kept-by-operator"
+)
+
+// ImageReport records what happened to one image during a run.
+type ImageReport struct {
+	ImageID     string   `json:"ami-id"`
+	Name        string   `json:"ami-name"`
+	Action      string   `json:"action"`
+	SnapshotIDs []string `json:"snapshot-ids,omitempty"`
+	// SnapshotGiB and EstimatedMonthlySavings are only filled in when
+	// EstimatePurgeSavings has been run.
+	SnapshotGiB             int64   `json:"snapshot-gib,omitempty"`
+	EstimatedMonthlySavings float64 `json:"estimated-monthly-savings,omitempty"`
+	Error                   string  `json:"error,omitempty"`
+	// Group is the image's value for the ReportGroupTagKey tag, if
+	// there is one.
+	Group string `json:"group,omitempty"`
+}
+
+// ReportWriter receives an ImageReport for each image Run processes.
+// Run may call Write from several goroutines at once. Close is called by
+// whoever made the writer, once the run is over.
+type ReportWriter interface {
+	Write(report ImageReport) error
+	Close() error
+}
+
+// jsonReportWriter holds every report until Close, then writes them out
+// as a single JSON array.
+type jsonReportWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	reports []ImageReport
+}
+
+// NewJSONReportWriter returns a ReportWriter that writes all of the
+// reports to w as one JSON array when it's closed.
+func NewJSONReportWriter(w io.Writer) ReportWriter {
+	return &jsonReportWriter{w: w, reports: []ImageReport{}}
+}
+
+func (j *jsonReportWriter) Write(report ImageReport) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.reports = append(j.reports, report)
+	return nil
+}
+
+func (j *jsonReportWriter) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return json.NewEncoder(j.w).Encode(j.reports)
+}
+
+// jsonLinesReportWriter writes each report as soon as it gets it.
+type jsonLinesReportWriter struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewJSONLinesReportWriter returns a ReportWriter that writes each report
+// to w as a line of JSON as soon as it arrives, so that a long run can be
+// followed as it goes. Nothing is buffered, so there's nothing to do on
+// Close.
+func NewJSONLinesReportWriter(w io.Writer) ReportWriter {
+	return &jsonLinesReportWriter{encoder: json.NewEncoder(w)}
+}
+
+func (j *jsonLinesReportWriter) Write(report ImageReport) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.encoder.Encode(report)
+}
+
+func (j *jsonLinesReportWriter) Close() error {
+	return nil
+}
+
+// ReadReport reads back a report written by either of our ReportWriters:
+// a single JSON array, or a line of JSON for each image.
+func ReadReport(r io.Reader) ([]ImageReport, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// The array starts with a bracket; anything else is JSON lines.
+	var reports []ImageReport
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		if err := json.Unmarshal(data, &reports); err != nil {
+			return nil, err
+		}
+		return reports, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for decoder.More() {
+		var report ImageReport
+		if err := decoder.Decode(&report); err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// ReportDiff is how this run's purge candidates differ from the images
+// in a previous run's report.
+type ReportDiff struct {
+	// New are candidates now that weren't in the previous report.
+	New []string
+	// Gone were in the previous report and no longer exist.
+	Gone []string
+	// Protected were in the previous report and still exist, but
+	// aren't candidates any more.
+	Protected []string
+}
+
+// DiffReport compares the images in a previous run's report against the
+// IDs of the images scanned this run and the candidates among them. It
+// only needs what we already have, so it makes no AWS calls. Each list is
+// sorted so the output is stable.
+func DiffReport(previous []ImageReport, scanned, candidates []string) ReportDiff {
+	var previousIDs []string
+	for _, report := range previous {
+		previousIDs = append(previousIDs, report.ImageID)
+	}
+	added, removed := DiffImageIDs(previousIDs, candidates)
+
+	scannedSet := make(map[string]bool, len(scanned))
+	for _, imageID := range scanned {
+		scannedSet[imageID] = true
+	}
+	diff := ReportDiff{New: added}
+	for _, imageID := range removed {
+		if scannedSet[imageID] {
+			diff.Protected = append(diff.Protected, imageID)
+		} else {
+			diff.Gone = append(diff.Gone, imageID)
+		}
+	}
+	return diff
+}
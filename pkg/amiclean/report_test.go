@@ -0,0 +1,177 @@
+package amiclean
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestJSONLinesReportWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := NewJSONLinesReportWriter(&out)
+
+	// Each report should show up as soon as it's written, not at Close.
+	if err := w.Write(ImageReport{ImageID: "ami-1", Action: ReportActionPurged, SnapshotIDs: []string{"snap-1"}}); err != nil {
+		t.Fatalf("ERROR: Write returned error: %v", err)
+	}
+	expected := `{"ami-id":"ami-1","ami-name":"","action":"purged","snapshot-ids":["snap-1"]}` + "\n"
+	if out.String() != expected {
+		t.Errorf("ERROR: JSON lines report after one write;\n\texpected: %q\n\tgot: %q", expected, out.String())
+	}
+	if err := w.Write(ImageReport{ImageID: "ami-2", Action: ReportActionFailed, Error: "boom"}); err != nil {
+		t.Fatalf("ERROR: Write returned error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("ERROR: Close returned error: %v", err)
+	}
+	expected += `{"ami-id":"ami-2","ami-name":"","action":"failed","error":"boom"}` + "\n"
+	if out.String() != expected {
+		t.Errorf("ERROR: JSON lines report;\n\texpected: %q\n\tgot: %q", expected, out.String())
+	}
+}
+
+func TestJSONReportWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := NewJSONReportWriter(&out)
+	w.Write(ImageReport{ImageID: "ami-1", Action: ReportActionWouldPurge})
+	if out.Len() != 0 {
+		t.Errorf("ERROR: JSON report wrote %q before Close", out.String())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("ERROR: Close returned error: %v", err)
+	}
+	expected := `[{"ami-id":"ami-1","ami-name":"","action":"would-purge"}]` + "\n"
+	if out.String() != expected {
+		t.Errorf("ERROR: JSON report;\n\texpected: %q\n\tgot: %q", expected, out.String())
+	}
+
+	// An empty run should still be valid JSON.
+	out.Reset()
+	NewJSONReportWriter(&out).Close()
+	if out.String() != "[]\n" {
+		t.Errorf("ERROR: empty JSON report;\n\texpected: %q\n\tgot: %q", "[]\n", out.String())
+	}
+}
+
+func TestRunReport(t *testing.T) {
+	var out bytes.Buffer
+	mock := &mockEC2Client{
+		deregisterErrors: map[string]error{
+			*newishDevImage.ImageId: errors.New("UnauthorizedOperation"),
+		},
+	}
+	a := AMIClean{
+		Delete:          true,
+		ContinueOnError: true,
+		Concurrency:     2,
+		Report:          NewJSONLinesReportWriter(&out),
+		Logger:          logger,
+		EC2Client:       mock,
+	}
+	a.Run(context.Background(), []*ec2.Image{newMasterImage, newishDevImage, oldDevImage, noEbsImage})
+
+	actions := make(map[string]string)
+	decoder := json.NewDecoder(&out)
+	for decoder.More() {
+		var r ImageReport
+		if err := decoder.Decode(&r); err != nil {
+			t.Fatalf("ERROR: could not decode report line: %v", err)
+		}
+		actions[r.ImageID] = r.Action
+	}
+	expected := map[string]string{
+		"ami-11111111111111111": ReportActionPurged,
+		"ami-22222222222222222": ReportActionFailed,
+		"ami-33333333333333333": ReportActionPurged,
+		"ami-44444444444444444": ReportActionSkipped,
+	}
+	if !reflect.DeepEqual(actions, expected) {
+		t.Errorf("ERROR: Run report;\n\texpected: %v\n\tgot: %v", expected, actions)
+	}
+}
+
+func TestReportKeptByOperator(t *testing.T) {
+	var out bytes.Buffer
+	a := AMIClean{
+		Delete:    true,
+		Report:    NewJSONLinesReportWriter(&out),
+		Logger:    logger,
+		EC2Client: &mockEC2Client{},
+	}
+	a.ReportKeptByOperator([]*ec2.Image{newishDevImage})
+	a.Run(context.Background(), []*ec2.Image{oldDevImage})
+
+	var reports []ImageReport
+	decoder := json.NewDecoder(&out)
+	for decoder.More() {
+		var r ImageReport
+		if err := decoder.Decode(&r); err != nil {
+			t.Fatalf("ERROR: could not decode report line: %v", err)
+		}
+		reports = append(reports, r)
+	}
+	// What was kept has nothing deleted along with it.
+	expected := []ImageReport{
+		{ImageID: "ami-22222222222222222", Name: "devimage-alpha", Action: ReportActionKeptByOperator},
+		{ImageID: "ami-33333333333333333", Name: "devimage-bravo", Action: ReportActionPurged, SnapshotIDs: []string{"snap-33333333333333333"}},
+	}
+	if !reflect.DeepEqual(reports, expected) {
+		t.Errorf("ERROR: report of kept and purged images;\n\texpected: %+v\n\tgot: %+v", expected, reports)
+	}
+}
+
+func TestReadReport(t *testing.T) {
+	reports := []ImageReport{
+		{ImageID: "ami-1", Name: "one", Action: ReportActionWouldPurge},
+		{ImageID: "ami-2", Name: "two", Action: ReportActionFailed, Error: "nope"},
+	}
+
+	for _, format := range []string{"json", "jsonl"} {
+		var out bytes.Buffer
+		w := NewJSONReportWriter(&out)
+		if format == "jsonl" {
+			w = NewJSONLinesReportWriter(&out)
+		}
+		for _, report := range reports {
+			w.Write(report)
+		}
+		w.Close()
+
+		got, err := ReadReport(&out)
+		if err != nil {
+			t.Fatalf("ERROR: ReadReport of %v returned error: %v", format, err)
+		}
+		if !reflect.DeepEqual(got, reports) {
+			t.Errorf("ERROR: ReadReport of %v;\n\texpected: %v\n\tgot: %v", format, reports, got)
+		}
+	}
+
+	if _, err := ReadReport(strings.NewReader("[{")); err == nil {
+		t.Errorf("ERROR: ReadReport accepted a truncated report")
+	}
+}
+
+func TestDiffReport(t *testing.T) {
+	previous := []ImageReport{
+		{ImageID: "ami-kept", Action: ReportActionWouldPurge},
+		{ImageID: "ami-deleted", Action: ReportActionWouldPurge},
+		{ImageID: "ami-protected", Action: ReportActionWouldPurge},
+	}
+	scanned := []string{"ami-kept", "ami-protected", "ami-new", "ami-young"}
+	candidates := []string{"ami-new", "ami-kept"}
+
+	expected := ReportDiff{
+		New:       []string{"ami-new"},
+		Gone:      []string{"ami-deleted"},
+		Protected: []string{"ami-protected"},
+	}
+	if got := DiffReport(previous, scanned, candidates); !reflect.DeepEqual(got, expected) {
+		t.Errorf("ERROR: DiffReport;\n\texpected: %+v\n\tgot: %+v", expected, got)
+	}
+}
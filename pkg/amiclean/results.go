@@ -0,0 +1,64 @@
+package amiclean
+
+import (
+	"sync"
+)
+
+// Results lists what a run purged: the AMIs deregistered and the
+// snapshots deleted, or marked for deletion if there is a grace period.
+// In dry run mode, these are what would have been purged.
+// ProtectedImageIDs are the images left alone because they have
+// deregistration protection.
+type Results struct {
+	ImageIDs          []string
+	SnapshotIDs       []string
+	ProtectedImageIDs []string
+}
+
+// ResultCollector gathers Results from several goroutines at once. The
+// zero value is ready to use.
+type ResultCollector struct {
+	mu        sync.Mutex
+	results   Results
+	snapshots map[string]bool
+}
+
+// Add records an image we purged, along with its snapshots. A snapshot
+// shared with an image added earlier is only recorded once.
+func (c *ResultCollector) Add(imageID string, snapshotIDs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.snapshots == nil {
+		c.snapshots = make(map[string]bool)
+	}
+	c.results.ImageIDs = append(c.results.ImageIDs, imageID)
+	for _, snapshotID := range snapshotIDs {
+		if !c.snapshots[snapshotID] {
+			c.snapshots[snapshotID] = true
+			c.results.SnapshotIDs = append(c.results.SnapshotIDs, snapshotID)
+		}
+	}
+}
+
+// AddProtected records an image we left alone because it has
+// deregistration protection.
+func (c *ResultCollector) AddProtected(imageID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.results.ProtectedImageIDs = append(c.results.ProtectedImageIDs, imageID)
+}
+
+// Snapshot returns a copy of everything collected so far, which is safe
+// to use while more results are still being added.
+func (c *ResultCollector) Snapshot() Results {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return Results{
+		ImageIDs:          append([]string(nil), c.results.ImageIDs...),
+		SnapshotIDs:       append([]string(nil), c.results.SnapshotIDs...),
+		ProtectedImageIDs: append([]string(nil), c.results.ProtectedImageIDs...),
+	}
+}
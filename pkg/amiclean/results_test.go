@@ -0,0 +1,45 @@
+package amiclean
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// Run this one with -race to make sure the collector is really safe to
+// share between goroutines.
+func TestResultCollector(t *testing.T) {
+	const goroutines = 20
+	const perGoroutine = 50
+
+	var collector ResultCollector
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < perGoroutine; i++ {
+				imageID := fmt.Sprintf("ami-%d-%d", g, i)
+				collector.Add(imageID, []string{"snap-a-" + imageID, "snap-b-" + imageID})
+				// Reading while others are writing is part of
+				// what we're testing.
+				collector.Snapshot()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	results := collector.Snapshot()
+	if len(results.ImageIDs) != goroutines*perGoroutine {
+		t.Errorf("ERROR: expected %v image IDs, got %v", goroutines*perGoroutine, len(results.ImageIDs))
+	}
+	if len(results.SnapshotIDs) != 2*goroutines*perGoroutine {
+		t.Errorf("ERROR: expected %v snapshot IDs, got %v", 2*goroutines*perGoroutine, len(results.SnapshotIDs))
+	}
+
+	// Changing what we got back mustn't change the collector.
+	results.ImageIDs[0] = "changed"
+	if collector.Snapshot().ImageIDs[0] == "changed" {
+		t.Errorf("ERROR: Snapshot returned the collector's own slice")
+	}
+}
@@ -0,0 +1,120 @@
+package amiclean
+
+import (
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+// RetainReasonMinRetain is the reason recorded for images kept back by
+// MinRetain.
+const RetainReasonMinRetain = "min-retain"
+
+// RetainReasonMinImagesRetained is the reason recorded for images kept
+// back by MinImagesRetained.
+const RetainReasonMinImagesRetained = "min-images-retained"
+
+// RetainReasonOperator is the reason recorded for images someone chose
+// to keep when asked about each one.
+const RetainReasonOperator = "operator"
+
+// ApplyMinRetain keeps back the MinRetain newest of the images we would
+// otherwise purge, so a policy that matches everything still leaves a few
+// to roll back to. It returns the images left to purge, in their original
+// order, and the ones kept, newest first. Each image kept is logged.
+// Images whose lifecycle tag sets keepMin aren't counted, since
+// ApplyLifecycleKeepMin has already dealt with them.
+//
+// With GroupByTagKey, the MinRetain newest are kept for each value of
+// that tag instead, with images that don't have it kept as one more
+// group, UntaggedGroup. The ones kept are then newest first within each
+// group, with the groups in the order they first turn up in images.
+func (a *AMIClean) ApplyMinRetain(images []*ec2.Image) (purge, retained []*ec2.Image) {
+	if a.MinRetain <= 0 {
+		return images, nil
+	}
+
+	var newest []*ec2.Image
+	for _, image := range images {
+		if !a.hasKeepMin(image) {
+			newest = append(newest, image)
+		}
+	}
+	if a.GroupByTagKey == "" {
+		return a.retainNewest(images, newest, a.MinRetain, RetainReasonMinRetain)
+	}
+
+	var groups []string
+	grouped := make(map[string][]*ec2.Image)
+	for _, image := range newest {
+		group := tagGroup(image, a.GroupByTagKey)
+		if _, ok := grouped[group]; !ok {
+			groups = append(groups, group)
+		}
+		grouped[group] = append(grouped[group], image)
+	}
+	kept := make(map[*ec2.Image]bool)
+	for _, group := range groups {
+		_, groupRetained := a.retainNewest(grouped[group], grouped[group], a.MinRetain, RetainReasonMinRetain)
+		for _, image := range groupRetained {
+			kept[image] = true
+		}
+		retained = append(retained, groupRetained...)
+	}
+	for _, image := range images {
+		if !kept[image] {
+			purge = append(purge, image)
+		}
+	}
+	return purge, retained
+}
+
+// ApplyMinImagesRetained is a floor on how many images are left once
+// the run is done, whatever else the policy says, so that an over-eager
+// one can't empty the account. total is how many images there are now,
+// matched or not. If purging all of images would leave fewer than
+// MinImagesRetained, the newest of them are spared until it wouldn't.
+// It returns the images left to purge, in their original order, and the
+// ones spared, newest first. Each image spared is logged.
+func (a *AMIClean) ApplyMinImagesRetained(images []*ec2.Image, total int) (purge, retained []*ec2.Image) {
+	spare := a.MinImagesRetained - (total - len(images))
+	if a.MinImagesRetained <= 0 || spare <= 0 {
+		return images, nil
+	}
+
+	newest := make([]*ec2.Image, len(images))
+	copy(newest, images)
+	return a.retainNewest(images, newest, spare, RetainReasonMinImagesRetained)
+}
+
+// retainNewest keeps back the n newest of candidates, which are some or
+// all of images, logging each one with the reason. It sorts candidates
+// in place, and returns what's left of images to purge, in their
+// original order, and the ones kept, newest first.
+func (a *AMIClean) retainNewest(images, candidates []*ec2.Image, n int, reason string) (purge, retained []*ec2.Image) {
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return imageCreationTime(candidates[i]).After(imageCreationTime(candidates[j]))
+	})
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+
+	kept := make(map[*ec2.Image]bool, len(candidates))
+	for _, image := range candidates {
+		kept[image] = true
+		a.Logger.Info("retaining ami by policy",
+			zap.String("ami-id", aws.StringValue(image.ImageId)),
+			zap.String("ami-name", aws.StringValue(image.Name)),
+			zap.String("ami-creation-date", aws.StringValue(image.CreationDate)),
+			zap.String("reason", reason),
+		)
+	}
+	for _, image := range images {
+		if !kept[image] {
+			purge = append(purge, image)
+		}
+	}
+	return purge, candidates
+}
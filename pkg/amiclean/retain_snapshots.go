@@ -0,0 +1,53 @@
+package amiclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+const (
+	// RetainedFromTagKey is the tag we put on the snapshots of an image
+	// deregistered with RetainSnapshots, when TagRetainedSnapshots is
+	// set. Its value is the ID of the image they came from, which is
+	// otherwise lost once it's gone.
+	RetainedFromTagKey = "retained-from-ami"
+)
+
+// retainSnapshots is what PurgeImage does with an image's snapshots in
+// place of deleting them, when RetainSnapshots is set: nothing, other
+// than marking them with the image they came from if we've been asked
+// to.
+func (a *AMIClean) retainSnapshots(imageID string, snapshotIDs []string) error {
+	if len(snapshotIDs) == 0 {
+		return nil
+	}
+	if !a.TagRetainedSnapshots {
+		a.Logger.Info("keeping snapshots of deregistered ami",
+			zap.String("ami-id", imageID),
+			zap.Strings("snapshot-ids", snapshotIDs),
+		)
+		return nil
+	}
+	if !a.Delete {
+		a.Logger.Info("would tag snapshots to keep",
+			zap.String("ami-id", imageID),
+			zap.Strings("snapshot-ids", snapshotIDs),
+		)
+		return nil
+	}
+
+	a.Logger.Info("tagging snapshots to keep",
+		zap.String("ami-id", imageID),
+		zap.Strings("snapshot-ids", snapshotIDs),
+	)
+	return a.timeCall("CreateTags", zap.String("ami-id", imageID), func() error {
+		_, err := a.EC2Client.CreateTags(&ec2.CreateTagsInput{
+			Resources: aws.StringSlice(snapshotIDs),
+			Tags: []*ec2.Tag{
+				{Key: aws.String(RetainedFromTagKey), Value: aws.String(imageID)},
+			},
+		})
+		return err
+	})
+}
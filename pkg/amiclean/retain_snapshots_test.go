@@ -0,0 +1,76 @@
+package amiclean
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestRunRetainSnapshots(t *testing.T) {
+	tables := []struct {
+		tag      bool
+		expected []string
+	}{
+		{false, []string{
+			"DeregisterImage:ami-retain1",
+			"DeregisterImage:ami-retain2",
+		}},
+		{true, []string{
+			"DeregisterImage:ami-retain1",
+			"CreateTags:snap-retain1",
+			"DeregisterImage:ami-retain2",
+			"CreateTags:snap-retain2a",
+			"CreateTags:snap-retain2b",
+		}},
+	}
+
+	for _, table := range tables {
+		first := batchTestImage("ami-retain1", "snap-retain1")
+		second := batchTestImage("ami-retain2", "snap-retain2a", "snap-retain2b")
+		mock := &mockEC2Client{}
+		var out bytes.Buffer
+		a := AMIClean{
+			Delete:               true,
+			RetainSnapshots:      true,
+			TagRetainedSnapshots: table.tag,
+			Report:               NewJSONLinesReportWriter(&out),
+			Logger:               logger,
+			EC2Client:            mock,
+		}
+
+		results, err := a.Run(context.Background(), []*ec2.Image{first, second})
+		if err != nil {
+			t.Fatalf("ERROR: Run returned error: %v", err)
+		}
+		if !reflect.DeepEqual(mock.calls, table.expected) {
+			t.Errorf("ERROR: Run with RetainSnapshots, tagging %v;\n\texpected calls: %v\n\tgot: %v",
+				table.tag, table.expected, mock.calls)
+		}
+		for _, input := range mock.createTagsInputs {
+			tag := input.Tags[0]
+			if aws.StringValue(tag.Key) != RetainedFromTagKey {
+				t.Errorf("ERROR: retained snapshot tag key;\n\texpected: %v\n\tgot: %v", RetainedFromTagKey, aws.StringValue(tag.Key))
+			}
+		}
+		// The snapshots are still counted, as the ones we kept.
+		expectedSnapshots := []string{"snap-retain1", "snap-retain2a", "snap-retain2b"}
+		if !reflect.DeepEqual(results.SnapshotIDs, expectedSnapshots) {
+			t.Errorf("ERROR: Run with RetainSnapshots;\n\texpected snapshots: %v\n\tgot: %v", expectedSnapshots, results.SnapshotIDs)
+		}
+		decoder := json.NewDecoder(&out)
+		for decoder.More() {
+			var r ImageReport
+			if err := decoder.Decode(&r); err != nil {
+				t.Fatalf("ERROR: could not decode report line: %v", err)
+			}
+			if r.Action != ReportActionDeregistered {
+				t.Errorf("ERROR: report action for %v;\n\texpected: %v\n\tgot: %v", r.ImageID, ReportActionDeregistered, r.Action)
+			}
+		}
+	}
+}
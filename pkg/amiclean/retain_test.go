@@ -0,0 +1,207 @@
+package amiclean
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestApplyMinRetain(t *testing.T) {
+	image := func(id, creationDate string) *ec2.Image {
+		return &ec2.Image{
+			ImageId:      aws.String(id),
+			Name:         aws.String("devimage-" + id),
+			CreationDate: aws.String(creationDate),
+		}
+	}
+	images := []*ec2.Image{
+		image("ami-2", "2019-02-01T00:00:00.000Z"),
+		image("ami-4", "2019-03-01T00:00:00.000Z"),
+		image("ami-1", "2019-01-01T00:00:00.000Z"),
+		image("ami-3", "2019-02-15T00:00:00.000Z"),
+	}
+	ids := func(images []*ec2.Image) []string {
+		var imageIDs []string
+		for _, image := range images {
+			imageIDs = append(imageIDs, *image.ImageId)
+		}
+		return imageIDs
+	}
+
+	tables := []struct {
+		minRetain int
+		purge     []string
+		retained  []string
+	}{
+		{0, []string{"ami-2", "ami-4", "ami-1", "ami-3"}, nil},
+		{1, []string{"ami-2", "ami-1", "ami-3"}, []string{"ami-4"}},
+		{2, []string{"ami-2", "ami-1"}, []string{"ami-4", "ami-3"}},
+		{4, nil, []string{"ami-4", "ami-3", "ami-2", "ami-1"}},
+		{10, nil, []string{"ami-4", "ami-3", "ami-2", "ami-1"}},
+	}
+
+	for _, table := range tables {
+		a := AMIClean{
+			MinRetain: table.minRetain,
+			Logger:    logger,
+		}
+		purge, retained := a.ApplyMinRetain(images)
+		if !reflect.DeepEqual(ids(purge), table.purge) || !reflect.DeepEqual(ids(retained), table.retained) {
+			t.Errorf("ERROR: ApplyMinRetain with MinRetain %v;\n\texpected: purge %v, retain %v\n\tgot: purge %v, retain %v",
+				table.minRetain,
+				table.purge,
+				table.retained,
+				ids(purge),
+				ids(retained),
+			)
+		}
+	}
+}
+
+func TestApplyMinImagesRetained(t *testing.T) {
+	image := func(id, creationDate string) *ec2.Image {
+		return &ec2.Image{
+			ImageId:      aws.String(id),
+			Name:         aws.String("devimage-" + id),
+			CreationDate: aws.String(creationDate),
+		}
+	}
+	images := []*ec2.Image{
+		image("ami-2", "2019-02-01T00:00:00.000Z"),
+		image("ami-4", "2019-03-01T00:00:00.000Z"),
+		image("ami-1", "2019-01-01T00:00:00.000Z"),
+		image("ami-3", "2019-02-15T00:00:00.000Z"),
+	}
+	ids := func(images []*ec2.Image) []string {
+		var imageIDs []string
+		for _, image := range images {
+			imageIDs = append(imageIDs, *image.ImageId)
+		}
+		return imageIDs
+	}
+
+	tables := []struct {
+		minImagesRetained int
+		total             int
+		purge             []string
+		retained          []string
+	}{
+		// No floor.
+		{0, 4, []string{"ami-2", "ami-4", "ami-1", "ami-3"}, nil},
+		// Enough images that didn't match are left either way.
+		{3, 7, []string{"ami-2", "ami-4", "ami-1", "ami-3"}, nil},
+		{3, 10, []string{"ami-2", "ami-4", "ami-1", "ami-3"}, nil},
+		// Purging them all would leave 1 of 5, so 2 are spared.
+		{3, 5, []string{"ami-2", "ami-1"}, []string{"ami-4", "ami-3"}},
+		// Everything matched, so the floor is all that's left.
+		{1, 4, []string{"ami-2", "ami-1", "ami-3"}, []string{"ami-4"}},
+		{10, 4, nil, []string{"ami-4", "ami-3", "ami-2", "ami-1"}},
+	}
+
+	for _, table := range tables {
+		a := AMIClean{
+			MinImagesRetained: table.minImagesRetained,
+			Logger:            logger,
+		}
+		purge, retained := a.ApplyMinImagesRetained(images, table.total)
+		if !reflect.DeepEqual(ids(purge), table.purge) || !reflect.DeepEqual(ids(retained), table.retained) {
+			t.Errorf("ERROR: ApplyMinImagesRetained with MinImagesRetained %v of %v images;\n\texpected: purge %v, retain %v\n\tgot: purge %v, retain %v",
+				table.minImagesRetained,
+				table.total,
+				table.purge,
+				table.retained,
+				ids(purge),
+				ids(retained),
+			)
+		}
+	}
+	// The images passed in have to stay in their original order.
+	if !reflect.DeepEqual(ids(images), []string{"ami-2", "ami-4", "ami-1", "ami-3"}) {
+		t.Errorf("ERROR: ApplyMinImagesRetained reordered the images it was given: %v", ids(images))
+	}
+}
+
+func TestApplyMinRetainGroupByTagKey(t *testing.T) {
+	image := func(id, creationDate, service string) *ec2.Image {
+		image := &ec2.Image{
+			ImageId:      aws.String(id),
+			Name:         aws.String("devimage-" + id),
+			CreationDate: aws.String(creationDate),
+		}
+		if service != "" {
+			image.Tags = []*ec2.Tag{{Key: aws.String("service"), Value: aws.String(service)}}
+		}
+		return image
+	}
+	images := []*ec2.Image{
+		image("api-1", "2019-01-01T00:00:00.000Z", "api"),
+		image("web-1", "2019-01-02T00:00:00.000Z", "web"),
+		image("api-3", "2019-03-01T00:00:00.000Z", "api"),
+		image("none-1", "2019-01-03T00:00:00.000Z", ""),
+		image("api-2", "2019-02-01T00:00:00.000Z", "api"),
+		image("web-2", "2019-02-02T00:00:00.000Z", "web"),
+		image("none-2", "2019-02-03T00:00:00.000Z", ""),
+		image("worker-1", "2019-01-04T00:00:00.000Z", "worker"),
+	}
+	ids := func(images []*ec2.Image) []string {
+		var imageIDs []string
+		for _, image := range images {
+			imageIDs = append(imageIDs, *image.ImageId)
+		}
+		return imageIDs
+	}
+
+	tables := []struct {
+		minRetain int
+		purge     []string
+		retained  []string
+		// perGroup is how many images were kept of each group.
+		perGroup map[string]int
+	}{
+		{
+			1,
+			[]string{"api-1", "web-1", "none-1", "api-2"},
+			[]string{"api-3", "web-2", "none-2", "worker-1"},
+			map[string]int{"api": 1, "web": 1, UntaggedGroup: 1, "worker": 1},
+		},
+		{
+			2,
+			[]string{"api-1"},
+			[]string{"api-3", "api-2", "web-2", "web-1", "none-2", "none-1", "worker-1"},
+			map[string]int{"api": 2, "web": 2, UntaggedGroup: 2, "worker": 1},
+		},
+		{
+			3,
+			nil,
+			[]string{"api-3", "api-2", "api-1", "web-2", "web-1", "none-2", "none-1", "worker-1"},
+			map[string]int{"api": 3, "web": 2, UntaggedGroup: 2, "worker": 1},
+		},
+	}
+
+	for _, table := range tables {
+		a := AMIClean{
+			MinRetain:     table.minRetain,
+			GroupByTagKey: "service",
+			Logger:        logger,
+		}
+		purge, retained := a.ApplyMinRetain(images)
+		perGroup := make(map[string]int)
+		for _, image := range retained {
+			perGroup[tagGroup(image, "service")]++
+		}
+		if !reflect.DeepEqual(ids(purge), table.purge) || !reflect.DeepEqual(ids(retained), table.retained) ||
+			!reflect.DeepEqual(perGroup, table.perGroup) {
+			t.Errorf("ERROR: ApplyMinRetain with MinRetain %v by service;\n\texpected: purge %v, retain %v (%v)\n\tgot: purge %v, retain %v (%v)",
+				table.minRetain,
+				table.purge,
+				table.retained,
+				table.perGroup,
+				ids(purge),
+				ids(retained),
+				perGroup,
+			)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package amiclean
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"gopkg.in/yaml.v2"
+)
+
+// Rule is one entry in a policy of AMIs to purge. An image matches a rule
+// when its name has the rule's prefix and matches its regex, it has the
+// rule's tag with one of the rule's values, and it is older than the
+// rule's retention. Anything the rule leaves out isn't checked; without
+// TagValues, having the tag key at all is enough, and without Days the
+// usual expiration date applies.
+type Rule struct {
+	TagKey     string   `json:"tag-key" yaml:"tag-key"`
+	TagValues  []string `json:"tag-values" yaml:"tag-values"`
+	NamePrefix string   `json:"name-prefix" yaml:"name-prefix"`
+	NameRegex  string   `json:"name-regex" yaml:"name-regex"`
+	Days       *int     `json:"days" yaml:"days"`
+
+	nameRegex *regexp.Regexp
+}
+
+// ReadRules reads a policy of rules from r. The policy is a JSON array
+// of rules, keyed like the command line flags they stand in for:
+//
+//	[
+//	  {"tag-key": "branch", "tag-values": ["feature-*"], "days": 7},
+//	  {"name-prefix": "base-", "name-regex": "-rc[0-9]+$"}
+//	]
+//
+// Every rule has to select on something, since a rule with only a
+// retention would match every image old enough.
+func ReadRules(r io.Reader) ([]Rule, error) {
+	var rules []Rule
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rules); err != nil {
+		return nil, err
+	}
+	return checkRules(rules)
+}
+
+// ReadRulesYAML reads a policy of rules from r, as ReadRules does, but
+// written as YAML:
+//
+//	# Feature branches go after a week.
+//	- tag-key: branch
+//	  tag-values: ["feature-*"]
+//	  days: 7
+//	- name-prefix: base-
+//	  name-regex: -rc[0-9]+$
+func ReadRulesYAML(r io.Reader) ([]Rule, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err := yaml.UnmarshalStrict(data, &rules); err != nil {
+		return nil, err
+	}
+	return checkRules(rules)
+}
+
+// checkRules makes sure each of the rules read from a policy makes
+// sense, and compiles their regexes.
+func checkRules(rules []Rule) ([]Rule, error) {
+	for i := range rules {
+		rule := &rules[i]
+		if rule.TagKey == "" && rule.NamePrefix == "" && rule.NameRegex == "" {
+			return nil, fmt.Errorf("rule %d: must have a tag-key, name-prefix or name-regex", i+1)
+		}
+		if rule.TagKey == "" && len(rule.TagValues) > 0 {
+			return nil, fmt.Errorf("rule %d: tag-values need a tag-key", i+1)
+		}
+		if rule.Days != nil && *rule.Days < 0 {
+			return nil, fmt.Errorf("rule %d: days must not be negative", i+1)
+		}
+		if rule.NameRegex != "" {
+			var err error
+			if rule.nameRegex, err = regexp.Compile(rule.NameRegex); err != nil {
+				return nil, fmt.Errorf("rule %d: invalid name-regex: %v", i+1, err)
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// matchesName returns true if the image's name fits the rule.
+func (r *Rule) matchesName(name string) bool {
+	if !strings.HasPrefix(name, r.NamePrefix) {
+		return false
+	}
+	if r.NameRegex == "" {
+		return true
+	}
+	if r.nameRegex != nil {
+		return r.nameRegex.MatchString(name)
+	}
+	// Rules built in code rather than read from a policy haven't had
+	// their regex compiled; one that doesn't compile matches nothing.
+	matched, err := regexp.MatchString(r.NameRegex, name)
+	return err == nil && matched
+}
+
+// matchesTags returns true if the image has the rule's tag, with one of
+// its values if it has any.
+func (r *Rule) matchesTags(image *ec2.Image) bool {
+	if r.TagKey == "" {
+		return true
+	}
+	for _, tag := range image.Tags {
+		if aws.StringValue(tag.Key) != r.TagKey {
+			continue
+		}
+		if len(r.TagValues) == 0 {
+			return true
+		}
+		for _, value := range r.TagValues {
+			if matchTagValue(value, aws.StringValue(tag.Value)) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// matchRule returns the index of the first of our Rules the image
+// matches, and false if it matches none of them.
+func (a *AMIClean) matchRule(image *ec2.Image, creationTime time.Time) (int, bool) {
+	for i := range a.Rules {
+		rule := &a.Rules[i]
+		if !rule.matchesName(aws.StringValue(image.Name)) || !rule.matchesTags(image) {
+			continue
+		}
+		if rule.Days != nil {
+			if creationTime.AddDate(0, 0, *rule.Days).After(a.now()) {
+				continue
+			}
+		} else if !a.isExpired(image, creationTime) {
+			continue
+		}
+		return i, true
+	}
+	return 0, false
+}
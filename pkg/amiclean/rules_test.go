@@ -0,0 +1,140 @@
+package amiclean
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestReadRules(t *testing.T) {
+	tables := []struct {
+		policy string
+		rules  int
+		valid  bool
+	}{
+		{`[]`, 0, true},
+		{`[{"tag-key": "branch", "tag-values": ["feature-*", "bugfix-*"], "days": 7}]`, 1, true},
+		{`[{"name-prefix": "base-"}, {"name-regex": "-rc[0-9]+$", "days": 0}]`, 2, true},
+		// A rule has to select on something.
+		{`[{"days": 7}]`, 0, false},
+		{`[{"tag-values": ["feature-*"]}]`, 0, false},
+		{`[{"tag-key": "branch", "days": -1}]`, 0, false},
+		{`[{"name-regex": "("}]`, 0, false},
+		// A misspelled key would otherwise quietly widen the rule.
+		{`[{"tag-key": "branch", "tag-value": "master"}]`, 0, false},
+		{`{"tag-key": "branch"}`, 0, false},
+	}
+
+	for _, table := range tables {
+		rules, err := ReadRules(strings.NewReader(table.policy))
+		if (err == nil) != table.valid || len(rules) != table.rules {
+			t.Errorf("ERROR: ReadRules(%v);\n\texpected: %v rules, valid %v\n\tgot: %v rules, error %v",
+				table.policy,
+				table.rules,
+				table.valid,
+				len(rules),
+				err,
+			)
+		}
+	}
+}
+
+func TestReadRulesYAML(t *testing.T) {
+	tables := []struct {
+		policy string
+		rules  int
+		valid  bool
+	}{
+		{"[]", 0, true},
+		{"- tag-key: branch\n  tag-values: [feature-*, bugfix-*]\n  days: 7\n", 1, true},
+		{"- name-prefix: base-\n- name-regex: -rc[0-9]+$\n  days: 0\n", 2, true},
+		{"- days: 7\n", 0, false},
+		{"- tag-key: branch\n  days: -1\n", 0, false},
+		{"- tag-key: branch\n  tag-value: master\n", 0, false},
+		{"tag-key: branch\n", 0, false},
+	}
+
+	for _, table := range tables {
+		rules, err := ReadRulesYAML(strings.NewReader(table.policy))
+		if (err == nil) != table.valid || len(rules) != table.rules {
+			t.Errorf("ERROR: ReadRulesYAML(%q);\n\texpected: %v rules, valid %v\n\tgot: %v rules, error %v",
+				table.policy,
+				table.rules,
+				table.valid,
+				len(rules),
+				err,
+			)
+		}
+	}
+
+	rules, err := ReadRulesYAML(strings.NewReader("- tag-key: branch\n  tag-values: [feature-*]\n  days: 7\n"))
+	if err != nil {
+		t.Fatalf("ERROR: ReadRulesYAML() returned error: %v", err)
+	}
+	if rules[0].TagKey != "branch" || len(rules[0].TagValues) != 1 || rules[0].Days == nil || *rules[0].Days != 7 {
+		t.Errorf("ERROR: ReadRulesYAML();\n\texpected: %v\n\tgot: %+v", "branch=feature-* after 7 days", rules[0])
+	}
+}
+
+func TestCheckImageRules(t *testing.T) {
+	image := func(name, creationDate, branch string) *ec2.Image {
+		return &ec2.Image{
+			Name:         aws.String(name),
+			ImageId:      aws.String("ami-99999999999999999"),
+			CreationDate: aws.String(creationDate),
+			Tags: []*ec2.Tag{
+				{Key: aws.String("branch"), Value: aws.String(branch)},
+			},
+			RootDeviceType: aws.String("ebs"),
+		}
+	}
+	rules, err := ReadRules(strings.NewReader(`[
+		{"tag-key": "branch", "tag-values": ["feature-*", "bugfix-*"], "days": 7},
+		{"name-prefix": "base-", "name-regex": "-rc[0-9]+$"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []struct {
+		name     string
+		image    *ec2.Image
+		expected bool
+	}{
+		// The first rule's own retention is shorter than the global
+		// one.
+		{"feature branch past rule retention", image("app-1", "2019-03-20T00:00:00.000Z", "feature-foo"), true},
+		{"feature branch within rule retention", image("app-1", "2019-03-30T00:00:00.000Z", "feature-foo"), false},
+		{"bugfix branch", image("app-1", "2019-03-20T00:00:00.000Z", "bugfix-bar"), true},
+		{"master branch", image("app-1", "2019-01-01T00:00:00.000Z", "master"), false},
+		// The second rule falls back to the global retention.
+		{"release candidate past expiration", image("base-1.2-rc3", "2019-02-01T00:00:00.000Z", "master"), true},
+		{"release candidate within expiration", image("base-1.2-rc3", "2019-03-20T00:00:00.000Z", "master"), false},
+		{"release", image("base-1.2", "2019-02-01T00:00:00.000Z", "master"), false},
+	}
+
+	for _, table := range tables {
+		a := AMIClean{
+			Rules:          rules,
+			ExpirationDate: now.AddDate(0, 0, -30),
+			Now:            stoppedClock,
+			Logger:         logger,
+		}
+		if got := a.CheckImage(table.image); got != table.expected {
+			t.Errorf("ERROR: CheckImage with rules, %v;\n\texpected: %v\n\tgot: %v",
+				table.name,
+				table.expected,
+				got,
+			)
+		}
+		if got := a.ExplainImage(table.image).Selected; got != table.expected {
+			t.Errorf("ERROR: ExplainImage with rules, %v;\n\texpected: %v\n\tgot: %v",
+				table.name,
+				table.expected,
+				got,
+			)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package amiclean
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+const (
+	// ScheduledDeletionTagKey is the tag MarkImages puts on AMIs that
+	// should be purged by a later run. Its value is the time, in RFC8601
+	// format, after which the AMI can go.
+	ScheduledDeletionTagKey = "scheduled-for-deletion"
+	// ScheduledDeletionAfterTagKey is the tag MarkImages puts the time
+	// an AMI can go in when a MarkerTemplate, rather than the time, is
+	// the ScheduledDeletionTagKey value.
+	ScheduledDeletionAfterTagKey = "scheduled-for-deletion-after"
+
+	// maxTagValueLength is the longest value AWS allows on a tag.
+	maxTagValueLength = 256
+
+	// markImagesBatchSize is how many images we tag in a single
+	// CreateTags call, to stay well under the API's limits.
+	markImagesBatchSize = 200
+)
+
+// MarkerData is what a MarkerTemplate is executed against. MarkImages
+// fills in Now and DeleteAfter, in RFC8601 format; the rest is up to
+// the caller.
+type MarkerData struct {
+	RunID       string
+	Now         string
+	DeleteAfter string
+	Region      string
+	Branch      string
+}
+
+// ParseMarkerTemplate parses text as a MarkerTemplate, using the
+// text/template syntax. So that a bad template is caught before any AMI
+// is marked, it's tried out against a MarkerData with every field set,
+// and has to render to something that fits in a tag value.
+func ParseMarkerTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("marker").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	sample := MarkerData{
+		RunID:       "00000000-0000-0000-0000-000000000000",
+		Now:         RFC8601,
+		DeleteAfter: RFC8601,
+		Region:      "us-east-1",
+		Branch:      "master",
+	}
+	value, err := renderMarker(tmpl, sample)
+	if err != nil {
+		return nil, err
+	}
+	if value == "" {
+		return nil, fmt.Errorf("marker template renders an empty value")
+	}
+	return tmpl, nil
+}
+
+// renderMarker executes tmpl against data, making sure the result is
+// short enough to be a tag value.
+func renderMarker(tmpl *template.Template, data MarkerData) (string, error) {
+	var value bytes.Buffer
+	if err := tmpl.Execute(&value, data); err != nil {
+		return "", err
+	}
+	if value.Len() > maxTagValueLength {
+		return "", fmt.Errorf("marker template renders %d characters, more than the %d a tag value can hold", value.Len(), maxTagValueLength)
+	}
+	return value.String(), nil
+}
+
+// MarkImages tags images to be purged once MarkGracePeriod has passed,
+// instead of purging them now. This gives people a chance to see what is
+// about to go, and to remove the tag from anything that should stay.
+// Images that are already marked keep their original date. With a
+// MarkerTemplate, the mark's value is the template executed against
+// MarkerData, and the date goes in ScheduledDeletionAfterTagKey. It
+// returns the IDs of the images it marked (or would have, in dry run
+// mode).
+func (a *AMIClean) MarkImages(images []*ec2.Image) ([]string, error) {
+	var imageIDs []string
+	for _, image := range images {
+		if _, marked := scheduledDeletionTime(image); marked {
+			continue
+		}
+		imageIDs = append(imageIDs, *image.ImageId)
+	}
+	if len(imageIDs) == 0 {
+		return nil, nil
+	}
+
+	now := a.now()
+	deleteAfter := now.Add(a.MarkGracePeriod).Format(RFC8601)
+	tags := []*ec2.Tag{
+		{Key: aws.String(ScheduledDeletionTagKey), Value: aws.String(deleteAfter)},
+	}
+	if a.MarkerTemplate != nil {
+		data := a.MarkerData
+		data.Now = now.Format(RFC8601)
+		data.DeleteAfter = deleteAfter
+		marker, err := renderMarker(a.MarkerTemplate, data)
+		if err != nil {
+			return nil, err
+		}
+		tags = []*ec2.Tag{
+			{Key: aws.String(ScheduledDeletionTagKey), Value: aws.String(marker)},
+			{Key: aws.String(ScheduledDeletionAfterTagKey), Value: aws.String(deleteAfter)},
+		}
+	}
+	for _, imageID := range imageIDs {
+		if a.Delete {
+			a.Logger.Info("marking ami for deletion",
+				zap.String("ami-id", imageID),
+				zap.String("delete-after", deleteAfter),
+				zap.String("marker", aws.StringValue(tags[0].Value)),
+			)
+		} else {
+			a.Logger.Info("would mark ami for deletion",
+				zap.String("ami-id", imageID),
+				zap.String("delete-after", deleteAfter),
+				zap.String("marker", aws.StringValue(tags[0].Value)),
+			)
+		}
+	}
+	if !a.Delete {
+		return imageIDs, nil
+	}
+
+	for start := 0; start < len(imageIDs); start += markImagesBatchSize {
+		end := start + markImagesBatchSize
+		if end > len(imageIDs) {
+			end = len(imageIDs)
+		}
+		batch := imageIDs[start:end]
+		err := a.timeCall("CreateTags", zap.Strings("ami-ids", batch), func() error {
+			_, err := a.EC2Client.CreateTags(&ec2.CreateTagsInput{
+				Resources: aws.StringSlice(batch),
+				Tags:      tags,
+			})
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return imageIDs, nil
+}
+
+// scheduledDeletionTime returns the time an image was marked to be
+// purged after, and whether it's marked at all. The time comes from
+// ScheduledDeletionAfterTagKey if the image has it, since the mark
+// itself is then a MarkerTemplate's, and otherwise from the mark. An
+// image with a mark we can't parse counts as marked, but with a zero
+// time.
+func scheduledDeletionTime(image *ec2.Image) (time.Time, bool) {
+	var marker, after *string
+	for _, tag := range image.Tags {
+		switch aws.StringValue(tag.Key) {
+		case ScheduledDeletionTagKey:
+			marker = tag.Value
+		case ScheduledDeletionAfterTagKey:
+			after = tag.Value
+		}
+	}
+	if marker == nil {
+		return time.Time{}, false
+	}
+	if after != nil {
+		marker = after
+	}
+	deleteAfter, err := time.Parse(RFC8601, aws.StringValue(marker))
+	if err != nil {
+		return time.Time{}, true
+	}
+	return deleteAfter, true
+}
+
+// markExpired returns true if MarkImages marked the image and its grace
+// period is over. A mark we can't parse doesn't count, so that a mangled
+// tag never makes an image easier to purge.
+func (a *AMIClean) markExpired(image *ec2.Image, now time.Time) bool {
+	deleteAfter, marked := scheduledDeletionTime(image)
+	if !marked {
+		return false
+	}
+	if deleteAfter.IsZero() {
+		a.Logger.Warn("could not parse scheduled deletion time on ami",
+			zap.String("ami-id", *image.ImageId),
+		)
+		return false
+	}
+	return deleteAfter.Before(now)
+}
@@ -0,0 +1,198 @@
+package amiclean
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func markedTestImage(imageID, deleteAfter string) *ec2.Image {
+	return &ec2.Image{
+		Name:         aws.String("devimage-marked"),
+		ImageId:      aws.String(imageID),
+		CreationDate: aws.String("2019-03-01T21:04:57.000Z"),
+		Tags: []*ec2.Tag{
+			{Key: aws.String(ScheduledDeletionTagKey), Value: aws.String(deleteAfter)},
+		},
+		RootDeviceType: aws.String("ebs"),
+	}
+}
+
+func TestMarkImages(t *testing.T) {
+	mock := &mockEC2Client{}
+	a := AMIClean{
+		Delete:          true,
+		MarkGracePeriod: 7 * 24 * time.Hour,
+		Logger:          logger,
+		EC2Client:       mock,
+	}
+
+	// The image that's already marked should keep its date.
+	images := []*ec2.Image{oldDevImage, markedTestImage("ami-marked", "2019-03-08T00:00:00.000Z"), newMasterImage}
+	marked, err := a.MarkImages(images)
+	if err != nil {
+		t.Fatalf("ERROR: MarkImages returned error: %v", err)
+	}
+	expected := []string{"ami-33333333333333333", "ami-11111111111111111"}
+	if !reflect.DeepEqual(marked, expected) {
+		t.Errorf("ERROR: MarkImages;\n\texpected: %v\n\tgot: %v", expected, marked)
+	}
+	if !reflect.DeepEqual(aws.StringValueSlice(mock.createTagsInputs[0].Resources), expected) {
+		t.Errorf("ERROR: MarkImages tagged %v, expected %v", aws.StringValueSlice(mock.createTagsInputs[0].Resources), expected)
+	}
+	tag := mock.createTagsInputs[0].Tags[0]
+	if *tag.Key != ScheduledDeletionTagKey {
+		t.Errorf("ERROR: expected tag key %v, got %v", ScheduledDeletionTagKey, *tag.Key)
+	}
+	if _, err := time.Parse(RFC8601, *tag.Value); err != nil {
+		t.Errorf("ERROR: could not parse scheduled deletion time %v: %v", *tag.Value, err)
+	}
+
+	// In dry run mode, nothing gets tagged.
+	mock = &mockEC2Client{}
+	a.Delete = false
+	a.EC2Client = mock
+	if _, err := a.MarkImages(images); err != nil {
+		t.Fatalf("ERROR: MarkImages returned error: %v", err)
+	}
+	if len(mock.calls) != 0 {
+		t.Errorf("ERROR: MarkImages in dry run mode made API calls: %v", mock.calls)
+	}
+}
+
+func TestCheckImageRequireMarked(t *testing.T) {
+	images := []*ec2.Image{
+		markedTestImage("ami-past", "2019-03-08T00:00:00.000Z"),
+		markedTestImage("ami-future", "2019-04-02T00:00:00.000Z"),
+		markedTestImage("ami-garbled", "next week"),
+		oldDevImage,
+	}
+	expected := []bool{true, false, false, false}
+
+	a := AMIClean{
+		RequireMarked:  true,
+		ExpirationDate: now,
+		Now:            stoppedClock,
+		Logger:         logger,
+	}
+	for index, image := range images {
+		if a.CheckImage(image) != expected[index] {
+			t.Errorf("ERROR: CheckImage with RequireMarked for %v;\n\texpected: %v\n\tgot: %v",
+				*image.ImageId,
+				expected[index],
+				!expected[index],
+			)
+		}
+	}
+}
+
+func TestMarkImagesBatches(t *testing.T) {
+	var images []*ec2.Image
+	var expected []string
+	for i := 0; i < markImagesBatchSize*2+1; i++ {
+		imageID := fmt.Sprintf("ami-%017d", i)
+		images = append(images, &ec2.Image{ImageId: aws.String(imageID)})
+		expected = append(expected, imageID)
+	}
+	mock := &mockEC2Client{}
+	a := AMIClean{
+		Delete:          true,
+		MarkGracePeriod: 7 * 24 * time.Hour,
+		Logger:          logger,
+		EC2Client:       mock,
+	}
+
+	marked, err := a.MarkImages(images)
+	if err != nil {
+		t.Fatalf("ERROR: MarkImages returned error: %v", err)
+	}
+	if !reflect.DeepEqual(marked, expected) {
+		t.Errorf("ERROR: MarkImages marked %v images, expected %v", len(marked), len(expected))
+	}
+	var tagged []string
+	for _, input := range mock.createTagsInputs {
+		if len(input.Resources) > markImagesBatchSize {
+			t.Errorf("ERROR: MarkImages tagged %v images in one call, expected at most %v", len(input.Resources), markImagesBatchSize)
+		}
+		tagged = append(tagged, aws.StringValueSlice(input.Resources)...)
+	}
+	if len(mock.createTagsInputs) != 3 || !reflect.DeepEqual(tagged, expected) {
+		t.Errorf("ERROR: MarkImages;\n\texpected: 3 calls tagging %v images\n\tgot: %v calls tagging %v", len(expected), len(mock.createTagsInputs), len(tagged))
+	}
+}
+
+func TestMarkImagesTemplate(t *testing.T) {
+	tmpl, err := ParseMarkerTemplate("run:{{.RunID}},at:{{.Now}},region:{{.Region}},branch:{{.Branch}}")
+	if err != nil {
+		t.Fatalf("ERROR: ParseMarkerTemplate returned error: %v", err)
+	}
+	mock := &mockEC2Client{}
+	a := AMIClean{
+		Delete:          true,
+		MarkGracePeriod: 7 * 24 * time.Hour,
+		MarkerTemplate:  tmpl,
+		MarkerData:      MarkerData{RunID: "run-1", Region: "us-west-2", Branch: "feature"},
+		Now:             stoppedClock,
+		Logger:          logger,
+		EC2Client:       mock,
+	}
+
+	if _, err := a.MarkImages([]*ec2.Image{oldDevImage}); err != nil {
+		t.Fatalf("ERROR: MarkImages returned error: %v", err)
+	}
+	expected := []*ec2.Tag{
+		{
+			Key:   aws.String(ScheduledDeletionTagKey),
+			Value: aws.String("run:run-1,at:2019-04-01T00:00:00.000Z,region:us-west-2,branch:feature"),
+		},
+		{
+			Key:   aws.String(ScheduledDeletionAfterTagKey),
+			Value: aws.String("2019-04-08T00:00:00.000Z"),
+		},
+	}
+	if !reflect.DeepEqual(mock.createTagsInputs[0].Tags, expected) {
+		t.Errorf("ERROR: MarkImages with a template;\n\texpected: %v\n\tgot: %v", expected, mock.createTagsInputs[0].Tags)
+	}
+
+	// What it tagged has to be purged by a later run once the time is up.
+	marked := &ec2.Image{ImageId: aws.String("ami-marked"), Tags: expected}
+	if deleteAfter, ok := scheduledDeletionTime(marked); !ok || !deleteAfter.Equal(now.Add(a.MarkGracePeriod)) {
+		t.Errorf("ERROR: scheduledDeletionTime of a templated mark;\n\texpected: %v\n\tgot: %v, %v",
+			now.Add(a.MarkGracePeriod), deleteAfter, ok)
+	}
+}
+
+func TestParseMarkerTemplate(t *testing.T) {
+	tables := []struct {
+		text  string
+		valid bool
+	}{
+		{"run:{{.RunID}},at:{{.Now}}", true},
+		{"{{.DeleteAfter}}", true},
+		{"fixed", true},
+		// Doesn't parse.
+		{"run:{{.RunID", false},
+		// Not a field of MarkerData.
+		{"{{.Account}}", false},
+		// Nothing to tag with.
+		{"{{if false}}x{{end}}", false},
+		// Too long for a tag value.
+		{strings.Repeat("x", 257), false},
+	}
+
+	for _, table := range tables {
+		_, err := ParseMarkerTemplate(table.text)
+		if (err == nil) != table.valid {
+			t.Errorf("ERROR: ParseMarkerTemplate of %q;\n\texpected valid: %v\n\tgot: %v",
+				table.text,
+				table.valid,
+				err,
+			)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package amiclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+// CheckShared looks up an image's launch permissions and returns who it's
+// shared with: "all" if it's public, and otherwise the accounts,
+// organizations and organizational units allowed to launch it. Deleting
+// an image like that can break people we don't know about. Our own
+// archive account doesn't count, since archiveImage shares images with it
+// on the way out.
+func (a *AMIClean) CheckShared(image *ec2.Image) ([]string, error) {
+	if aws.BoolValue(image.Public) {
+		return []string{"all"}, nil
+	}
+
+	permissions, err := a.launchPermissions(image)
+	if err != nil {
+		return nil, err
+	}
+
+	var sharedWith []string
+	for _, permission := range permissions {
+		switch {
+		case aws.StringValue(permission.Group) == ec2.PermissionGroupAll:
+			sharedWith = append(sharedWith, "all")
+		case permission.UserId != nil:
+			if *permission.UserId != a.ArchiveAccountID {
+				sharedWith = append(sharedWith, *permission.UserId)
+			}
+		case permission.OrganizationArn != nil:
+			sharedWith = append(sharedWith, *permission.OrganizationArn)
+		case permission.OrganizationalUnitArn != nil:
+			sharedWith = append(sharedWith, *permission.OrganizationalUnitArn)
+		}
+	}
+	return sharedWith, nil
+}
+
+// launchPermissions looks up who is allowed to launch an image.
+func (a *AMIClean) launchPermissions(image *ec2.Image) ([]*ec2.LaunchPermission, error) {
+	var output *ec2.DescribeImageAttributeOutput
+	err := a.timeCall("DescribeImageAttribute", zap.String("ami-id", *image.ImageId), func() error {
+		var err error
+		output, err = a.EC2Client.DescribeImageAttribute(&ec2.DescribeImageAttributeInput{
+			Attribute: aws.String(ec2.ImageAttributeNameLaunchPermission),
+			ImageId:   image.ImageId,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.LaunchPermissions, nil
+}
+
+// ignoresSharedUsage says whether an image is one we've been told is
+// only used by us, whoever it's shared with, because its ID is in
+// IgnoreSharedImageIDs or it has IgnoreSharedTag.
+func (a *AMIClean) ignoresSharedUsage(image *ec2.Image) bool {
+	if a.IgnoreSharedImageIDs[aws.StringValue(image.ImageId)] {
+		return true
+	}
+	if a.IgnoreSharedTag != nil {
+		matched, _ := matchTags(image, a.IgnoreSharedTag)
+		return matched
+	}
+	return false
+}
+
+// revokeLaunchPermissions takes away everyone else's permission to
+// launch an image we're about to deregister despite its sharing, so
+// that nothing elsewhere can launch it in the meantime, and anything
+// that was going to finds out now. Our own archive account keeps its
+// permission, since archiveImage needs it.
+func (a *AMIClean) revokeLaunchPermissions(image *ec2.Image) error {
+	imageID := *image.ImageId
+	permissions, err := a.launchPermissions(image)
+	if err != nil {
+		return err
+	}
+
+	var revoke []*ec2.LaunchPermission
+	for _, permission := range permissions {
+		if permission.UserId != nil && *permission.UserId == a.ArchiveAccountID {
+			continue
+		}
+		revoke = append(revoke, permission)
+	}
+	if len(revoke) == 0 {
+		return nil
+	}
+
+	if !a.Delete {
+		a.Logger.Info("would revoke ami launch permissions",
+			zap.String("ami-id", imageID),
+			zap.Int("launch-permissions", len(revoke)),
+		)
+		return nil
+	}
+	a.Logger.Warn("revoking ami launch permissions",
+		zap.String("ami-id", imageID),
+		zap.Int("launch-permissions", len(revoke)),
+	)
+	return a.timeCall("ModifyImageAttribute", zap.String("ami-id", imageID), func() error {
+		_, err := a.EC2Client.ModifyImageAttribute(&ec2.ModifyImageAttributeInput{
+			ImageId: aws.String(imageID),
+			LaunchPermission: &ec2.LaunchPermissionModifications{
+				Remove: revoke,
+			},
+		})
+		return err
+	})
+}
@@ -0,0 +1,199 @@
+package amiclean
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func (m *mockEC2Client) DescribeImageAttribute(input *ec2.DescribeImageAttributeInput) (*ec2.DescribeImageAttributeOutput, error) {
+	permissions, ok := m.launchPermissions[*input.ImageId]
+	if !ok && m.launchPermissions != nil {
+		return nil, errors.New("no such image")
+	}
+	return &ec2.DescribeImageAttributeOutput{
+		ImageId:           input.ImageId,
+		LaunchPermissions: permissions,
+	}, nil
+}
+
+func sharedTestImage(id string, public bool) *ec2.Image {
+	return &ec2.Image{
+		Name:           aws.String("devimage-shared"),
+		ImageId:        aws.String(id),
+		CreationDate:   aws.String("2019-01-01T00:00:00.000Z"),
+		Public:         aws.Bool(public),
+		RootDeviceType: aws.String("ebs"),
+	}
+}
+
+func TestCheckImageSkipShared(t *testing.T) {
+	m := &mockEC2Client{
+		launchPermissions: map[string][]*ec2.LaunchPermission{
+			"ami-public":   {{Group: aws.String("all")}},
+			"ami-unshared": nil,
+			"ami-account":  {{UserId: aws.String("123456789012")}},
+			"ami-org": {
+				{OrganizationArn: aws.String("arn:aws:organizations::123456789012:organization/o-abc")},
+				{OrganizationalUnitArn: aws.String("arn:aws:organizations::123456789012:ou/o-abc/ou-def")},
+			},
+			"ami-archive": {{UserId: aws.String("210987654321")}},
+		},
+	}
+
+	tables := []struct {
+		image      *ec2.Image
+		sharedWith []string
+		expected   bool
+	}{
+		{sharedTestImage("ami-public", true), []string{"all"}, false},
+		// An image can be public through its launch permissions
+		// without the DescribeImages result saying so.
+		{sharedTestImage("ami-public", false), []string{"all"}, false},
+		{sharedTestImage("ami-unshared", false), nil, true},
+		{sharedTestImage("ami-account", false), []string{"123456789012"}, false},
+		{sharedTestImage("ami-org", false), []string{
+			"arn:aws:organizations::123456789012:organization/o-abc",
+			"arn:aws:organizations::123456789012:ou/o-abc/ou-def",
+		}, false},
+		// Sharing with our own archive account doesn't count.
+		{sharedTestImage("ami-archive", false), nil, true},
+		// If we can't tell, we leave the image alone.
+		{sharedTestImage("ami-missing", false), nil, false},
+	}
+
+	for _, table := range tables {
+		a := AMIClean{
+			SkipShared:       true,
+			ArchiveAccountID: "210987654321",
+			ExpirationDate:   now,
+			Now:              stoppedClock,
+			Logger:           logger,
+			EC2Client:        m,
+		}
+
+		sharedWith, _ := a.CheckShared(table.image)
+		if !reflect.DeepEqual(sharedWith, table.sharedWith) {
+			t.Errorf("ERROR: CheckShared(%v);\n\texpected: %v\n\tgot: %v",
+				*table.image.ImageId,
+				table.sharedWith,
+				sharedWith,
+			)
+		}
+		if got := a.CheckImage(table.image); got != table.expected {
+			t.Errorf("ERROR: CheckImage of %v with SkipShared;\n\texpected: %v\n\tgot: %v",
+				*table.image.ImageId,
+				table.expected,
+				got,
+			)
+		}
+
+		// Without SkipShared, sharing doesn't matter.
+		a.SkipShared = false
+		if !a.CheckImage(table.image) {
+			t.Errorf("ERROR: CheckImage of %v without SkipShared;\n\texpected: true\n\tgot: false",
+				*table.image.ImageId,
+			)
+		}
+	}
+}
+
+func TestCheckImageIgnoreSharedUsage(t *testing.T) {
+	m := &mockEC2Client{
+		launchPermissions: map[string][]*ec2.LaunchPermission{
+			"ami-listed":   {{UserId: aws.String("123456789012")}},
+			"ami-tagged":   {{UserId: aws.String("123456789012")}},
+			"ami-other":    {{UserId: aws.String("123456789012")}},
+			"ami-unshared": nil,
+		},
+	}
+	tagged := sharedTestImage("ami-tagged", false)
+	tagged.Tags = []*ec2.Tag{{Key: aws.String("internal-only"), Value: aws.String("true")}}
+
+	tables := []struct {
+		image    *ec2.Image
+		expected bool
+	}{
+		{sharedTestImage("ami-listed", false), true},
+		{tagged, true},
+		// Only the images we were told about.
+		{sharedTestImage("ami-other", false), false},
+		{sharedTestImage("ami-unshared", false), true},
+	}
+
+	for _, table := range tables {
+		a := AMIClean{
+			SkipShared:           true,
+			IgnoreSharedImageIDs: map[string]bool{"ami-listed": true},
+			IgnoreSharedTag:      &ec2.Tag{Key: aws.String("internal-only")},
+			ExpirationDate:       now,
+			Now:                  stoppedClock,
+			Logger:               logger,
+			EC2Client:            m,
+		}
+		if got := a.CheckImage(table.image); got != table.expected {
+			t.Errorf("ERROR: CheckImage of %v with ignored shared usage;\n\texpected: %v\n\tgot: %v",
+				*table.image.ImageId,
+				table.expected,
+				got,
+			)
+		}
+	}
+}
+
+func TestPurgeImageRevokeLaunchPermissions(t *testing.T) {
+	image := sharedTestImage("ami-listed", false)
+
+	tables := []struct {
+		delete   bool
+		ignored  bool
+		expected []string
+	}{
+		// Everyone but the archive account loses access first.
+		{true, true, []string{
+			"ModifyImageAttribute:ami-listed:-123456789012",
+			"ModifyImageAttribute:ami-listed:-all",
+			"DeregisterImage:ami-listed",
+		}},
+		// A dry run only says it would.
+		{false, true, nil},
+		// Images purged for any other reason keep their permissions.
+		{true, false, []string{"DeregisterImage:ami-listed"}},
+	}
+
+	for _, table := range tables {
+		m := &mockEC2Client{
+			launchPermissions: map[string][]*ec2.LaunchPermission{
+				"ami-listed": {
+					{UserId: aws.String("123456789012")},
+					{Group: aws.String("all")},
+					{UserId: aws.String("210987654321")},
+				},
+			},
+		}
+		a := AMIClean{
+			Delete:                  table.delete,
+			RevokeLaunchPermissions: true,
+			ArchiveAccountID:        "210987654321",
+			Logger:                  logger,
+			EC2Client:               m,
+		}
+		if table.ignored {
+			a.IgnoreSharedImageIDs = map[string]bool{"ami-listed": true}
+		}
+		if _, err := a.PurgeImage(image); err != nil {
+			t.Fatalf("ERROR: PurgeImage returned error: %v", err)
+		}
+		if !reflect.DeepEqual(m.calls, table.expected) {
+			t.Errorf("ERROR: PurgeImage with RevokeLaunchPermissions, delete %v, ignored %v;\n\texpected calls: %v\n\tgot: %v",
+				table.delete,
+				table.ignored,
+				table.expected,
+				m.calls,
+			)
+		}
+	}
+}
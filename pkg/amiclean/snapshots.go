@@ -0,0 +1,33 @@
+package amiclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// GetSnapshots gets us all the EBS snapshots owned by our account. Unlike
+// DescribeImages, DescribeSnapshots is paginated, so we walk all the
+// pages and return a single list.
+func (a *AMIClean) GetSnapshots() ([]*ec2.Snapshot, error) {
+	var snapshots []*ec2.Snapshot
+
+	input := &ec2.DescribeSnapshotsInput{
+		OwnerIds: []*string{aws.String("self")},
+	}
+
+	err := a.EC2Client.DescribeSnapshotsPages(input,
+		func(page *ec2.DescribeSnapshotsOutput, lastPage bool) bool {
+			for _, snapshot := range page.Snapshots {
+				if snapshot != nil && snapshot.SnapshotId != nil {
+					snapshots = append(snapshots, snapshot)
+				}
+			}
+			return true
+		})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshots, nil
+}
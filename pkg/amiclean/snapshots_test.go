@@ -0,0 +1,46 @@
+package amiclean
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestGetSnapshots(t *testing.T) {
+	mock := &mockEC2Client{
+		snapshotPages: [][]*ec2.Snapshot{
+			{
+				{SnapshotId: aws.String("snap-11111111111111111")},
+				nil,
+			},
+			{
+				{SnapshotId: aws.String("snap-22222222222222222")},
+				{SnapshotId: nil},
+				{SnapshotId: aws.String("snap-33333333333333333")},
+			},
+		},
+	}
+	a := AMIClean{
+		Logger:    logger,
+		EC2Client: mock,
+	}
+
+	snapshots, err := a.GetSnapshots()
+	if err != nil {
+		t.Fatalf("ERROR: GetSnapshots returned error: %v", err)
+	}
+
+	expected := []string{"snap-11111111111111111", "snap-22222222222222222", "snap-33333333333333333"}
+	if len(snapshots) != len(expected) {
+		t.Fatalf("ERROR: expected %v snapshots, got %v", len(expected), len(snapshots))
+	}
+	for index, snapshot := range snapshots {
+		if *snapshot.SnapshotId != expected[index] {
+			t.Errorf("ERROR: expected snapshot %v, got %v", expected[index], *snapshot.SnapshotId)
+		}
+	}
+	if owners := mock.describeSnapshotsInput.OwnerIds; len(owners) != 1 || *owners[0] != "self" {
+		t.Errorf("ERROR: expected DescribeSnapshots for owner self, got %v", aws.StringValueSlice(owners))
+	}
+}
@@ -0,0 +1,43 @@
+package amiclean
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// ConfirmStable checks that the candidates SelectImages picked from
+// GetImages aren't a passing view of things. DescribeImages is
+// eventually consistent, so right after a burst of registrations it can
+// list images that aren't quite up to date. After waiting for delay, we
+// fetch the images again, always from AWS rather than the ImageCache,
+// and select from them the same way. It returns the IDs of the images
+// selected the second time but not the first (added), and the other way
+// around (removed); if both are empty, the candidates are stable.
+func (a *AMIClean) ConfirmStable(ctx context.Context, candidates []*ec2.Image, delay time.Duration) (added, removed []string, err error) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	case <-timer.C:
+	}
+
+	output, err := a.describeImages()
+	if err != nil {
+		return nil, nil, err
+	}
+	confirmed := a.SelectImages(output.Images)
+
+	var firstIDs, secondIDs []string
+	for _, image := range candidates {
+		firstIDs = append(firstIDs, aws.StringValue(image.ImageId))
+	}
+	for _, image := range confirmed {
+		secondIDs = append(secondIDs, aws.StringValue(image.ImageId))
+	}
+	added, removed = DiffImageIDs(firstIDs, secondIDs)
+	return added, removed, nil
+}
@@ -0,0 +1,87 @@
+package amiclean
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestConfirmStable(t *testing.T) {
+	// An old dev image that only turns up in the second listing, as one
+	// registered moments before the first might.
+	appeared := &ec2.Image{
+		ImageId:      aws.String("ami-44444444444444444"),
+		Name:         oldDevImage.Name,
+		CreationDate: oldDevImage.CreationDate,
+		State:        oldDevImage.State,
+	}
+
+	tables := []struct {
+		second  []*ec2.Image
+		added   []string
+		removed []string
+	}{
+		{testImages, nil, nil},
+		{[]*ec2.Image{newMasterImage, newishDevImage, noEbsImage}, nil, []string{*oldDevImage.ImageId}},
+		{append([]*ec2.Image{appeared}, testImages...), []string{*appeared.ImageId}, nil},
+	}
+
+	for _, table := range tables {
+		mock := &mockEC2Client{imagesPerCall: [][]*ec2.Image{testImages, table.second}}
+		a := AMIClean{
+			NamePrefix:     "devimage",
+			ExpirationDate: now.AddDate(0, 0, -30),
+			Now:            stoppedClock,
+			Logger:         logger,
+			EC2Client:      mock,
+			ImageCache:     NewImageCache(time.Hour),
+		}
+		output, err := a.GetImages()
+		if err != nil {
+			t.Fatalf("ERROR: GetImages returned error: %v", err)
+		}
+		candidates := a.SelectImages(output.Images)
+
+		added, removed, err := a.ConfirmStable(context.Background(), candidates, time.Millisecond)
+		if err != nil {
+			t.Fatalf("ERROR: ConfirmStable returned error: %v", err)
+		}
+		if !reflect.DeepEqual(added, table.added) || !reflect.DeepEqual(removed, table.removed) {
+			t.Errorf("ERROR: ConfirmStable;\n\texpected: added %v, removed %v\n\tgot: added %v, removed %v",
+				table.added, table.removed, added, removed)
+		}
+		// The second listing has to come from AWS, not the cache.
+		if mock.describeImagesCalls != 2 {
+			t.Errorf("ERROR: DescribeImages calls;\n\texpected: 2\n\tgot: %v", mock.describeImagesCalls)
+		}
+	}
+}
+
+func TestConfirmStableErrors(t *testing.T) {
+	a := AMIClean{
+		NamePrefix:     "devimage",
+		ExpirationDate: now.AddDate(0, 0, -30),
+		Now:            stoppedClock,
+		Logger:         logger,
+		EC2Client:      &mockEC2Client{describeImagesErr: awserr.New("RequestLimitExceeded", "slow down", nil)},
+	}
+	if _, _, err := a.ConfirmStable(context.Background(), nil, time.Millisecond); err == nil {
+		t.Errorf("ERROR: ConfirmStable didn't return the DescribeImages error")
+	}
+
+	mock := &mockEC2Client{}
+	a.EC2Client = mock
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := a.ConfirmStable(ctx, nil, time.Hour); err != context.Canceled {
+		t.Errorf("ERROR: ConfirmStable with a canceled context;\n\texpected: %v\n\tgot: %v", context.Canceled, err)
+	}
+	if mock.describeImagesCalls != 0 {
+		t.Errorf("ERROR: ConfirmStable listed the images after being canceled")
+	}
+}
@@ -0,0 +1,23 @@
+package amiclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// matchState returns true if the image is in one of our States, or if we
+// don't have any. Images that are pending, failed or in error are often
+// missing fields a finished image has, so they're best kept out unless
+// they are what we're after.
+func (a *AMIClean) matchState(image *ec2.Image) bool {
+	if len(a.States) == 0 {
+		return true
+	}
+	state := aws.StringValue(image.State)
+	for _, want := range a.States {
+		if state == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package amiclean
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestCheckImageStates(t *testing.T) {
+	available := &ec2.Image{
+		Name:           aws.String("devimage-available"),
+		ImageId:        aws.String("ami-available"),
+		State:          aws.String(ec2.ImageStateAvailable),
+		CreationDate:   aws.String("2019-01-01T00:00:00.000Z"),
+		RootDeviceType: aws.String("ebs"),
+	}
+	// Images that never finished building can be missing most of what
+	// a finished one has.
+	pending := &ec2.Image{
+		ImageId: aws.String("ami-pending"),
+		State:   aws.String(ec2.ImageStatePending),
+	}
+	failed := &ec2.Image{
+		ImageId:        aws.String("ami-failed"),
+		State:          aws.String(ec2.ImageStateFailed),
+		RootDeviceType: aws.String("ebs"),
+	}
+
+	tables := []struct {
+		states   []string
+		image    *ec2.Image
+		expected bool
+	}{
+		{[]string{ec2.ImageStateAvailable}, available, true},
+		{[]string{ec2.ImageStateAvailable}, pending, false},
+		{[]string{ec2.ImageStateAvailable}, failed, false},
+		// Cleaning up failed builds.
+		{[]string{ec2.ImageStateFailed}, available, false},
+		{[]string{ec2.ImageStateFailed}, failed, true},
+		{[]string{ec2.ImageStateAvailable, ec2.ImageStateFailed}, failed, true},
+		// Without any states, we don't look.
+		{nil, failed, true},
+	}
+
+	for _, table := range tables {
+		a := AMIClean{
+			States:         table.states,
+			ExpirationDate: now,
+			Now:            stoppedClock,
+			Logger:         logger,
+		}
+		if got := a.CheckImage(table.image); got != table.expected {
+			t.Errorf("ERROR: CheckImage of %v with states %v;\n\texpected: %v\n\tgot: %v",
+				*table.image.ImageId,
+				table.states,
+				table.expected,
+				got,
+			)
+		}
+	}
+}
+
+func TestRunFailedImages(t *testing.T) {
+	// A failed build has nothing but its ID and state to go on, and no
+	// snapshots to delete.
+	failed := &ec2.Image{
+		ImageId:        aws.String("ami-failed"),
+		State:          aws.String(ec2.ImageStateFailed),
+		RootDeviceType: aws.String("ebs"),
+	}
+	available := &ec2.Image{
+		Name:           aws.String("devimage-available"),
+		ImageId:        aws.String("ami-available"),
+		State:          aws.String(ec2.ImageStateAvailable),
+		CreationDate:   aws.String("2019-01-01T00:00:00.000Z"),
+		RootDeviceType: aws.String("ebs"),
+	}
+	mock := &mockEC2Client{}
+	a := AMIClean{
+		Delete:         true,
+		States:         []string{ec2.ImageStateFailed},
+		ExpirationDate: now,
+		Now:            stoppedClock,
+		Logger:         logger,
+		EC2Client:      mock,
+	}
+
+	ctx := context.Background()
+	results, err := a.Run(ctx, a.SelectImages([]*ec2.Image{failed, available}))
+	if err != nil {
+		t.Fatalf("ERROR: Run returned error: %v", err)
+	}
+	expected := []string{"DeregisterImage:ami-failed"}
+	if !reflect.DeepEqual(mock.calls, expected) || !reflect.DeepEqual(results.ImageIDs, []string{"ami-failed"}) {
+		t.Errorf("ERROR: Run of failed images;\n\texpected calls: %v\n\tgot: %v, purged %v", expected, mock.calls, results.ImageIDs)
+	}
+}
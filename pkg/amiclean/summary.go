@@ -0,0 +1,219 @@
+package amiclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// describeSnapshotsBatchSize is how many snapshot IDs we ask about in a
+// single DescribeSnapshots call.
+const describeSnapshotsBatchSize = 200
+
+// Summary describes the outcome of a cleanup run. In dry run mode, the
+// purged and deleted counts are what would have been removed.
+type Summary struct {
+	ImagesScanned    int `json:"images-scanned"`
+	ImagesMatched    int `json:"images-matched"`
+	ImagesPurged     int `json:"images-purged"`
+	SnapshotsDeleted int `json:"snapshots-deleted"`
+	// SnapshotsRetained counts the snapshots of deregistered images we
+	// kept, with RetainSnapshots.
+	SnapshotsRetained int `json:"snapshots-retained,omitempty"`
+	// SnapshotsDeferred counts snapshots marked for deletion by a later
+	// pass, when there is a snapshot grace period.
+	SnapshotsDeferred int `json:"snapshots-deferred,omitempty"`
+	// RetainedByPolicy counts the matched images we kept anyway, by
+	// the reason they were kept, such as RetainReasonMinRetain. They
+	// are counted in ImagesMatched but not ImagesPurged.
+	RetainedByPolicy map[string]int `json:"retained-by-policy,omitempty"`
+	// ImagesProtected counts matched images left alone because they
+	// have deregistration protection.
+	ImagesProtected int `json:"images-protected,omitempty"`
+	// ImagesMarked counts images tagged for a later purge, in
+	// soft-delete mode.
+	ImagesMarked int `json:"images-marked,omitempty"`
+	// ImagesDeprecated counts images deprecated instead of purged.
+	ImagesDeprecated int `json:"images-deprecated,omitempty"`
+	// Errors counts failures that stopped part of the run.
+	Errors int `json:"errors"`
+	// ErrorCodes counts the errors by their AWS error code, as grouped
+	// by GroupErrors.
+	ErrorCodes map[string]int `json:"error-codes,omitempty"`
+	// DeniedActions lists the calls we weren't permitted to make, as
+	// "Action:resource-id".
+	DeniedActions []string `json:"denied-actions,omitempty"`
+	// SnapshotsNotDeleted lists the snapshots VerifySnapshotsDeleted
+	// still found after they were deleted.
+	SnapshotsNotDeleted []string `json:"snapshots-not-deleted,omitempty"`
+	// Interrupted is set if the run was stopped early by a signal or a
+	// deadline, leaving some of the matched images unpurged.
+	Interrupted bool `json:"interrupted,omitempty"`
+	// SnapshotGiB and EstimatedMonthlySavings are only filled in when
+	// a snapshot cost was given.
+	SnapshotGiB             int64   `json:"snapshot-gib,omitempty"`
+	EstimatedMonthlySavings float64 `json:"estimated-monthly-savings,omitempty"`
+	// Groups are the GroupTotals of the run, when grouping by a tag.
+	Groups map[string]GroupTotal `json:"groups,omitempty"`
+	// AgeHistogram counts the images scanned by age, if it was asked
+	// for.
+	AgeHistogram *AgeHistogram `json:"age-histogram,omitempty"`
+}
+
+// Add adds the counts from another run's summary to this one, such as
+// when totalling the summaries of several regions.
+func (s *Summary) Add(other Summary) {
+	s.ImagesScanned += other.ImagesScanned
+	s.ImagesMatched += other.ImagesMatched
+	s.ImagesPurged += other.ImagesPurged
+	s.SnapshotsDeleted += other.SnapshotsDeleted
+	s.SnapshotsRetained += other.SnapshotsRetained
+	s.SnapshotsDeferred += other.SnapshotsDeferred
+	for reason, count := range other.RetainedByPolicy {
+		if s.RetainedByPolicy == nil {
+			s.RetainedByPolicy = make(map[string]int)
+		}
+		s.RetainedByPolicy[reason] += count
+	}
+	s.ImagesProtected += other.ImagesProtected
+	s.ImagesMarked += other.ImagesMarked
+	s.ImagesDeprecated += other.ImagesDeprecated
+	s.Errors += other.Errors
+	for code, count := range other.ErrorCodes {
+		if s.ErrorCodes == nil {
+			s.ErrorCodes = make(map[string]int)
+		}
+		s.ErrorCodes[code] += count
+	}
+	s.DeniedActions = append(s.DeniedActions, other.DeniedActions...)
+	s.SnapshotsNotDeleted = append(s.SnapshotsNotDeleted, other.SnapshotsNotDeleted...)
+	s.Interrupted = s.Interrupted || other.Interrupted
+	s.SnapshotGiB += other.SnapshotGiB
+	s.EstimatedMonthlySavings += other.EstimatedMonthlySavings
+	for group, total := range other.Groups {
+		if s.Groups == nil {
+			s.Groups = make(map[string]GroupTotal)
+		}
+		sum := s.Groups[group]
+		sum.ImagesPurged += total.ImagesPurged
+		sum.SnapshotGiB += total.SnapshotGiB
+		sum.EstimatedMonthlySavings += total.EstimatedMonthlySavings
+		s.Groups[group] = sum
+	}
+	if other.AgeHistogram != nil {
+		if s.AgeHistogram == nil {
+			s.AgeHistogram = NewAgeHistogram()
+		}
+		s.AgeHistogram.Merge(other.AgeHistogram)
+	}
+}
+
+// EstimateSnapshotSavings adds up the sizes of the snapshots we are
+// deleting, in GiB, and multiplies them by the cost of a GiB-month of
+// snapshot storage. Snapshots are incremental, so this overestimates the
+// real savings; it's meant as a rough figure for reporting.
+func EstimateSnapshotSavings(sizes []int64, costPerGiBMonth float64) (int64, float64) {
+	var totalGiB int64
+	for _, size := range sizes {
+		totalGiB += size
+	}
+	return totalGiB, float64(totalGiB) * costPerGiBMonth
+}
+
+// ImageSnapshotIDs returns the IDs of the EBS snapshots backing an image.
+// Images without an EBS root device have none that we will delete.
+// Mappings for instance store volumes, or EBS volumes without a snapshot,
+// are skipped.
+func ImageSnapshotIDs(image *ec2.Image) []string {
+	var snapshotIDs []string
+	if aws.StringValue(image.RootDeviceType) != "ebs" {
+		return snapshotIDs
+	}
+	for _, blockDevice := range image.BlockDeviceMappings {
+		if blockDevice.Ebs == nil || blockDevice.Ebs.SnapshotId == nil {
+			continue
+		}
+		snapshotIDs = append(snapshotIDs, *blockDevice.Ebs.SnapshotId)
+	}
+	return snapshotIDs
+}
+
+// EstimatePurgeSavings is the pre-flight cost estimate for purging the
+// given images. It looks up the sizes of their snapshots and returns the
+// total in GiB along with what storing that much costs a month at
+// SnapshotCost per GiB-month. A snapshot shared by several of the images
+// is only counted once. The sizes are kept, so that the Report can show
+// each image's share.
+func (a *AMIClean) EstimatePurgeSavings(images []*ec2.Image) (int64, float64, error) {
+	// In a dry run, snapshots other images use aren't going anywhere.
+	if !a.Delete && !a.BatchSnapshots && a.dryRunReferences == nil {
+		a.findDryRunReferences(images)
+	}
+
+	seen := make(map[string]bool)
+	var snapshotIDs []string
+	for _, image := range images {
+		for _, snapshotID := range a.deletableSnapshots(image) {
+			if !seen[snapshotID] {
+				seen[snapshotID] = true
+				snapshotIDs = append(snapshotIDs, snapshotID)
+			}
+		}
+	}
+
+	sizes := make(map[string]int64, len(snapshotIDs))
+	err := a.describeSnapshots(snapshotIDs, func(snapshot *ec2.Snapshot) {
+		sizes[aws.StringValue(snapshot.SnapshotId)] = aws.Int64Value(snapshot.VolumeSize)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	a.snapshotSizes = sizes
+
+	var sizeList []int64
+	for _, size := range sizes {
+		sizeList = append(sizeList, size)
+	}
+	totalGiB, savings := EstimateSnapshotSavings(sizeList, a.SnapshotCost)
+	return totalGiB, savings, nil
+}
+
+// GetSnapshotSizes looks up the size, in GiB, of each of the given
+// snapshots.
+func (a *AMIClean) GetSnapshotSizes(snapshotIDs []string) ([]int64, error) {
+	var sizes []int64
+	err := a.describeSnapshots(snapshotIDs, func(snapshot *ec2.Snapshot) {
+		sizes = append(sizes, aws.Int64Value(snapshot.VolumeSize))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+// describeSnapshots calls fn for each of the given snapshots, asking
+// about them a batch at a time.
+func (a *AMIClean) describeSnapshots(snapshotIDs []string, fn func(*ec2.Snapshot)) error {
+	for start := 0; start < len(snapshotIDs); start += describeSnapshotsBatchSize {
+		end := start + describeSnapshotsBatchSize
+		if end > len(snapshotIDs) {
+			end = len(snapshotIDs)
+		}
+		input := &ec2.DescribeSnapshotsInput{
+			SnapshotIds: aws.StringSlice(snapshotIDs[start:end]),
+		}
+		err := a.EC2Client.DescribeSnapshotsPages(input,
+			func(page *ec2.DescribeSnapshotsOutput, lastPage bool) bool {
+				for _, snapshot := range page.Snapshots {
+					if snapshot != nil {
+						fn(snapshot)
+					}
+				}
+				return true
+			})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package amiclean
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestEstimateSnapshotSavings(t *testing.T) {
+	tables := []struct {
+		sizes    []int64
+		cost     float64
+		totalGiB int64
+		savings  float64
+	}{
+		{nil, 0.05, 0, 0},
+		{[]int64{8}, 0, 8, 0},
+		{[]int64{8, 100, 12}, 0.05, 120, 6},
+	}
+
+	for _, table := range tables {
+		totalGiB, savings := EstimateSnapshotSavings(table.sizes, table.cost)
+		if totalGiB != table.totalGiB || savings != table.savings {
+			t.Errorf("ERROR: sizes: %v, cost: %v;\n\texpected: %v GiB, %v\n\tgot: %v GiB, %v",
+				table.sizes,
+				table.cost,
+				table.totalGiB,
+				table.savings,
+				totalGiB,
+				savings,
+			)
+		}
+	}
+}
+
+func TestImageSnapshotIDs(t *testing.T) {
+	expected := [][]string{
+		{"snap-11111111111111111"},
+		{"snap-22222222222222222", "snap-22222222222222223"},
+		{"snap-33333333333333333"},
+		nil,
+	}
+	for index, image := range testImages {
+		snapshotIDs := ImageSnapshotIDs(image)
+		if !reflect.DeepEqual(snapshotIDs, expected[index]) {
+			t.Errorf("ERROR: ImageSnapshotIDs for %v;\n\texpected: %v\n\tgot: %v",
+				*image.ImageId,
+				expected[index],
+				snapshotIDs,
+			)
+		}
+	}
+}
+
+func TestEstimatePurgeSavings(t *testing.T) {
+	// The two images share a snapshot, which only counts once in the
+	// total but is part of each image's share in the report.
+	first := batchTestImage("ami-first", "snap-shared", "snap-first")
+	second := batchTestImage("ami-second", "snap-shared")
+	mock := &mockEC2Client{
+		snapshotPages: [][]*ec2.Snapshot{
+			{
+				{SnapshotId: aws.String("snap-shared"), VolumeSize: aws.Int64(8)},
+				{SnapshotId: aws.String("snap-first"), VolumeSize: aws.Int64(100)},
+			},
+		},
+	}
+	var out bytes.Buffer
+	a := AMIClean{
+		Delete:       true,
+		SnapshotCost: 0.5,
+		Report:       NewJSONLinesReportWriter(&out),
+		Logger:       logger,
+		EC2Client:    mock,
+	}
+
+	totalGiB, savings, err := a.EstimatePurgeSavings([]*ec2.Image{first, second})
+	if err != nil {
+		t.Fatalf("ERROR: EstimatePurgeSavings returned error: %v", err)
+	}
+	if totalGiB != 108 || savings != 54 {
+		t.Errorf("ERROR: EstimatePurgeSavings;\n\texpected: 108 GiB, 54\n\tgot: %v GiB, %v", totalGiB, savings)
+	}
+
+	a.Run(context.Background(), []*ec2.Image{first, second})
+	shares := make(map[string][2]float64)
+	decoder := json.NewDecoder(&out)
+	for decoder.More() {
+		var r ImageReport
+		if err := decoder.Decode(&r); err != nil {
+			t.Fatalf("ERROR: could not decode report line: %v", err)
+		}
+		shares[r.ImageID] = [2]float64{float64(r.SnapshotGiB), r.EstimatedMonthlySavings}
+	}
+	expected := map[string][2]float64{
+		"ami-first":  {108, 54},
+		"ami-second": {8, 4},
+	}
+	if !reflect.DeepEqual(shares, expected) {
+		t.Errorf("ERROR: Run report after EstimatePurgeSavings;\n\texpected: %v\n\tgot: %v", expected, shares)
+	}
+}
+
+func TestSummaryAdd(t *testing.T) {
+	total := Summary{
+		ImagesScanned:    10,
+		ImagesPurged:     2,
+		SnapshotsDeleted: 3,
+		DeniedActions:    []string{"DeregisterImage:ami-1"},
+	}
+	total.Add(Summary{
+		ImagesScanned:       5,
+		ImagesMatched:       4,
+		ImagesPurged:        1,
+		SnapshotsDeleted:    1,
+		RetainedByPolicy:    map[string]int{RetainReasonMinRetain: 3},
+		Errors:              1,
+		ErrorCodes:          map[string]int{"Throttling": 1},
+		DeniedActions:       []string{"DeleteSnapshot:snap-2"},
+		Interrupted:         true,
+		SnapshotsNotDeleted: []string{"snap-3"},
+		SnapshotGiB:         8,
+		Groups:              map[string]GroupTotal{"web": {ImagesPurged: 1, SnapshotGiB: 8}},
+	})
+	total.Add(Summary{
+		RetainedByPolicy: map[string]int{RetainReasonMinRetain: 1},
+		ImagesDeprecated: 2,
+		Groups:           map[string]GroupTotal{"web": {ImagesPurged: 2, SnapshotGiB: 4}, "db": {ImagesPurged: 1}},
+	})
+
+	expected := Summary{
+		ImagesScanned:       15,
+		ImagesMatched:       4,
+		ImagesPurged:        3,
+		SnapshotsDeleted:    4,
+		RetainedByPolicy:    map[string]int{RetainReasonMinRetain: 4},
+		ImagesDeprecated:    2,
+		Errors:              1,
+		ErrorCodes:          map[string]int{"Throttling": 1},
+		DeniedActions:       []string{"DeregisterImage:ami-1", "DeleteSnapshot:snap-2"},
+		Interrupted:         true,
+		SnapshotsNotDeleted: []string{"snap-3"},
+		SnapshotGiB:         8,
+		Groups:              map[string]GroupTotal{"web": {ImagesPurged: 3, SnapshotGiB: 12}, "db": {ImagesPurged: 1}},
+	}
+	if !reflect.DeepEqual(total, expected) {
+		t.Errorf("ERROR: Summary.Add;\n\texpected: %+v\n\tgot: %+v", expected, total)
+	}
+}
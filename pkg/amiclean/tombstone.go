@@ -0,0 +1,48 @@
+package amiclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+const (
+	// PurgedByTagKey and PurgedAtTagKey are the tombstone tags we put on
+	// AMIs and snapshots just before deleting them, when TagBeforeDelete
+	// is set. They show up in CloudTrail and AWS Config, which makes it
+	// easier to work out afterward what removed a resource and when.
+	PurgedByTagKey = "PurgedBy"
+	PurgedAtTagKey = "PurgedAt"
+
+	// PurgedByTagValue identifies this tool in the PurgedBy tag.
+	PurgedByTagValue = "ami-cleaner"
+)
+
+// tagPurged puts the tombstone tags on an image and its snapshots before
+// we delete them.
+func (a *AMIClean) tagPurged(imageID string, snapshotIDs []string) error {
+	purgedAt := a.now().Format(RFC8601)
+	resourceIDs := append([]string{imageID}, snapshotIDs...)
+	if !a.Delete {
+		a.Logger.Info("would tag resources before purging",
+			zap.Strings("resource-ids", resourceIDs),
+			zap.String("purged-at", purgedAt),
+		)
+		return nil
+	}
+
+	a.Logger.Info("tagging resources before purging",
+		zap.Strings("resource-ids", resourceIDs),
+		zap.String("purged-at", purgedAt),
+	)
+	return a.timeCall("CreateTags", zap.String("ami-id", imageID), func() error {
+		_, err := a.EC2Client.CreateTags(&ec2.CreateTagsInput{
+			Resources: aws.StringSlice(resourceIDs),
+			Tags: []*ec2.Tag{
+				{Key: aws.String(PurgedByTagKey), Value: aws.String(PurgedByTagValue)},
+				{Key: aws.String(PurgedAtTagKey), Value: aws.String(purgedAt)},
+			},
+		})
+		return err
+	})
+}
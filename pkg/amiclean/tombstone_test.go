@@ -0,0 +1,63 @@
+package amiclean
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPurgeImageTagBeforeDelete(t *testing.T) {
+	mock := &mockEC2Client{}
+	a := AMIClean{
+		Delete:          true,
+		TagBeforeDelete: true,
+		Logger:          logger,
+		EC2Client:       mock,
+	}
+
+	_, err := a.PurgeImage(newishDevImage)
+	if err != nil {
+		t.Fatalf("ERROR: PurgeImage returned error: %v", err)
+	}
+
+	// Everything should be tagged before anything is removed.
+	expected := []string{
+		"CreateTags:ami-22222222222222222",
+		"CreateTags:snap-22222222222222222",
+		"CreateTags:snap-22222222222222223",
+		"DeregisterImage:ami-22222222222222222",
+		"DeleteSnapshot:snap-22222222222222222",
+		"DeleteSnapshot:snap-22222222222222223",
+	}
+	if !reflect.DeepEqual(mock.calls, expected) {
+		t.Errorf("ERROR: PurgeImage with TagBeforeDelete;\n\texpected: %v\n\tgot: %v", expected, mock.calls)
+	}
+
+	tags := mock.createTagsInputs[0].Tags
+	if *tags[0].Key != PurgedByTagKey || *tags[0].Value != PurgedByTagValue {
+		t.Errorf("ERROR: expected tag %v=%v, got %v=%v", PurgedByTagKey, PurgedByTagValue, *tags[0].Key, *tags[0].Value)
+	}
+	if *tags[1].Key != PurgedAtTagKey {
+		t.Errorf("ERROR: expected tag key %v, got %v", PurgedAtTagKey, *tags[1].Key)
+	}
+	if _, err := time.Parse(RFC8601, *tags[1].Value); err != nil {
+		t.Errorf("ERROR: could not parse purge time %v: %v", *tags[1].Value, err)
+	}
+}
+
+func TestPurgeImageTagBeforeDeleteDryRun(t *testing.T) {
+	mock := &mockEC2Client{}
+	a := AMIClean{
+		TagBeforeDelete: true,
+		Logger:          logger,
+		EC2Client:       mock,
+	}
+
+	_, err := a.PurgeImage(newishDevImage)
+	if err != nil {
+		t.Fatalf("ERROR: PurgeImage returned error: %v", err)
+	}
+	if len(mock.calls) != 0 {
+		t.Errorf("ERROR: expected no API calls in dry run mode, got %v", mock.calls)
+	}
+}
@@ -0,0 +1,71 @@
+package amiclean
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+// ttlDateLayouts are the ways a TTL tag can give a date to expire at,
+// rather than a number of days.
+var ttlDateLayouts = []string{"2006-01-02", time.RFC3339}
+
+// isExpired returns true if an image is old enough to be purged, which
+// is once its expirationTime has come.
+func (a *AMIClean) isExpired(image *ec2.Image, creationTime time.Time) bool {
+	return !a.expirationTime(image, creationTime).After(a.now())
+}
+
+// expirationTime works out when an image expires. That's normally as
+// long after its creation as our ExpirationDate is before now, but if we
+// have a TTLTagKey and the image is tagged with it, the tag's value is
+// either the number of days after its creation the image should be kept,
+// or the date it expires at, instead. A TTL tag we can't make sense of
+// gets a warning, and the image falls back to the usual policy. The
+// ttlDays in a lifecycle tag, if we have a LifecycleTagKey, overrides
+// both.
+func (a *AMIClean) expirationTime(image *ec2.Image, creationTime time.Time) time.Time {
+	if days, ok := a.lifecycleTTL(image); ok {
+		return creationTime.AddDate(0, 0, days)
+	}
+	if a.TTLTagKey != "" {
+		for _, tag := range image.Tags {
+			if aws.StringValue(tag.Key) != a.TTLTagKey {
+				continue
+			}
+			expiresAt, ok := ttlExpiration(aws.StringValue(tag.Value), creationTime)
+			if !ok {
+				a.Logger.Warn("could not parse TTL tag; using the global retention",
+					zap.String("ami-id", *image.ImageId),
+					zap.String("ttl-tag-key", a.TTLTagKey),
+					zap.String("ttl-tag-value", aws.StringValue(tag.Value)),
+				)
+				break
+			}
+			return expiresAt
+		}
+	}
+
+	return creationTime.Add(a.now().Sub(a.ExpirationDate))
+}
+
+// ttlExpiration works out when an image expires from its TTL tag's
+// value: a whole number of days after it was created, or a date. A
+// date without a time is the start of that day, in UTC.
+func ttlExpiration(value string, creationTime time.Time) (time.Time, bool) {
+	if days, err := strconv.Atoi(value); err == nil {
+		if days < 0 {
+			return time.Time{}, false
+		}
+		return creationTime.AddDate(0, 0, days), true
+	}
+	for _, layout := range ttlDateLayouts {
+		if expiresAt, err := time.Parse(layout, value); err == nil {
+			return expiresAt, true
+		}
+	}
+	return time.Time{}, false
+}
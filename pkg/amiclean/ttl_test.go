@@ -0,0 +1,145 @@
+package amiclean
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func ttlTestImage(ttl string) *ec2.Image {
+	return &ec2.Image{
+		Name:         aws.String("devimage-ttl"),
+		ImageId:      aws.String("ami-99999999999999999"),
+		CreationDate: aws.String("2019-03-31T21:04:57.000Z"),
+		Tags: []*ec2.Tag{
+			{Key: aws.String("ttl-days"), Value: aws.String(ttl)},
+		},
+		RootDeviceType: aws.String("ebs"),
+	}
+}
+
+func TestCheckImageTTL(t *testing.T) {
+	tables := []struct {
+		ttl           string
+		retentionDays int
+		expected      bool
+	}{
+		// The image is only a day older than our test "now", so the
+		// global policy alone would keep it with a 30 day retention.
+		{"1", 30, true},
+		// A long TTL keeps an image the global policy would purge.
+		{"36500", 0, false},
+		// Malformed TTLs fall back to the global policy.
+		{"fourteen", 30, false},
+		{"fourteen", 0, true},
+		{"-1", 0, true},
+	}
+
+	for _, table := range tables {
+		a := AMIClean{
+			TTLTagKey:      "ttl-days",
+			ExpirationDate: now.AddDate(0, 0, -table.retentionDays),
+			Logger:         logger,
+		}
+		if a.CheckImage(ttlTestImage(table.ttl)) != table.expected {
+			t.Errorf("ERROR: CheckImage with TTL %v and retention %v;\n\texpected: %v\n\tgot: %v",
+				table.ttl,
+				table.retentionDays,
+				table.expected,
+				!table.expected,
+			)
+		}
+	}
+}
+
+func TestCheckImageTTLDate(t *testing.T) {
+	tables := []struct {
+		ttl           string
+		retentionDays int
+		expected      bool
+	}{
+		// A date that has come expires the image, even a day after
+		// it was created. A date alone is the start of that day.
+		{"2019-03-31", 30, true},
+		{"2019-04-01", 30, true},
+		{"2019-03-31T22:00:00Z", 30, true},
+		// One still to come keeps it, however old.
+		{"2019-06-01", 0, false},
+		{"2019-04-01T00:00:01Z", 0, false},
+		// Malformed dates fall back to the global policy.
+		{"2019-06-31", 0, true},
+		{"June 1st", 30, false},
+	}
+
+	for _, table := range tables {
+		a := AMIClean{
+			TTLTagKey:      "ttl-days",
+			ExpirationDate: now.AddDate(0, 0, -table.retentionDays),
+			Now:            stoppedClock,
+			Logger:         logger,
+		}
+		if a.CheckImage(ttlTestImage(table.ttl)) != table.expected {
+			t.Errorf("ERROR: CheckImage with TTL date %v and retention %v;\n\texpected: %v\n\tgot: %v",
+				table.ttl,
+				table.retentionDays,
+				table.expected,
+				!table.expected,
+			)
+		}
+	}
+}
+
+func TestCheckImageAgeBoundaries(t *testing.T) {
+	image := func(creationDate string, tags ...*ec2.Tag) *ec2.Image {
+		return &ec2.Image{
+			Name:           aws.String("devimage-boundary"),
+			ImageId:        aws.String("ami-99999999999999999"),
+			CreationDate:   aws.String(creationDate),
+			Tags:           tags,
+			RootDeviceType: aws.String("ebs"),
+		}
+	}
+	ttl := &ec2.Tag{Key: aws.String("ttl-days"), Value: aws.String("7")}
+
+	tables := []struct {
+		name     string
+		image    *ec2.Image
+		expected bool
+	}{
+		// An image created exactly at the expiration date has expired,
+		// and one created a millisecond later hasn't.
+		{"at expiration", image("2019-03-25T00:00:00.000Z"), true},
+		{"just after expiration", image("2019-03-25T00:00:00.001Z"), false},
+		// The same goes for a TTL, which counts from the creation date
+		// up to now.
+		{"at ttl", image("2019-03-25T00:00:00.000Z", ttl), true},
+		{"just inside ttl", image("2019-03-25T00:00:00.001Z", ttl), false},
+	}
+
+	a := AMIClean{
+		TTLTagKey:      "ttl-days",
+		ExpirationDate: now.AddDate(0, 0, -7),
+		Now:            stoppedClock,
+		Logger:         logger,
+	}
+	for _, table := range tables {
+		if a.CheckImage(table.image) != table.expected {
+			t.Errorf("ERROR: CheckImage %v;\n\texpected: %v\n\tgot: %v", table.name, table.expected, !table.expected)
+		}
+	}
+
+	// A deprecation time has to have passed, so one that's exactly now
+	// doesn't count yet.
+	deprecated := image("2019-03-01T00:00:00.000Z")
+	deprecated.DeprecationTime = aws.String(now.Format(RFC8601))
+	a = AMIClean{DeprecatedOnly: true, Now: stoppedClock, Logger: logger}
+	if a.CheckImage(deprecated) {
+		t.Errorf("ERROR: CheckImage with deprecation time now;\n\texpected: false\n\tgot: true")
+	}
+	a.Now = func() time.Time { return now.Add(time.Millisecond) }
+	if !a.CheckImage(deprecated) {
+		t.Errorf("ERROR: CheckImage with deprecation time just past;\n\texpected: true\n\tgot: false")
+	}
+}
@@ -0,0 +1,21 @@
+package amiclean
+
+// acquireUsageCheck waits for one of the UsageCheckConcurrency slots
+// for a CheckUnused call, and returns the function that gives it back.
+// Run rechecks usage from each of its Concurrency workers, and without
+// a limit, every one of them can have a DescribeInstances call out at
+// once. With UsageCheckConcurrency unset, there's no limit.
+func (a *AMIClean) acquireUsageCheck() (release func()) {
+	if a.UsageCheckConcurrency < 1 {
+		return func() {}
+	}
+	a.mu.Lock()
+	if a.usageChecks == nil {
+		a.usageChecks = make(chan struct{}, a.UsageCheckConcurrency)
+	}
+	slots := a.usageChecks
+	a.mu.Unlock()
+
+	slots <- struct{}{}
+	return func() { <-slots }
+}
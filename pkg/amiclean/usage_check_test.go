@@ -0,0 +1,103 @@
+package amiclean
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// concurrentUsageClient counts how many DescribeInstances calls are out
+// at once, holding each one long enough for the others to pile up. If
+// err is set, every call fails with it.
+type concurrentUsageClient struct {
+	*mockEC2Client
+	err error
+
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+}
+
+func (c *concurrentUsageClient) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	c.mu.Lock()
+	c.inFlight++
+	if c.inFlight > c.peak {
+		c.peak = c.inFlight
+	}
+	c.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	c.mu.Lock()
+	c.inFlight--
+	c.mu.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.mockEC2Client.DescribeInstances(input)
+}
+
+func TestUsageCheckConcurrency(t *testing.T) {
+	var images []*ec2.Image
+	for i := 0; i < 16; i++ {
+		images = append(images, batchTestImage(fmt.Sprintf("ami-%d", i)))
+	}
+
+	tables := []struct {
+		usageCheckConcurrency int
+		maxPeak               int
+	}{
+		{1, 1},
+		{2, 2},
+		// Without a limit, it's only the workers that hold them back.
+		{0, 8},
+	}
+
+	for _, table := range tables {
+		client := &concurrentUsageClient{mockEC2Client: &mockEC2Client{}}
+		a := AMIClean{
+			Delete:                true,
+			Unused:                true,
+			RecheckUnused:         true,
+			UsageCheckConcurrency: table.usageCheckConcurrency,
+			Concurrency:           8,
+			Now:                   stoppedClock,
+			Logger:                logger,
+			EC2Client:             client,
+		}
+		results, err := a.Run(context.Background(), images)
+		if err != nil {
+			t.Fatalf("ERROR: Run returned error: %v", err)
+		}
+		if len(results.ImageIDs) != len(images) || client.peak > table.maxPeak {
+			t.Errorf("ERROR: Run with UsageCheckConcurrency %v;\n\texpected: %v purged, at most %v usage checks at once\n\tgot: %v purged, %v at once",
+				table.usageCheckConcurrency,
+				len(images),
+				table.maxPeak,
+				len(results.ImageIDs),
+				client.peak,
+			)
+		}
+	}
+}
+
+func TestCheckUnusedReleasesSlot(t *testing.T) {
+	// A failed check has to give its slot back, or the next one would
+	// wait forever.
+	a := AMIClean{
+		UsageCheckConcurrency: 1,
+		Logger:                logger,
+		EC2Client:             &concurrentUsageClient{mockEC2Client: &mockEC2Client{}, err: fmt.Errorf("throttled")},
+	}
+	image := &ec2.Image{ImageId: aws.String("ami-1")}
+	for i := 0; i < 2; i++ {
+		if _, err := a.CheckUnused(image); err == nil {
+			t.Errorf("ERROR: CheckUnused with a failing DescribeInstances;\n\texpected: error\n\tgot: nil")
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package amiclean
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"go.uber.org/zap"
+)
+
+// verifyDeletionInterval is how long VerifySnapshotsDeleted waits
+// between looks at the snapshots still to go.
+var verifyDeletionInterval = 5 * time.Second
+
+// VerifySnapshotsDeleted confirms that snapshots we've deleted are gone.
+// DeleteSnapshot returns before the deletion is finished, and for a
+// little while after, DescribeSnapshots can still list the snapshot. We
+// keep asking about the ones that are still there until none are, or
+// until timeout. We ask by filtering on their IDs, so that the ones
+// already gone just drop out of the results, instead of the whole call
+// failing with InvalidSnapshot.NotFound, which also counts as them all
+// being gone. It returns the snapshots left once the time was up, or ctx
+// was done, sorted.
+func (a *AMIClean) VerifySnapshotsDeleted(ctx context.Context, snapshotIDs []string, timeout time.Duration) ([]string, error) {
+	remaining := snapshotIDs
+	deadline := time.Now().Add(timeout)
+	for {
+		var err error
+		remaining, err = a.existingSnapshots(remaining)
+		if err != nil {
+			return nil, err
+		}
+		if len(remaining) == 0 {
+			return nil, nil
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			break
+		}
+		if wait > verifyDeletionInterval {
+			wait = verifyDeletionInterval
+		}
+		a.Logger.Debug("waiting for deleted snapshots to go",
+			zap.Strings("snapshot-ids", remaining),
+		)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			sort.Strings(remaining)
+			return remaining, nil
+		case <-timer.C:
+		}
+	}
+	sort.Strings(remaining)
+	return remaining, nil
+}
+
+// existingSnapshots returns which of the snapshots DescribeSnapshots
+// still lists, asking about them a batch at a time.
+func (a *AMIClean) existingSnapshots(snapshotIDs []string) ([]string, error) {
+	var existing []string
+	for start := 0; start < len(snapshotIDs); start += describeSnapshotsBatchSize {
+		end := start + describeSnapshotsBatchSize
+		if end > len(snapshotIDs) {
+			end = len(snapshotIDs)
+		}
+		input := &ec2.DescribeSnapshotsInput{
+			Filters: []*ec2.Filter{
+				{Name: aws.String("snapshot-id"), Values: aws.StringSlice(snapshotIDs[start:end])},
+			},
+		}
+		err := a.EC2Client.DescribeSnapshotsPages(input,
+			func(page *ec2.DescribeSnapshotsOutput, lastPage bool) bool {
+				for _, snapshot := range page.Snapshots {
+					if snapshot != nil && snapshot.SnapshotId != nil {
+						existing = append(existing, *snapshot.SnapshotId)
+					}
+				}
+				return true
+			})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidSnapshot.NotFound" {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return existing, nil
+}
@@ -0,0 +1,93 @@
+package amiclean
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestVerifySnapshotsDeleted(t *testing.T) {
+	defer func(interval time.Duration) { verifyDeletionInterval = interval }(verifyDeletionInterval)
+	verifyDeletionInterval = time.Millisecond
+
+	snapshot := func(snapshotID string) *ec2.Snapshot {
+		return &ec2.Snapshot{SnapshotId: aws.String(snapshotID)}
+	}
+	snapshotIDs := []string{"snap-1", "snap-2", "snap-3"}
+
+	tables := []struct {
+		name      string
+		perCall   [][][]*ec2.Snapshot
+		err       error
+		remaining []string
+		calls     int
+	}{
+		{"gone at once", nil, nil, nil, 1},
+		{"gone after a while", [][][]*ec2.Snapshot{
+			{{snapshot("snap-1"), snapshot("snap-3")}},
+			{{snapshot("snap-3")}},
+		}, nil, nil, 3},
+		{"not found", nil, awserr.New("InvalidSnapshot.NotFound", "gone", nil), nil, 1},
+	}
+
+	for _, table := range tables {
+		mock := &mockEC2Client{snapshotPagesPerCall: table.perCall, describeSnapshotsErr: table.err}
+		a := AMIClean{Logger: logger, EC2Client: mock}
+		remaining, err := a.VerifySnapshotsDeleted(context.Background(), snapshotIDs, time.Minute)
+		if err != nil {
+			t.Fatalf("ERROR: VerifySnapshotsDeleted %v returned error: %v", table.name, err)
+		}
+		if !reflect.DeepEqual(remaining, table.remaining) || mock.describeSnapshotsCalls != table.calls {
+			t.Errorf("ERROR: VerifySnapshotsDeleted %v;\n\texpected: %v left after %v calls\n\tgot: %v left after %v calls",
+				table.name, table.remaining, table.calls, remaining, mock.describeSnapshotsCalls)
+		}
+	}
+
+	// The later looks only ask about what was still there.
+	mock := &mockEC2Client{snapshotPagesPerCall: [][][]*ec2.Snapshot{{{snapshot("snap-2")}}}}
+	a := AMIClean{Logger: logger, EC2Client: mock}
+	if _, err := a.VerifySnapshotsDeleted(context.Background(), snapshotIDs, time.Minute); err != nil {
+		t.Fatalf("ERROR: VerifySnapshotsDeleted returned error: %v", err)
+	}
+	filter := mock.describeSnapshotsInput.Filters[0]
+	if aws.StringValue(filter.Name) != "snapshot-id" || !reflect.DeepEqual(aws.StringValueSlice(filter.Values), []string{"snap-2"}) {
+		t.Errorf("ERROR: last DescribeSnapshots filter;\n\texpected: snapshot-id [snap-2]\n\tgot: %v %v",
+			aws.StringValue(filter.Name), aws.StringValueSlice(filter.Values))
+	}
+}
+
+func TestVerifySnapshotsDeletedTimeout(t *testing.T) {
+	defer func(interval time.Duration) { verifyDeletionInterval = interval }(verifyDeletionInterval)
+	verifyDeletionInterval = time.Millisecond
+
+	// A snapshot that never goes.
+	mock := &mockEC2Client{snapshotPages: [][]*ec2.Snapshot{{{SnapshotId: aws.String("snap-2")}}}}
+	a := AMIClean{Logger: logger, EC2Client: mock}
+	remaining, err := a.VerifySnapshotsDeleted(context.Background(), []string{"snap-1", "snap-2"}, 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("ERROR: VerifySnapshotsDeleted returned error: %v", err)
+	}
+	if expected := []string{"snap-2"}; !reflect.DeepEqual(remaining, expected) {
+		t.Errorf("ERROR: VerifySnapshotsDeleted after the timeout;\n\texpected: %v\n\tgot: %v", expected, remaining)
+	}
+	if mock.describeSnapshotsCalls < 2 {
+		t.Errorf("ERROR: expected DescribeSnapshots to be polled, got %v calls", mock.describeSnapshotsCalls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	remaining, err = a.VerifySnapshotsDeleted(ctx, []string{"snap-2"}, time.Hour)
+	if err != nil || !reflect.DeepEqual(remaining, []string{"snap-2"}) {
+		t.Errorf("ERROR: VerifySnapshotsDeleted once canceled;\n\texpected: [snap-2], no error\n\tgot: %v, %v", remaining, err)
+	}
+
+	mock.describeSnapshotsErr = awserr.New("UnauthorizedOperation", "not allowed", nil)
+	if _, err := a.VerifySnapshotsDeleted(context.Background(), []string{"snap-2"}, time.Minute); err == nil {
+		t.Errorf("ERROR: VerifySnapshotsDeleted didn't return the DescribeSnapshots error")
+	}
+}
@@ -0,0 +1,30 @@
+package amiclean
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// rootVolumeType returns the volume type (gp2, gp3, io1 and so on) of
+// the EBS volume the image boots from. That's the mapping for the
+// image's root device if we can find it, and otherwise the first EBS
+// mapping. It returns "" for an image with no EBS mappings.
+func rootVolumeType(image *ec2.Image) string {
+	var first *ec2.EbsBlockDevice
+	for _, blockDevice := range image.BlockDeviceMappings {
+		if blockDevice.Ebs == nil {
+			continue
+		}
+		if image.RootDeviceName != nil &&
+			aws.StringValue(blockDevice.DeviceName) == *image.RootDeviceName {
+			return aws.StringValue(blockDevice.Ebs.VolumeType)
+		}
+		if first == nil {
+			first = blockDevice.Ebs
+		}
+	}
+	if first == nil {
+		return ""
+	}
+	return aws.StringValue(first.VolumeType)
+}
@@ -0,0 +1,80 @@
+package amiclean
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func volumeTypeTestImage(name string, volumeTypes ...string) *ec2.Image {
+	image := &ec2.Image{
+		Name:           aws.String(name),
+		ImageId:        aws.String("ami-99999999999999999"),
+		CreationDate:   aws.String("2019-03-01T21:04:57.000Z"),
+		RootDeviceName: aws.String("/dev/xvda"),
+		RootDeviceType: aws.String("ebs"),
+	}
+	for index, volumeType := range volumeTypes {
+		deviceName := "/dev/xvda"
+		if index > 0 {
+			deviceName = "/dev/xvdb"
+		}
+		image.BlockDeviceMappings = append(image.BlockDeviceMappings, &ec2.BlockDeviceMapping{
+			DeviceName: aws.String(deviceName),
+			Ebs: &ec2.EbsBlockDevice{
+				SnapshotId: aws.String("snap-99999999999999999"),
+				VolumeType: aws.String(volumeType),
+			},
+		})
+	}
+	return image
+}
+
+func TestCheckImageBackingVolumeType(t *testing.T) {
+	gp2Image := volumeTypeTestImage("gp2", "gp2")
+	gp3Image := volumeTypeTestImage("gp3", "gp3")
+	// Only the root volume counts, not the data volume.
+	io1RootImage := volumeTypeTestImage("io1-root", "io1", "gp3")
+	images := []*ec2.Image{gp2Image, gp3Image, io1RootImage, noEbsImage}
+
+	tables := []struct {
+		volumeType string
+		resultSet  []bool
+	}{
+		{"", []bool{true, true, true, true}},
+		{"gp2", []bool{true, false, false, false}},
+		{"gp3", []bool{false, true, false, false}},
+		{"io1", []bool{false, false, true, false}},
+	}
+
+	for _, table := range tables {
+		a := AMIClean{
+			BackingVolumeType: table.volumeType,
+			ExpirationDate:    now,
+			Logger:            logger,
+		}
+		for index, image := range images {
+			if a.CheckImage(image) != table.resultSet[index] {
+				t.Errorf("ERROR: CheckImage with volume type %q for %v;\n\texpected: %v\n\tgot: %v",
+					table.volumeType,
+					*image.Name,
+					table.resultSet[index],
+					!table.resultSet[index],
+				)
+			}
+		}
+	}
+}
+
+func TestRootVolumeType(t *testing.T) {
+	// Without a root device name, we fall back to the first EBS volume.
+	image := volumeTypeTestImage("no-root-name", "io1", "gp3")
+	image.RootDeviceName = nil
+	if got := rootVolumeType(image); got != "io1" {
+		t.Errorf("ERROR: rootVolumeType;\n\texpected: io1\n\tgot: %v", got)
+	}
+	if got := rootVolumeType(noEbsImage); got != "" {
+		t.Errorf("ERROR: rootVolumeType for image without EBS;\n\texpected: \"\"\n\tgot: %v", got)
+	}
+}